@@ -26,8 +26,10 @@ import (
 	"os"
 	"os/signal"
 	"runtime/pprof"
+	"strconv"
 	"strings"
 	"sync"
+	"syscall"
 	"time"
 )
 
@@ -37,6 +39,7 @@ type PblioStats struct {
 	Spc       *spc.SpcStats     `json:"spc"`
 	Cache     *cache.CacheStats `json:"cache,omitempty"`
 	Log       *cache.LogStats   `json:"log,omitempty"`
+	Verify    *spc.VerifyStats  `json:"verify,omitempty"`
 }
 
 const (
@@ -51,8 +54,33 @@ var (
 	runlen                   int
 	blocksize, contexts      int
 	bsu, dataperiod          int
+	bcsize, compressratio    int
+	cachemem, discardrate    int
 	usedirectio, cpuprofile  bool
-	cachesavefile            string
+	dedup, cachemmap         bool
+	cachesavefile, keyfile   string
+	warmfile, hotsetfile     string
+	pinfile, unpinfile       string
+	listpins                 bool
+	warmrate                 int
+	tracefile, traceformat   string
+	tracemap, replay         string
+	workload                 string
+	readpercent, iosize      int
+	iops, hotspot            int
+	hotspotios, hotspotshift int
+	zipfskew                 float64
+	verify, spc1phases       bool
+	phaselen                 int
+	reportfile               string
+	bsusearch                bool
+	searchmin, searchlen     int
+	targetmean, targetp95    float64
+)
+
+const (
+	replayTimed = "timed"
+	replayFast  = "fast"
 )
 
 func init() {
@@ -60,11 +88,73 @@ func init() {
 	flag.StringVar(&asu2, "asu2", "", "\n\tASU2 - User Store")
 	flag.StringVar(&asu3, "asu3", "", "\n\tLog")
 	flag.StringVar(&cachefilename, "cache", "", "\n\tCache file name")
+	flag.IntVar(&cachemem, "cachemem", 0, "\n\tUse a RAM only cache of this size in MB instead of a cache file."+
+		"\n\tCache metadata is not saved")
+	flag.BoolVar(&cachemmap, "cachemmap", false, "\n\tMemory map the cache file instead of using direct I/O."+
+		"\n\tThe kernel writes the cache back to the file")
 	flag.StringVar(&cachesavefile, "cachemeta", "cache.pbl", "\n\tPersistent cache metadata location")
 	flag.IntVar(&bsu, "bsu", 50, "\n\tNumber of BSUs (Business Scaling Units)."+
 		"\n\tEach BSU requires 50 IOPs from the back end storage")
 	flag.IntVar(&runlen, "runlen", 300, "\n\tBenchmark run time length in seconds")
-	flag.IntVar(&blocksize, "blocksize", 4, "\n\tCache block size in KB")
+	flag.IntVar(&blocksize, "blocksize", 4*KB, "\n\tCache block size in bytes."+
+		"\n\tMust be a multiple of 512 which divides 512 KB")
+	flag.IntVar(&bcsize, "bcsize", 0, "\n\tRAM buffer cache tier size in MB."+
+		"\n\tHot blocks are promoted from the cache file to RAM."+
+		"\n\tSet to 0 to disable")
+	flag.IntVar(&compressratio, "compress", 0, "\n\tCompress blocks in the cache file."+
+		"\n\tValue is the expected compression ratio, used to size"+
+		"\n\tthe cache metadata. Set to 0 to disable")
+	flag.IntVar(&discardrate, "discard", 0, "\n\tMaximum MB/s of unused cache file regions to discard."+
+		"\n\tSet to 0 to disable")
+	flag.BoolVar(&dedup, "dedup", false, "\n\tDeduplicate blocks with identical contents in the cache."+
+		"\n\tWith -keyfile, only blocks of the same device are deduplicated")
+	flag.StringVar(&keyfile, "keyfile", "", "\n\tEncrypt blocks in the cache file using the keys in this file."+
+		"\n\tEach line contains a device id and a hex encoded AES-XTS key."+
+		"\n\tThe file is read again on SIGHUP")
+	flag.StringVar(&warmfile, "warm", "", "\n\tWarm the cache before the run with the address ranges in this file."+
+		"\n\tEach line contains a device id, a block, and a number of blocks")
+	flag.IntVar(&warmrate, "warmrate", 0, "\n\tMaximum MB/s read from the ASUs to warm the cache."+
+		"\n\tSet to 0 to read as fast as possible")
+	flag.StringVar(&hotsetfile, "hotset", "", "\n\tSave the address ranges in the cache to this file after the run."+
+		"\n\tThe file can be used with -warm")
+	flag.StringVar(&pinfile, "pin", "", "\n\tPin the address ranges in this file so their blocks are never evicted."+
+		"\n\tEach line contains a device id, a block, and a number of blocks."+
+		"\n\tPins are saved with the cache metadata")
+	flag.StringVar(&unpinfile, "unpin", "", "\n\tRemove the pinned address ranges in this file before pinning")
+	flag.BoolVar(&listpins, "listpins", false, "\n\tPrint the pinned address ranges before the run")
+	flag.StringVar(&tracefile, "trace", "", "\n\tReplay the I/O trace in this file instead of running SPC-1."+
+		"\n\tOnly ASU1 is required, and any file can be used as an ASU")
+	flag.StringVar(&traceformat, "traceformat", spc.TraceBlkparse, "\n\tFormat of the trace: blkparse, fio (iolog v2 or v3),"+
+		"\n\tor msr (SNIA MSR Cambridge CSV)")
+	flag.StringVar(&tracemap, "tracemap", "", "\n\tComma separated list of device=asu mapping trace devices to ASUs."+
+		"\n\tOther devices are assigned to the ASUs in the order they appear")
+	flag.StringVar(&replay, "replay", replayTimed, "\n\tReplay mode: timed sends the I/O at the times in the trace,"+
+		"\n\tfast sends the I/O as fast as possible")
+	flag.StringVar(&workload, "workload", "", "\n\tRun a synthetic workload on ASU1 instead of SPC-1:"+
+		"\n\tuniform, zipf, sequential, or hotspot."+
+		"\n\tOnly ASU1 is required")
+	flag.IntVar(&readpercent, "readpercent", 70, "\n\tPercent of the synthetic workload I/O which are reads")
+	flag.IntVar(&iosize, "iosize", 4, "\n\tSize of the synthetic workload I/O in KB, a multiple of 4")
+	flag.IntVar(&iops, "iops", 0, "\n\tI/O per second of the synthetic workload."+
+		"\n\tSet to 0 to send the I/O as fast as possible")
+	flag.Float64Var(&zipfskew, "zipfskew", 1.1, "\n\tSkew of the zipf workload, larger than 1."+
+		"\n\tLarger values concentrate the I/O on fewer blocks")
+	flag.IntVar(&hotspot, "hotspot", 10, "\n\tPercent of the blocks in the hot spot of the hotspot workload")
+	flag.IntVar(&hotspotios, "hotspotios", 90, "\n\tPercent of the I/O to the hot spot of the hotspot workload")
+	flag.IntVar(&hotspotshift, "hotspotshift", 60, "\n\tSeconds before the hot spot moves to the next blocks."+
+		"\n\tSet to 0 to never move the hot spot")
+	flag.BoolVar(&verify, "verify", false, "\n\tStamp the blocks written and check the blocks read have"+
+		"\n\tthe contents last written.  Mismatches are printed")
+	flag.BoolVar(&spc1phases, "spc1phases", false, "\n\tRun the SPC-1 test phases: sustainability for the run time,"+
+		"\n\tthen the ramp and repeatability phases, and print a report")
+	flag.IntVar(&phaselen, "phaselen", 600, "\n\tRun time length in seconds of each SPC-1 phase after sustainability")
+	flag.StringVar(&reportfile, "report", "spc1report.json", "\n\tSPC-1 phases or BSU search report file in JSON format")
+	flag.BoolVar(&bsusearch, "bsusearch", false, "\n\tSearch for the highest number of BSUs, up to -bsu, under the"+
+		"\n\tlatency targets.  With a cache, the search is run again without it")
+	flag.IntVar(&searchmin, "searchmin", 1, "\n\tLowest number of BSUs of the BSU search")
+	flag.IntVar(&searchlen, "searchlen", 60, "\n\tRun time length in seconds of each BSU search trial")
+	flag.Float64Var(&targetmean, "targetlatency", 0, "\n\tMean latency target in ms of the BSU search")
+	flag.Float64Var(&targetp95, "targetp95", 0, "\n\tp95 latency target in ms of the BSU search")
 	flag.BoolVar(&usedirectio, "directio", true, "\n\tUse O_DIRECT on ASU files")
 	flag.BoolVar(&cpuprofile, "cpuprofile", false, "\n\tCreate a Go cpu profile for analysis")
 	flag.StringVar(&pbliodata, "data", "pblio.data", "\n\tStats file in CSV format")
@@ -80,13 +170,51 @@ func main() {
 	// conformance
 	contexts = int((bsu + 99) / 100)
 
-	if asu1 == "" ||
+	if tracefile != "" && workload != "" {
+		fmt.Print("Only one of a trace or a workload can be set\n")
+		return
+	}
+	if spc1phases && (tracefile != "" || workload != "") {
+		fmt.Print("SPC-1 phases cannot be run with a trace or a workload\n")
+		return
+	}
+	if bsusearch {
+		if spc1phases || tracefile != "" || workload != "" {
+			fmt.Print("BSU search cannot be run with SPC-1 phases, a trace or a workload\n")
+			return
+		}
+		if targetmean <= 0 && targetp95 <= 0 {
+			fmt.Print("BSU search needs a mean or p95 latency target\n")
+			return
+		}
+		if searchmin < 1 || searchmin > bsu {
+			fmt.Print("BSU search range must be between 1 and the BSUs\n")
+			return
+		}
+	}
+	if tracefile != "" || workload != "" {
+		if asu1 == "" {
+			fmt.Print("ASU1 file must be set\n")
+			return
+		}
+		if replay != replayTimed && replay != replayFast {
+			fmt.Printf("Unknown replay mode: %s\n", replay)
+			return
+		}
+	} else if asu1 == "" ||
 		asu2 == "" ||
 		asu3 == "" {
 		fmt.Print("ASU files must be set\n")
 		return
 	}
 
+	// Log segments of 512 KB must stay aligned to the sectors
+	// of the cache device
+	if blocksize <= 0 || blocksize%512 != 0 || (512*KB)%blocksize != 0 {
+		fmt.Print("Block size must be a multiple of 512 which divides 512 KB\n")
+		return
+	}
+
 	// Open stats file
 	fp, err := os.Create(pbliodata)
 	if err != nil {
@@ -97,12 +225,13 @@ func main() {
 	defer fp.Close()
 
 	// Setup number of blocks
-	blocksize_bytes := uint32(blocksize * KB)
+	blocksize_bytes := uint32(blocksize)
 
 	// Open cache
 	var c *cache.CacheMap
 	var log *cache.Log
-	var logblocks uint32
+	var keys *cache.KeyFile
+	var logblocks uint64
 
 	// Show banner
 	fmt.Println("-----")
@@ -110,21 +239,65 @@ func main() {
 	fmt.Println("-----")
 
 	// Determine if we need to use the cache
-	if cachefilename != "" {
+	if cachefilename != "" || cachemem > 0 {
+		// Open the cache device
+		var dev cache.LogDevice
+		if cachemem > 0 {
+			dev = cache.NewMemoryLogDevice(int64(cachemem) * MB)
+			cachefilename = "RAM"
+			cachesavefile = ""
+		} else if cachemmap {
+			dev, err = cache.OpenMmapLogDevice(cachefilename)
+			if err != nil {
+				fmt.Println(err)
+				return
+			}
+		} else {
+			dev, err = cache.OpenLogDevice(cachefilename,
+				true, // Use DirectIO to SSD
+			)
+			if err != nil {
+				fmt.Println(err)
+				return
+			}
+		}
+
 		// Create log
-		log, logblocks, err = cache.NewLog(cachefilename,
+		log, logblocks, err = cache.NewLogFromDevice(dev,
 			blocksize_bytes,
 			(512*KB)/blocksize_bytes,
-			0,    // buffer cache has been removed for now
-			true, // Use DirectIO to SSD
+			uint32(bcsize*MB),
+			uint32(compressratio),
 		)
 		if err != nil {
+			dev.Close()
 			fmt.Println(err)
 			return
 		}
 
 		// Connect cache metadata with log
 		c = cache.NewCacheMap(logblocks, blocksize_bytes, log.Msgchan)
+
+		// Blocks encrypted with the keys of different devices
+		// cannot be shared
+		if dedup && keyfile != "" {
+			c.EnableDeviceDedup()
+		} else if dedup {
+			c.EnableDedup()
+		}
+		log.SetInvalidator(func(index uint64, current func() bool) {
+			c.InvalidateLogBlock(index, current)
+		})
+		c.SetReleaser(log.Free)
+		log.SetDiscardRate(uint64(discardrate * MB))
+		if keyfile != "" {
+			keys, err = cache.NewKeyFile(keyfile)
+			if err != nil {
+				fmt.Println(err)
+				return
+			}
+			log.SetKeyProvider(keys)
+		}
 		cache_state := "New"
 		if _, err = os.Stat(cachesavefile); err == nil {
 			err = c.Load(cachesavefile, log)
@@ -138,11 +311,20 @@ func main() {
 		// Start log goroutines
 		log.Start()
 
+		// Update the pins saved with the metadata
+		err = pins(c)
+		if err != nil {
+			fmt.Println(err)
+			return
+		}
+
 		// Print banner
 		fmt.Printf("Cache   : %s (%s)\n"+
-			"C Size  : %.2f GB\n",
+			"C Size  : %.2f GB\n"+
+			"B Size  : %v MB\n",
 			cachefilename, cache_state,
-			float64(logblocks*blocksize_bytes)/GB)
+			float64(logblocks*uint64(blocksize_bytes))/GB,
+			bcsize)
 	} else {
 		fmt.Println("Cache   : None")
 	}
@@ -151,41 +333,52 @@ func main() {
 	spcinfo := spc.NewSpcInfo(c, usedirectio, blocksize)
 
 	// Open asus
-	for _, v := range strings.Split(asu1, ",") {
-		err = spcinfo.Open(1, v)
+	err = openAsus(spcinfo)
+	if err != nil {
+		fmt.Print(err)
+		return
+	}
+	defer spcinfo.Close()
+
+	// Start cpu profiling
+	if cpuprofile {
+		f, _ := os.Create("cpuprofile")
+		pprof.StartCPUProfile(f)
+		defer pprof.StopCPUProfile()
+	}
+
+	// Open the trace, create the synthetic workload, or initialize
+	// Spc1 workload
+	var trace spc.TraceReader
+	if tracefile != "" {
+		trace, err = openTrace(spcinfo)
 		if err != nil {
-			fmt.Print(err)
+			fmt.Println(err)
 			return
 		}
-	}
-	for _, v := range strings.Split(asu2, ",") {
-		err = spcinfo.Open(2, v)
+	} else if workload != "" {
+		trace, err = newWorkload(spcinfo)
 		if err != nil {
-			fmt.Print(err)
+			fmt.Println(err)
 			return
 		}
-	}
-	for _, v := range strings.Split(asu3, ",") {
-		err = spcinfo.Open(3, v)
+		replay = replayFast
+		if iops > 0 {
+			replay = replayTimed
+		}
+	} else {
+		err = spcinfo.Spc1Init(bsu, contexts)
 		if err != nil {
 			fmt.Print(err)
 			return
 		}
 	}
-	defer spcinfo.Close()
 
-	// Start cpu profiling
-	if cpuprofile {
-		f, _ := os.Create("cpuprofile")
-		pprof.StartCPUProfile(f)
-		defer pprof.StopCPUProfile()
-	}
-
-	// Initialize Spc1 workload
-	err = spcinfo.Spc1Init(bsu, contexts)
-	if err != nil {
-		fmt.Print(err)
-		return
+	// Check the data read
+	if verify {
+		spcinfo.EnableVerify(func(e *spc.VerifyError) {
+			fmt.Printf("Verify error: %v\n", e)
+		})
 	}
 
 	// This channel will be used for the io to return
@@ -206,8 +399,36 @@ func main() {
 		bsu,
 		contexts,
 		runlen)
+	if tracefile != "" {
+		fmt.Printf("Trace   : %s (%s, %s)\n", tracefile, traceformat, replay)
+	}
+	if workload != "" {
+		fmt.Printf("Workload: %s (%v%% reads, %v KB, %v IOPS)\n",
+			workload, readpercent, iosize, iops)
+	}
+	if spc1phases {
+		fmt.Printf("Phases  : %v s each\n", phaselen)
+	}
+	if bsusearch {
+		fmt.Printf("Search  : %v-%v BSUs, %v s trials, mean %v ms, p95 %v ms\n",
+			searchmin, bsu, searchlen, targetmean, targetp95)
+	}
 	fmt.Println("-----")
 
+	// Warm the cache
+	if c != nil && warmfile != "" {
+		err = warm(spcinfo)
+		if err != nil {
+			fmt.Println(err)
+			return
+		}
+	}
+
+	// Reload the keys on SIGHUP
+	if keys != nil {
+		reloadKeys(keys, c)
+	}
+
 	// Shutdown on signal
 	quit := make(chan struct{})
 	signalch := make(chan os.Signal, 1)
@@ -220,11 +441,36 @@ func main() {
 		}
 	}()
 
-	// Spawn contexts coroutines
+	// Spawn contexts coroutines, run the SPC-1 phases, or replay
+	// the trace
 	var wg sync.WaitGroup
-	for context := 0; context < contexts; context++ {
+	var replayerr, phaseerr, searcherr error
+	var report *spc.Spc1Report
+	var searches []*spc.BsuSearch
+	if bsusearch {
 		wg.Add(1)
-		go spcinfo.Context(&wg, iotime, quit, runlen, context)
+		go func() {
+			defer wg.Done()
+			searches, searcherr = searchBsu(spcinfo, c != nil, iotime, quit)
+		}()
+	} else if spc1phases {
+		report = spc.NewSpc1Report(bsu)
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			phaseerr = runPhases(spcinfo, report, iotime, quit)
+		}()
+	} else if trace != nil {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			replayerr = spcinfo.Replay(trace, iotime, quit, runlen, replay == replayTimed)
+		}()
+	} else {
+		for context := 0; context < contexts; context++ {
+			wg.Add(1)
+			go spcinfo.Context(&wg, iotime, quit, runlen, context)
+		}
 	}
 
 	// Used to collect all the stats
@@ -258,15 +504,17 @@ func main() {
 				end := time.Now()
 				ios := spcstats.IosDelta(prev_spcstats)
 				iops := float64(ios) / end.Sub(start).Seconds()
-				fmt.Printf("ios:%v IOPS:%.2f Latency:%.4f ms"+
+				fmt.Printf("ios:%v IOPS:%.2f Latency:%.4f ms p99:%.4f ms"+
 					"                                   \r",
-					ios, iops, spcstats.MeanLatencyDeltaUsecs(prev_spcstats)/1000)
+					ios, iops, spcstats.MeanLatencyDeltaUsecs(prev_spcstats)/1000,
+					spcstats.LatencyPercentileDeltaUsecs(prev_spcstats, 99)/1000)
 
 				// Get stats from the cache
 				if c != nil {
 					pbliostats.Cache = c.Stats()
 					pbliostats.Log = log.Stats()
 				}
+				pbliostats.Verify = spcinfo.VerifyStats()
 
 				// Save stats
 				pbliostats.Timestamp = time.Now().Unix()
@@ -291,9 +539,10 @@ func main() {
 		iops := float64(totalios) / end.Sub(totaltime).Seconds()
 
 		// Print final info
-		fmt.Printf("Avg IOPS:%.2f  Avg Latency:%.4f ms"+
+		fmt.Printf("Avg IOPS:%.2f  Avg Latency:%.4f ms  p99 Latency:%.4f ms"+
 			"                        \n",
-			iops, spcstats.MeanLatencyUsecs()/1000)
+			iops, spcstats.MeanLatencyUsecs()/1000,
+			spcstats.LatencyPercentileUsecs(99)/1000)
 
 		fmt.Print("\n")
 	}()
@@ -304,15 +553,59 @@ func main() {
 	// Now we can close the output goroutine
 	close(iotime)
 	outputwg.Wait()
+	if replayerr != nil {
+		fmt.Printf("Unable to replay trace: %s\n", replayerr)
+	}
+	if phaseerr != nil {
+		fmt.Printf("Unable to run SPC-1 phases: %s\n", phaseerr)
+	}
+	if searcherr != nil {
+		fmt.Printf("Unable to search BSUs: %s\n", searcherr)
+	}
+	if report != nil {
+		fmt.Print(report)
+		fmt.Print("\n")
+		err = saveReport(report)
+		if err != nil {
+			fmt.Printf("Unable to save report: %s\n", err)
+		}
+	}
+	if bsusearch {
+		for i, search := range searches {
+			if i == 0 && c != nil {
+				fmt.Print("BSU search with cache\n")
+			} else {
+				fmt.Print("BSU search without cache\n")
+			}
+			fmt.Print(search)
+			fmt.Print("\n")
+		}
+		err = saveReport(searches)
+		if err != nil {
+			fmt.Printf("Unable to save report: %s\n", err)
+		}
+	}
+	if verifystats := spcinfo.VerifyStats(); verifystats != nil {
+		fmt.Printf("Verified: %v blocks  Not written: %v blocks  Errors: %v\n\n",
+			verifystats.Verified, verifystats.Skipped, verifystats.Errors)
+	}
 
 	// Print cache stats
 	if c != nil {
 		c.Close()
 		log.Close()
-		err = c.Save(cachesavefile, log)
-		if err != nil {
-			fmt.Printf("Unable to save metadata: %s\n", err)
-			os.Remove(cachesavefile)
+		if hotsetfile != "" {
+			err = saveHotSet(c)
+			if err != nil {
+				fmt.Printf("Unable to save hot set: %s\n", err)
+			}
+		}
+		if cachesavefile != "" {
+			err = c.Save(cachesavefile, log)
+			if err != nil {
+				fmt.Printf("Unable to save metadata: %s\n", err)
+				os.Remove(cachesavefile)
+			}
 		}
 		fmt.Print(c)
 		fmt.Print(log)
@@ -320,3 +613,294 @@ func main() {
 	metrics.Flush()
 
 }
+
+// Runs each SPC-1 phase, adding the results to the report, until all
+// the phases are done or quit is closed
+func runPhases(spcinfo *spc.SpcInfo,
+	report *spc.Spc1Report,
+	iotime chan<- *spc.IoStats,
+	quit <-chan struct{}) error {
+
+	for _, phase := range spc.Spc1Phases(runlen, phaselen) {
+		select {
+		case <-quit:
+			return nil
+		default:
+		}
+
+		fmt.Printf("Phase: %s (%v BSUs, %v s)"+
+			"                                                  \n",
+			phase.Name, phase.Bsu(bsu), phase.Runlen)
+		result, err := spcinfo.RunPhase(phase, bsu, iotime, quit)
+		if err != nil {
+			return err
+		}
+		report.Add(result)
+	}
+
+	return nil
+}
+
+// Searches for the highest number of BSUs under the latency targets.
+// With a cache, the search is run again on the ASUs without it.
+func searchBsu(spcinfo *spc.SpcInfo,
+	cached bool,
+	iotime chan<- *spc.IoStats,
+	quit <-chan struct{}) ([]*spc.BsuSearch, error) {
+
+	spcinfos := []*spc.SpcInfo{spcinfo}
+	if cached {
+		nocache := spc.NewSpcInfo(nil, usedirectio, blocksize)
+		err := openAsus(nocache)
+		if err != nil {
+			return nil, err
+		}
+		defer nocache.Close()
+		spcinfos = append(spcinfos, nocache)
+
+		// The search without the cache writes to the ASUs, so the
+		// blocks in the cache are stale once it is done
+		defer spcinfo.InvalidateCache()
+	}
+
+	searches := make([]*spc.BsuSearch, 0, len(spcinfos))
+	for _, s := range spcinfos {
+		search := spc.NewBsuSearch(searchmin, bsu,
+			time.Duration(targetmean*float64(time.Millisecond)),
+			time.Duration(targetp95*float64(time.Millisecond)))
+		searches = append(searches, search)
+
+		_, err := search.Run(func(trialbsu int) (*spc.Spc1PhaseResult, error) {
+			fmt.Printf("Trial: %v BSUs (%v s)"+
+				"                                                  \n",
+				trialbsu, searchlen)
+			return s.BsuTrial(trialbsu, searchlen, iotime, quit)
+		}, quit)
+		if err != nil {
+			return searches, err
+		}
+	}
+
+	return searches, nil
+}
+
+// Rereads the key file every time a SIGHUP is received.  Blocks
+// of devices whose key was changed or removed can no longer be
+// read, so they are invalidated.
+func reloadKeys(keys *cache.KeyFile, c *cache.CacheMap) {
+	hupch := make(chan os.Signal, 1)
+	signal.Notify(hupch, syscall.SIGHUP)
+	go func() {
+		for range hupch {
+			changed, err := keys.Reload()
+			if err != nil {
+				fmt.Println(err)
+				continue
+			}
+			for _, devid := range changed {
+				c.InvalidateDevice(devid)
+			}
+		}
+	}()
+}
+
+func saveReport(report interface{}) error {
+	fp, err := os.Create(reportfile)
+	if err != nil {
+		return err
+	}
+	defer fp.Close()
+
+	return json.NewEncoder(fp).Encode(report)
+}
+
+// Opens the ASU files set in the command line
+func openAsus(spcinfo *spc.SpcInfo) error {
+	for _, v := range strings.Split(asu1, ",") {
+		err := spcinfo.Open(1, v)
+		if err != nil {
+			return err
+		}
+	}
+	for _, v := range strings.Split(asu2, ",") {
+		if v == "" {
+			continue
+		}
+		err := spcinfo.Open(2, v)
+		if err != nil {
+			return err
+		}
+	}
+	for _, v := range strings.Split(asu3, ",") {
+		if v == "" {
+			continue
+		}
+		err := spcinfo.Open(3, v)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Reads the address ranges in the warm file through the cache
+// while printing the progress
+func warm(spcinfo *spc.SpcInfo) error {
+	ranges, err := readRanges(warmfile)
+	if err != nil {
+		return err
+	}
+
+	warmer := spcinfo.Warmer(uint64(warmrate * MB))
+	done := make(chan error, 1)
+	go func() {
+		done <- warmer.Warm(ranges, nil)
+	}()
+
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+	for {
+		select {
+		case err = <-done:
+			progress := warmer.Progress()
+			fmt.Printf("%v\n", &progress)
+			fmt.Println("-----")
+			return err
+		case <-ticker.C:
+			progress := warmer.Progress()
+			fmt.Printf("%v\r", &progress)
+		}
+	}
+}
+
+// Removes the ranges in the unpin file, pins the ranges in the pin
+// file, and prints the pinned ranges if requested
+func pins(c *cache.CacheMap) error {
+	if unpinfile != "" {
+		ranges, err := readRanges(unpinfile)
+		if err != nil {
+			return err
+		}
+		for _, r := range ranges {
+			err = c.Unpin(r.Devid, r.Start, r.Length)
+			if err != nil {
+				return fmt.Errorf("Unable to unpin %v %v %v: %s",
+					r.Devid, r.Start, r.Length, err)
+			}
+		}
+	}
+
+	if pinfile != "" {
+		ranges, err := readRanges(pinfile)
+		if err != nil {
+			return err
+		}
+		for _, r := range ranges {
+			err = c.Pin(r.Devid, r.Start, r.Length)
+			if err != nil {
+				return fmt.Errorf("Unable to pin %v %v %v: %s",
+					r.Devid, r.Start, r.Length, err)
+			}
+		}
+	}
+
+	if listpins {
+		pinned := c.Pins()
+		ranges := make([]cache.AddressRange, len(pinned))
+		for i, p := range pinned {
+			ranges[i] = cache.AddressRange(p)
+		}
+		fmt.Printf("Pins    : %v ranges, %v blocks in the cache\n",
+			len(ranges), c.PinnedBlocks())
+		return cache.WriteAddressRanges(os.Stdout, ranges)
+	}
+
+	return nil
+}
+
+func readRanges(filename string) ([]cache.AddressRange, error) {
+	fp, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer fp.Close()
+
+	return cache.ReadAddressRanges(fp)
+}
+
+func saveHotSet(c *cache.CacheMap) error {
+	fp, err := os.Create(hotsetfile)
+	if err != nil {
+		return err
+	}
+	defer fp.Close()
+
+	return cache.WriteAddressRanges(fp, c.HotSet())
+}
+
+// Opens the trace file and maps its devices to the ASUs.  The file
+// is read while the trace is replayed, so it is not closed.
+func openTrace(spcinfo *spc.SpcInfo) (spc.TraceReader, error) {
+	for _, mapping := range strings.Split(tracemap, ",") {
+		if mapping == "" {
+			continue
+		}
+
+		i := strings.LastIndex(mapping, "=")
+		if i < 0 {
+			return nil, fmt.Errorf("Invalid trace mapping: %s", mapping)
+		}
+		asu, err := strconv.Atoi(mapping[i+1:])
+		if err != nil {
+			return nil, fmt.Errorf("Invalid trace mapping: %s", mapping)
+		}
+		err = spcinfo.MapDevice(mapping[:i], asu)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	fp, err := os.Open(tracefile)
+	if err != nil {
+		return nil, err
+	}
+
+	trace, err := spc.NewTraceReader(bufio.NewReader(fp), traceformat)
+	if err != nil {
+		fp.Close()
+		return nil, err
+	}
+
+	return trace, nil
+}
+
+// Creates the synthetic workload on ASU1
+func newWorkload(spcinfo *spc.SpcInfo) (spc.TraceReader, error) {
+	if iosize <= 0 || iosize%4 != 0 {
+		return nil, fmt.Errorf("I/O size must be a multiple of 4 KB")
+	}
+
+	err := spcinfo.MapDevice(spc.WorkloadDevice, 1)
+	if err != nil {
+		return nil, err
+	}
+
+	w, err := spc.NewWorkload(&spc.WorkloadConfig{
+		Type:         workload,
+		Blocks:       spcinfo.Blocks(1),
+		IoBlocks:     uint32(iosize / 4),
+		ReadPercent:  readpercent,
+		Iops:         iops,
+		Skew:         zipfskew,
+		HotPercent:   hotspot,
+		HotIoPercent: hotspotios,
+		HotShift:     time.Duration(hotspotshift) * time.Second,
+		Seed:         time.Now().UnixNano(),
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return w, nil
+}
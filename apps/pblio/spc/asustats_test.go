@@ -103,10 +103,10 @@ func TestAsuStatCsvDelta(t *testing.T) {
 	tests.Assert(t, split[1] == "4096")
 
 	// Write
-	tests.Assert(t, split[4] == "2")                       // 1 io
-	tests.Assert(t, split[5] == fmt.Sprintf("%v", 4*KB*6)) // 6 4KB Blocks
+	tests.Assert(t, split[10] == "2")                       // 1 io
+	tests.Assert(t, split[11] == fmt.Sprintf("%v", 4*KB*6)) // 6 4KB Blocks
 
 	// Total
-	tests.Assert(t, split[8] == "3")
-	tests.Assert(t, split[9] == fmt.Sprintf("%v", 4*KB*7)) // 7 4KB Blocks
+	tests.Assert(t, split[20] == "3")
+	tests.Assert(t, split[21] == fmt.Sprintf("%v", 4*KB*7)) // 7 4KB Blocks
 }
@@ -22,137 +22,161 @@ import (
 	"io"
 )
 
+// Reads whole blocks from the backend and places them in the cache.
+// The part of the blocks which overlaps the caller buffer at the byte
+// offset is copied to the buffer.
 func readandstore(fp io.ReaderAt,
 	c *cache.CacheMap,
-	devid uint16,
+	devid uint32,
+	block, nblocks, blocksize_bytes uint64,
 	offset uint64,
-	nblocks uint64,
 	buffer []byte,
 	retchan chan *message.Message) {
 
-	fp.ReadAt(buffer, int64(offset))
+	start := block * blocksize_bytes
+	end := start + nblocks*blocksize_bytes
+
+	// Read directly into the caller buffer if it holds whole blocks
+	var data []byte
+	if start >= offset && end <= offset+uint64(len(buffer)) {
+		data = buffer[start-offset : end-offset]
+		fp.ReadAt(data, int64(start))
+	} else {
+		data = cache.AlignedBuffer(int(end-start), cache.DefaultAlignment)
+		fp.ReadAt(data, int64(start))
+
+		lo, hi := start, end
+		if offset > lo {
+			lo = offset
+		}
+		if offset+uint64(len(buffer)) < hi {
+			hi = offset + uint64(len(buffer))
+		}
+		copy(buffer[lo-offset:hi-offset], data[lo-start:hi-start])
+	}
 
 	m := message.NewMsgPut()
 	m.RetChan = retchan
 	io := m.IoPkt()
-	io.Address = cache.Address64(cache.Address{Devid: devid, Lba: offset})
-	io.Buffer = buffer
+	io.Devid = devid
+	io.Address = block
+	io.Buffer = data
 	io.Blocks = uint32(nblocks)
 
 	c.Put(m)
 }
 
+// Reads the buffer at the byte offset from the cache, and the
+// parts which are not in the cache from the backend.  The I/O does
+// not need to be aligned to the cache block size.  Returns which
+// cache blocks were read from the cache.
 func read(fp io.ReaderAt,
 	c *cache.CacheMap,
-	devid uint16,
+	devid uint32,
 	offset, blocksize_bytes uint64,
-	nblocks int,
-	buffer []byte) {
+	buffer []byte) []bool {
+
+	godbc.Require(len(buffer) > 0)
 
-	godbc.Require(len(buffer)%(4*KB) == 0)
-	godbc.Require(blocksize_bytes%(4*KB) == 0)
+	block, blockoffset, nblocks := cache.SubBlockRange(offset,
+		uint64(len(buffer)),
+		uint32(blocksize_bytes))
 
-	here := make(chan *message.Message, nblocks)
-	cacheoffset := cache.Address64(cache.Address{Devid: devid, Lba: offset})
+	here := make(chan *message.Message, nblocks+1)
 	msg := message.NewMsgGet()
 	msg.RetChan = here
 	iopkt := msg.IoPkt()
 	iopkt.Buffer = buffer
-	iopkt.Address = cacheoffset
-	iopkt.Blocks = uint32(nblocks)
+	iopkt.Devid = devid
+	iopkt.Address = block
+	iopkt.Offset = blockoffset
+	iopkt.Blocks = nblocks
 
 	msgs := 0
+	hitmap := make([]bool, nblocks)
 	hitpkt, err := c.Get(msg)
-	if err != nil {
-		//fmt.Printf("|nblocks:%d::hits:0--", nblocks)
-		// None found
-		// Read the whole thing from backend
-		fp.ReadAt(buffer, int64(offset))
-
-		m := message.NewMsgPut()
-		m.RetChan = here
-
-		io := m.IoPkt()
-		io.Address = cacheoffset
-		io.Buffer = buffer
-		io.Blocks = uint32(nblocks)
-		c.Put(m)
+	if err == nil {
+		hitmap = hitpkt.Hitmap
 		msgs++
+	}
 
-	} else if hitpkt.Hits != nblocks {
-		//fmt.Printf("|******nblocks:%d::hits:%d--", nblocks, hitpkt.Hits)
-		// Read from storage the ones that did not have
-		// in the hit map.
-		var be_offset, be_block, be_nblocks uint64
-		var be_read_ready = false
-		for block := uint64(0); block < uint64(nblocks); block++ {
-			if !hitpkt.Hitmap[block] {
-				if be_read_ready {
-					be_nblocks++
-				} else {
-					be_read_ready = true
-					be_offset = offset + (block * blocksize_bytes)
-					be_block = block
-					be_nblocks++
-				}
-			} else {
-				if be_read_ready {
-					// Send read
-					buffer_offset := be_block * blocksize_bytes
-					msgs++
-					go readandstore(fp, c, devid, be_offset, be_nblocks,
-						buffer[buffer_offset:(buffer_offset+blocksize_bytes)],
-						here)
-					be_read_ready = false
-					be_nblocks = 0
-					be_offset = 0
-					be_block = 0
-				}
+	// Read from storage the blocks for which missing returns true
+	fetch := func(missing func(block uint32) bool) {
+		for first := uint32(0); first < nblocks; {
+			if !missing(first) {
+				first++
+				continue
 			}
-		}
-		if be_read_ready {
-			buffer_offset := be_block * blocksize_bytes
+
+			last := first
+			for last < nblocks && missing(last) {
+				last++
+			}
+
 			msgs++
-			go readandstore(fp, c, devid, be_offset, be_nblocks,
-				buffer[buffer_offset:(buffer_offset+blocksize_bytes)],
+			go readandstore(fp, c, devid,
+				block+uint64(first),
+				uint64(last-first),
+				blocksize_bytes,
+				offset,
+				buffer,
 				here)
-
+			first = last
 		}
-
-	} else {
-		msgs = 1
 	}
 
+	// Read from storage the ones that were not in the cache
+	fetch(func(block uint32) bool {
+		return !hitmap[block]
+	})
+
 	// Wait for blocks to be returned
 	for msg := range here {
 
 		msgs--
-		godbc.Check(msg.Err == nil, msg)
+
+		// Some cached blocks could not be returned.  The cache
+		// invalidates them, so read them from the backend like
+		// misses.  Errors placing the blocks read from the backend
+		// in the cache are ignored, since the data was read.
+		if msg.Err != nil && msg.Type == message.MsgGet {
+			hits := append([]bool(nil), hitmap...)
+			hitpkt.ClearFailed()
+			fetch(func(block uint32) bool {
+				return hits[block] && !hitmap[block]
+			})
+		}
 		godbc.Check(msgs >= 0, msgs)
 
 		if msgs == 0 {
-			return
+			break
 		}
 	}
+
+	return hitmap
 }
 
+// Writes the buffer at the byte offset to the backend and the cache.
+// The I/O does not need to be aligned to the cache block size.
 func write(fp io.WriterAt,
 	c *cache.CacheMap,
-	devid uint16,
+	devid uint32,
 	offset, blocksize_bytes uint64,
-	nblocks int,
 	buffer []byte) {
 
-	godbc.Require(len(buffer)%(4*KB) == 0)
-	godbc.Require(blocksize_bytes%(4*KB) == 0)
+	godbc.Require(len(buffer) > 0)
+
+	block, blockoffset, nblocks := cache.SubBlockRange(offset,
+		uint64(len(buffer)),
+		uint32(blocksize_bytes))
 
-	here := make(chan *message.Message, nblocks)
-	cacheoffset := cache.Address64(cache.Address{Devid: devid, Lba: offset})
+	here := make(chan *message.Message, 1)
 
 	// Send invalidates for each block
 	iopkt := &message.IoPkt{
-		Address: cacheoffset,
-		Blocks:  uint32(nblocks),
+		Devid:   devid,
+		Address: block,
+		Blocks:  nblocks,
 	}
 	c.Invalidate(iopkt)
 
@@ -160,12 +184,15 @@ func write(fp io.WriterAt,
 	// :TODO: check return status
 	fp.WriteAt(buffer, int64(offset))
 
-	// Now write to cache
+	// Now write to cache.  Blocks which are only
+	// partially written are not cached.
 	msg := message.NewMsgPut()
 	msg.RetChan = here
 	iopkt = msg.IoPkt()
-	iopkt.Blocks = uint32(nblocks)
-	iopkt.Address = cacheoffset
+	iopkt.Blocks = nblocks
+	iopkt.Devid = devid
+	iopkt.Address = block
+	iopkt.Offset = blockoffset
 	iopkt.Buffer = buffer
 	c.Put(msg)
 
@@ -0,0 +1,116 @@
+//
+// Copyright (c) 2014 The pblcache Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+package spc
+
+import (
+	"bytes"
+	"github.com/pblcache/pblcache/cache"
+	"github.com/pblcache/pblcache/tests"
+	"testing"
+)
+
+func TestCacheIoSubBlock(t *testing.T) {
+	l, blocks, err := cache.NewLogFromDevice(cache.NewMemoryLogDevice(64*4096),
+		4096, 2, 0, 0)
+	tests.Assert(t, err == nil)
+	c := cache.NewCacheMap(blocks, 4096, l.Msgchan)
+	l.Start()
+	defer l.Close()
+
+	// Backend device
+	backend := cache.NewMemoryLogDevice(64 * 4096)
+	data := make([]byte, 64*4096)
+	for i := range data {
+		data[i] = byte(i / 512)
+	}
+	backend.WriteAt(data, 0)
+
+	// Unaligned read populates the cache with whole blocks
+	buf := make([]byte, 1024)
+	read(backend, c, 1, 4096+3584, 4096, buf)
+	tests.Assert(t, bytes.Equal(buf, data[4096+3584:4096+3584+1024]))
+	tests.Assert(t, c.Stats().Insertions == 2)
+
+	// Read it again from the cache
+	buf = make([]byte, 1024)
+	read(backend, c, 1, 4096+3584, 4096, buf)
+	tests.Assert(t, bytes.Equal(buf, data[4096+3584:4096+3584+1024]))
+	tests.Assert(t, c.Stats().Readhits == 2)
+
+	// 512 byte write invalidates the block
+	buf = bytes.Repeat([]byte{0xff}, 512)
+	write(backend, c, 1, 2*4096+512, 4096, buf)
+	copy(data[2*4096+512:], buf)
+
+	buf = make([]byte, 4096)
+	read(backend, c, 1, 2*4096, 4096, buf)
+	tests.Assert(t, bytes.Equal(buf, data[2*4096:3*4096]))
+
+	// Aligned read of the whole range
+	buf = make([]byte, 4*4096)
+	read(backend, c, 1, 0, 4096, buf)
+	tests.Assert(t, bytes.Equal(buf, data[:4*4096]))
+}
+
+type cacheIoKeys struct {
+	keys map[uint32][]byte
+}
+
+func (k *cacheIoKeys) Key(devid uint32) ([]byte, error) {
+	if key, ok := k.keys[devid]; ok {
+		return key, nil
+	}
+	return nil, cache.ErrKeyNotFound
+}
+
+func TestCacheIoFailedBlocks(t *testing.T) {
+	l, blocks, err := cache.NewLogFromDevice(cache.NewMemoryLogDevice(64*4096),
+		4096, 2, 0, 0)
+	tests.Assert(t, err == nil)
+	keys := &cacheIoKeys{
+		keys: map[uint32][]byte{1: bytes.Repeat([]byte{1}, 32)},
+	}
+	l.SetKeyProvider(keys)
+	c := cache.NewCacheMap(blocks, 4096, l.Msgchan)
+	l.Start()
+	defer l.Close()
+
+	backend := cache.NewMemoryLogDevice(64 * 4096)
+	data := make([]byte, 64*4096)
+	for i := range data {
+		data[i] = byte(i / 4096)
+	}
+	backend.WriteAt(data, 0)
+
+	buf := make([]byte, 4*4096)
+	hitmap := read(backend, c, 1, 0, 4096, buf)
+	tests.Assert(t, c.Stats().Insertions == 4)
+	for _, hit := range hitmap {
+		tests.Assert(t, !hit)
+	}
+
+	// The cached blocks can no longer be read, and the blocks
+	// read from the backend cannot be placed in the cache
+	delete(keys.keys, 1)
+	buf = make([]byte, 8*4096)
+	hitmap = read(backend, c, 1, 0, 4096, buf)
+	tests.Assert(t, bytes.Equal(buf, data[:8*4096]))
+	tests.Assert(t, len(hitmap) == 8)
+	for _, hit := range hitmap {
+		tests.Assert(t, !hit)
+	}
+	tests.Assert(t, c.Stats().Readhits == 4)
+}
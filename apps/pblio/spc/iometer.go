@@ -18,12 +18,14 @@ package spc
 import (
 	"fmt"
 	"github.com/lpabon/tm"
+	"github.com/pblcache/pblcache/cache"
 	"time"
 )
 
 type IoMeter struct {
-	Latency tm.TimeDuration `json:"latency"`
-	Ios     uint64          `json:"ios"`
+	Latency   tm.TimeDuration `json:"latency"`
+	Histogram cache.Histogram `json:"latency_histogram"`
+	Ios       uint64          `json:"ios"`
 
 	// 4KB Blocks transferred
 	Blocks uint64 `json:"blocks"`
@@ -33,6 +35,7 @@ func (i *IoMeter) Collect(iostat *IoStats) {
 	i.Ios++
 	i.Blocks += uint64(iostat.Io.Blocks)
 	i.Latency.Add(iostat.Latency)
+	i.Histogram.Add(iostat.Latency)
 }
 
 func (i *IoMeter) Csv(delta time.Duration) string {
@@ -42,7 +45,8 @@ func (i *IoMeter) Csv(delta time.Duration) string {
 		i.Ios,
 		i.Blocks*4*KB,
 		(float64(i.Blocks*4*KB)/float64(MB))/delta.Seconds()) +
-		i.Latency.Csv()
+		i.Latency.Csv() +
+		i.Histogram.Csv()
 }
 
 func (i *IoMeter) CsvDelta(prev *IoMeter, delta time.Duration) string {
@@ -53,7 +57,8 @@ func (i *IoMeter) CsvDelta(prev *IoMeter, delta time.Duration) string {
 		i.Ios-prev.Ios,
 		(i.Blocks-prev.Blocks)*4*KB,
 		(float64((i.Blocks-prev.Blocks)*4*KB)/float64(MB))/delta.Seconds(),
-		i.Latency.DeltaMeanTimeUsecs(&prev.Latency))
+		i.Latency.DeltaMeanTimeUsecs(&prev.Latency)) +
+		i.Histogram.CsvDelta(&prev.Histogram)
 }
 
 func (i *IoMeter) MeanLatencyDeltaUsecs(prev *IoMeter) float64 {
@@ -64,6 +69,14 @@ func (i *IoMeter) MeanLatencyUsecs() float64 {
 	return i.Latency.MeanTimeUsecs()
 }
 
+func (i *IoMeter) LatencyPercentileDeltaUsecs(prev *IoMeter, percent float64) float64 {
+	return i.Histogram.Delta(&prev.Histogram).PercentileUsecs(percent)
+}
+
+func (i *IoMeter) LatencyPercentileUsecs(percent float64) float64 {
+	return i.Histogram.PercentileUsecs(percent)
+}
+
 func (i *IoMeter) IosDelta(prev *IoMeter) uint64 {
 	return i.Ios - prev.Ios
 }
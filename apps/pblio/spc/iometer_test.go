@@ -54,6 +54,11 @@ func TestIoMeterCollect(t *testing.T) {
 	tests.Assert(t, meter.Blocks == 5)
 	tests.Assert(t, meter.Ios == 2)
 	tests.Assert(t, meter.Latency.MeanTimeUsecs() == 2000.0)
+	tests.Assert(t, meter.Histogram.Count() == 2)
+	tests.Assert(t, meter.Histogram.Max() == time.Millisecond*3)
+	tests.Assert(t, meter.LatencyPercentileUsecs(50) >= 1000.0)
+	tests.Assert(t, meter.LatencyPercentileUsecs(50) < 1100.0)
+	tests.Assert(t, meter.LatencyPercentileUsecs(100) == 3000.0)
 
 }
 
@@ -87,6 +92,10 @@ func TestIoMeterCsvDelta(t *testing.T) {
 	tests.Assert(t, split[1] == "4096")
 	tests.Assert(t, strings.Contains(split[2], "3.9"))
 	tests.Assert(t, strings.Contains(split[3], "3000"))
+
+	// Latency histogram
+	tests.Assert(t, split[4] == "1")
+	tests.Assert(t, split[9] == "3000")
 }
 
 func TestIoMeterDeltas(t *testing.T) {
@@ -114,3 +123,22 @@ func TestIoMeterDeltas(t *testing.T) {
 	tests.Assert(t, meter.IosDelta(prev) == 500)
 	tests.Assert(t, meter.MeanLatencyUsecs() == 1500.0)
 }
+
+func TestIoMeterLatencyPercentiles(t *testing.T) {
+	prev := &IoMeter{}
+	for i := 0; i < 99; i++ {
+		prev.Histogram.Add(time.Millisecond)
+	}
+	prev.Histogram.Add(time.Second)
+
+	meter := &IoMeter{}
+	*meter = *prev
+	for i := 0; i < 100; i++ {
+		meter.Histogram.Add(2 * time.Millisecond)
+	}
+
+	tests.Assert(t, meter.LatencyPercentileUsecs(100) == 1000000.0)
+	tests.Assert(t, prev.LatencyPercentileUsecs(99) < 1100.0)
+	tests.Assert(t, meter.LatencyPercentileDeltaUsecs(prev, 99) >= 2000.0)
+	tests.Assert(t, meter.LatencyPercentileDeltaUsecs(prev, 99) < 2200.0)
+}
@@ -0,0 +1,282 @@
+//
+// Copyright (c) 2014 The pblcache Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package spc
+
+import (
+	"fmt"
+	"math"
+	"sync"
+	"time"
+)
+
+const (
+	// SPC-1 limit of the average response time
+	Spc1ResponseTimeLimit = 30 * time.Millisecond
+
+	// Largest difference of the IOPS of a phase from the IOPS
+	// requested, and of the repeatability phases from the primary
+	// phases
+	Spc1Tolerance = 0.05
+
+	Spc1IopsPerBsu = 50
+)
+
+// SPC-1 test phases
+const (
+	PhaseSustainability = "Sustainability"
+	PhaseIops           = "IOPS"
+	PhaseRamp95         = "Ramp 95%"
+	PhaseRamp90         = "Ramp 90%"
+	PhaseRamp80         = "Ramp 80%"
+	PhaseRamp50         = "Ramp 50%"
+	PhaseLrt            = "Ramp 10%"
+	PhaseRepeat1Lrt     = "Repeat 1 10%"
+	PhaseRepeat1Iops    = "Repeat 1 IOPS"
+	PhaseRepeat2Lrt     = "Repeat 2 10%"
+	PhaseRepeat2Iops    = "Repeat 2 IOPS"
+)
+
+type Spc1Phase struct {
+	Name string `json:"name"`
+
+	// Percent of the BSUs of the test run
+	Percent int `json:"percent"`
+
+	// Run time in seconds
+	Runlen int `json:"runlen"`
+}
+
+// Returns the phases of an SPC-1 test run.  Sustainability runs for
+// the sustain seconds, and the other phases for runlen seconds.
+func Spc1Phases(sustain, runlen int) []Spc1Phase {
+	return []Spc1Phase{
+		{PhaseSustainability, 100, sustain},
+		{PhaseIops, 100, runlen},
+		{PhaseRamp95, 95, runlen},
+		{PhaseRamp90, 90, runlen},
+		{PhaseRamp80, 80, runlen},
+		{PhaseRamp50, 50, runlen},
+		{PhaseLrt, 10, runlen},
+		{PhaseRepeat1Lrt, 10, runlen},
+		{PhaseRepeat1Iops, 100, runlen},
+		{PhaseRepeat2Lrt, 10, runlen},
+		{PhaseRepeat2Iops, 100, runlen},
+	}
+}
+
+// Number of BSUs of the phase of a test run with the BSUs
+func (p *Spc1Phase) Bsu(bsu int) int {
+	phasebsu := int(math.Floor(float64(bsu*p.Percent)/100 + 0.5))
+	if phasebsu < 1 {
+		phasebsu = 1
+	}
+	return phasebsu
+}
+
+type Spc1PhaseResult struct {
+	Phase   Spc1Phase     `json:"phase"`
+	Bsu     int           `json:"bsu"`
+	Elapsed time.Duration `json:"elapsed"`
+	Stats   *SpcStats     `json:"stats"`
+}
+
+func (r *Spc1PhaseResult) RequestedIops() float64 {
+	return float64(r.Bsu * Spc1IopsPerBsu)
+}
+
+func (r *Spc1PhaseResult) Iops() float64 {
+	if r.Elapsed == 0 {
+		return 0.0
+	}
+	return float64(r.Stats.Total.Ios) / r.Elapsed.Seconds()
+}
+
+func (r *Spc1PhaseResult) ReadPercent() float64 {
+	if r.Stats.Total.Ios == 0 {
+		return 0.0
+	}
+	return 100 * float64(r.Stats.Read.Ios) / float64(r.Stats.Total.Ios)
+}
+
+// Average response time
+func (r *Spc1PhaseResult) ResponseTimeUsecs() float64 {
+	return r.Stats.MeanLatencyUsecs()
+}
+
+// Average response time of the ASU
+func (r *Spc1PhaseResult) AsuResponseTimeUsecs(asu int) float64 {
+	return r.Stats.Asustats[asu-1].Total.MeanLatencyUsecs()
+}
+
+// Returns why the phase failed, or an empty string if it passed
+func (r *Spc1PhaseResult) failure() string {
+	if math.Abs(r.Iops()-r.RequestedIops()) > Spc1Tolerance*r.RequestedIops() {
+		return fmt.Sprintf("IOPS not within %v%% of %v",
+			Spc1Tolerance*100, r.RequestedIops())
+	}
+	if r.ResponseTimeUsecs() > float64(Spc1ResponseTimeLimit/time.Microsecond) {
+		return fmt.Sprintf("Response time over %v", Spc1ResponseTimeLimit)
+	}
+	return ""
+}
+
+// Runs the phase of a test run with the BSUs.  Each I/O is also sent
+// to iotime, if set.  Must be called after all the ASUs are opened.
+func (s *SpcInfo) RunPhase(phase Spc1Phase,
+	bsu int,
+	iotime chan<- *IoStats,
+	quit <-chan struct{}) (*Spc1PhaseResult, error) {
+
+	result := &Spc1PhaseResult{
+		Phase: phase,
+		Bsu:   phase.Bsu(bsu),
+		Stats: NewSpcStats(),
+	}
+
+	// Same number of contexts as a run with the BSUs of the phase
+	contexts := (result.Bsu + 99) / 100
+	err := s.Spc1Init(result.Bsu, contexts)
+	if err != nil {
+		return nil, err
+	}
+
+	phaseio := make(chan *IoStats, 1024)
+	collected := make(chan struct{})
+	go func() {
+		defer close(collected)
+		for iostat := range phaseio {
+			result.Stats.Collect(iostat)
+			if iotime != nil {
+				iotime <- iostat
+			}
+		}
+	}()
+
+	start := time.Now()
+	var wg sync.WaitGroup
+	for context := 0; context < contexts; context++ {
+		wg.Add(1)
+		go s.Context(&wg, phaseio, quit, phase.Runlen, context)
+	}
+	wg.Wait()
+	result.Elapsed = time.Now().Sub(start)
+
+	close(phaseio)
+	<-collected
+
+	return result, nil
+}
+
+// Results of an SPC-1 test run
+type Spc1Report struct {
+	Bsu     int                `json:"bsu"`
+	Results []*Spc1PhaseResult `json:"results"`
+}
+
+func NewSpc1Report(bsu int) *Spc1Report {
+	return &Spc1Report{
+		Bsu:     bsu,
+		Results: make([]*Spc1PhaseResult, 0),
+	}
+}
+
+func (r *Spc1Report) Add(result *Spc1PhaseResult) {
+	r.Results = append(r.Results, result)
+}
+
+func (r *Spc1Report) result(name string) *Spc1PhaseResult {
+	for _, result := range r.Results {
+		if result.Phase.Name == name {
+			return result
+		}
+	}
+	return nil
+}
+
+// Returns why the phase failed, or an empty string if it passed.
+// Repeatability phases must also have IOPS within the tolerance of
+// the primary IOPS phase, or a response time within the tolerance of
+// the primary 10% phase.
+func (r *Spc1Report) failure(result *Spc1PhaseResult) string {
+	if failure := result.failure(); failure != "" {
+		return failure
+	}
+
+	switch result.Phase.Name {
+	case PhaseRepeat1Iops, PhaseRepeat2Iops:
+		if primary := r.result(PhaseIops); primary != nil &&
+			math.Abs(result.Iops()-primary.Iops()) > Spc1Tolerance*primary.Iops() {
+			return fmt.Sprintf("IOPS not within %v%% of the IOPS phase",
+				Spc1Tolerance*100)
+		}
+	case PhaseRepeat1Lrt, PhaseRepeat2Lrt:
+		if primary := r.result(PhaseLrt); primary != nil &&
+			result.ResponseTimeUsecs() > (1+Spc1Tolerance)*primary.ResponseTimeUsecs() {
+			return fmt.Sprintf("Response time over %v%% of the 10%% phase",
+				100+Spc1Tolerance*100)
+		}
+	}
+
+	return ""
+}
+
+// True if all the phases of the test run passed
+func (r *Spc1Report) Pass() bool {
+	if len(r.Results) != len(Spc1Phases(0, 0)) {
+		return false
+	}
+	for _, result := range r.Results {
+		if r.failure(result) != "" {
+			return false
+		}
+	}
+	return true
+}
+
+func (r *Spc1Report) String() string {
+	s := fmt.Sprintf("SPC-1 report for %v BSUs\n", r.Bsu)
+	s += fmt.Sprintf("%-15s %5s %10s %10s %7s %9s %9s %9s %9s  %s\n",
+		"Phase", "BSUs", "Requested", "IOPS", "Read %",
+		"RT (ms)", "ASU1 (ms)", "ASU2 (ms)", "ASU3 (ms)", "Result")
+
+	for _, result := range r.Results {
+		status := "Pass"
+		if failure := r.failure(result); failure != "" {
+			status = "Fail: " + failure
+		}
+
+		s += fmt.Sprintf("%-15s %5v %10.2f %10.2f %7.2f %9.3f %9.3f %9.3f %9.3f  %s\n",
+			result.Phase.Name,
+			result.Bsu,
+			result.RequestedIops(),
+			result.Iops(),
+			result.ReadPercent(),
+			result.ResponseTimeUsecs()/1000,
+			result.AsuResponseTimeUsecs(1)/1000,
+			result.AsuResponseTimeUsecs(2)/1000,
+			result.AsuResponseTimeUsecs(3)/1000,
+			status)
+	}
+
+	if r.Pass() {
+		s += "Result: Pass\n"
+	} else {
+		s += "Result: Fail\n"
+	}
+
+	return s
+}
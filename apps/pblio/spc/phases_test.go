@@ -0,0 +1,165 @@
+//
+// Copyright (c) 2014 The pblcache Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package spc
+
+import (
+	"github.com/lpabon/goioworkload/spc1"
+	"github.com/pblcache/pblcache/cache"
+	"github.com/pblcache/pblcache/tests"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Returns the result of a one second phase with the ios and latency
+func newPhaseResult(name string, bsu, ios int, latency time.Duration) *Spc1PhaseResult {
+	result := &Spc1PhaseResult{
+		Phase:   Spc1Phase{Name: name, Percent: 100, Runlen: 1},
+		Bsu:     bsu,
+		Elapsed: time.Second,
+		Stats:   NewSpcStats(),
+	}
+	for i := 0; i < ios; i++ {
+		result.Stats.Collect(&IoStats{
+			Io: &spc1.Spc1Io{
+				Asu:    uint32(i%3) + 1,
+				Isread: i%2 == 0,
+				Blocks: 1,
+			},
+			Latency: latency,
+		})
+	}
+	return result
+}
+
+func TestSpc1Phases(t *testing.T) {
+	phases := Spc1Phases(30, 10)
+	tests.Assert(t, len(phases) == 11)
+	tests.Assert(t, phases[0].Name == PhaseSustainability)
+	tests.Assert(t, phases[0].Runlen == 30)
+	for _, phase := range phases[1:] {
+		tests.Assert(t, phase.Runlen == 10)
+	}
+
+	percents := []int{100, 100, 95, 90, 80, 50, 10, 10, 100, 10, 100}
+	for i, phase := range phases {
+		tests.Assert(t, phase.Percent == percents[i])
+	}
+
+	// BSUs are rounded, with at least one
+	tests.Assert(t, phases[2].Bsu(50) == 48)
+	tests.Assert(t, phases[6].Bsu(50) == 5)
+	tests.Assert(t, phases[6].Bsu(4) == 1)
+	tests.Assert(t, phases[0].Bsu(50) == 50)
+}
+
+func TestSpc1PhaseResult(t *testing.T) {
+	result := newPhaseResult(PhaseIops, 2, 100, 2*time.Millisecond)
+	tests.Assert(t, result.RequestedIops() == 100)
+	tests.Assert(t, result.Iops() == 100)
+	tests.Assert(t, result.ReadPercent() == 50)
+	tests.Assert(t, result.ResponseTimeUsecs() == 2000)
+	tests.Assert(t, result.AsuResponseTimeUsecs(3) == 2000)
+	tests.Assert(t, result.failure() == "")
+
+	// Too few IOPS
+	result = newPhaseResult(PhaseIops, 2, 94, 2*time.Millisecond)
+	tests.Assert(t, strings.Contains(result.failure(), "IOPS"))
+
+	// Too slow
+	result = newPhaseResult(PhaseIops, 2, 100, 31*time.Millisecond)
+	tests.Assert(t, strings.Contains(result.failure(), "Response time"))
+}
+
+func TestSpc1Report(t *testing.T) {
+	report := NewSpc1Report(10)
+	for _, phase := range Spc1Phases(1, 1) {
+		result := newPhaseResult(phase.Name, phase.Bsu(10),
+			phase.Bsu(10)*Spc1IopsPerBsu, time.Millisecond)
+		result.Phase = phase
+		report.Add(result)
+		if phase.Name != PhaseRepeat2Iops {
+			tests.Assert(t, !report.Pass())
+		}
+	}
+	tests.Assert(t, report.Pass())
+	tests.Assert(t, strings.Contains(report.String(), "Result: Pass"))
+
+	// Repeatability response time over the 10% phase
+	lrt := report.result(PhaseRepeat2Lrt)
+	report.Results[9] = newPhaseResult(PhaseRepeat2Lrt, lrt.Bsu,
+		lrt.Bsu*Spc1IopsPerBsu, 2*time.Millisecond)
+	tests.Assert(t, !report.Pass())
+	tests.Assert(t, strings.Contains(report.String(), "Result: Fail"))
+	report.Results[9] = lrt
+	tests.Assert(t, report.Pass())
+
+	// Repeatability IOPS not within the tolerance of the IOPS phase,
+	// with each within the tolerance of the IOPS requested
+	primary := report.result(PhaseIops)
+	primary.Elapsed = time.Second * 100 / 96
+	repeat := report.result(PhaseRepeat1Iops)
+	repeat.Elapsed = time.Second * 100 / 104
+	tests.Assert(t, primary.failure() == "")
+	tests.Assert(t, repeat.failure() == "")
+	tests.Assert(t, strings.Contains(report.failure(repeat), "IOPS phase"))
+	tests.Assert(t, !report.Pass())
+}
+
+func TestSpcRunPhase(t *testing.T) {
+	var cache *cache.CacheMap
+	s := NewSpcInfo(cache, false, 4*KB)
+
+	mockfile := tests.NewMockFile()
+	mockfile.MockSeek = func(offset int64, whence int) (int64, error) {
+		return int64(4 * GB), nil
+	}
+	defer tests.Patch(&openFile,
+		func(name string, flag int, perm os.FileMode) (Filer, error) {
+			return mockfile, nil
+		}).Restore()
+
+	tests.Assert(t, s.Open(1, "asu1file") == nil)
+	tests.Assert(t, s.Open(2, "asu2file") == nil)
+	tests.Assert(t, s.Open(3, "asu3file") == nil)
+	defer s.Close()
+
+	// Each I/O is collected in the phase stats and sent to iotime
+	iotime := make(chan *IoStats, 1024)
+	sent := 0
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for _ = range iotime {
+			sent++
+		}
+	}()
+
+	phase := Spc1Phase{Name: PhaseRamp50, Percent: 50, Runlen: 1}
+	result, err := s.RunPhase(phase, 4, iotime, make(chan struct{}))
+	tests.Assert(t, err == nil)
+	close(iotime)
+	<-done
+
+	tests.Assert(t, result.Bsu == 2)
+	tests.Assert(t, result.Elapsed >= time.Second)
+	tests.Assert(t, result.Stats.Total.Ios > 0)
+	tests.Assert(t, result.Stats.Total.Ios == uint64(sent))
+	tests.Assert(t, result.Stats.Total.Ios ==
+		result.Stats.Read.Ios+result.Stats.Write.Ios)
+}
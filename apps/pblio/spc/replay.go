@@ -0,0 +1,191 @@
+//
+// Copyright (c) 2014 The pblcache Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package spc
+
+import (
+	"fmt"
+	"github.com/lpabon/godbc"
+	"github.com/lpabon/goioworkload/spc1"
+	"io"
+	"sync"
+	"time"
+)
+
+const (
+	// Largest I/O sent, the size of the buffer of sendio in 4 KB blocks
+	replayMaxBlocks = 64
+)
+
+// Maps a device of the trace to an ASU.  Devices which are not mapped
+// are assigned to the ASUs opened in the order the devices first
+// appear in the trace.
+func (s *SpcInfo) MapDevice(device string, asu int) error {
+	if asu < 1 || asu > ASUs {
+		return fmt.Errorf("Unknown ASU %d", asu)
+	}
+	if s.asus[asu-1].len == 0 {
+		return fmt.Errorf("ASU%d is not open", asu)
+	}
+
+	s.tracemap[device] = asu
+	return nil
+}
+
+func (s *SpcInfo) traceAsu(device string) (int, error) {
+	if asu, ok := s.tracemap[device]; ok {
+		return asu, nil
+	}
+
+	for i := 0; i < ASUs; i++ {
+		asu := s.nextasu%ASUs + 1
+		s.nextasu++
+		if s.asus[asu-1].len != 0 {
+			s.tracemap[device] = asu
+			return asu, nil
+		}
+	}
+
+	return 0, fmt.Errorf("No ASU open for device %s", device)
+}
+
+// Returns the I/Os of the trace I/O on its ASU.  The trace I/O is
+// aligned to 4 KB, moved inside the ASU if it is past the end, and
+// split into I/Os which fit the buffer of sendio.
+func (s *SpcInfo) traceIos(tio *TraceIo) ([]*spc1.Spc1Io, error) {
+	asu, err := s.traceAsu(tio.Device)
+	if err != nil {
+		return nil, err
+	}
+	asulen := uint64(s.asus[asu-1].len)
+
+	block := tio.Offset / (4 * KB)
+	blocks := (tio.Offset+tio.Length+4*KB-1)/(4*KB) - block
+	if blocks > asulen {
+		blocks = asulen
+	}
+	block %= asulen
+	if block+blocks > asulen {
+		block = asulen - blocks
+	}
+
+	ios := make([]*spc1.Spc1Io, 0, (blocks+replayMaxBlocks-1)/replayMaxBlocks)
+	for blocks > 0 {
+		n := blocks
+		if n > replayMaxBlocks {
+			n = replayMaxBlocks
+		}
+
+		ios = append(ios, &spc1.Spc1Io{
+			Asu:    uint32(asu),
+			Offset: uint32(block),
+			Blocks: uint32(n),
+			Isread: tio.Isread,
+			When:   tio.When,
+		})
+		block += n
+		blocks -= n
+	}
+
+	return ios, nil
+}
+
+// Replays the trace on the ASUs.  When timed is set the I/Os are sent
+// at the times in the trace, otherwise they are sent as fast as the
+// ASUs and cache complete them.  Returns when the trace ends, after
+// runlen seconds, or when quit is closed.
+func (s *SpcInfo) Replay(trace TraceReader,
+	iotime chan<- *IoStats,
+	quit <-chan struct{},
+	runlen int,
+	timed bool) error {
+
+	godbc.Require(trace != nil)
+
+	// Same number of streams and io contexts as Context
+	streams := 8
+	iostreams := make([]chan *IoStats, streams)
+
+	var iostreamwg sync.WaitGroup
+	for stream := 0; stream < streams; stream++ {
+		iostreams[stream] = make(chan *IoStats, 64)
+		for i := 0; i < 32; i++ {
+			iostreamwg.Add(1)
+			go s.sendio(&iostreamwg, iostreams[stream], iotime)
+		}
+	}
+
+	var err error
+	start := time.Now()
+	stop := time.After(time.Second * time.Duration(runlen))
+	stream := 0
+	ioloop := true
+	for ioloop {
+		var tio *TraceIo
+		tio, err = trace.Next()
+		if err == io.EOF {
+			err = nil
+			break
+		} else if err != nil {
+			break
+		}
+
+		var ios []*spc1.Spc1Io
+		ios, err = s.traceIos(tio)
+		if err != nil {
+			break
+		}
+
+		if timed {
+			sleep_time := start.Add(tio.When).Sub(time.Now())
+			if sleep_time > 0 {
+				select {
+				case <-quit:
+					ioloop = false
+				case <-stop:
+					ioloop = false
+				case <-time.After(sleep_time):
+				}
+			}
+		}
+
+		for _, spcio := range ios {
+			if !ioloop {
+				break
+			}
+
+			spcio.Stream = uint32(stream)
+			select {
+			case <-quit:
+				ioloop = false
+			case <-stop:
+				ioloop = false
+			case iostreams[stream] <- &IoStats{
+				Io:    spcio,
+				Start: time.Now(),
+			}:
+				stream = (stream + 1) % streams
+			}
+		}
+	}
+
+	for stream := 0; stream < streams; stream++ {
+		close(iostreams[stream])
+	}
+	iostreamwg.Wait()
+
+	return err
+}
@@ -0,0 +1,181 @@
+//
+// Copyright (c) 2014 The pblcache Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package spc
+
+import (
+	"github.com/pblcache/pblcache/cache"
+	"github.com/pblcache/pblcache/tests"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSpcMapDevice(t *testing.T) {
+	var c *cache.CacheMap
+	s := NewSpcInfo(c, false, 4*KB)
+	s.asus[ASU1].len = 100
+	s.asus[ASU3].len = 10
+
+	tests.Assert(t, s.MapDevice("sdb", 0) != nil)
+	tests.Assert(t, s.MapDevice("sdb", 4) != nil)
+	tests.Assert(t, s.MapDevice("sdb", 2) != nil)
+	tests.Assert(t, s.MapDevice("sdb", 3) == nil)
+
+	// Other devices are assigned to the ASUs which are open
+	asu, err := s.traceAsu("sdb")
+	tests.Assert(t, err == nil && asu == 3)
+	asu, err = s.traceAsu("sdc")
+	tests.Assert(t, err == nil && asu == 1)
+	asu, err = s.traceAsu("sdd")
+	tests.Assert(t, err == nil && asu == 3)
+	asu, err = s.traceAsu("sde")
+	tests.Assert(t, err == nil && asu == 1)
+	asu, err = s.traceAsu("sdc")
+	tests.Assert(t, err == nil && asu == 1)
+
+	// No ASUs open
+	s = NewSpcInfo(c, false, 4*KB)
+	_, err = s.traceAsu("sdb")
+	tests.Assert(t, err != nil)
+}
+
+func TestSpcTraceIos(t *testing.T) {
+	var c *cache.CacheMap
+	s := NewSpcInfo(c, false, 4*KB)
+	s.asus[ASU1].len = 100
+
+	// Aligned to 4 KB
+	ios, err := s.traceIos(&TraceIo{
+		Device: "sdb",
+		Offset: 4*KB + 512,
+		Length: 4 * KB,
+		Isread: true,
+		When:   time.Second,
+	})
+	tests.Assert(t, err == nil)
+	tests.Assert(t, len(ios) == 1)
+	tests.Assert(t, ios[0].Asu == 1)
+	tests.Assert(t, ios[0].Offset == 1)
+	tests.Assert(t, ios[0].Blocks == 2)
+	tests.Assert(t, ios[0].Isread)
+	tests.Assert(t, ios[0].When == time.Second)
+
+	// Past the end of the ASU
+	ios, err = s.traceIos(&TraceIo{
+		Device: "sdb",
+		Offset: 198 * 4 * KB,
+		Length: 4 * 4 * KB,
+	})
+	tests.Assert(t, err == nil)
+	tests.Assert(t, len(ios) == 1)
+	tests.Assert(t, ios[0].Offset == 96)
+	tests.Assert(t, ios[0].Blocks == 4)
+
+	// Split into I/Os which fit the buffer
+	ios, err = s.traceIos(&TraceIo{
+		Device: "sdb",
+		Offset: 0,
+		Length: 80 * 4 * KB,
+	})
+	tests.Assert(t, err == nil)
+	tests.Assert(t, len(ios) == 2)
+	tests.Assert(t, ios[0].Offset == 0)
+	tests.Assert(t, ios[0].Blocks == replayMaxBlocks)
+	tests.Assert(t, ios[1].Offset == replayMaxBlocks)
+	tests.Assert(t, ios[1].Blocks == 80-replayMaxBlocks)
+
+	// Larger than the ASU
+	ios, err = s.traceIos(&TraceIo{
+		Device: "sdb",
+		Offset: 0,
+		Length: 1000 * 4 * KB,
+	})
+	tests.Assert(t, err == nil)
+	tests.Assert(t, len(ios) == 2)
+	tests.Assert(t, ios[0].Blocks+ios[1].Blocks == 100)
+}
+
+func TestSpcReplay(t *testing.T) {
+	var c *cache.CacheMap
+	s := NewSpcInfo(c, false, 4*KB)
+
+	tmpfile := tests.Tempfile()
+	err := tests.CreateFile(tmpfile, 256*4*KB)
+	tests.Assert(t, err == nil)
+	defer os.Remove(tmpfile)
+	err = s.Open(1, tmpfile)
+	tests.Assert(t, err == nil)
+	defer s.Close()
+
+	text := `fio version 2 iolog
+/dev/sdb read 0 4096
+/dev/sdb wait 100000 0
+/dev/sdb write 8192 8192
+/dev/sdb read 0 524288
+`
+	replay := func(timed bool) ([]*IoStats, time.Duration, error) {
+		trace, err := NewTraceReader(strings.NewReader(text), TraceFio)
+		tests.Assert(t, err == nil)
+
+		iotime := make(chan *IoStats, 16)
+		done := make(chan []*IoStats)
+		go func() {
+			stats := make([]*IoStats, 0)
+			for iostat := range iotime {
+				stats = append(stats, iostat)
+			}
+			done <- stats
+		}()
+
+		start := time.Now()
+		err = s.Replay(trace, iotime, nil, 60, timed)
+		elapsed := time.Now().Sub(start)
+		close(iotime)
+
+		return <-done, elapsed, err
+	}
+
+	// As fast as possible
+	stats, elapsed, err := replay(false)
+	tests.Assert(t, err == nil)
+	tests.Assert(t, len(stats) == 4)
+	tests.Assert(t, elapsed < 100*time.Millisecond)
+
+	reads, blocks := 0, uint32(0)
+	for _, iostat := range stats {
+		tests.Assert(t, iostat.Io.Asu == 1)
+		if iostat.Io.Isread {
+			reads++
+		}
+		blocks += iostat.Io.Blocks
+	}
+	tests.Assert(t, reads == 3)
+	tests.Assert(t, blocks == 1+2+128)
+
+	// At the times in the trace
+	stats, elapsed, err = replay(true)
+	tests.Assert(t, err == nil)
+	tests.Assert(t, len(stats) == 4)
+	tests.Assert(t, elapsed >= 100*time.Millisecond)
+
+	// Errors in the trace are returned
+	trace, err := NewTraceReader(strings.NewReader("bad"), TraceFio)
+	tests.Assert(t, err == nil)
+	err = s.Replay(trace, make(chan *IoStats, 1), nil, 60, false)
+	tests.Assert(t, err != nil)
+}
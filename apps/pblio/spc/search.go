@@ -0,0 +1,155 @@
+//
+// Copyright (c) 2014 The pblcache Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package spc
+
+import (
+	"fmt"
+	"github.com/lpabon/godbc"
+	"sort"
+	"time"
+)
+
+// Binary search over the BSUs for the highest number of BSUs of an
+// SPC-1 run which stays under the latency targets
+type BsuSearch struct {
+	// Range of BSUs searched
+	Low  int `json:"low"`
+	High int `json:"high"`
+
+	// Latency targets, or zero if not set
+	MeanLatency time.Duration `json:"mean_latency"`
+	P95Latency  time.Duration `json:"p95_latency"`
+
+	// Highest number of BSUs which passed, or zero if none
+	Bsu int `json:"bsu"`
+
+	// Trial results in the order they were run
+	Results []*Spc1PhaseResult `json:"results"`
+}
+
+func NewBsuSearch(low, high int, mean, p95 time.Duration) *BsuSearch {
+	godbc.Require(low > 0)
+	godbc.Require(low <= high)
+	godbc.Require(mean > 0 || p95 > 0)
+
+	return &BsuSearch{
+		Low:         low,
+		High:        high,
+		MeanLatency: mean,
+		P95Latency:  p95,
+		Results:     make([]*Spc1PhaseResult, 0),
+	}
+}
+
+// True if the trial stayed under the latency targets and had IOPS
+// within the tolerance of the IOPS requested.  A system which cannot
+// keep up with the IOPS requested falls behind, so the latency of the
+// I/O sent does not show it is overloaded.
+func (b *BsuSearch) Pass(result *Spc1PhaseResult) bool {
+	if result.Iops() < (1-Spc1Tolerance)*result.RequestedIops() {
+		return false
+	}
+	if b.MeanLatency > 0 &&
+		result.ResponseTimeUsecs() > float64(b.MeanLatency/time.Microsecond) {
+		return false
+	}
+	if b.P95Latency > 0 &&
+		result.Stats.LatencyPercentileUsecs(95) > float64(b.P95Latency/time.Microsecond) {
+		return false
+	}
+	return true
+}
+
+// Runs a trial for each BSU count the search visits, and returns the
+// highest number of BSUs which passed, or zero if none.  The search
+// stops early, without an error, when quit is closed.
+func (b *BsuSearch) Run(trial func(bsu int) (*Spc1PhaseResult, error),
+	quit <-chan struct{}) (int, error) {
+
+	low, high := b.Low, b.High
+	for low <= high {
+		select {
+		case <-quit:
+			return b.Bsu, nil
+		default:
+		}
+
+		bsu := low + (high-low)/2
+		result, err := trial(bsu)
+		if err != nil {
+			return b.Bsu, err
+		}
+		b.Results = append(b.Results, result)
+
+		if b.Pass(result) {
+			b.Bsu = bsu
+			low = bsu + 1
+		} else {
+			high = bsu - 1
+		}
+	}
+
+	return b.Bsu, nil
+}
+
+// Runs a trial of SPC-1 with the BSUs for runlen seconds
+func (s *SpcInfo) BsuTrial(bsu, runlen int,
+	iotime chan<- *IoStats,
+	quit <-chan struct{}) (*Spc1PhaseResult, error) {
+
+	phase := Spc1Phase{
+		Name:    fmt.Sprintf("Trial %v", bsu),
+		Percent: 100,
+		Runlen:  runlen,
+	}
+	return s.RunPhase(phase, bsu, iotime, quit)
+}
+
+// Trial results sorted by BSUs
+func (b *BsuSearch) Curve() []*Spc1PhaseResult {
+	curve := make([]*Spc1PhaseResult, len(b.Results))
+	copy(curve, b.Results)
+	sort.Slice(curve, func(i, j int) bool {
+		return curve[i].Bsu < curve[j].Bsu
+	})
+	return curve
+}
+
+func (b *BsuSearch) String() string {
+	s := fmt.Sprintf("%5s %10s %10s %9s %9s  %s\n",
+		"BSUs", "Requested", "IOPS", "Mean (ms)", "p95 (ms)", "Result")
+	for _, result := range b.Curve() {
+		status := "Pass"
+		if !b.Pass(result) {
+			status = "Fail"
+		}
+		s += fmt.Sprintf("%5v %10.2f %10.2f %9.3f %9.3f  %s\n",
+			result.Bsu,
+			result.RequestedIops(),
+			result.Iops(),
+			result.ResponseTimeUsecs()/1000,
+			result.Stats.LatencyPercentileUsecs(95)/1000,
+			status)
+	}
+	if b.Bsu > 0 {
+		s += fmt.Sprintf("Maximum BSUs: %v (%v IOPS)\n",
+			b.Bsu, b.Bsu*Spc1IopsPerBsu)
+	} else {
+		s += "Maximum BSUs: None\n"
+	}
+	return s
+}
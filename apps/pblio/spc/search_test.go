@@ -0,0 +1,112 @@
+//
+// Copyright (c) 2014 The pblcache Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package spc
+
+import (
+	"errors"
+	"github.com/pblcache/pblcache/tests"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Returns a trial which meets the IOPS requested, with a latency of
+// a millisecond per BSU
+func newLinearTrial(trials *[]int) func(bsu int) (*Spc1PhaseResult, error) {
+	return func(bsu int) (*Spc1PhaseResult, error) {
+		*trials = append(*trials, bsu)
+		return newPhaseResult("Trial", bsu, bsu*Spc1IopsPerBsu,
+			time.Duration(bsu)*time.Millisecond), nil
+	}
+}
+
+func TestBsuSearchPass(t *testing.T) {
+	search := NewBsuSearch(1, 10, 5*time.Millisecond, 0)
+	tests.Assert(t, search.Pass(newPhaseResult("Trial", 2, 100, 5*time.Millisecond)))
+	tests.Assert(t, !search.Pass(newPhaseResult("Trial", 2, 100, 6*time.Millisecond)))
+
+	// Falling behind the IOPS requested fails
+	tests.Assert(t, !search.Pass(newPhaseResult("Trial", 2, 90, time.Millisecond)))
+
+	// p95 target
+	search = NewBsuSearch(1, 10, 0, 5*time.Millisecond)
+	tests.Assert(t, search.Pass(newPhaseResult("Trial", 2, 100, 4*time.Millisecond)))
+	tests.Assert(t, !search.Pass(newPhaseResult("Trial", 2, 100, 8*time.Millisecond)))
+}
+
+func TestBsuSearchRun(t *testing.T) {
+	trials := make([]int, 0)
+	search := NewBsuSearch(1, 100, 37*time.Millisecond, 0)
+	bsu, err := search.Run(newLinearTrial(&trials), make(chan struct{}))
+	tests.Assert(t, err == nil)
+	tests.Assert(t, bsu == 37)
+	tests.Assert(t, search.Bsu == 37)
+
+	// Binary search over 100 BSUs
+	tests.Assert(t, len(trials) <= 7)
+	tests.Assert(t, len(search.Results) == len(trials))
+
+	// Curve is sorted by BSUs
+	curve := search.Curve()
+	for i := 1; i < len(curve); i++ {
+		tests.Assert(t, curve[i-1].Bsu < curve[i].Bsu)
+	}
+	tests.Assert(t, strings.Contains(search.String(), "Maximum BSUs: 37"))
+
+	// All pass
+	trials = trials[:0]
+	search = NewBsuSearch(5, 20, time.Second, 0)
+	bsu, err = search.Run(newLinearTrial(&trials), make(chan struct{}))
+	tests.Assert(t, err == nil)
+	tests.Assert(t, bsu == 20)
+
+	// None pass
+	trials = trials[:0]
+	search = NewBsuSearch(5, 20, time.Millisecond, 0)
+	bsu, err = search.Run(newLinearTrial(&trials), make(chan struct{}))
+	tests.Assert(t, err == nil)
+	tests.Assert(t, bsu == 0)
+	tests.Assert(t, strings.Contains(search.String(), "Maximum BSUs: None"))
+}
+
+func TestBsuSearchStop(t *testing.T) {
+	// Errors stop the search
+	search := NewBsuSearch(1, 100, time.Second, 0)
+	trialerr := errors.New("trial")
+	trials := 0
+	bsu, err := search.Run(func(bsu int) (*Spc1PhaseResult, error) {
+		trials++
+		if trials == 2 {
+			return nil, trialerr
+		}
+		return newPhaseResult("Trial", bsu, bsu*Spc1IopsPerBsu, time.Millisecond), nil
+	}, make(chan struct{}))
+	tests.Assert(t, err == trialerr)
+	tests.Assert(t, bsu == 50)
+	tests.Assert(t, len(search.Results) == 1)
+
+	// Quit stops the search
+	quit := make(chan struct{})
+	search = NewBsuSearch(1, 100, time.Second, 0)
+	bsu, err = search.Run(func(bsu int) (*Spc1PhaseResult, error) {
+		close(quit)
+		return newPhaseResult("Trial", bsu, bsu*Spc1IopsPerBsu, time.Millisecond), nil
+	}, quit)
+	tests.Assert(t, err == nil)
+	tests.Assert(t, bsu == 50)
+	tests.Assert(t, len(search.Results) == 1)
+}
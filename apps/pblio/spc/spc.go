@@ -33,8 +33,16 @@ const (
 
 type SpcInfo struct {
 	asus      []*Asu
+	devids    []uint32
 	pblcache  *cache.CacheMap
 	blocksize int
+
+	// ASU of each device of a trace and the next ASU assigned
+	tracemap map[string]int
+	nextasu  int
+
+	// Set in verify mode
+	verifier *verifier
 }
 
 func NewSpcInfo(c *cache.CacheMap,
@@ -44,13 +52,29 @@ func NewSpcInfo(c *cache.CacheMap,
 	s := &SpcInfo{
 		pblcache:  c,
 		asus:      make([]*Asu, ASUs),
+		devids:    make([]uint32, ASUs),
 		blocksize: blocksize,
+		tracemap:  make(map[string]int),
 	}
 
 	s.asus[ASU1] = NewAsu(usedirectio)
 	s.asus[ASU2] = NewAsu(usedirectio)
 	s.asus[ASU3] = NewAsu(usedirectio)
 
+	// Each ASU is a volume in the cache
+	if c != nil {
+		for asu := range s.devids {
+			name := fmt.Sprintf("asu%d", asu+1)
+			devid, ok := c.LookupVolume(name)
+			if !ok {
+				var err error
+				devid, err = c.RegisterVolume(name)
+				godbc.Check(err == nil, err)
+			}
+			s.devids[asu] = devid
+		}
+	}
+
 	return s
 }
 
@@ -59,16 +83,34 @@ func (s *SpcInfo) sendio(wg *sync.WaitGroup,
 	iotime chan<- *IoStats) {
 	defer wg.Done()
 
-	buffer := make([]byte, 4*KB*64)
+	// Aligned for ASUs and caches opened with direct I/O
+	buffer := cache.AlignedBuffer(4*KB*64, cache.DefaultAlignment)
 	for iostat := range iostream {
 
 		// Make sure the io is correct
 		io := iostat.Io
 		godbc.Invariant(io)
+
+		// Stamp the blocks written
+		if s.verifier != nil {
+			s.verifier.lock(uint64(io.Offset), io.Blocks)
+			if !io.Isread {
+				s.verifier.stamp(buffer[0:io.Blocks*4*KB], int(io.Asu), uint64(io.Offset))
+			}
+		}
+
+		var hitmap []bool
 		if io.Asu == 3 {
-			s.asus[ASU3].WriteAt(
-				buffer[0:io.Blocks*4*KB],
-				int64(io.Offset)*int64(4*KB))
+			// Only replayed traces read ASU3
+			if io.Isread {
+				s.asus[ASU3].ReadAt(
+					buffer[0:io.Blocks*4*KB],
+					int64(io.Offset)*int64(4*KB))
+			} else {
+				s.asus[ASU3].WriteAt(
+					buffer[0:io.Blocks*4*KB],
+					int64(io.Offset)*int64(4*KB))
+			}
 		} else {
 			// Send the io
 			if io.Isread {
@@ -76,12 +118,11 @@ func (s *SpcInfo) sendio(wg *sync.WaitGroup,
 					s.asus[io.Asu-1].ReadAt(buffer[0:io.Blocks*4*KB],
 						int64(io.Offset)*int64(4*KB))
 				} else {
-					read(s.asus[io.Asu-1],
+					hitmap = read(s.asus[io.Asu-1],
 						s.pblcache,
-						uint16(io.Asu),
+						s.devids[io.Asu-1],
 						uint64(io.Offset)*uint64(4*KB),
-						uint64(s.blocksize*KB),
-						int(io.Blocks),
+						uint64(s.blocksize),
 						buffer[0:io.Blocks*4*KB])
 				}
 			} else {
@@ -91,21 +132,60 @@ func (s *SpcInfo) sendio(wg *sync.WaitGroup,
 				} else {
 					write(s.asus[io.Asu-1],
 						s.pblcache,
-						uint16(io.Asu),
+						s.devids[io.Asu-1],
 						uint64(io.Offset)*uint64(4*KB),
-						uint64(s.blocksize*KB),
-						int(io.Blocks),
+						uint64(s.blocksize),
 						buffer[0:io.Blocks*4*KB])
 				}
 			}
 		}
 
+		// Check the blocks read
+		if s.verifier != nil {
+			if io.Isread {
+				s.verifier.check(buffer[0:io.Blocks*4*KB],
+					int(io.Asu),
+					s.devids[io.Asu-1],
+					uint64(io.Offset),
+					func(i int) bool {
+						return hitmap != nil &&
+							hitmap[s.cacheBlock(io.Offset, i)]
+					})
+			}
+			s.verifier.unlock(uint64(io.Offset), io.Blocks)
+		}
+
 		// Report back the latency
 		iostat.Latency = time.Now().Sub(iostat.Start)
 		iotime <- iostat
 	}
 }
 
+// Returns the index of the cache block in the I/O at the 4 KB offset
+// which has the 4 KB block at the index in the I/O
+func (s *SpcInfo) cacheBlock(offset uint32, index int) int {
+	blocksize := uint64(s.blocksize)
+	start := uint64(offset) * 4 * KB
+	return int((start+uint64(index)*4*KB)/blocksize - start/blocksize)
+}
+
+// Stamps each block written with its address, generation and
+// checksum, and checks each block read has the generation last
+// written.  Blocks read which do not are passed to report.  Must be
+// called after the ASUs are sized by Spc1Init() or opened for a trace,
+// and before any I/O.
+func (s *SpcInfo) EnableVerify(report func(e *VerifyError)) {
+	s.verifier = newVerifier(s.asus, report)
+}
+
+// Returns nil when not in verify mode
+func (s *SpcInfo) VerifyStats() *VerifyStats {
+	if s.verifier == nil {
+		return nil
+	}
+	return s.verifier.stats()
+}
+
 // Add a file to the specified ASU and open for reading
 // and writing.  Can be called multiple times to add many
 // files to a specified ASU
@@ -157,6 +237,13 @@ func (s *SpcInfo) Size(asu int) float64 {
 	return s.asus[asu-1].Size()
 }
 
+// Size in 4 KB blocks
+func (s *SpcInfo) Blocks(asu int) uint64 {
+	godbc.Require(asu > 0 && asu < 4, asu)
+
+	return uint64(s.asus[asu-1].len)
+}
+
 // Must be called after all the ASUs are opened
 func (s *SpcInfo) Spc1Init(bsu, contexts int) error {
 	godbc.Require(s.asus[ASU1].len != 0)
@@ -249,6 +336,30 @@ func (s *SpcInfo) Context(wg *sync.WaitGroup,
 	iostreamwg.Wait()
 }
 
+// Returns a Warmer which reads the ASUs through the cache.  Must be
+// called after Spc1Init() and only when using a cache.
+func (s *SpcInfo) Warmer(bandwidth uint64) *Warmer {
+	godbc.Require(s.pblcache != nil)
+
+	blocksize := uint64(s.blocksize)
+	w := NewWarmer(s.pblcache, blocksize, bandwidth)
+	for asu, devid := range s.devids {
+		w.AddDevice(devid, s.asus[asu], uint64(s.asus[asu].len)*4*KB/blocksize)
+	}
+
+	return w
+}
+
+// Removes the blocks of the ASUs from the cache.  Must be called
+// after the ASUs have been written without going through the cache.
+func (s *SpcInfo) InvalidateCache() {
+	godbc.Require(s.pblcache != nil)
+
+	for _, devid := range s.devids {
+		s.pblcache.InvalidateDevice(devid)
+	}
+}
+
 // Close all spc files
 func (s *SpcInfo) Close() {
 	for _, asu := range s.asus {
@@ -354,3 +354,33 @@ func TestSpcContextQuit(t *testing.T) {
 	s.Close()
 
 }
+
+func TestSpcInvalidateCache(t *testing.T) {
+	l, blocks, err := cache.NewLogFromDevice(cache.NewMemoryLogDevice(256*4096),
+		4096, 2, 0, 0)
+	tests.Assert(t, err == nil)
+	c := cache.NewCacheMap(blocks, 4096, l.Msgchan)
+	l.Start()
+	defer l.Close()
+
+	s := NewSpcInfo(c, false, 4096)
+	w := NewWarmer(c, 4096, 0)
+	for _, devid := range s.devids {
+		w.AddDevice(devid, cache.NewMemoryLogDevice(10*4096), 10)
+	}
+	other, err := c.RegisterVolume("other")
+	tests.Assert(t, err == nil)
+	w.AddDevice(other, cache.NewMemoryLogDevice(10*4096), 10)
+	tests.Assert(t, w.Warm([]cache.AddressRange{
+		cache.AddressRange{Devid: s.devids[ASU1], Start: 0, Length: 10},
+		cache.AddressRange{Devid: s.devids[ASU3], Start: 0, Length: 10},
+		cache.AddressRange{Devid: other, Start: 0, Length: 10},
+	}, nil) == nil)
+	tests.Assert(t, len(c.HotSet()) == 3)
+
+	// Only the blocks of the ASUs are removed
+	s.InvalidateCache()
+	hotset := c.HotSet()
+	tests.Assert(t, len(hotset) == 1)
+	tests.Assert(t, hotset[0].Devid == other)
+}
@@ -92,6 +92,14 @@ func (s *SpcStats) MeanLatencyUsecs() float64 {
 	return s.Total.MeanLatencyUsecs()
 }
 
+func (s *SpcStats) LatencyPercentileDeltaUsecs(prev *SpcStats, percent float64) float64 {
+	return s.Total.LatencyPercentileDeltaUsecs(&prev.Total, percent)
+}
+
+func (s *SpcStats) LatencyPercentileUsecs(percent float64) float64 {
+	return s.Total.LatencyPercentileUsecs(percent)
+}
+
 func (s *SpcStats) IosDelta(prev *SpcStats) uint64 {
 	return s.Total.IosDelta(&prev.Total)
 }
@@ -207,12 +207,12 @@ func TestSpcStats(t *testing.T) {
 	tests.Assert(t, split[1] == fmt.Sprintf("%v", 2*4*KB))
 
 	// Total Writes
-	tests.Assert(t, split[4] == "2")
-	tests.Assert(t, split[5] == fmt.Sprintf("%v", 12*4*KB))
+	tests.Assert(t, split[10] == "2")
+	tests.Assert(t, split[11] == fmt.Sprintf("%v", 12*4*KB))
 
 	// Total
-	tests.Assert(t, split[8] == "3")
-	tests.Assert(t, split[9] == fmt.Sprintf("%v", 14*4*KB))
+	tests.Assert(t, split[20] == "3")
+	tests.Assert(t, split[21] == fmt.Sprintf("%v", 14*4*KB))
 
 	latency := s.MeanLatencyDeltaUsecs(prev)
 	tests.Assert(t, latency == 3000.0)
@@ -0,0 +1,316 @@
+//
+// Copyright (c) 2014 The pblcache Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package spc
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Trace formats
+const (
+	TraceBlkparse = "blkparse"
+	TraceFio      = "fio"
+	TraceMsr      = "msr"
+)
+
+const (
+	sectorSize = 512
+)
+
+var (
+	ErrTraceFormat = errors.New("Unknown trace format")
+)
+
+// I/O read from a trace
+type TraceIo struct {
+	// Time since the start of the trace
+	When time.Duration
+
+	// Device or file name in the trace
+	Device string
+
+	// Offset and length in bytes
+	Offset uint64
+	Length uint64
+	Isread bool
+}
+
+type TraceReader interface {
+	// Returns the next read or write in the trace, or io.EOF after
+	// the last one
+	Next() (*TraceIo, error)
+}
+
+// Returns a reader of the trace in the format.  Supported formats are
+// blkparse text output, fio iolog version 2 and 3, and the SNIA MSR
+// Cambridge CSV.
+func NewTraceReader(r io.Reader, format string) (TraceReader, error) {
+	t := &trace{
+		scanner: bufio.NewScanner(r),
+	}
+
+	switch format {
+	case TraceBlkparse:
+		t.parse = t.blkparse
+	case TraceFio:
+		t.parse = t.fio
+	case TraceMsr:
+		t.parse = t.msr
+	default:
+		return nil, ErrTraceFormat
+	}
+
+	return t, nil
+}
+
+type trace struct {
+	scanner *bufio.Scanner
+	line    int
+
+	// Parses the fields of a line, returning nil for lines which
+	// are not reads or writes
+	parse func(fields []string) (*TraceIo, error)
+
+	// Time of the first I/O in the units of the trace
+	start   float64
+	ticks   uint64
+	started bool
+
+	// fio iolog version and the time waited in version 2
+	version int
+	waited  time.Duration
+}
+
+func (t *trace) Next() (*TraceIo, error) {
+	for t.scanner.Scan() {
+		t.line++
+
+		text := strings.TrimSpace(t.scanner.Text())
+		if text == "" {
+			continue
+		}
+
+		io, err := t.parse(strings.Fields(text))
+		if err != nil {
+			return nil, fmt.Errorf("Line %d: %v", t.line, err)
+		}
+		if io != nil {
+			return io, nil
+		}
+	}
+
+	if err := t.scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	return nil, io.EOF
+}
+
+// Returns the time since the first I/O from the timestamp
+func (t *trace) since(timestamp float64, unit time.Duration) time.Duration {
+	if !t.started {
+		t.start = timestamp
+		t.started = true
+	}
+
+	return time.Duration((timestamp - t.start) * float64(unit))
+}
+
+// Default blkparse output, for example:
+//
+//	8,0    3        1     0.000000000   697  Q  WS 1234 + 8 [kjournald]
+//
+// Only the requests queued, action Q, are used.
+func (t *trace) blkparse(fields []string) (*TraceIo, error) {
+	if len(fields) < 10 ||
+		!strings.Contains(fields[0], ",") ||
+		fields[5] != "Q" ||
+		fields[8] != "+" {
+		return nil, nil
+	}
+
+	rwbs := fields[6]
+	isread := strings.Contains(rwbs, "R")
+	if !isread && !strings.Contains(rwbs, "W") {
+		return nil, nil
+	}
+
+	timestamp, err := strconv.ParseFloat(fields[3], 64)
+	if err != nil {
+		return nil, err
+	}
+	sector, err := strconv.ParseUint(fields[7], 10, 64)
+	if err != nil {
+		return nil, err
+	}
+	sectors, err := strconv.ParseUint(fields[9], 10, 64)
+	if err != nil {
+		return nil, err
+	}
+	if sectors == 0 {
+		return nil, nil
+	}
+
+	return &TraceIo{
+		When:   t.since(timestamp, time.Second),
+		Device: fields[0],
+		Offset: sector * sectorSize,
+		Length: sectors * sectorSize,
+		Isread: isread,
+	}, nil
+}
+
+// fio iolog starting with a "fio version 2 iolog" or "fio version 3
+// iolog" line.  Lines are "file action offset length" in version 2,
+// where a wait action waits offset microseconds, and "timestamp file
+// action offset length" with a timestamp in milliseconds in version 3.
+func (t *trace) fio(fields []string) (*TraceIo, error) {
+	if t.version == 0 {
+		if len(fields) != 4 ||
+			fields[0] != "fio" ||
+			fields[1] != "version" ||
+			fields[3] != "iolog" ||
+			(fields[2] != "2" && fields[2] != "3") {
+			return nil, errors.New("Not a fio iolog version 2 or 3")
+		}
+		t.version, _ = strconv.Atoi(fields[2])
+		return nil, nil
+	}
+
+	when := t.waited
+	if t.version == 3 {
+		if len(fields) < 3 {
+			return nil, errors.New("Missing fields")
+		}
+		timestamp, err := strconv.ParseFloat(fields[0], 64)
+		if err != nil {
+			return nil, err
+		}
+		when = t.since(timestamp, time.Millisecond)
+		fields = fields[1:]
+	}
+	if len(fields) < 2 {
+		return nil, errors.New("Missing fields")
+	}
+
+	action := fields[1]
+	switch action {
+	case "read", "write", "wait":
+	default:
+		// File actions, syncs and trims
+		return nil, nil
+	}
+	if len(fields) != 4 {
+		return nil, fmt.Errorf("Expected offset and length for %s", action)
+	}
+
+	offset, err := strconv.ParseUint(fields[2], 10, 64)
+	if err != nil {
+		return nil, err
+	}
+	length, err := strconv.ParseUint(fields[3], 10, 64)
+	if err != nil {
+		return nil, err
+	}
+
+	if action == "wait" {
+		t.waited += time.Duration(offset) * time.Microsecond
+		return nil, nil
+	}
+	if length == 0 {
+		return nil, nil
+	}
+
+	return &TraceIo{
+		When:   when,
+		Device: fields[0],
+		Offset: offset,
+		Length: length,
+		Isread: action == "read",
+	}, nil
+}
+
+// SNIA MSR Cambridge CSV, for example:
+//
+//	128166372003061629,hm,1,Read,383496192,32768,151
+//
+// The fields are the timestamp in 100 nanosecond units, host name,
+// disk number, type, offset, size and response time.  A header line
+// is skipped.
+func (t *trace) msr(fields []string) (*TraceIo, error) {
+	fields = strings.Split(strings.Join(fields, ""), ",")
+	if len(fields) < 6 {
+		return nil, errors.New("Expected at least 6 fields")
+	}
+
+	timestamp, err := strconv.ParseUint(fields[0], 10, 64)
+	if err != nil {
+		if t.line == 1 {
+			return nil, nil
+		}
+		return nil, err
+	}
+
+	var isread bool
+	switch strings.ToLower(fields[3]) {
+	case "read":
+		isread = true
+	case "write":
+		isread = false
+	default:
+		return nil, fmt.Errorf("Unknown type %s", fields[3])
+	}
+
+	offset, err := strconv.ParseUint(fields[4], 10, 64)
+	if err != nil {
+		return nil, err
+	}
+	length, err := strconv.ParseUint(fields[5], 10, 64)
+	if err != nil {
+		return nil, err
+	}
+	if length == 0 {
+		return nil, nil
+	}
+
+	// Timestamps are too large to subtract as floats
+	if !t.started {
+		t.ticks = timestamp
+		t.started = true
+	}
+
+	// Records are not always in order.  Those older than the
+	// first I/O are sent right away.
+	when := time.Duration(0)
+	if timestamp > t.ticks {
+		when = time.Duration(int64(timestamp-t.ticks)) * 100 * time.Nanosecond
+	}
+
+	return &TraceIo{
+		When:   when,
+		Device: fields[1] + "_" + fields[2],
+		Offset: offset,
+		Length: length,
+		Isread: isread,
+	}, nil
+}
@@ -0,0 +1,159 @@
+//
+// Copyright (c) 2014 The pblcache Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package spc
+
+import (
+	"github.com/pblcache/pblcache/tests"
+	"io"
+	"strings"
+	"testing"
+	"time"
+)
+
+func readTrace(t *testing.T, text, format string) ([]*TraceIo, error) {
+	trace, err := NewTraceReader(strings.NewReader(text), format)
+	tests.Assert(t, err == nil)
+
+	ios := make([]*TraceIo, 0)
+	for {
+		tio, err := trace.Next()
+		if err == io.EOF {
+			return ios, nil
+		} else if err != nil {
+			return ios, err
+		}
+		ios = append(ios, tio)
+	}
+}
+
+func TestTraceFormat(t *testing.T) {
+	_, err := NewTraceReader(strings.NewReader(""), "nope")
+	tests.Assert(t, err == ErrTraceFormat)
+}
+
+func TestTraceBlkparse(t *testing.T) {
+	text := `
+  8,0    3        1     1.500000000   697  Q   R 1024 + 8 [fio]
+  8,0    3        2     1.500001000   697  G   R 1024 + 8 [fio]
+  8,0    3        3     1.500002000   697  C   R 1024 + 8 [0]
+  8,16   1        1     1.750000000   697  Q  WS 16 + 16 [kjournald]
+  8,16   1        2     1.800000000   697  Q  FN [kjournald]
+  8,16   1        3     2.000000000   697  Q   D 32 + 8 [fstrim]
+CPU0 (8,0):
+ Reads Queued:           1,        4KiB	 Writes Queued:           1,        8KiB
+`
+	ios, err := readTrace(t, text, TraceBlkparse)
+	tests.Assert(t, err == nil)
+	tests.Assert(t, len(ios) == 2)
+
+	tests.Assert(t, ios[0].When == 0)
+	tests.Assert(t, ios[0].Device == "8,0")
+	tests.Assert(t, ios[0].Offset == 1024*512)
+	tests.Assert(t, ios[0].Length == 8*512)
+	tests.Assert(t, ios[0].Isread)
+
+	tests.Assert(t, ios[1].When == 250*time.Millisecond)
+	tests.Assert(t, ios[1].Device == "8,16")
+	tests.Assert(t, ios[1].Offset == 16*512)
+	tests.Assert(t, ios[1].Length == 16*512)
+	tests.Assert(t, !ios[1].Isread)
+
+	// Bad sector
+	_, err = readTrace(t, "8,0 3 1 1.5 697 Q R x + 8 [fio]\n", TraceBlkparse)
+	tests.Assert(t, err != nil)
+	tests.Assert(t, strings.HasPrefix(err.Error(), "Line 1:"))
+}
+
+func TestTraceFio(t *testing.T) {
+	text := `fio version 2 iolog
+/dev/sdb add
+/dev/sdb open
+/dev/sdb read 4096 8192
+/dev/sdb wait 1500 0
+/dev/sdb write 0 4096
+/dev/sdb sync 0 0
+/dev/sdb trim 0 4096
+/dev/sdb close
+`
+	ios, err := readTrace(t, text, TraceFio)
+	tests.Assert(t, err == nil)
+	tests.Assert(t, len(ios) == 2)
+	tests.Assert(t, ios[0].When == 0)
+	tests.Assert(t, ios[0].Device == "/dev/sdb")
+	tests.Assert(t, ios[0].Offset == 4096)
+	tests.Assert(t, ios[0].Length == 8192)
+	tests.Assert(t, ios[0].Isread)
+	tests.Assert(t, ios[1].When == 1500*time.Microsecond)
+	tests.Assert(t, !ios[1].Isread)
+
+	text = `fio version 3 iolog
+100 /dev/sdc add
+100 /dev/sdc open
+100 /dev/sdc write 8192 4096
+112 /dev/sdc read 8192 4096
+`
+	ios, err = readTrace(t, text, TraceFio)
+	tests.Assert(t, err == nil)
+	tests.Assert(t, len(ios) == 2)
+	tests.Assert(t, ios[0].When == 0)
+	tests.Assert(t, !ios[0].Isread)
+	tests.Assert(t, ios[1].When == 12*time.Millisecond)
+	tests.Assert(t, ios[1].Isread)
+
+	// Missing header
+	_, err = readTrace(t, "/dev/sdb read 0 4096\n", TraceFio)
+	tests.Assert(t, err != nil)
+
+	// Missing length
+	_, err = readTrace(t, "fio version 2 iolog\n/dev/sdb read 0\n", TraceFio)
+	tests.Assert(t, err != nil)
+	tests.Assert(t, strings.HasPrefix(err.Error(), "Line 2:"))
+}
+
+func TestTraceMsr(t *testing.T) {
+	text := `Timestamp,Hostname,DiskNumber,Type,Offset,Size,ResponseTime
+128166372003061629,hm,1,Read,383496192,32768,151
+128166372013061629,hm,0,Write,4096,4096,200
+`
+	ios, err := readTrace(t, text, TraceMsr)
+	tests.Assert(t, err == nil)
+	tests.Assert(t, len(ios) == 2)
+	tests.Assert(t, ios[0].When == 0)
+	tests.Assert(t, ios[0].Device == "hm_1")
+	tests.Assert(t, ios[0].Offset == 383496192)
+	tests.Assert(t, ios[0].Length == 32768)
+	tests.Assert(t, ios[0].Isread)
+	tests.Assert(t, ios[1].When == time.Second)
+	tests.Assert(t, ios[1].Device == "hm_0")
+	tests.Assert(t, !ios[1].Isread)
+
+	// Records older than the first I/O are sent right away
+	text = `128166372013061629,hm,1,Read,0,4096,151
+128166372003061629,hm,1,Read,4096,4096,151
+128166372023061629,hm,1,Read,8192,4096,151
+`
+	ios, err = readTrace(t, text, TraceMsr)
+	tests.Assert(t, err == nil)
+	tests.Assert(t, len(ios) == 3)
+	tests.Assert(t, ios[0].When == 0)
+	tests.Assert(t, ios[1].When == 0)
+	tests.Assert(t, ios[2].When == time.Second)
+
+	// Unknown type
+	_, err = readTrace(t, "128166372003061629,hm,1,Trim,0,4096,1\n", TraceMsr)
+	tests.Assert(t, err != nil)
+}
@@ -0,0 +1,219 @@
+//
+// Copyright (c) 2014 The pblcache Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package spc
+
+import (
+	"encoding/binary"
+	"fmt"
+	"github.com/pblcache/pblcache/cache"
+	"sort"
+	"sync"
+	"sync/atomic"
+)
+
+const (
+	// "pblverif"
+	verifyMagic = 0x70626c7665726966
+
+	// Stamp at the start of each 4 KB block, followed by a pattern
+	// and the checksum of the block in the last 4 bytes
+	verifyMagicOffset      = 0
+	verifyAsuOffset        = 8
+	verifyBlockOffset      = 16
+	verifyGenerationOffset = 24
+	verifyPatternOffset    = 32
+	verifyChecksumOffset   = 4*KB - 4
+
+	// Number of locks of the blocks
+	verifyLocks = 1024
+)
+
+// Block read which does not have the contents last written
+type VerifyError struct {
+	Asu   int
+	Devid uint32
+
+	// Block in 4 KB units
+	Block uint64
+
+	Expected uint64
+	Found    uint64
+
+	// Whether the block was read from the cache
+	Hit bool
+
+	Reason string
+}
+
+func (e *VerifyError) Error() string {
+	origin := "backend"
+	if e.Hit {
+		origin = "cache"
+	}
+
+	return fmt.Sprintf("ASU%d devid %d block %d offset %d read from the %s: %s, "+
+		"expected generation %d found %d",
+		e.Asu, e.Devid, e.Block, e.Block*4*KB, origin, e.Reason,
+		e.Expected, e.Found)
+}
+
+type VerifyStats struct {
+	Verified uint64 `json:"verified"`
+	Skipped  uint64 `json:"skipped"`
+	Errors   uint64 `json:"errors"`
+}
+
+// Stamps the blocks written with their address and generation, and
+// checks the blocks read have the generation last written.  I/O to
+// the same blocks is serialized so the expected generation is known.
+type verifier struct {
+	generations [ASUs][]uint32
+	locks       [verifyLocks]sync.Mutex
+	report      func(e *VerifyError)
+
+	// Blocks checked, blocks never written, and errors found
+	verified uint64
+	skipped  uint64
+	errors   uint64
+}
+
+func newVerifier(asus []*Asu, report func(e *VerifyError)) *verifier {
+	v := &verifier{
+		report: report,
+	}
+	for asu := range asus {
+		v.generations[asu] = make([]uint32, asus[asu].len)
+	}
+
+	return v
+}
+
+// Returns the locks of the blocks in increasing order
+func (v *verifier) blockLocks(block uint64, blocks uint32) []int {
+	n := int(blocks)
+	if n > verifyLocks {
+		n = verifyLocks
+	}
+
+	locks := make([]int, n)
+	for i := range locks {
+		locks[i] = int((block + uint64(i)) % verifyLocks)
+	}
+	sort.Ints(locks)
+
+	return locks
+}
+
+func (v *verifier) lock(block uint64, blocks uint32) {
+	for _, l := range v.blockLocks(block, blocks) {
+		v.locks[l].Lock()
+	}
+}
+
+func (v *verifier) unlock(block uint64, blocks uint32) {
+	for _, l := range v.blockLocks(block, blocks) {
+		v.locks[l].Unlock()
+	}
+}
+
+// Fills the buffer with the blocks at the next generation.  Must be
+// called with the blocks locked.
+func (v *verifier) stamp(buffer []byte, asu int, block uint64) {
+	for i := 0; i*4*KB < len(buffer); i++ {
+		b := buffer[i*4*KB : (i+1)*4*KB]
+		address := block + uint64(i)
+
+		v.generations[asu-1][address]++
+		generation := uint64(v.generations[asu-1][address])
+
+		binary.LittleEndian.PutUint64(b[verifyMagicOffset:], verifyMagic)
+		binary.LittleEndian.PutUint64(b[verifyAsuOffset:], uint64(asu))
+		binary.LittleEndian.PutUint64(b[verifyBlockOffset:], address)
+		binary.LittleEndian.PutUint64(b[verifyGenerationOffset:], generation)
+		pattern := address*0x9e3779b97f4a7c15 ^ generation
+		for off := verifyPatternOffset; off+8 <= verifyChecksumOffset; off += 8 {
+			binary.LittleEndian.PutUint64(b[off:], pattern)
+		}
+		binary.LittleEndian.PutUint32(b[verifyChecksumOffset:],
+			cache.Checksum(b[:verifyChecksumOffset]))
+	}
+}
+
+// Checks the blocks read.  hit returns if the block at the index in
+// the buffer was read from the cache.  Must be called with the blocks
+// locked.
+func (v *verifier) check(buffer []byte,
+	asu int,
+	devid uint32,
+	block uint64,
+	hit func(i int) bool) {
+
+	for i := 0; i*4*KB < len(buffer); i++ {
+		b := buffer[i*4*KB : (i+1)*4*KB]
+		address := block + uint64(i)
+
+		// Contents of blocks not written are not known
+		expected := uint64(v.generations[asu-1][address])
+		if expected == 0 {
+			atomic.AddUint64(&v.skipped, 1)
+			continue
+		}
+		atomic.AddUint64(&v.verified, 1)
+
+		found := binary.LittleEndian.Uint64(b[verifyGenerationOffset:])
+		reason := ""
+		switch {
+		case binary.LittleEndian.Uint32(b[verifyChecksumOffset:]) !=
+			cache.Checksum(b[:verifyChecksumOffset]):
+			reason = "checksum mismatch"
+		case binary.LittleEndian.Uint64(b[verifyMagicOffset:]) != verifyMagic:
+			reason = "block not stamped"
+		case binary.LittleEndian.Uint64(b[verifyAsuOffset:]) != uint64(asu) ||
+			binary.LittleEndian.Uint64(b[verifyBlockOffset:]) != address:
+			reason = fmt.Sprintf("contents of ASU%d block %d",
+				binary.LittleEndian.Uint64(b[verifyAsuOffset:]),
+				binary.LittleEndian.Uint64(b[verifyBlockOffset:]))
+		case found < expected:
+			reason = "stale data"
+		case found > expected:
+			reason = "generation not written"
+		default:
+			continue
+		}
+
+		atomic.AddUint64(&v.errors, 1)
+		if v.report != nil {
+			v.report(&VerifyError{
+				Asu:      asu,
+				Devid:    devid,
+				Block:    address,
+				Expected: expected,
+				Found:    found,
+				Hit:      hit(i),
+				Reason:   reason,
+			})
+		}
+	}
+}
+
+func (v *verifier) stats() *VerifyStats {
+	return &VerifyStats{
+		Verified: atomic.LoadUint64(&v.verified),
+		Skipped:  atomic.LoadUint64(&v.skipped),
+		Errors:   atomic.LoadUint64(&v.errors),
+	}
+}
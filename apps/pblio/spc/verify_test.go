@@ -0,0 +1,167 @@
+//
+// Copyright (c) 2014 The pblcache Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package spc
+
+import (
+	"github.com/pblcache/pblcache/cache"
+	"github.com/pblcache/pblcache/message"
+	"github.com/pblcache/pblcache/tests"
+	"os"
+	"sort"
+	"strings"
+	"testing"
+)
+
+func TestVerifyBlockLocks(t *testing.T) {
+	v := newVerifier([]*Asu{}, nil)
+
+	locks := v.blockLocks(verifyLocks-2, 4)
+	tests.Assert(t, len(locks) == 4)
+	tests.Assert(t, sort.IntsAreSorted(locks))
+	tests.Assert(t, locks[0] == 0 && locks[3] == verifyLocks-1)
+
+	locks = v.blockLocks(10, verifyLocks+10)
+	tests.Assert(t, len(locks) == verifyLocks)
+}
+
+func TestVerifyStampCheck(t *testing.T) {
+	asus := []*Asu{{len: 16}, {len: 16}, {len: 0}}
+	errors := make([]*VerifyError, 0)
+	v := newVerifier(asus, func(e *VerifyError) {
+		errors = append(errors, e)
+	})
+	hit := func(i int) bool {
+		return i == 1
+	}
+
+	// Blocks never written are skipped
+	buffer := make([]byte, 2*4*KB)
+	v.check(buffer, 1, 7, 4, hit)
+	tests.Assert(t, len(errors) == 0)
+	tests.Assert(t, v.stats().Skipped == 2)
+
+	// Read the blocks written
+	v.stamp(buffer, 1, 4)
+	old := make([]byte, len(buffer))
+	copy(old, buffer)
+	v.check(buffer, 1, 7, 4, hit)
+	tests.Assert(t, len(errors) == 0)
+	tests.Assert(t, v.stats().Verified == 2)
+
+	// Stale data from the cache
+	v.stamp(buffer, 1, 4)
+	v.check(old, 1, 7, 4, hit)
+	tests.Assert(t, len(errors) == 2)
+	tests.Assert(t, errors[0].Reason == "stale data")
+	tests.Assert(t, errors[0].Asu == 1)
+	tests.Assert(t, errors[0].Devid == 7)
+	tests.Assert(t, errors[0].Block == 4)
+	tests.Assert(t, errors[0].Expected == 2)
+	tests.Assert(t, errors[0].Found == 1)
+	tests.Assert(t, !errors[0].Hit)
+	tests.Assert(t, errors[1].Block == 5)
+	tests.Assert(t, errors[1].Hit)
+	tests.Assert(t, strings.Contains(errors[1].Error(), "read from the cache"))
+
+	// Contents of another block
+	v.check(buffer[4*KB:], 1, 7, 4, hit)
+	tests.Assert(t, len(errors) == 3)
+	tests.Assert(t, strings.HasPrefix(errors[2].Reason, "contents of ASU1 block 5"))
+
+	// Contents of the same block in another ASU
+	v.stamp(old[:4*KB], 2, 4)
+	v.check(old[:4*KB], 1, 7, 4, hit)
+	tests.Assert(t, len(errors) == 4)
+	tests.Assert(t, strings.HasPrefix(errors[3].Reason, "contents of ASU2 block 4"))
+
+	// Corrupted
+	buffer[100]++
+	v.check(buffer, 1, 7, 4, hit)
+	tests.Assert(t, len(errors) == 5)
+	tests.Assert(t, errors[4].Reason == "checksum mismatch")
+
+	// Zeros
+	v.check(make([]byte, 4*KB), 1, 7, 4, hit)
+	tests.Assert(t, len(errors) == 6)
+	tests.Assert(t, errors[5].Reason == "checksum mismatch")
+	tests.Assert(t, v.stats().Errors == 6)
+}
+
+func TestSpcVerifyReplay(t *testing.T) {
+	// Cache with 8 KB blocks
+	l, blocks, err := cache.NewLogFromDevice(cache.NewMemoryLogDevice(64*8*KB),
+		8*KB, 2, 0, 0)
+	tests.Assert(t, err == nil)
+	c := cache.NewCacheMap(blocks, 8*KB, l.Msgchan)
+	l.Start()
+	defer l.Close()
+
+	s := NewSpcInfo(c, false, 8*KB)
+	tmpfile := tests.Tempfile()
+	err = tests.CreateFile(tmpfile, 256*4*KB)
+	tests.Assert(t, err == nil)
+	defer os.Remove(tmpfile)
+	err = s.Open(1, tmpfile)
+	tests.Assert(t, err == nil)
+	defer s.Close()
+
+	tests.Assert(t, s.VerifyStats() == nil)
+	errors := make(chan *VerifyError, 16)
+	s.EnableVerify(func(e *VerifyError) {
+		errors <- e
+	})
+
+	// Replays each I/O after the previous one completes
+	replay := func(ios ...string) {
+		for _, io := range ios {
+			trace, err := NewTraceReader(
+				strings.NewReader("fio version 2 iolog\n"+io+"\n"),
+				TraceFio)
+			tests.Assert(t, err == nil)
+
+			iotime := make(chan *IoStats, 16)
+			err = s.Replay(trace, iotime, nil, 60, false)
+			tests.Assert(t, err == nil)
+			tests.Assert(t, len(iotime) == 1)
+		}
+	}
+
+	// Reads through the cache and from the backend
+	replay("asu1 write 0 32768",
+		"asu1 read 0 32768",
+		"asu1 write 4096 4096",
+		"asu1 read 0 32768")
+	tests.Assert(t, len(errors) == 0)
+	stats := s.VerifyStats()
+	tests.Assert(t, stats.Verified == 16)
+	tests.Assert(t, stats.Errors == 0)
+	tests.Assert(t, c.Stats().Readhits > 0)
+
+	// Stale data in the backend
+	fp, err := os.OpenFile(tmpfile, os.O_RDWR, 0)
+	tests.Assert(t, err == nil)
+	fp.WriteAt(make([]byte, 4*KB), 7*4*KB)
+	fp.Close()
+	c.Invalidate(&message.IoPkt{Devid: s.devids[ASU1], Address: 3, Blocks: 1})
+
+	replay("asu1 read 24576 8192")
+	tests.Assert(t, len(errors) == 1)
+	e := <-errors
+	tests.Assert(t, e.Block == 7)
+	tests.Assert(t, !e.Hit)
+	tests.Assert(t, e.Devid == s.devids[ASU1])
+}
@@ -0,0 +1,190 @@
+//
+// Copyright (c) 2014 The pblcache Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+package spc
+
+import (
+	"errors"
+	"fmt"
+	"github.com/lpabon/godbc"
+	"github.com/pblcache/pblcache/cache"
+	"io"
+	"sync"
+	"time"
+)
+
+const (
+	// Maximum number of cache blocks read at a time
+	warmIoBlocks = 32
+)
+
+var (
+	ErrWarmStopped = errors.New("Cache warming was stopped")
+)
+
+type WarmProgress struct {
+	Blocks  uint64
+	Warmed  uint64
+	Skipped uint64
+	Elapsed time.Duration
+	Done    bool
+}
+
+type warmDevice struct {
+	fp     io.ReaderAt
+	blocks uint64
+}
+
+// Warms the cache by reading address ranges from the backend
+// through the cache
+type Warmer struct {
+	c         *cache.CacheMap
+	devices   map[uint32]*warmDevice
+	blocksize uint64
+	bandwidth uint64
+	start     time.Time
+	progress  WarmProgress
+	lock      sync.Mutex
+}
+
+// Bandwidth is the maximum number of bytes per second read from
+// the backend.  Set to 0 to read as fast as possible.
+func NewWarmer(c *cache.CacheMap, blocksize, bandwidth uint64) *Warmer {
+	godbc.Require(c != nil)
+	godbc.Require(blocksize > 0)
+
+	return &Warmer{
+		c:         c,
+		devices:   make(map[uint32]*warmDevice),
+		blocksize: blocksize,
+		bandwidth: bandwidth,
+	}
+}
+
+// Adds the backend of the device with the specified number of
+// cache blocks
+func (w *Warmer) AddDevice(devid uint32, fp io.ReaderAt, blocks uint64) {
+	w.devices[devid] = &warmDevice{
+		fp:     fp,
+		blocks: blocks,
+	}
+}
+
+// Reads the ranges from their backends through the cache.  Blocks of
+// unknown devices, or past the end of their device, are skipped.
+// Returns ErrWarmStopped if quit is closed before all the ranges have
+// been read.  Progress() may be called while the cache is warming.
+func (w *Warmer) Warm(ranges []cache.AddressRange, quit <-chan struct{}) error {
+	w.lock.Lock()
+	w.start = time.Now()
+	w.progress = WarmProgress{}
+	for _, r := range ranges {
+		w.progress.Blocks += r.Length
+	}
+	w.lock.Unlock()
+
+	buffer := cache.AlignedBuffer(int(warmIoBlocks*w.blocksize), cache.DefaultAlignment)
+	bytes := uint64(0)
+	for _, r := range ranges {
+		dev, ok := w.devices[r.Devid]
+		if !ok {
+			w.update(0, r.Length)
+			continue
+		}
+
+		for lba := r.Start; lba-r.Start < r.Length; {
+			select {
+			case <-quit:
+				return ErrWarmStopped
+			default:
+			}
+
+			if lba >= dev.blocks {
+				w.update(0, r.Length-(lba-r.Start))
+				break
+			}
+
+			blocks := r.Length - (lba - r.Start)
+			if blocks > warmIoBlocks {
+				blocks = warmIoBlocks
+			}
+			if lba+blocks > dev.blocks {
+				blocks = dev.blocks - lba
+			}
+
+			read(dev.fp,
+				w.c,
+				r.Devid,
+				lba*w.blocksize,
+				w.blocksize,
+				buffer[:blocks*w.blocksize])
+			w.update(blocks, 0)
+
+			bytes += blocks * w.blocksize
+			w.throttle(bytes)
+			lba += blocks
+		}
+	}
+
+	w.lock.Lock()
+	w.progress.Done = true
+	w.lock.Unlock()
+
+	return nil
+}
+
+// Returns the progress of the current or last call to Warm()
+func (w *Warmer) Progress() WarmProgress {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+
+	progress := w.progress
+	if !w.start.IsZero() {
+		progress.Elapsed = time.Since(w.start)
+	}
+
+	return progress
+}
+
+func (w *Warmer) update(warmed, skipped uint64) {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+
+	w.progress.Warmed += warmed
+	w.progress.Skipped += skipped
+}
+
+// Sleeps until reading the number of bytes since the start
+// is within the bandwidth
+func (w *Warmer) throttle(bytes uint64) {
+	if w.bandwidth == 0 {
+		return
+	}
+
+	expected := time.Duration(float64(bytes) / float64(w.bandwidth) * float64(time.Second))
+	if sleep := expected - time.Since(w.start); sleep > 0 {
+		time.Sleep(sleep)
+	}
+}
+
+func (p *WarmProgress) String() string {
+	percent := 100.0
+	if p.Blocks != 0 {
+		percent = float64(p.Warmed+p.Skipped) / float64(p.Blocks) * 100
+	}
+
+	return fmt.Sprintf("Warmed %d of %d blocks (%.1f%%), %d skipped, in %v",
+		p.Warmed, p.Blocks, percent, p.Skipped, p.Elapsed)
+}
@@ -0,0 +1,99 @@
+//
+// Copyright (c) 2014 The pblcache Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+package spc
+
+import (
+	"github.com/pblcache/pblcache/cache"
+	"github.com/pblcache/pblcache/tests"
+	"testing"
+	"time"
+)
+
+func TestWarm(t *testing.T) {
+	l, blocks, err := cache.NewLogFromDevice(cache.NewMemoryLogDevice(256*4096),
+		4096, 2, 0, 0)
+	tests.Assert(t, err == nil)
+	c := cache.NewCacheMap(blocks, 4096, l.Msgchan)
+	l.Start()
+	defer l.Close()
+
+	backend := cache.NewMemoryLogDevice(100 * 4096)
+	w := NewWarmer(c, 4096, 0)
+	w.AddDevice(1, backend, 100)
+
+	ranges := []cache.AddressRange{
+		cache.AddressRange{Devid: 1, Start: 0, Length: 40},
+		cache.AddressRange{Devid: 1, Start: 90, Length: 20},
+		cache.AddressRange{Devid: 2, Start: 0, Length: 5},
+	}
+	tests.Assert(t, w.Warm(ranges, nil) == nil)
+
+	progress := w.Progress()
+	tests.Assert(t, progress.Done)
+	tests.Assert(t, progress.Blocks == 65)
+	tests.Assert(t, progress.Warmed == 50)
+	tests.Assert(t, progress.Skipped == 15)
+	tests.Assert(t, c.Stats().Insertions == 50)
+
+	hotset := c.HotSet()
+	tests.Assert(t, len(hotset) == 2)
+	tests.Assert(t, hotset[0] == cache.AddressRange{Devid: 1, Start: 0, Length: 40})
+	tests.Assert(t, hotset[1] == cache.AddressRange{Devid: 1, Start: 90, Length: 10})
+
+	// Warming again reads from the cache
+	tests.Assert(t, w.Warm(hotset, nil) == nil)
+	tests.Assert(t, c.Stats().Insertions == 50)
+	tests.Assert(t, c.Stats().Readhits == 50)
+}
+
+func TestWarmBandwidth(t *testing.T) {
+	l, blocks, err := cache.NewLogFromDevice(cache.NewMemoryLogDevice(256*4096),
+		4096, 2, 0, 0)
+	tests.Assert(t, err == nil)
+	c := cache.NewCacheMap(blocks, 4096, l.Msgchan)
+	l.Start()
+	defer l.Close()
+
+	// 64 blocks at 1MB/s takes 250ms
+	w := NewWarmer(c, 4096, 1024*1024)
+	w.AddDevice(1, cache.NewMemoryLogDevice(64*4096), 64)
+	start := time.Now()
+	tests.Assert(t, w.Warm([]cache.AddressRange{
+		cache.AddressRange{Devid: 1, Start: 0, Length: 64},
+	}, nil) == nil)
+	tests.Assert(t, time.Since(start) >= 200*time.Millisecond)
+	tests.Assert(t, w.Progress().Warmed == 64)
+}
+
+func TestWarmStopped(t *testing.T) {
+	l, blocks, err := cache.NewLogFromDevice(cache.NewMemoryLogDevice(256*4096),
+		4096, 2, 0, 0)
+	tests.Assert(t, err == nil)
+	c := cache.NewCacheMap(blocks, 4096, l.Msgchan)
+	l.Start()
+	defer l.Close()
+
+	w := NewWarmer(c, 4096, 0)
+	w.AddDevice(1, cache.NewMemoryLogDevice(64*4096), 64)
+	quit := make(chan struct{})
+	close(quit)
+	err = w.Warm([]cache.AddressRange{
+		cache.AddressRange{Devid: 1, Start: 0, Length: 64},
+	}, quit)
+	tests.Assert(t, err == ErrWarmStopped)
+	tests.Assert(t, !w.Progress().Done)
+	tests.Assert(t, w.Progress().Warmed == 0)
+}
@@ -0,0 +1,181 @@
+//
+// Copyright (c) 2014 The pblcache Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package spc
+
+import (
+	"errors"
+	"math/rand"
+	"time"
+)
+
+// Synthetic workload types
+const (
+	WorkloadUniform    = "uniform"
+	WorkloadZipf       = "zipf"
+	WorkloadSequential = "sequential"
+	WorkloadHotspot    = "hotspot"
+)
+
+const (
+	// Device of the I/O of synthetic workloads
+	WorkloadDevice = "workload"
+)
+
+type WorkloadConfig struct {
+	Type string
+
+	// Size of the device and of each I/O in 4 KB blocks
+	Blocks   uint64
+	IoBlocks uint32
+
+	// Percent of the I/O which are reads
+	ReadPercent int
+
+	// I/O per second sent.  Set to 0 to send the I/O as fast as
+	// possible.
+	Iops int
+
+	// Skew of the zipf distribution, larger than 1.  Lower blocks
+	// are the hottest.
+	Skew float64
+
+	// Percent of the blocks in the hot spot, and percent of the I/O
+	// to the hot spot.  The hot spot moves to the blocks after it
+	// every shift period.  Set the period to 0 to never move it.
+	HotPercent   int
+	HotIoPercent int
+	HotShift     time.Duration
+
+	Seed int64
+}
+
+// Synthetic workload on a single device.  Implements TraceReader so
+// it can be replayed like a trace, with the I/O sent at the
+// configured rate when replayed with timing.  The workload never
+// ends.
+type Workload struct {
+	config WorkloadConfig
+	rand   *rand.Rand
+	zipf   *rand.Zipf
+
+	// Number of I/O offsets in the device
+	offsets uint64
+
+	ios   uint64
+	next  uint64
+	start time.Time
+}
+
+func NewWorkload(config *WorkloadConfig) (*Workload, error) {
+	if config.IoBlocks == 0 {
+		return nil, errors.New("I/O size must be larger than 0")
+	}
+	if config.Blocks < uint64(config.IoBlocks) {
+		return nil, errors.New("Device is smaller than the I/O size")
+	}
+	if config.ReadPercent < 0 || config.ReadPercent > 100 {
+		return nil, errors.New("Read percent must be between 0 and 100")
+	}
+	if config.Iops < 0 {
+		return nil, errors.New("I/O per second cannot be negative")
+	}
+
+	w := &Workload{
+		config:  *config,
+		rand:    rand.New(rand.NewSource(config.Seed)),
+		offsets: config.Blocks / uint64(config.IoBlocks),
+		start:   time.Now(),
+	}
+
+	switch config.Type {
+	case WorkloadUniform, WorkloadSequential:
+	case WorkloadZipf:
+		if config.Skew <= 1 {
+			return nil, errors.New("Zipf skew must be larger than 1")
+		}
+		w.zipf = rand.NewZipf(w.rand, config.Skew, 1, w.offsets-1)
+	case WorkloadHotspot:
+		if config.HotPercent <= 0 || config.HotPercent > 100 {
+			return nil, errors.New("Hot spot percent must be between 1 and 100")
+		}
+		if config.HotIoPercent < 0 || config.HotIoPercent > 100 {
+			return nil, errors.New("Hot spot I/O percent must be between 0 and 100")
+		}
+		if config.HotShift < 0 {
+			return nil, errors.New("Hot spot shift period cannot be negative")
+		}
+	default:
+		return nil, errors.New("Unknown workload " + config.Type)
+	}
+
+	return w, nil
+}
+
+// Time of the I/O since the start of the workload
+func (w *Workload) when() time.Duration {
+	if w.config.Iops == 0 {
+		return time.Since(w.start)
+	}
+	return time.Duration(w.ios) * time.Second / time.Duration(w.config.Iops)
+}
+
+// Returns the offset in the hot spot at the time, or anywhere in the
+// device for the I/O which do not go to the hot spot
+func (w *Workload) hotspot(when time.Duration) uint64 {
+	if w.rand.Intn(100) >= w.config.HotIoPercent {
+		return uint64(w.rand.Int63n(int64(w.offsets)))
+	}
+
+	size := w.offsets * uint64(w.config.HotPercent) / 100
+	if size == 0 {
+		size = 1
+	}
+
+	start := uint64(0)
+	if w.config.HotShift > 0 {
+		start = uint64(when/w.config.HotShift) * size
+	}
+
+	return (start + uint64(w.rand.Int63n(int64(size)))) % w.offsets
+}
+
+func (w *Workload) Next() (*TraceIo, error) {
+	when := w.when()
+
+	var offset uint64
+	switch w.config.Type {
+	case WorkloadUniform:
+		offset = uint64(w.rand.Int63n(int64(w.offsets)))
+	case WorkloadZipf:
+		offset = w.zipf.Uint64()
+	case WorkloadSequential:
+		offset = w.next
+		w.next = (w.next + 1) % w.offsets
+	case WorkloadHotspot:
+		offset = w.hotspot(when)
+	}
+	w.ios++
+
+	iosize := uint64(w.config.IoBlocks) * 4 * KB
+	return &TraceIo{
+		When:   when,
+		Device: WorkloadDevice,
+		Offset: offset * iosize,
+		Length: iosize,
+		Isread: w.rand.Intn(100) < w.config.ReadPercent,
+	}, nil
+}
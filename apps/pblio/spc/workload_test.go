@@ -0,0 +1,151 @@
+//
+// Copyright (c) 2014 The pblcache Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package spc
+
+import (
+	"github.com/pblcache/pblcache/tests"
+	"testing"
+	"time"
+)
+
+func TestWorkloadConfig(t *testing.T) {
+	configs := []WorkloadConfig{
+		{Type: WorkloadUniform, Blocks: 100},
+		{Type: WorkloadUniform, Blocks: 1, IoBlocks: 2},
+		{Type: WorkloadUniform, Blocks: 100, IoBlocks: 1, ReadPercent: 101},
+		{Type: WorkloadUniform, Blocks: 100, IoBlocks: 1, Iops: -1},
+		{Type: WorkloadZipf, Blocks: 100, IoBlocks: 1, Skew: 1.0},
+		{Type: WorkloadHotspot, Blocks: 100, IoBlocks: 1, HotPercent: 0},
+		{Type: WorkloadHotspot, Blocks: 100, IoBlocks: 1, HotPercent: 10, HotIoPercent: 101},
+		{Type: "nope", Blocks: 100, IoBlocks: 1},
+	}
+	for _, config := range configs {
+		_, err := NewWorkload(&config)
+		tests.Assert(t, err != nil)
+	}
+}
+
+func TestWorkloadUniform(t *testing.T) {
+	w, err := NewWorkload(&WorkloadConfig{
+		Type:        WorkloadUniform,
+		Blocks:      101,
+		IoBlocks:    2,
+		ReadPercent: 70,
+		Iops:        100,
+	})
+	tests.Assert(t, err == nil)
+
+	reads := 0
+	for i := 0; i < 10000; i++ {
+		tio, err := w.Next()
+		tests.Assert(t, err == nil)
+		tests.Assert(t, tio.Device == WorkloadDevice)
+		tests.Assert(t, tio.Length == 2*4*KB)
+		tests.Assert(t, tio.Offset%(2*4*KB) == 0)
+		tests.Assert(t, tio.Offset+tio.Length <= 100*4*KB)
+		tests.Assert(t, tio.When == time.Duration(i)*10*time.Millisecond)
+		if tio.Isread {
+			reads++
+		}
+	}
+	tests.Assert(t, reads > 6500 && reads < 7500)
+}
+
+func TestWorkloadSequential(t *testing.T) {
+	w, err := NewWorkload(&WorkloadConfig{
+		Type:     WorkloadSequential,
+		Blocks:   4,
+		IoBlocks: 1,
+	})
+	tests.Assert(t, err == nil)
+
+	for i := 0; i < 10; i++ {
+		tio, err := w.Next()
+		tests.Assert(t, err == nil)
+		tests.Assert(t, tio.Offset == uint64(i%4)*4*KB)
+		tests.Assert(t, !tio.Isread)
+	}
+}
+
+func TestWorkloadZipf(t *testing.T) {
+	w, err := NewWorkload(&WorkloadConfig{
+		Type:        WorkloadZipf,
+		Blocks:      1000,
+		IoBlocks:    1,
+		ReadPercent: 100,
+		Skew:        1.5,
+	})
+	tests.Assert(t, err == nil)
+
+	low := 0
+	for i := 0; i < 10000; i++ {
+		tio, err := w.Next()
+		tests.Assert(t, err == nil)
+		tests.Assert(t, tio.Offset < 1000*4*KB)
+		tests.Assert(t, tio.Isread)
+		if tio.Offset < 10*4*KB {
+			low++
+		}
+	}
+
+	// Most of the I/O goes to the lowest blocks
+	tests.Assert(t, low > 5000)
+}
+
+func TestWorkloadHotspot(t *testing.T) {
+	w, err := NewWorkload(&WorkloadConfig{
+		Type:         WorkloadHotspot,
+		Blocks:       1000,
+		IoBlocks:     1,
+		Iops:         1000,
+		HotPercent:   10,
+		HotIoPercent: 100,
+		HotShift:     time.Second,
+	})
+	tests.Assert(t, err == nil)
+
+	// The hot spot moves every 1000 I/Os
+	for i := 0; i < 10000; i++ {
+		tio, err := w.Next()
+		tests.Assert(t, err == nil)
+
+		start := uint64(i/1000) * 100
+		block := tio.Offset / (4 * KB)
+		tests.Assert(t, block >= start && block < start+100)
+	}
+
+	// Part of the I/O outside of the hot spot
+	w, err = NewWorkload(&WorkloadConfig{
+		Type:         WorkloadHotspot,
+		Blocks:       1000,
+		IoBlocks:     1,
+		Iops:         1000,
+		HotPercent:   10,
+		HotIoPercent: 50,
+	})
+	tests.Assert(t, err == nil)
+
+	hot := 0
+	for i := 0; i < 10000; i++ {
+		tio, err := w.Next()
+		tests.Assert(t, err == nil)
+		if tio.Offset < 100*4*KB {
+			hot++
+		}
+	}
+	tests.Assert(t, hot > 5000 && hot < 6000)
+}
@@ -0,0 +1,410 @@
+//
+// Copyright (c) 2014 The pblcache Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package main
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"github.com/lpabon/goioworkload/spc1"
+	"github.com/pblcache/pblcache/apps/pblio/spc"
+	"github.com/pblcache/pblcache/cache"
+	"io"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	KB = 1024
+	MB = 1024 * KB
+	GB = 1024 * MB
+)
+
+const (
+	policyLru   = "lru"
+	policyClock = "clock"
+
+	// RAM used by the cache metadata of each block of a cache
+	// size simulated with clock
+	clockBytesPerBlock = 128
+)
+
+var (
+	asusize, bsu, ios   int
+	blocksize, points   int
+	maxsize, maxmem     int
+	rate                float64
+	policies, pblsimdat string
+	tracefile, format   string
+	workload            string
+	readpercent, iosize int
+	iops, hotspot       int
+	hotspotios          int
+	hotspotshift        int
+	zipfskew            float64
+)
+
+// I/O simulated, in bytes
+type simio struct {
+	devid          uint32
+	offset, length uint64
+	isread         bool
+}
+
+func init() {
+	flag.IntVar(&asusize, "asusize", 100, "\n\tSize of ASU1 and of ASU2 in GB."+
+		"\n\tASU3 is sized as required by SPC-1")
+	flag.IntVar(&bsu, "bsu", 50, "\n\tNumber of BSUs (Business Scaling Units)")
+	flag.IntVar(&ios, "ios", 1000000, "\n\tNumber of I/Os to simulate")
+	flag.IntVar(&blocksize, "blocksize", 4, "\n\tCache block size in KB")
+	flag.IntVar(&maxsize, "maxsize", 0, "\n\tLargest cache size simulated in MB."+
+		"\n\tSet to 0 to use a tenth of the size of ASU1 and ASU2")
+	flag.IntVar(&points, "points", 10, "\n\tNumber of cache sizes simulated up to the largest")
+	flag.Float64Var(&rate, "rate", 0.01, "\n\tSampling rate used to compute the LRU miss ratio curve")
+	flag.StringVar(&policies, "policies", policyLru,
+		"\n\tComma separated list of eviction policies simulated: lru, clock."+
+			"\n\tlru is estimated with SHARDS in a single pass using little RAM."+
+			"\n\tclock runs the cache metadata for each cache size, which uses"+
+			"\n\tabout 128 bytes of RAM per block of every cache size simulated")
+	flag.IntVar(&maxmem, "maxmem", 2048, "\n\tLargest amount of RAM in MB used to simulate clock."+
+		"\n\tpblsim exits if the cache sizes simulated would use more")
+	flag.StringVar(&tracefile, "trace", "", "\n\tSimulate the I/O trace in this file instead of SPC-1."+
+		"\n\tEach device in the trace is simulated as a device in the cache")
+	flag.StringVar(&format, "traceformat", spc.TraceBlkparse, "\n\tFormat of the trace: blkparse, fio (iolog v2 or v3),"+
+		"\n\tor msr (SNIA MSR Cambridge CSV)")
+	flag.StringVar(&workload, "workload", "", "\n\tSimulate a synthetic workload on a device of the size of ASU1"+
+		"\n\tinstead of SPC-1: uniform, zipf, sequential, or hotspot")
+	flag.IntVar(&readpercent, "readpercent", 70, "\n\tPercent of the synthetic workload I/O which are reads")
+	flag.IntVar(&iosize, "iosize", 4, "\n\tSize of the synthetic workload I/O in KB, a multiple of 4")
+	flag.IntVar(&iops, "iops", 1000, "\n\tI/O per second of the synthetic workload."+
+		"\n\tUsed to move the hot spot of the hotspot workload")
+	flag.Float64Var(&zipfskew, "zipfskew", 1.1, "\n\tSkew of the zipf workload, larger than 1")
+	flag.IntVar(&hotspot, "hotspot", 10, "\n\tPercent of the blocks in the hot spot of the hotspot workload")
+	flag.IntVar(&hotspotios, "hotspotios", 90, "\n\tPercent of the I/O to the hot spot of the hotspot workload")
+	flag.IntVar(&hotspotshift, "hotspotshift", 60, "\n\tSeconds before the hot spot moves to the next blocks."+
+		"\n\tSet to 0 to never move the hot spot")
+	flag.StringVar(&pblsimdat, "data", "pblsim.csv", "\n\tMiss ratio curve file in CSV format")
+}
+
+// Simulates the cache of each size on its own goroutine
+func clockSimulators(sizes []uint64,
+	blocksize_bytes uint32,
+	wg *sync.WaitGroup) ([]*cache.Simulator, []chan *simio) {
+
+	sims := make([]*cache.Simulator, len(sizes))
+	iochans := make([]chan *simio, len(sizes))
+	for i, size := range sizes {
+		sim := cache.NewSimulator(size, blocksize_bytes)
+		iochan := make(chan *simio, 1024)
+		sims[i], iochans[i] = sim, iochan
+
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for io := range iochan {
+				if io.isread {
+					sim.Read(io.devid, io.offset, io.length)
+				} else {
+					sim.Write(io.devid, io.offset, io.length)
+				}
+			}
+		}()
+	}
+
+	return sims, iochans
+}
+
+// Sends the number of SPC-1 I/Os to the function in the order the
+// contexts would send them.  ASU3 is not used, like in pblio.
+func spc1Ios(contexts, ios int, f func(io *simio)) {
+	next := make([]*spc1.Spc1Io, contexts)
+	for i := 0; i < ios; i++ {
+		context := 0
+		for c := range next {
+			if next[c] == nil {
+				next[c] = spc1.NewSpc1Io(c)
+				next[c].Generate()
+			}
+			if next[c].When < next[context].When {
+				context = c
+			}
+		}
+		io := next[context]
+		next[context] = nil
+
+		if io.Asu == 3 {
+			continue
+		}
+
+		f(&simio{
+			devid:  io.Asu,
+			offset: uint64(io.Offset) * 4 * KB,
+			length: uint64(io.Blocks) * 4 * KB,
+			isread: io.Isread,
+		})
+	}
+}
+
+// Sends up to the number of I/Os in the trace to the function.  Each
+// device in the trace is given a device id in the order it appears.
+func traceIos(trace spc.TraceReader, ios int, f func(io *simio)) error {
+	devids := make(map[string]uint32)
+	for i := 0; i < ios; i++ {
+		tio, err := trace.Next()
+		if err == io.EOF {
+			return nil
+		} else if err != nil {
+			return err
+		}
+
+		devid, ok := devids[tio.Device]
+		if !ok {
+			devid = uint32(len(devids) + 1)
+			devids[tio.Device] = devid
+		}
+
+		f(&simio{
+			devid:  devid,
+			offset: tio.Offset,
+			length: tio.Length,
+			isread: tio.Isread,
+		})
+	}
+
+	return nil
+}
+
+func main() {
+	flag.Parse()
+
+	// Same number of contexts as pblio
+	contexts := int((bsu + 99) / 100)
+
+	lru, clock := false, false
+	for _, policy := range strings.Split(policies, ",") {
+		switch policy {
+		case policyLru:
+			lru = true
+		case policyClock:
+			clock = true
+		default:
+			fmt.Printf("Unknown policy: %s\n", policy)
+			return
+		}
+	}
+
+	if blocksize <= 0 || blocksize%4 != 0 {
+		fmt.Println("Block size must be a multiple of 4 KB")
+		return
+	}
+	if iosize <= 0 || iosize%4 != 0 {
+		fmt.Println("I/O size must be a multiple of 4 KB")
+		return
+	}
+	if iops <= 0 {
+		fmt.Println("I/O per second must be larger than 0")
+		return
+	}
+	if rate <= 0 || rate > 1 {
+		fmt.Println("Sampling rate must be larger than 0 and at most 1")
+		return
+	}
+	if points <= 0 {
+		fmt.Println("Number of points must be larger than 0")
+		return
+	}
+
+	// Sizes of the ASUs in 4 KB blocks
+	asu1 := uint32(uint64(asusize) * GB / (4 * KB))
+	asu2 := asu1
+	asu3 := uint32(float64(2*asu1) / 9)
+	spc1.Spc1Init(bsu, contexts, asu1, asu2, asu3)
+
+	// Cache sizes in blocks
+	blocksize_bytes := uint32(blocksize * KB)
+	if maxsize == 0 {
+		if tracefile != "" {
+			fmt.Println("Largest cache size must be set for traces")
+			return
+		}
+		maxsize = 2 * asusize * GB / MB / 10
+	}
+	maxblocks := uint64(maxsize) * MB / uint64(blocksize_bytes)
+	sizes := make([]uint64, points)
+	for i := range sizes {
+		sizes[i] = maxblocks * uint64(i+1) / uint64(points)
+		if sizes[i] == 0 {
+			sizes[i] = 1
+		}
+	}
+
+	// Each cache size simulated with clock has the metadata of all
+	// its blocks
+	if clock {
+		clockblocks := uint64(0)
+		for _, size := range sizes {
+			clockblocks += size
+		}
+		if mem := clockblocks * clockBytesPerBlock / MB; mem > uint64(maxmem) {
+			fmt.Printf("Simulating clock needs about %v MB of RAM, more than %v MB.\n"+
+				"Lower -maxsize or -points, or raise -maxmem\n", mem, maxmem)
+			return
+		}
+	}
+
+	fmt.Println("------")
+	fmt.Println("pblsim")
+	fmt.Println("------")
+	if tracefile != "" {
+		fmt.Printf("Trace   : %s (%s)\n", tracefile, format)
+	} else if workload != "" {
+		fmt.Printf("Workload: %s (%v%% reads, %v KB, %v GB)\n",
+			workload, readpercent, iosize, asusize)
+	} else {
+		fmt.Printf("ASU1    : %v GB\n"+
+			"ASU2    : %v GB\n"+
+			"BSUs    : %v\n",
+			asusize,
+			asusize,
+			bsu)
+	}
+	fmt.Printf("I/Os    : %v\n"+
+		"Policies: %v\n"+
+		"Max Size: %v MB\n",
+		ios,
+		policies,
+		maxsize)
+	fmt.Println("------")
+
+	var mrc *cache.MissRatioCurve
+	if lru {
+		mrc = cache.NewMissRatioCurve(rate)
+	}
+
+	var wg sync.WaitGroup
+	var sims []*cache.Simulator
+	var iochans []chan *simio
+	if clock {
+		sims, iochans = clockSimulators(sizes, blocksize_bytes, &wg)
+	}
+
+	simulate := func(io *simio) {
+		for _, iochan := range iochans {
+			iochan <- io
+		}
+
+		if mrc != nil {
+			block, _, nblocks := cache.SubBlockRange(io.offset,
+				io.length,
+				blocksize_bytes)
+			for b := uint64(0); b < uint64(nblocks); b++ {
+				mrc.Reference(cache.Address{
+					Devid: io.devid,
+					Lba:   block + b,
+				}, io.isread)
+			}
+		}
+	}
+
+	var err error
+	if tracefile != "" {
+		var fp *os.File
+		fp, err = os.Open(tracefile)
+		if err == nil {
+			var trace spc.TraceReader
+			trace, err = spc.NewTraceReader(bufio.NewReader(fp), format)
+			if err == nil {
+				err = traceIos(trace, ios, simulate)
+			}
+			fp.Close()
+		}
+	} else if workload != "" {
+		var w *spc.Workload
+		w, err = spc.NewWorkload(&spc.WorkloadConfig{
+			Type:         workload,
+			Blocks:       uint64(asu1),
+			IoBlocks:     uint32(iosize / 4),
+			ReadPercent:  readpercent,
+			Iops:         iops,
+			Skew:         zipfskew,
+			HotPercent:   hotspot,
+			HotIoPercent: hotspotios,
+			HotShift:     time.Duration(hotspotshift) * time.Second,
+			Seed:         time.Now().UnixNano(),
+		})
+		if err == nil {
+			err = traceIos(w, ios, simulate)
+		}
+	} else {
+		spc1Ios(contexts, ios, simulate)
+	}
+
+	for _, iochan := range iochans {
+		close(iochan)
+	}
+	wg.Wait()
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+
+	// Save and print the curve
+	fp, err := os.Create(pblsimdat)
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+	defer fp.Close()
+	data := bufio.NewWriter(fp)
+	defer data.Flush()
+
+	fmt.Printf("%-12s %-12s %-12s\n", "Size (MB)", "LRU Miss", "CLOCK Miss")
+	for i, size := range sizes {
+		mb := float64(size*uint64(blocksize_bytes)) / MB
+		line := fmt.Sprintf("%-12.2f", mb)
+		csv := fmt.Sprintf("%v,", mb)
+
+		if mrc != nil {
+			missratio := mrc.MissRatio(size)
+			line += fmt.Sprintf(" %-12.4f", missratio)
+			csv += fmt.Sprintf("%v,", missratio)
+		} else {
+			line += fmt.Sprintf(" %-12s", "-")
+			csv += ","
+		}
+
+		if sims != nil {
+			missratio := 1.0 - sims[i].Stats().ReadHitRate()
+			line += fmt.Sprintf(" %-12.4f", missratio)
+			csv += fmt.Sprintf("%v,", missratio)
+			sims[i].Close()
+		} else {
+			line += fmt.Sprintf(" %-12s", "-")
+			csv += ","
+		}
+
+		fmt.Println(line)
+		data.WriteString(csv + "\n")
+	}
+
+	if mrc != nil {
+		fmt.Println("------")
+		fmt.Print(mrc)
+	}
+}
@@ -16,28 +16,44 @@
 package cache
 
 import (
-	"github.com/lpabon/godbc"
+	"github.com/pblcache/pblcache/message"
 )
 
 const (
-	MAX_LBA = uint64(1 << 48)
+	// Legacy metadata packed the device id in the upper 16 bits
+	// and the block address in the lower 48 bits of a uint64.
+	legacyDevidShift = 48
+	legacyLbaMask    = uint64(1<<legacyDevidShift) - 1
 )
 
+// Address of a block in a backend.  It is used as the key to the
+// cache map.
 type Address struct {
-	Devid uint16
+	Devid uint32
 	Lba   uint64
 }
 
-func Address64(address Address) uint64 {
-	godbc.Require(address.Lba < MAX_LBA)
-	return (uint64(address.Devid) << 48) | uint64(address.Lba)
+// Returns the address of the block which is blocks after address.
+func (a Address) Add(blocks uint64) Address {
+	return Address{
+		Devid: a.Devid,
+		Lba:   a.Lba + blocks,
+	}
 }
 
-func AddressValue(address uint64) Address {
-	var a Address
-
-	a.Devid = uint16(address >> 48)
-	a.Lba = uint64(0xFFFFFFFFFFFF) & address
+// Returns the address of the first block of an IoPkt
+func IoAddress(io *message.IoPkt) Address {
+	return Address{
+		Devid: io.Devid,
+		Lba:   io.Address,
+	}
+}
 
-	return a
+// Converts an address saved by metadata versions which packed the
+// device id and block into a single uint64.
+func legacyAddress(address uint64) Address {
+	return Address{
+		Devid: uint32(address >> legacyDevidShift),
+		Lba:   address & legacyLbaMask,
+	}
 }
@@ -16,19 +16,38 @@
 package cache
 
 import (
+	"github.com/pblcache/pblcache/message"
 	"github.com/pblcache/pblcache/tests"
 	"testing"
 )
 
-func TestAddressUtils(t *testing.T) {
+func TestAddressAdd(t *testing.T) {
 	a := Address{
-		Devid: uint16(9876),
-		Lba:   uint64(123456789),
+		Devid: uint32(1 << 20),
+		Lba:   uint64(1 << 50),
 	}
 
-	merged := Address64(a)
-	converted := AddressValue(merged)
+	next := a.Add(10)
+	tests.Assert(t, next.Devid == a.Devid)
+	tests.Assert(t, next.Lba == a.Lba+10)
+	tests.Assert(t, next != a)
+	tests.Assert(t, next.Add(0) == next)
+}
+
+func TestIoAddress(t *testing.T) {
+	io := &message.IoPkt{
+		Devid:   uint32(123456),
+		Address: uint64(1 << 60),
+	}
+
+	a := IoAddress(io)
+	tests.Assert(t, a.Devid == io.Devid)
+	tests.Assert(t, a.Lba == io.Address)
+}
+
+func TestLegacyAddress(t *testing.T) {
+	a := legacyAddress((uint64(9876) << 48) | uint64(123456789))
 
-	tests.Assert(t, a.Devid == converted.Devid)
-	tests.Assert(t, a.Lba == converted.Lba)
+	tests.Assert(t, a.Devid == uint32(9876))
+	tests.Assert(t, a.Lba == uint64(123456789))
 }
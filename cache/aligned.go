@@ -0,0 +1,106 @@
+//
+// Copyright (c) 2014 The pblcache Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package cache
+
+import (
+	"github.com/lpabon/godbc"
+	"sync"
+	"unsafe"
+)
+
+const (
+	// Alignment which satisfies direct I/O on most devices
+	DefaultAlignment = 4096
+)
+
+// Allocates a buffer of size bytes whose start address is a
+// multiple of alignment, as required by direct I/O.
+func AlignedBuffer(size, alignment int) []byte {
+	godbc.Require(size >= 0)
+	godbc.Require(alignment > 0)
+
+	if alignment == 1 {
+		return make([]byte, size)
+	}
+
+	buf := make([]byte, size+alignment)
+	offset := 0
+	if rem := int(uintptr(unsafe.Pointer(&buf[0])) % uintptr(alignment)); rem != 0 {
+		offset = alignment - rem
+	}
+	buf = buf[offset : offset+size : offset+size]
+
+	godbc.Ensure(alignedAddress(buf, alignment))
+
+	return buf
+}
+
+// Returns true if the start address and the length of the
+// buffer are multiples of alignment
+func IsAligned(buf []byte, alignment int) bool {
+	godbc.Require(alignment > 0)
+
+	return len(buf)%alignment == 0 && alignedAddress(buf, alignment)
+}
+
+func alignedAddress(buf []byte, alignment int) bool {
+	if cap(buf) == 0 {
+		return true
+	}
+
+	return uintptr(unsafe.Pointer(&buf[:1][0]))%uintptr(alignment) == 0
+}
+
+// Pool of aligned buffers of the same size
+type BufferPool struct {
+	size      int
+	alignment int
+	pool      sync.Pool
+}
+
+func NewBufferPool(size, alignment int) *BufferPool {
+	godbc.Require(size > 0)
+	godbc.Require(alignment > 0)
+
+	p := &BufferPool{
+		size:      size,
+		alignment: alignment,
+	}
+	p.pool.New = func() interface{} {
+		return AlignedBuffer(p.size, p.alignment)
+	}
+
+	return p
+}
+
+// Size in bytes of each buffer in the pool
+func (p *BufferPool) Size() int {
+	return p.size
+}
+
+// Returns an aligned buffer of Size() bytes.  The contents
+// of the buffer are undefined.
+func (p *BufferPool) Get() []byte {
+	return p.pool.Get().([]byte)
+}
+
+// Returns the buffer to the pool.  Only buffers returned
+// by Get() may be returned to the pool.
+func (p *BufferPool) Put(buf []byte) {
+	godbc.Require(len(buf) == p.size)
+	p.pool.Put(buf[:p.size])
+}
@@ -0,0 +1,156 @@
+//
+// Copyright (c) 2014 The pblcache Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package cache
+
+import (
+	"bytes"
+	"github.com/pblcache/pblcache/message"
+	"github.com/pblcache/pblcache/tests"
+	"testing"
+)
+
+func TestAlignedBuffer(t *testing.T) {
+	for _, alignment := range []int{1, 512, 4096} {
+		for _, size := range []int{0, 512, 4096, 3 * 4096} {
+			buf := AlignedBuffer(size, alignment)
+			tests.Assert(t, len(buf) == size)
+			tests.Assert(t, cap(buf) == size)
+			tests.Assert(t, alignedAddress(buf, alignment))
+			tests.Assert(t, IsAligned(buf, alignment) == (size%alignment == 0))
+		}
+	}
+}
+
+func TestIsAligned(t *testing.T) {
+	buf := AlignedBuffer(2*4096, 4096)
+	tests.Assert(t, IsAligned(buf, 4096))
+	tests.Assert(t, IsAligned(buf[4096:], 4096))
+	tests.Assert(t, !IsAligned(buf[1:4097], 4096))
+	tests.Assert(t, !IsAligned(buf[:4095], 4096))
+	tests.Assert(t, IsAligned(buf[1:4097], 1))
+}
+
+func TestBufferPool(t *testing.T) {
+	p := NewBufferPool(8192, 4096)
+	tests.Assert(t, p.Size() == 8192)
+
+	buf := p.Get()
+	tests.Assert(t, len(buf) == 8192)
+	tests.Assert(t, IsAligned(buf, 4096))
+	p.Put(buf)
+
+	buf = p.Get()
+	tests.Assert(t, len(buf) == 8192)
+	tests.Assert(t, IsAligned(buf, 4096))
+}
+
+func TestLogBounce(t *testing.T) {
+	// Device which requires aligned buffers
+	mockfile := tests.NewMockFile()
+	mockfile.MockSeek = func(offset int64, whence int) (int64, error) {
+		return 128 * 4096, nil
+	}
+	mockfile.MockReadAt = func(p []byte, off int64) (int, error) {
+		tests.Assert(t, IsAligned(p, 4096))
+		for i := range p {
+			p[i] = byte(off / 4096)
+		}
+		return len(p), nil
+	}
+
+	l, blocks, err := NewLogFromDevice(&alignedLogDevice{mockLogDevice{mockfile}},
+		4096, 2, 0, 0)
+	tests.Assert(t, err == nil)
+	tests.Assert(t, blocks == 128)
+	tests.Assert(t, l.Alignment() == 4096)
+	for i := range l.segments {
+		tests.Assert(t, IsAligned(l.segments[i].segmentbuf, 4096))
+	}
+	l.Start()
+
+	here := make(chan *message.Message)
+	read := func(buffer []byte, index uint64, nblocks uint32) {
+		m := message.NewMsgGet()
+		m.RetChan = here
+		io := m.IoPkt()
+		io.Buffer = buffer
+		io.LogBlock = index
+		io.Blocks = nblocks
+		l.Msgchan <- m
+		<-here
+	}
+
+	// Aligned buffer is read directly
+	buf := AlignedBuffer(4096, 4096)
+	read(buf, 100, 1)
+	tests.Assert(t, bytes.Equal(buf, bytes.Repeat([]byte{100}, 4096)))
+	tests.Assert(t, l.Stats().Bounces == 0)
+
+	// Unaligned buffer is bounced
+	buf = AlignedBuffer(4097, 4096)[1:]
+	read(buf, 101, 1)
+	tests.Assert(t, bytes.Equal(buf, bytes.Repeat([]byte{101}, 4096)))
+	tests.Assert(t, l.Stats().Bounces == 1)
+
+	// Unaligned buffer larger than a segment
+	buf = AlignedBuffer(4*4096+1, 4096)[1:]
+	read(buf, 96, 4)
+	tests.Assert(t, buf[0] == 96)
+	tests.Assert(t, l.Stats().Bounces == 2)
+
+	l.Close()
+}
+
+func TestLogBounceSmallBlocks(t *testing.T) {
+	mockfile := tests.NewMockFile()
+	mockfile.MockSeek = func(offset int64, whence int) (int64, error) {
+		return 128 * 4096, nil
+	}
+	mockfile.MockReadAt = func(p []byte, off int64) (int, error) {
+		tests.Assert(t, IsAligned(p, 4096))
+		tests.Assert(t, off%4096 == 0)
+		for i := range p {
+			p[i] = byte((off + int64(i)) / 512)
+		}
+		return len(p), nil
+	}
+
+	// 512 byte blocks on a device with 4096 byte alignment
+	l, blocks, err := NewLogFromDevice(&alignedLogDevice{mockLogDevice{mockfile}},
+		512, 16, 0, 0)
+	tests.Assert(t, err == nil)
+	tests.Assert(t, blocks == 1024)
+	l.Start()
+
+	// Read from a segment which is not in memory
+	index := uint64(900)
+	here := make(chan *message.Message)
+	m := message.NewMsgGet()
+	m.RetChan = here
+	io := m.IoPkt()
+	io.Buffer = AlignedBuffer(2*512, 4096)
+	io.LogBlock = index
+	io.Blocks = 2
+	l.Msgchan <- m
+	<-here
+
+	tests.Assert(t, bytes.Equal(io.Buffer[:512], bytes.Repeat([]byte{byte(index)}, 512)))
+	tests.Assert(t, bytes.Equal(io.Buffer[512:], bytes.Repeat([]byte{byte(index + 1)}, 512)))
+	tests.Assert(t, l.Stats().Bounces == 1)
+
+	l.Close()
+}
@@ -21,28 +21,35 @@ import (
 	"github.com/lpabon/godbc"
 )
 
-const (
-	INVALID_KEY = ^uint64(0)
+var (
+	INVALID_KEY = Address{Devid: ^uint32(0), Lba: ^uint64(0)}
 )
 
 type BlockDescriptor struct {
-	key       uint64
+	key       Address
 	clock_set bool
 	used      bool
+	pinned    bool
+	inserted  int64
 }
 
 type BlockDescriptorArraySave struct {
-	Index uint32
-	Size  uint32
+	Index uint64
+	Size  uint64
 }
 
 type BlockDescriptorArray struct {
-	bds   []BlockDescriptor
-	size  uint32
-	index uint32
+	bds    []BlockDescriptor
+	size   uint64
+	index  uint64
+	pinned uint64
+
+	// Returns true if a pinned entry has expired, so it is
+	// evicted even though it is pinned
+	expired func(index uint64) bool
 }
 
-func NewBlockDescriptorArray(blocks uint32) *BlockDescriptorArray {
+func NewBlockDescriptorArray(blocks uint64) *BlockDescriptorArray {
 
 	godbc.Require(blocks > 0)
 
@@ -54,13 +61,24 @@ func NewBlockDescriptorArray(blocks uint32) *BlockDescriptorArray {
 	return c
 }
 
-func (c *BlockDescriptorArray) Insert(key uint64) (newindex uint32, evictkey uint64, evict bool) {
+func (c *BlockDescriptorArray) Insert(key Address) (newindex uint64, evictkey Address, evict bool) {
+	godbc.Require(c.pinned < c.size)
+
 	for {
 
 		// Use the current index to check the current entry
 		for ; c.index < c.size; c.index++ {
 			entry := &c.bds[c.index]
 
+			// Pinned entries are not evicted until they expire
+			if entry.pinned {
+				if c.expired == nil || !c.expired(c.index) {
+					continue
+				}
+				c.Unpin(c.index)
+				entry.clock_set = false
+			}
+
 			// CLOCK: If it has been used recently, then do not evict
 			if entry.clock_set {
 				entry.clock_set = false
@@ -93,16 +111,37 @@ func (c *BlockDescriptorArray) Insert(key uint64) (newindex uint32, evictkey uin
 	}
 }
 
-func (c *BlockDescriptorArray) Using(index uint32) {
+func (c *BlockDescriptorArray) Using(index uint64) {
 	c.bds[index].clock_set = true
 }
 
-func (c *BlockDescriptorArray) Free(index uint32) {
+func (c *BlockDescriptorArray) Free(index uint64) {
+	c.Unpin(index)
 	c.bds[index].clock_set = false
 	c.bds[index].used = false
 	c.bds[index].key = INVALID_KEY
 }
 
+// Keeps the entry from being evicted until it is unpinned or freed
+func (c *BlockDescriptorArray) Pin(index uint64) {
+	if !c.bds[index].pinned {
+		c.bds[index].pinned = true
+		c.pinned++
+	}
+}
+
+func (c *BlockDescriptorArray) Unpin(index uint64) {
+	if c.bds[index].pinned {
+		c.bds[index].pinned = false
+		c.pinned--
+	}
+}
+
+// Returns the number of pinned entries
+func (c *BlockDescriptorArray) Pinned() uint64 {
+	return c.pinned
+}
+
 func (c *BlockDescriptorArray) Save() (*BlockDescriptorArraySave, error) {
 	cms := &BlockDescriptorArraySave{}
 	cms.Index = c.index
@@ -111,7 +150,7 @@ func (c *BlockDescriptorArray) Save() (*BlockDescriptorArraySave, error) {
 	return cms, nil
 }
 
-func (c *BlockDescriptorArray) Load(cms *BlockDescriptorArraySave, addressmap map[uint64]uint32) error {
+func (c *BlockDescriptorArray) Load(cms *BlockDescriptorArraySave, addressmap map[Address]uint64) error {
 
 	if cms.Size != c.size {
 		return errors.New("Loaded metadata cache map size is not equal to the current cache map size")
@@ -126,3 +165,18 @@ func (c *BlockDescriptorArray) Load(cms *BlockDescriptorArraySave, addressmap ma
 
 	return nil
 }
+
+// Changes the number of block descriptors.  The descriptors past
+// the new size must have been freed.
+func (c *BlockDescriptorArray) Resize(blocks uint64) {
+	godbc.Require(blocks > 0)
+
+	bds := make([]BlockDescriptor, blocks)
+	copy(bds, c.bds)
+	c.bds = bds
+	c.size = blocks
+
+	if c.index >= blocks {
+		c.index = 0
+	}
+}
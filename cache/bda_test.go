@@ -23,7 +23,7 @@ import (
 func TestInsert(t *testing.T) {
 	bda := NewBlockDescriptorArray(2)
 
-	id := uint64(123)
+	id := Address{Lba: 123}
 	index, evictkey, evict := bda.Insert(id)
 	tests.Assert(t, bda.bds[0].key == id)
 	tests.Assert(t, bda.bds[0].clock_set == false)
@@ -36,7 +36,7 @@ func TestInsert(t *testing.T) {
 func TestUsing(t *testing.T) {
 	bda := NewBlockDescriptorArray(2)
 
-	id := uint64(123)
+	id := Address{Lba: 123}
 	index, evictkey, evict := bda.Insert(id)
 	tests.Assert(t, bda.bds[0].key == id)
 	tests.Assert(t, bda.bds[0].clock_set == false)
@@ -54,7 +54,7 @@ func TestUsing(t *testing.T) {
 func TestFree(t *testing.T) {
 	bda := NewBlockDescriptorArray(2)
 
-	id := uint64(123)
+	id := Address{Lba: 123}
 	index, evictkey, evict := bda.Insert(id)
 	tests.Assert(t, bda.bds[0].key == id)
 	tests.Assert(t, bda.bds[0].clock_set == false)
@@ -71,9 +71,9 @@ func TestFree(t *testing.T) {
 func TestEvictions(t *testing.T) {
 	bda := NewBlockDescriptorArray(2)
 
-	id1 := uint64(123)
-	id2 := uint64(456)
-	id3 := uint64(678)
+	id1 := Address{Lba: 123}
+	id2 := Address{Lba: 456}
+	id3 := Address{Lba: 678}
 
 	index, evictkey, evict := bda.Insert(id1)
 	tests.Assert(t, bda.bds[0].key == id1)
@@ -124,3 +124,38 @@ func TestEvictions(t *testing.T) {
 	tests.Assert(t, evictkey == id1)
 	tests.Assert(t, evict == true)
 }
+
+func TestPinned(t *testing.T) {
+	bda := NewBlockDescriptorArray(3)
+
+	id1 := Address{Lba: 123}
+	id2 := Address{Lba: 456}
+	id3 := Address{Lba: 678}
+
+	bda.Insert(id1)
+	bda.Insert(id2)
+	bda.Insert(id3)
+	bda.Pin(0)
+	bda.Pin(0)
+	tests.Assert(t, bda.bds[0].pinned == true)
+	tests.Assert(t, bda.Pinned() == 1)
+
+	// Pinned entries are skipped even when not in use
+	for i := 0; i < 10; i++ {
+		index, evictkey, evict := bda.Insert(Address{Lba: uint64(i)})
+		tests.Assert(t, index != 0)
+		tests.Assert(t, evict == true)
+		tests.Assert(t, evictkey != id1)
+	}
+	tests.Assert(t, bda.bds[0].key == id1)
+
+	bda.Unpin(0)
+	tests.Assert(t, bda.bds[0].pinned == false)
+	tests.Assert(t, bda.Pinned() == 0)
+
+	// Freeing unpins the entry
+	bda.Pin(1)
+	bda.Free(1)
+	tests.Assert(t, bda.bds[1].pinned == false)
+	tests.Assert(t, bda.Pinned() == 0)
+}
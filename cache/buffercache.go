@@ -0,0 +1,138 @@
+//
+// Copyright (c) 2014 The pblcache Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package cache
+
+import (
+	"github.com/lpabon/godbc"
+	"sync"
+)
+
+const (
+	// Number of reads from the storage device a log block
+	// needs before it is promoted to the buffer cache
+	BufferCachePromoteHits = 2
+)
+
+// BufferCache is the RAM tier which sits in front of the Log.  Blocks
+// are promoted from the storage device when they have been read
+// BufferCachePromoteHits times, and are demoted back to the storage
+// device when the buffer cache CLOCK policy evicts them.  Since
+// the data is still on the storage device, demotion only requires
+// the block to be removed from RAM.
+type BufferCache struct {
+	bda        *BlockDescriptorArray
+	buffer     []byte
+	index      map[uint64]uint64
+	candidates map[uint64]uint32
+	blocksize  uint32
+	blocks     uint32
+	stats      *logstats
+	lock       sync.Mutex
+}
+
+func NewBufferCache(size, blocksize uint32, stats *logstats) *BufferCache {
+	godbc.Require(blocksize > 0)
+	godbc.Require(size >= blocksize)
+	godbc.Require(stats != nil)
+
+	bc := &BufferCache{}
+	bc.blocksize = blocksize
+	bc.blocks = size / blocksize
+	bc.stats = stats
+	bc.bda = NewBlockDescriptorArray(uint64(bc.blocks))
+	bc.buffer = make([]byte, uint64(bc.blocks)*uint64(blocksize))
+	bc.index = make(map[uint64]uint64)
+	bc.candidates = make(map[uint64]uint32)
+
+	godbc.Ensure(bc.blocks > 0)
+	godbc.Ensure(len(bc.buffer) == int(bc.blocks*bc.blocksize))
+
+	return bc
+}
+
+func (b *BufferCache) slot(ramblock uint64) []byte {
+	return SubBlockBuffer(b.buffer, b.blocksize, uint32(ramblock), 1)
+}
+
+// Copies the log block into buf if it is in the buffer cache.
+// Returns true if it was a hit.
+func (b *BufferCache) Get(logblock uint64, buf []byte) bool {
+	godbc.Require(uint32(len(buf)) == b.blocksize)
+
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	if ramblock, ok := b.index[logblock]; ok {
+		copy(buf, b.slot(ramblock))
+		b.bda.Using(ramblock)
+		return true
+	}
+
+	return false
+}
+
+// Records that the log block was read from storage.  If the block
+// has been read enough times, it is promoted to the buffer cache.
+// The data read is only used if current returns true, which is
+// checked with the buffer cache lock held.  The data is stale when
+// the log block was written, and invalidated, after it was read.
+// Returns true if the block was promoted.
+func (b *BufferCache) StorageHit(logblock uint64, buf []byte, current func() bool) bool {
+	godbc.Require(uint32(len(buf)) == b.blocksize)
+
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	if _, ok := b.index[logblock]; ok || !current() {
+		return false
+	}
+
+	b.candidates[logblock]++
+	if b.candidates[logblock] < BufferCachePromoteHits {
+
+		// Do not let the candidate list grow without bounds
+		if uint32(len(b.candidates)) > b.blocks {
+			b.candidates = make(map[uint64]uint32)
+		}
+		return false
+	}
+	delete(b.candidates, logblock)
+
+	ramblock, evictkey, evict := b.bda.Insert(Address{Lba: logblock})
+	if evict {
+		delete(b.index, evictkey.Lba)
+		b.stats.Demotion()
+	}
+	b.index[logblock] = ramblock
+	copy(b.slot(ramblock), buf)
+	b.stats.Promotion()
+
+	return true
+}
+
+// Removes the log block from the buffer cache.  Must be called
+// when the log block is overwritten.
+func (b *BufferCache) Invalidate(logblock uint64) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	delete(b.candidates, logblock)
+	if ramblock, ok := b.index[logblock]; ok {
+		b.bda.Free(ramblock)
+		delete(b.index, logblock)
+	}
+}
@@ -0,0 +1,132 @@
+//
+// Copyright (c) 2014 The pblcache Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package cache
+
+import (
+	"github.com/pblcache/pblcache/tests"
+	"testing"
+)
+
+func TestNewBufferCache(t *testing.T) {
+	s := &logstats{}
+	bc := NewBufferCache(4*4096, 4096, s)
+	tests.Assert(t, bc != nil)
+	tests.Assert(t, bc.blocks == 4)
+	tests.Assert(t, len(bc.buffer) == 4*4096)
+	tests.Assert(t, len(bc.index) == 0)
+}
+
+// Data read from storage which is still current
+func current() bool {
+	return true
+}
+
+func TestBufferCachePromotion(t *testing.T) {
+	s := &logstats{}
+	bc := NewBufferCache(4*4096, 4096, s)
+
+	buf := make([]byte, 4096)
+	buf[0] = 'a'
+
+	// Not in the buffer cache
+	tests.Assert(t, bc.Get(10, make([]byte, 4096)) == false)
+
+	// Reads from storage promote only after
+	// BufferCachePromoteHits reads
+	for i := 1; i < BufferCachePromoteHits; i++ {
+		tests.Assert(t, bc.StorageHit(10, buf, current) == false)
+		tests.Assert(t, bc.Get(10, make([]byte, 4096)) == false)
+	}
+	tests.Assert(t, bc.StorageHit(10, buf, current) == true)
+	tests.Assert(t, s.promotions == 1)
+	tests.Assert(t, s.demotions == 0)
+
+	// Now it should be in the buffer cache
+	rbuf := make([]byte, 4096)
+	tests.Assert(t, bc.Get(10, rbuf) == true)
+	tests.Assert(t, rbuf[0] == 'a')
+
+	// Storage hits on a block already in the
+	// buffer cache are ignored
+	tests.Assert(t, bc.StorageHit(10, buf, current) == false)
+	tests.Assert(t, s.promotions == 1)
+}
+
+func TestBufferCacheStaleStorageHit(t *testing.T) {
+	s := &logstats{}
+	bc := NewBufferCache(4*4096, 4096, s)
+	buf := make([]byte, 4096)
+
+	// Data of a log block written after it was read is not promoted
+	for i := 0; i < BufferCachePromoteHits; i++ {
+		tests.Assert(t, bc.StorageHit(10, buf, func() bool {
+			return false
+		}) == false)
+	}
+	tests.Assert(t, s.promotions == 0)
+	tests.Assert(t, bc.Get(10, buf) == false)
+}
+
+func TestBufferCacheDemotion(t *testing.T) {
+	s := &logstats{}
+	bc := NewBufferCache(2*4096, 4096, s)
+	buf := make([]byte, 4096)
+
+	// Fill the buffer cache
+	for block := uint64(0); block < 2; block++ {
+		for i := 0; i < BufferCachePromoteHits; i++ {
+			bc.StorageHit(block, buf, current)
+		}
+	}
+	tests.Assert(t, s.promotions == 2)
+	tests.Assert(t, s.demotions == 0)
+	tests.Assert(t, len(bc.index) == 2)
+
+	// Mark block 0 as recently used
+	tests.Assert(t, bc.Get(0, buf) == true)
+
+	// Promote another block.  Block 1 should be demoted
+	for i := 0; i < BufferCachePromoteHits; i++ {
+		bc.StorageHit(2, buf, current)
+	}
+	tests.Assert(t, s.promotions == 3)
+	tests.Assert(t, s.demotions == 1)
+	tests.Assert(t, len(bc.index) == 2)
+	tests.Assert(t, bc.Get(0, buf) == true)
+	tests.Assert(t, bc.Get(1, buf) == false)
+	tests.Assert(t, bc.Get(2, buf) == true)
+}
+
+func TestBufferCacheInvalidate(t *testing.T) {
+	s := &logstats{}
+	bc := NewBufferCache(2*4096, 4096, s)
+	buf := make([]byte, 4096)
+
+	for i := 0; i < BufferCachePromoteHits; i++ {
+		bc.StorageHit(5, buf, current)
+	}
+	tests.Assert(t, bc.Get(5, buf) == true)
+
+	bc.Invalidate(5)
+	tests.Assert(t, bc.Get(5, buf) == false)
+	tests.Assert(t, len(bc.index) == 0)
+	tests.Assert(t, bc.bda.bds[0].used == false)
+
+	// Invalidating a block not in the buffer
+	// cache is not an error
+	bc.Invalidate(6)
+}
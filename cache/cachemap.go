@@ -23,34 +23,117 @@ import (
 	"github.com/pblcache/pblcache/message"
 	"os"
 	"sync"
+	"time"
+)
+
+const (
+	// Version of the cache map metadata.  Version 0 packed the device
+	// id and block address into a uint64 in Addressmap.
+	CacheMapSaveVersion = 1
 )
 
 type CacheMapSave struct {
-	Bda               *BlockDescriptorArraySave
-	Log               *LogSave
-	Addressmap        map[uint64]uint32
-	Blocks, Blocksize uint32
+	Version    int
+	Bda        *BlockDescriptorArraySave
+	Log        *LogSave
+	Addressmap map[uint64]uint32
+	Addresses  map[Address]uint64
+	Dedup      map[uint64]DedupBlockSave
+	Volumes    *VolumeSave
+	Pins       *PinSave
+	TTLs       map[uint32]time.Duration
+	Inserted   map[uint64]int64
+	Blocks     uint64
+	Blocksize  uint32
 }
 
 type CacheMap struct {
-	stats             *cachestats
-	bda               *BlockDescriptorArray
-	addressmap        map[uint64]uint32
-	blocks, blocksize uint32
-	pipeline          chan *message.Message
-	lock              sync.Mutex
+	stats      *cachestats
+	bda        *BlockDescriptorArray
+	addressmap map[Address]uint64
+	devices    deviceIndex
+	blocks     uint64
+	blocksize  uint32
+	pipeline   chan *message.Message
+	releaser   func(index uint64)
+	lock       sync.Mutex
+
+	// Deduplication
+	fingerprints map[dedupKey]uint64
+	dedup        map[uint64]*dedupBlock
+	dedupdevice  bool
+
+	// Volume registry
+	volumes   map[string]uint32
+	nextdevid uint32
+
+	// Pinned ranges
+	pins     []PinRange
+	pinlimit float64
+
+	// Time to live of the blocks of each device
+	ttls map[uint32]time.Duration
 }
 
 type HitmapPkt struct {
 	Hitmap []bool
 	Hits   int
+
+	// Messages which read the hits from the log
+	reads []hitmapRead
+}
+
+// Message which reads hits from the log starting at the block
+// of the I/O
+type hitmapRead struct {
+	msg   *message.Message
+	block uint32
+}
+
+func newHitmapPkt(blocks uint32) *HitmapPkt {
+	return &HitmapPkt{
+		Hitmap: make([]bool, blocks),
+	}
+}
+
+// Marks the blocks which could not be read from the log as misses,
+// so that the caller can read them from storage instead.  Must be
+// called once the Get message is done.  Returns the number of blocks
+// which were marked.
+func (h *HitmapPkt) ClearFailed() int {
+	cleared := 0
+	for _, read := range h.reads {
+		if read.msg.Err == nil {
+			continue
+		}
+		for block := read.block; block < read.block+read.msg.IoPkt().Blocks; block++ {
+			if h.Hitmap[block] {
+				h.Hitmap[block] = false
+				h.Hits--
+				cleared++
+			}
+		}
+	}
+
+	return cleared
+}
+
+// Adds the message to the reads of the hits
+func (h *HitmapPkt) addRead(m *message.Message, block uint32) {
+	h.reads = append(h.reads, hitmapRead{
+		msg:   m,
+		block: block,
+	})
 }
 
 var (
-	ErrNotFound = errors.New("None of the blocks where found")
+	ErrNotFound      = errors.New("None of the blocks where found")
+	ErrDedupMetadata = errors.New("Loaded metadata deduplication does not match the cache map")
+	ErrSaveVersion   = errors.New("Loaded metadata version is not supported")
+	ErrMessageType   = errors.New("Message type is not supported")
 )
 
-func NewCacheMap(blocks, blocksize uint32, pipeline chan *message.Message) *CacheMap {
+func NewCacheMap(blocks uint64, blocksize uint32, pipeline chan *message.Message) *CacheMap {
 
 	godbc.Require(blocks > 0)
 	godbc.Require(pipeline != nil)
@@ -62,7 +145,13 @@ func NewCacheMap(blocks, blocksize uint32, pipeline chan *message.Message) *Cach
 
 	cache.stats = &cachestats{}
 	cache.bda = NewBlockDescriptorArray(cache.blocks)
-	cache.addressmap = make(map[uint64]uint32)
+	cache.bda.expired = cache.expiredIndex
+	cache.addressmap = make(map[Address]uint64)
+	cache.devices = make(deviceIndex)
+	cache.volumes = make(map[string]uint32)
+	cache.nextdevid = FirstVolumeDevid
+	cache.pinlimit = DefaultPinLimit
+	cache.ttls = make(map[uint32]time.Duration)
 
 	godbc.Ensure(cache.blocks > 0)
 	godbc.Ensure(cache.bda != nil)
@@ -79,13 +168,60 @@ func (c *CacheMap) Invalidate(io *message.IoPkt) error {
 	c.lock.Lock()
 	defer c.lock.Unlock()
 
+	address := IoAddress(io)
 	for block := uint64(0); block < uint64(io.Blocks); block++ {
-		c.invalidate(io.Address + block)
+		c.invalidate(address.Add(block))
 	}
 
 	return nil
 }
 
+// Invalidates the address cached in the specified log block.  Used
+// by the Log to remove blocks which can no longer be read.  The log
+// block may have been reused since it was reported, so nothing is
+// invalidated unless current() returns true.
+func (c *CacheMap) InvalidateLogBlock(index uint64, current func() bool) bool {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if index >= c.blocks || !current() {
+		return false
+	}
+
+	if c.dedup != nil {
+		block, ok := c.dedup[index]
+		if !ok {
+			return false
+		}
+
+		// Remove all the addresses referencing the log block
+		addresses := append([]Address(nil), block.addresses...)
+		for _, address := range addresses {
+			c.invalidate(address)
+		}
+		return true
+	}
+
+	bd := &c.bda.bds[index]
+	if bd.used {
+		if owner, ok := c.addressmap[bd.key]; ok && owner == index {
+			return c.invalidate(bd.key)
+		}
+	}
+
+	return false
+}
+
+// Sets the function called with the log block number of blocks which
+// are no longer used by the cache map.  It is called with the cache map
+// lock held, so it must not block or call back into the cache map.
+func (c *CacheMap) SetReleaser(releaser func(index uint64)) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	c.releaser = releaser
+}
+
 func (c *CacheMap) Put(msg *message.Message) error {
 
 	err := msg.Check()
@@ -98,7 +234,9 @@ func (c *CacheMap) Put(msg *message.Message) error {
 
 	io := msg.IoPkt()
 
-	if io.Blocks > 1 {
+	if c.subBlock(io) {
+		c.putSubBlock(msg)
+	} else if io.Blocks > 1 {
 		// Have parent message wait for its children
 		defer msg.Done()
 
@@ -114,17 +252,30 @@ func (c *CacheMap) Put(msg *message.Message) error {
 			msg.Add(child)
 
 			child_io := child.IoPkt()
+			child_io.Devid = io.Devid
 			child_io.Address = io.Address + uint64(block)
 			child_io.Buffer = SubBlockBuffer(io.Buffer, c.blocksize, block, 1)
-			child_io.LogBlock = c.put(child_io.Address)
 			child_io.Blocks = 1
 
-			// Send to next one in line
-			c.pipeline <- child
+			var write bool
+			child_io.LogBlock, write = c.insert(IoAddress(child_io), child_io.Buffer)
+
+			// Send to next one in line unless the contents
+			// are already in the log
+			if write {
+				c.pipeline <- child
+			} else {
+				child.Done()
+			}
 		}
 	} else {
-		io.LogBlock = c.put(io.Address)
-		c.pipeline <- msg
+		var write bool
+		io.LogBlock, write = c.insert(IoAddress(io), io.Buffer)
+		if write {
+			c.pipeline <- msg
+		} else {
+			msg.Done()
+		}
 	}
 
 	return nil
@@ -141,26 +292,42 @@ func (c *CacheMap) Get(msg *message.Message) (*HitmapPkt, error) {
 	defer c.lock.Unlock()
 
 	io := msg.IoPkt()
-	hitmap := make([]bool, io.Blocks)
+	if c.subBlock(io) {
+		hitmappkt := c.getSubBlock(msg)
+		if hitmappkt == nil {
+			return nil, ErrNotFound
+		}
+		msg.Done()
+		return hitmappkt, nil
+	}
+
+	hitmappkt := newHitmapPkt(io.Blocks)
+	hitmap := hitmappkt.Hitmap
 	hits := 0
 
 	// Create a message
 	var m *message.Message
 	var mblock uint32
 
+	address := IoAddress(io)
 	for block := uint32(0); block < io.Blocks; block++ {
 		// Get
-		current_address := io.Address + uint64(block)
+		current_address := address.Add(uint64(block))
 		if index, ok := c.get(current_address); ok {
 			hitmap[block] = true
 			hits++
 
+			// Address the log block was written with
+			read_address := c.readAddress(index, current_address)
+
 			// Check if we already have a message ready
 			if m == nil {
 
 				// This is the first message, so let's set it up
 				m = c.create_get_submsg(msg,
-					current_address,
+					hitmappkt,
+					block,
+					read_address,
 					index,
 					SubBlockBuffer(io.Buffer, c.blocksize, block, 1))
 				mblock = block
@@ -171,10 +338,12 @@ func (c *CacheMap) Get(msg *message.Message) (*HitmapPkt, error) {
 
 				// If the next block is available on the log after this block, then
 				// we can optimize the read by reading a larger amount from the log.
-				if m.IoPkt().LogBlock+numblocks == index && hitmap[block-1] == true {
+				if m.IoPkt().LogBlock+uint64(numblocks) == index &&
+					IoAddress(m.IoPkt()).Add(uint64(numblocks)) == read_address &&
+					hitmap[block-1] == true {
 					// It is the next in both the cache and storage device
 					mio := m.IoPkt()
-					mio.Buffer = SubBlockBuffer(io.Buffer, c.blocksize, mblock, numblocks)
+					mio.Buffer = SubBlockBuffer(io.Buffer, c.blocksize, mblock, numblocks+1)
 					mio.Blocks++
 				} else {
 					// Send the previous one
@@ -182,7 +351,9 @@ func (c *CacheMap) Get(msg *message.Message) (*HitmapPkt, error) {
 
 					// This is the first message, so let's set it up
 					m = c.create_get_submsg(msg,
-						current_address,
+						hitmappkt,
+						block,
+						read_address,
 						index,
 						SubBlockBuffer(io.Buffer, c.blocksize, block, 1))
 					mblock = block
@@ -197,10 +368,7 @@ func (c *CacheMap) Get(msg *message.Message) (*HitmapPkt, error) {
 		c.pipeline <- m
 	}
 	if hits > 0 {
-		hitmappkt := &HitmapPkt{
-			Hitmap: hitmap,
-			Hits:   hits,
-		}
+		hitmappkt.Hits = hits
 		msg.Done()
 		return hitmappkt, nil
 	} else {
@@ -209,29 +377,36 @@ func (c *CacheMap) Get(msg *message.Message) (*HitmapPkt, error) {
 }
 
 func (c *CacheMap) create_get_submsg(msg *message.Message,
-	address uint64, logblock uint32,
+	hitmappkt *HitmapPkt, block uint32,
+	address Address, logblock uint64,
 	buffer []byte) *message.Message {
 
 	m := message.NewMsgGet()
 	msg.Add(m)
+	hitmappkt.addRead(m, block)
 
 	// Set IoPkt
 	mio := m.IoPkt()
-	mio.Address = address
+	mio.Devid = address.Devid
+	mio.Address = address.Lba
 	mio.Buffer = buffer
 	mio.LogBlock = logblock
 
 	return m
 }
 
-func (c *CacheMap) invalidate(key uint64) bool {
+func (c *CacheMap) invalidate(key Address) bool {
 	c.stats.invalidation()
 
-	if index, ok := c.addressmap[key]; ok {
+	index, ok := c.addressmap[key]
+	c.stats.deviceInvalidation(key.Devid, ok)
+	if ok {
 		c.stats.invalidateHit()
 
-		c.bda.Free(index)
-		delete(c.addressmap, key)
+		c.deleteAddress(key)
+		if c.unreference(index, key) {
+			c.free(index)
+		}
 
 		return true
 	}
@@ -239,43 +414,99 @@ func (c *CacheMap) invalidate(key uint64) bool {
 	return false
 }
 
-func (c *CacheMap) put(key uint64) (index uint32) {
+func (c *CacheMap) free(index uint64) {
+	c.bda.Free(index)
+
+	if c.releaser != nil {
+		c.releaser(index)
+	}
+}
+
+func (c *CacheMap) put(key Address) (index uint64) {
 
 	var (
-		evictkey uint64
+		evictkey Address
 		evict    bool
 	)
 
 	c.stats.insertion()
+	c.stats.deviceInsertion(key.Devid)
+
+	// The block with the previous contents of the address,
+	// for example an expired block, is no longer used
+	if previous, ok := c.addressmap[key]; ok {
+		if c.expired(previous, key.Devid) {
+			c.stats.expiration()
+		}
+		c.deleteAddress(key)
+		if c.unreference(previous, key) {
+			c.free(previous)
+		}
+	}
 
 	if index, evictkey, evict = c.bda.Insert(key); evict {
-		c.stats.eviction()
-		delete(c.addressmap, evictkey)
+		c.reclaimed(index, evictkey, key.Devid)
+		c.evict(index, evictkey)
+
+		// The evicted contents are no longer used
+		if c.releaser != nil {
+			c.releaser(index)
+		}
 	}
 
-	c.addressmap[key] = index
+	c.bda.bds[index].inserted = ttlNow().UnixNano()
+	c.setAddress(key, index)
 
 	return
 }
 
-func (c *CacheMap) get(key uint64) (index uint32, ok bool) {
+func (c *CacheMap) get(key Address) (index uint64, ok bool) {
 
 	c.stats.read()
 
 	if index, ok = c.addressmap[key]; ok {
+
+		// Expired blocks are not referenced, so the eviction
+		// sweep reclaims them.  Expiration overrides pinning, so
+		// they no longer count against the pin limit.
+		if c.expired(index, key.Devid) {
+			c.bda.bds[index].clock_set = false
+			c.bda.Unpin(index)
+			c.stats.deviceRead(key.Devid, false)
+			return 0, false
+		}
+
 		c.stats.readHit()
+		c.stats.deviceRead(key.Devid, true)
 		c.bda.Using(index)
+		if c.bda.bds[index].pinned {
+			c.stats.pinnedHit()
+		}
+	} else {
+		c.stats.deviceRead(key.Devid, false)
 	}
 
 	return
 }
 
 func (c *CacheMap) String() string {
-	return c.stats.stats().String()
+	return c.Stats().String()
 }
 
+// Returns the statistics of the cache, including the number of
+// blocks and bytes of each device currently in the cache
 func (c *CacheMap) Stats() *CacheStats {
-	return c.stats.stats()
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	stats := c.stats.stats()
+	for devid, blocks := range c.devices {
+		d := stats.device(devid)
+		d.Blocks = uint64(len(blocks))
+		d.Bytes = d.Blocks * uint64(c.blocksize)
+	}
+
+	return stats
 }
 
 func (c *CacheMap) StatsClear() {
@@ -288,7 +519,13 @@ func (c *CacheMap) Save(filename string, log *Log) error {
 	defer c.lock.Unlock()
 
 	cs := &CacheMapSave{}
-	cs.Addressmap = c.addressmap
+	cs.Version = CacheMapSaveVersion
+	cs.Addresses = c.addressmap
+	cs.Dedup = c.saveDedup()
+	cs.Volumes = c.saveVolumes()
+	cs.Pins = c.savePins()
+	cs.TTLs = c.ttls
+	cs.Inserted = c.saveInserted()
 	cs.Blocks = c.blocks
 	cs.Blocksize = c.blocksize
 
@@ -338,7 +575,25 @@ func (c *CacheMap) Load(filename string, log *Log) error {
 		return err
 	}
 
-	err = c.bda.Load(cs.Bda, cs.Addressmap)
+	err = cs.migrate()
+	if err != nil {
+		return err
+	}
+
+	err = c.loadDedup(cs.Dedup, cs.Addresses)
+	if err != nil {
+		return err
+	}
+
+	// The log may have been resized since the metadata was saved.
+	// Load the metadata as saved, then resize it.
+	blocks := c.blocks
+	if cs.Bda != nil && cs.Bda.Size != c.bda.size && cs.Bda.Size == cs.Blocks {
+		c.bda = NewBlockDescriptorArray(cs.Bda.Size)
+		c.bda.expired = c.expiredIndex
+	}
+
+	err = c.bda.Load(cs.Bda, cs.Addresses)
 	if err != nil {
 		return err
 	}
@@ -354,9 +609,52 @@ func (c *CacheMap) Load(filename string, log *Log) error {
 		}
 	}
 
-	c.addressmap = cs.Addressmap
+	c.addressmap = cs.Addresses
+	c.indexDevices()
+	c.loadVolumes(cs.Volumes)
 	c.blocks = cs.Blocks
 	c.blocksize = cs.Blocksize
 
+	if blocks != c.blocks {
+		c.resize(blocks)
+	}
+	c.loadTTLs(cs.TTLs, cs.Inserted)
+
+	// Let the log know which blocks are still used, and
+	// remove the ones which are no longer in the log
+	if log != nil {
+		for key, index := range c.addressmap {
+			if !log.reuse(index) {
+				c.invalidate(key)
+			}
+		}
+	}
+
+	c.loadPins(cs.Pins)
+
+	return nil
+}
+
+// Converts metadata saved by previous versions to the current version
+func (cs *CacheMapSave) migrate() error {
+	switch cs.Version {
+	case 0:
+		cs.Addresses = make(map[Address]uint64)
+		for key, index := range cs.Addressmap {
+			cs.Addresses[legacyAddress(key)] = uint64(index)
+		}
+		cs.Addressmap = nil
+
+		for index, block := range cs.Dedup {
+			block.Key = legacyAddress(block.Address)
+			cs.Dedup[index] = block
+		}
+
+		cs.Version = CacheMapSaveVersion
+	case CacheMapSaveVersion:
+	default:
+		return ErrSaveVersion
+	}
+
 	return nil
 }
@@ -0,0 +1,277 @@
+//
+// Copyright (c) 2014 The pblcache Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package cache
+
+import (
+	"crypto/sha256"
+	"github.com/lpabon/godbc"
+)
+
+// Fingerprint of the contents of a block
+type Fingerprint [sha256.Size]byte
+
+type DedupBlockSave struct {
+	Fingerprint Fingerprint
+
+	// Packed address used by version 0 of the metadata
+	Address uint64
+	Key     Address
+}
+
+// Blocks with the same key share a log block.  The device id is
+// only set if blocks are deduplicated per device.
+type dedupKey struct {
+	devid       uint32
+	fingerprint Fingerprint
+}
+
+// Reference counted log block shared by all the addresses
+// which have the same contents.
+type dedupBlock struct {
+	fingerprint Fingerprint
+
+	// Address used when the block was written to the log.  It
+	// must be used to read the block back since the Log
+	// may use it to encrypt the block.
+	address Address
+
+	// All the addresses referencing this log block
+	addresses []Address
+}
+
+// Enables content addressed deduplication.  When enabled, the contents
+// of each block are hashed on Put, and addresses with identical contents
+// share a single log block.  Must be called before the cache map is used.
+func (c *CacheMap) EnableDedup() {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	godbc.Require(len(c.addressmap) == 0)
+
+	c.fingerprints = make(map[dedupKey]uint64)
+	c.dedup = make(map[uint64]*dedupBlock)
+}
+
+// Same as EnableDedup(), but only addresses of the same device share
+// a log block.  Use it when the log encrypts the blocks of each device
+// with its own key.  Otherwise a shared block is encrypted with the
+// key of the device which wrote it, so changing that key loses the
+// block for all the devices, and a device can tell that another one
+// stores the same contents.
+func (c *CacheMap) EnableDeviceDedup() {
+	c.EnableDedup()
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	c.dedupdevice = true
+}
+
+// Returns the key of the contents written to the device
+func (c *CacheMap) dedupKey(devid uint32, fingerprint Fingerprint) dedupKey {
+	if !c.dedupdevice {
+		devid = 0
+	}
+
+	return dedupKey{
+		devid:       devid,
+		fingerprint: fingerprint,
+	}
+}
+
+// Returns the log block for the address and true if the
+// block needs to be sent to the Log to be written.
+func (c *CacheMap) insert(key Address, buffer []byte) (uint64, bool) {
+	if c.dedup == nil {
+		return c.put(key), true
+	}
+
+	godbc.Require(uint32(len(buffer)) == c.blocksize)
+
+	fingerprint := Fingerprint(sha256.Sum256(buffer))
+	dk := c.dedupKey(key.Devid, fingerprint)
+
+	// The previous contents of the address are no longer valid
+	if index, ok := c.addressmap[key]; ok {
+		c.deleteAddress(key)
+		if c.unreference(index, key) {
+			c.free(index)
+		}
+	}
+
+	// An expired block may be stale, so the contents are placed in
+	// a new block.  The expired block is reclaimed by the eviction
+	// sweep once none of its addresses are used.
+	if index, ok := c.fingerprints[dk]; ok && c.expired(index, key.Devid) {
+		delete(c.fingerprints, dk)
+	}
+
+	if index, ok := c.fingerprints[dk]; ok {
+		c.stats.insertion()
+		c.stats.deviceInsertion(key.Devid)
+		c.stats.deduplication()
+
+		block := c.dedup[index]
+		block.addresses = append(block.addresses, key)
+		c.setAddress(key, index)
+		c.bda.Using(index)
+
+		// The contents were just placed in the cache
+		// again for this address
+		c.bda.bds[index].inserted = ttlNow().UnixNano()
+
+		return index, false
+	}
+
+	index := c.put(key)
+	c.dedup[index] = &dedupBlock{
+		fingerprint: fingerprint,
+		address:     key,
+		addresses:   []Address{key},
+	}
+	c.fingerprints[dk] = index
+
+	return index, true
+}
+
+// Removes the reference from the address to the log block.  Returns
+// true if the log block is no longer referenced.
+func (c *CacheMap) unreference(index uint64, key Address) bool {
+	if c.dedup == nil {
+		return true
+	}
+
+	block := c.dedup[index]
+	for i, address := range block.addresses {
+		if address == key {
+			block.addresses = append(block.addresses[:i], block.addresses[i+1:]...)
+			break
+		}
+	}
+
+	if len(block.addresses) == 0 {
+		c.deleteFingerprint(index, block)
+		delete(c.dedup, index)
+		return true
+	}
+
+	// Make sure the block descriptor points to an address
+	// which is still referencing the log block
+	if c.bda.bds[index].key == key {
+		c.bda.bds[index].key = block.addresses[0]
+	}
+
+	return false
+}
+
+// Removes all addresses referencing the evicted log block
+func (c *CacheMap) evict(index uint64, evictkey Address) {
+	if c.dedup == nil {
+		c.deleteAddress(evictkey)
+		return
+	}
+
+	block := c.dedup[index]
+	for _, address := range block.addresses {
+		c.deleteAddress(address)
+	}
+	c.deleteFingerprint(index, block)
+	delete(c.dedup, index)
+}
+
+// Removes the fingerprint unless it has been moved to another log block
+func (c *CacheMap) deleteFingerprint(index uint64, block *dedupBlock) {
+	dk := c.dedupKey(block.address.Devid, block.fingerprint)
+	if current, ok := c.fingerprints[dk]; ok && current == index {
+		delete(c.fingerprints, dk)
+	}
+}
+
+// Returns the address which must be used to read the log block
+func (c *CacheMap) readAddress(index uint64, key Address) Address {
+	if c.dedup == nil {
+		return key
+	}
+
+	return c.dedup[index].address
+}
+
+func (c *CacheMap) saveDedup() map[uint64]DedupBlockSave {
+	if c.dedup == nil {
+		return nil
+	}
+
+	save := make(map[uint64]DedupBlockSave)
+	for index, block := range c.dedup {
+		save[index] = DedupBlockSave{
+			Fingerprint: block.fingerprint,
+			Key:         block.address,
+		}
+	}
+
+	return save
+}
+
+func (c *CacheMap) loadDedup(save map[uint64]DedupBlockSave,
+	addressmap map[Address]uint64) error {
+
+	if c.dedup == nil {
+		if save != nil {
+			return ErrDedupMetadata
+		}
+		return nil
+	}
+
+	if save == nil && len(addressmap) > 0 {
+		return ErrDedupMetadata
+	}
+
+	c.fingerprints = make(map[dedupKey]uint64)
+	c.dedup = make(map[uint64]*dedupBlock)
+	for index, block := range save {
+		c.dedup[index] = &dedupBlock{
+			fingerprint: block.Fingerprint,
+			address:     block.Key,
+		}
+		c.fingerprints[c.dedupKey(block.Key.Devid, block.Fingerprint)] = index
+	}
+
+	for address, index := range addressmap {
+		block, ok := c.dedup[index]
+		if !ok {
+			return ErrDedupMetadata
+		}
+
+		// Blocks may have been shared by all the devices
+		// when the metadata was saved
+		if c.dedupdevice && address.Devid != block.address.Devid {
+			delete(addressmap, address)
+			continue
+		}
+		block.addresses = append(block.addresses, address)
+	}
+
+	// Blocks which were only used by other devices
+	for index, block := range c.dedup {
+		if len(block.addresses) == 0 {
+			c.deleteFingerprint(index, block)
+			delete(c.dedup, index)
+		}
+	}
+
+	return nil
+}
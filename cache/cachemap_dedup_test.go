@@ -0,0 +1,266 @@
+//
+// Copyright (c) 2014 The pblcache Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package cache
+
+import (
+	"github.com/pblcache/pblcache/message"
+	"github.com/pblcache/pblcache/tests"
+	"os"
+	"testing"
+)
+
+func dedupPut(t *testing.T, c *CacheMap, address uint64, buffer []byte) *message.Message {
+	here := make(chan *message.Message, 1)
+	m := message.NewMsgPut()
+	m.RetChan = here
+	io := m.IoPkt()
+	io.Buffer = buffer
+	io.Address = address
+	io.Blocks = uint32(len(buffer)) / c.blocksize
+
+	err := c.Put(m)
+	tests.Assert(t, err == nil)
+
+	return <-here
+}
+
+func TestCacheMapDedup(t *testing.T) {
+	mocklog := make(chan *message.Message, 32)
+	pipeline := message.NewNullPipeline(mocklog)
+	pipeline.Start()
+	defer pipeline.Close()
+
+	c := NewCacheMap(8, 4096, pipeline.In)
+	c.EnableDedup()
+
+	// Write the same contents to three addresses
+	buffer := make([]byte, 4096)
+	buffer[0] = 1
+	go func() {
+		m := <-mocklog
+		m.Done()
+	}()
+	m := dedupPut(t, c, 10, buffer)
+	index := m.IoPkt().LogBlock
+
+	m = dedupPut(t, c, 20, buffer)
+	tests.Assert(t, m.IoPkt().LogBlock == index)
+	m = dedupPut(t, c, 30, buffer)
+	tests.Assert(t, m.IoPkt().LogBlock == index)
+
+	// Only the first one was sent to the log
+	tests.Assert(t, len(mocklog) == 0)
+	tests.Assert(t, c.addressmap[Address{Lba: 10}] == index)
+	tests.Assert(t, c.addressmap[Address{Lba: 20}] == index)
+	tests.Assert(t, c.addressmap[Address{Lba: 30}] == index)
+	tests.Assert(t, len(c.dedup[index].addresses) == 3)
+	tests.Assert(t, c.stats.insertions == 3)
+	tests.Assert(t, c.stats.deduplications == 2)
+	tests.Assert(t, c.Stats().DedupRatio() == 3.0)
+
+	// Reads use the address which wrote the block to the log
+	here := make(chan *message.Message, 1)
+	get := message.NewMsgGet()
+	get.RetChan = here
+	get.IoPkt().Address = 30
+	get.IoPkt().Buffer = make([]byte, 4096)
+	hitmap, err := c.Get(get)
+	tests.Assert(t, err == nil)
+	tests.Assert(t, hitmap.Hits == 1)
+	logmsg := <-mocklog
+	tests.Assert(t, logmsg.IoPkt().LogBlock == index)
+	tests.Assert(t, logmsg.IoPkt().Address == 10)
+	logmsg.Done()
+	<-here
+
+	// Invalidating an address keeps the block for the others
+	tests.Assert(t, c.Invalidate(&message.IoPkt{Address: 10, Blocks: 1}) == nil)
+	_, ok := c.addressmap[Address{Lba: 10}]
+	tests.Assert(t, !ok)
+	tests.Assert(t, c.bda.bds[index].used)
+	tests.Assert(t, c.bda.bds[index].key == Address{Lba: 20})
+
+	// Overwriting an address with new contents removes its reference
+	newbuffer := make([]byte, 4096)
+	newbuffer[0] = 2
+	go func() {
+		m := <-mocklog
+		m.Done()
+	}()
+	m = dedupPut(t, c, 20, newbuffer)
+	tests.Assert(t, m.IoPkt().LogBlock != index)
+	tests.Assert(t, len(c.dedup[index].addresses) == 1)
+
+	// Removing the last reference frees the log block
+	tests.Assert(t, c.Invalidate(&message.IoPkt{Address: 30, Blocks: 1}) == nil)
+	tests.Assert(t, !c.bda.bds[index].used)
+	_, ok = c.dedup[index]
+	tests.Assert(t, !ok)
+	tests.Assert(t, len(c.fingerprints) == 1)
+}
+
+func TestCacheMapDedupMultiblock(t *testing.T) {
+	mocklog := make(chan *message.Message, 32)
+	pipeline := message.NewNullPipeline(mocklog)
+	pipeline.Start()
+	defer pipeline.Close()
+
+	c := NewCacheMap(8, 4096, pipeline.In)
+	c.EnableDedup()
+
+	// Four blocks where the last three are the same
+	buffer := make([]byte, 4*4096)
+	buffer[0] = 1
+	go func() {
+		for i := 0; i < 2; i++ {
+			m := <-mocklog
+			m.Done()
+		}
+	}()
+	dedupPut(t, c, 0, buffer)
+	tests.Assert(t, c.addressmap[Address{Lba: 1}] == c.addressmap[Address{Lba: 2}])
+	tests.Assert(t, c.addressmap[Address{Lba: 1}] == c.addressmap[Address{Lba: 3}])
+	tests.Assert(t, c.addressmap[Address{Lba: 0}] != c.addressmap[Address{Lba: 1}])
+	tests.Assert(t, c.stats.deduplications == 2)
+}
+
+func TestCacheMapDedupEvictInvalidate(t *testing.T) {
+	nc := message.NewNullTerminator()
+	nc.Start()
+	defer nc.Close()
+
+	c := NewCacheMap(2, 4096, nc.In)
+	c.EnableDedup()
+
+	buffer := make([]byte, 4096)
+	for address := uint64(0); address < 4; address++ {
+		dedupPut(t, c, address, buffer)
+	}
+	index := c.addressmap[Address{Lba: 0}]
+
+	// Invalidating the log block removes all the addresses
+	tests.Assert(t, c.InvalidateLogBlock(index, current) == true)
+	tests.Assert(t, len(c.addressmap) == 0)
+	tests.Assert(t, !c.bda.bds[index].used)
+	tests.Assert(t, c.InvalidateLogBlock(index, current) == false)
+
+	// Evicting the log block removes all the addresses.  The shared
+	// log block was used by the deduplicated puts, so CLOCK evicts
+	// it only after giving it a second chance.
+	for address := uint64(0); address < 4; address++ {
+		dedupPut(t, c, address, buffer)
+	}
+	for block := byte(1); block <= 3; block++ {
+		unique := make([]byte, 4096)
+		unique[0] = block
+		dedupPut(t, c, uint64(block)+100, unique)
+	}
+	tests.Assert(t, len(c.addressmap) == 2)
+	tests.Assert(t, len(c.dedup) == 2)
+	tests.Assert(t, len(c.fingerprints) == 2)
+	tests.Assert(t, c.stats.evictions == 2)
+}
+
+func TestCacheMapDedupSaveLoad(t *testing.T) {
+	nc := message.NewNullTerminator()
+	nc.Start()
+	defer nc.Close()
+
+	save := tests.Tempfile()
+	defer os.Remove(save)
+
+	c := NewCacheMap(8, 4096, nc.In)
+	c.EnableDedup()
+
+	buffer := make([]byte, 4096)
+	for address := uint64(0); address < 4; address++ {
+		buffer[0] = byte(address % 2)
+		dedupPut(t, c, address, buffer)
+	}
+	tests.Assert(t, c.Save(save, nil) == nil)
+
+	// Dedup metadata cannot be loaded without dedup
+	c2 := NewCacheMap(8, 4096, nc.In)
+	tests.Assert(t, c2.Load(save, nil) == ErrDedupMetadata)
+
+	c2 = NewCacheMap(8, 4096, nc.In)
+	c2.EnableDedup()
+	tests.Assert(t, c2.Load(save, nil) == nil)
+	tests.Assert(t, len(c2.dedup) == 2)
+	tests.Assert(t, len(c2.fingerprints) == 2)
+	for index, block := range c.dedup {
+		tests.Assert(t, c2.dedup[index].fingerprint == block.fingerprint)
+		tests.Assert(t, c2.dedup[index].address == block.address)
+		tests.Assert(t, len(c2.dedup[index].addresses) == 2)
+	}
+
+	// Identical contents are still deduplicated
+	buffer[0] = 1
+	m := dedupPut(t, c2, 100, buffer)
+	tests.Assert(t, m.IoPkt().LogBlock == c2.addressmap[Address{Lba: 1}])
+	tests.Assert(t, c2.stats.deduplications == 1)
+}
+
+func TestCacheMapDedupDevice(t *testing.T) {
+	nc := message.NewNullTerminator()
+	nc.Start()
+	defer nc.Close()
+
+	save := tests.Tempfile()
+	defer os.Remove(save)
+
+	c := NewCacheMap(8, 4096, nc.In)
+	c.EnableDeviceDedup()
+
+	// Only addresses of the same device share a log block
+	buffer := make([]byte, 4096)
+	index, write := c.insert(Address{Devid: 1, Lba: 1}, buffer)
+	tests.Assert(t, write)
+	shared, write := c.insert(Address{Devid: 1, Lba: 2}, buffer)
+	tests.Assert(t, !write)
+	tests.Assert(t, shared == index)
+	other, write := c.insert(Address{Devid: 2, Lba: 1}, buffer)
+	tests.Assert(t, write)
+	tests.Assert(t, other != index)
+	tests.Assert(t, c.dedup[other].address == Address{Devid: 2, Lba: 1})
+	tests.Assert(t, len(c.fingerprints) == 2)
+
+	// Removing the blocks of a device keeps the other one
+	tests.Assert(t, c.InvalidateLogBlock(index, current) == true)
+	tests.Assert(t, len(c.fingerprints) == 1)
+	_, write = c.insert(Address{Devid: 2, Lba: 2}, buffer)
+	tests.Assert(t, !write)
+
+	// Blocks shared by devices when the metadata was saved are
+	// only kept for the device which wrote them
+	c = NewCacheMap(8, 4096, nc.In)
+	c.EnableDedup()
+	index, _ = c.insert(Address{Devid: 1, Lba: 1}, buffer)
+	c.insert(Address{Devid: 2, Lba: 1}, buffer)
+	c.insert(Address{Devid: 2, Lba: 2}, buffer)
+	c.invalidate(Address{Devid: 1, Lba: 1})
+	tests.Assert(t, len(c.addressmap) == 2)
+	tests.Assert(t, c.Save(save, nil) == nil)
+
+	c2 := NewCacheMap(8, 4096, nc.In)
+	c2.EnableDeviceDedup()
+	tests.Assert(t, c2.Load(save, nil) == nil)
+	tests.Assert(t, len(c2.addressmap) == 0)
+	tests.Assert(t, len(c2.dedup) == 0)
+	tests.Assert(t, len(c2.fingerprints) == 0)
+	tests.Assert(t, !c2.bda.bds[index].used)
+}
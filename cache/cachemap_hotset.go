@@ -0,0 +1,143 @@
+//
+// Copyright (c) 2014 The pblcache Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package cache
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Range of blocks of a device
+type AddressRange struct {
+	Devid  uint32
+	Start  uint64
+	Length uint64
+}
+
+// Returns the addresses in the cache as ranges of consecutive blocks.
+// The ranges with blocks which have been read since the CLOCK last
+// passed them are returned first.  The list can be saved with
+// WriteAddressRanges() and used to warm a new cache.
+func (c *CacheMap) HotSet() []AddressRange {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	hot := make([]Address, 0)
+	cold := make([]Address, 0)
+	for key, index := range c.addressmap {
+		if c.bda.bds[index].clock_set {
+			hot = append(hot, key)
+		} else {
+			cold = append(cold, key)
+		}
+	}
+
+	return append(addressRanges(hot), addressRanges(cold)...)
+}
+
+// Sorts the addresses and merges consecutive blocks into ranges
+func addressRanges(addresses []Address) []AddressRange {
+	sort.Slice(addresses, func(i, j int) bool {
+		if addresses[i].Devid != addresses[j].Devid {
+			return addresses[i].Devid < addresses[j].Devid
+		}
+		return addresses[i].Lba < addresses[j].Lba
+	})
+
+	ranges := make([]AddressRange, 0)
+	for _, address := range addresses {
+		if n := len(ranges); n > 0 &&
+			ranges[n-1].Devid == address.Devid &&
+			ranges[n-1].Start+ranges[n-1].Length == address.Lba {
+			ranges[n-1].Length++
+		} else {
+			ranges = append(ranges, AddressRange{
+				Devid:  address.Devid,
+				Start:  address.Lba,
+				Length: 1,
+			})
+		}
+	}
+
+	return ranges
+}
+
+// Writes the ranges one per line as the device id, the first
+// block, and the number of blocks
+func WriteAddressRanges(w io.Writer, ranges []AddressRange) error {
+	bw := bufio.NewWriter(w)
+	for _, r := range ranges {
+		_, err := fmt.Fprintf(bw, "%d %d %d\n", r.Devid, r.Start, r.Length)
+		if err != nil {
+			return err
+		}
+	}
+
+	return bw.Flush()
+}
+
+// Reads ranges written by WriteAddressRanges().  A line may also
+// contain only the device id and block of a single block, for example
+// from a trace.  Empty lines and lines starting with # are ignored.
+func ReadAddressRanges(r io.Reader) ([]AddressRange, error) {
+	ranges := make([]AddressRange, 0)
+
+	scanner := bufio.NewScanner(r)
+	for line := 1; scanner.Scan(); line++ {
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+
+		fields := strings.Fields(text)
+		if len(fields) < 2 || len(fields) > 3 {
+			return nil, fmt.Errorf("Line %d: expected a device id, block, and optional length", line)
+		}
+
+		devid, err := strconv.ParseUint(fields[0], 10, 32)
+		if err != nil {
+			return nil, fmt.Errorf("Line %d: %s", line, err)
+		}
+		start, err := strconv.ParseUint(fields[1], 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("Line %d: %s", line, err)
+		}
+		length := uint64(1)
+		if len(fields) == 3 {
+			length, err = strconv.ParseUint(fields[2], 10, 64)
+			if err != nil {
+				return nil, fmt.Errorf("Line %d: %s", line, err)
+			}
+		}
+
+		ranges = append(ranges, AddressRange{
+			Devid:  uint32(devid),
+			Start:  start,
+			Length: length,
+		})
+	}
+
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	return ranges, nil
+}
@@ -0,0 +1,80 @@
+//
+// Copyright (c) 2014 The pblcache Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package cache
+
+import (
+	"bytes"
+	"github.com/pblcache/pblcache/message"
+	"github.com/pblcache/pblcache/tests"
+	"strings"
+	"testing"
+)
+
+func TestCacheMapHotSet(t *testing.T) {
+	nc := message.NewNullTerminator()
+	nc.Start()
+	defer nc.Close()
+
+	c := NewCacheMap(16, 4096, nc.In)
+	tests.Assert(t, len(c.HotSet()) == 0)
+
+	for lba := uint64(10); lba < 14; lba++ {
+		c.put(Address{Devid: 1, Lba: lba})
+	}
+	c.put(Address{Devid: 1, Lba: 20})
+	c.put(Address{Devid: 2, Lba: 10})
+	c.put(Address{Devid: 2, Lba: 11})
+	c.get(Address{Devid: 2, Lba: 11})
+
+	// Blocks read recently are first
+	hotset := c.HotSet()
+	tests.Assert(t, len(hotset) == 4)
+	tests.Assert(t, hotset[0] == AddressRange{Devid: 2, Start: 11, Length: 1})
+	tests.Assert(t, hotset[1] == AddressRange{Devid: 1, Start: 10, Length: 4})
+	tests.Assert(t, hotset[2] == AddressRange{Devid: 1, Start: 20, Length: 1})
+	tests.Assert(t, hotset[3] == AddressRange{Devid: 2, Start: 10, Length: 1})
+}
+
+func TestAddressRangesReadWrite(t *testing.T) {
+	ranges := []AddressRange{
+		AddressRange{Devid: 1, Start: 10, Length: 4},
+		AddressRange{Devid: 4294967295, Start: 1 << 40, Length: 1},
+	}
+
+	var buf bytes.Buffer
+	tests.Assert(t, WriteAddressRanges(&buf, ranges) == nil)
+	read, err := ReadAddressRanges(&buf)
+	tests.Assert(t, err == nil)
+	tests.Assert(t, len(read) == 2)
+	tests.Assert(t, read[0] == ranges[0])
+	tests.Assert(t, read[1] == ranges[1])
+
+	// Single blocks, comments and empty lines
+	read, err = ReadAddressRanges(strings.NewReader("# trace\n\n3 100\n 3 101 2 \n"))
+	tests.Assert(t, err == nil)
+	tests.Assert(t, len(read) == 2)
+	tests.Assert(t, read[0] == AddressRange{Devid: 3, Start: 100, Length: 1})
+	tests.Assert(t, read[1] == AddressRange{Devid: 3, Start: 101, Length: 2})
+
+	_, err = ReadAddressRanges(strings.NewReader("1 2\n3\n"))
+	tests.Assert(t, err != nil)
+	tests.Assert(t, strings.HasPrefix(err.Error(), "Line 2:"))
+	_, err = ReadAddressRanges(strings.NewReader("1 x 3\n"))
+	tests.Assert(t, err != nil)
+	_, err = ReadAddressRanges(strings.NewReader("4294967296 1\n"))
+	tests.Assert(t, err != nil)
+}
@@ -0,0 +1,147 @@
+//
+// Copyright (c) 2014 The pblcache Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package cache
+
+import (
+	"github.com/pblcache/pblcache/message"
+)
+
+// Blocks of each device in the address map.  Allows all the blocks
+// of a device to be found without going through the whole address map.
+type deviceIndex map[uint32]map[uint64]struct{}
+
+func (c *CacheMap) setAddress(key Address, index uint64) {
+	c.addressmap[key] = index
+
+	blocks, ok := c.devices[key.Devid]
+	if !ok {
+		blocks = make(map[uint64]struct{})
+		c.devices[key.Devid] = blocks
+	}
+	blocks[key.Lba] = struct{}{}
+
+	c.pinAddress(key, index)
+}
+
+func (c *CacheMap) deleteAddress(key Address) {
+	delete(c.addressmap, key)
+
+	if blocks, ok := c.devices[key.Devid]; ok {
+		delete(blocks, key.Lba)
+		if len(blocks) == 0 {
+			delete(c.devices, key.Devid)
+		}
+	}
+}
+
+// Rebuilds the device index from the address map
+func (c *CacheMap) indexDevices() {
+	c.devices = make(deviceIndex)
+	for key := range c.addressmap {
+		blocks, ok := c.devices[key.Devid]
+		if !ok {
+			blocks = make(map[uint64]struct{})
+			c.devices[key.Devid] = blocks
+		}
+		blocks[key.Lba] = struct{}{}
+	}
+}
+
+// Invalidates length blocks of the device starting at block start.
+// Returns the number of blocks which were in the cache.  The cost
+// is proportional to the smaller of length and the number of blocks
+// of the device in the cache.
+func (c *CacheMap) InvalidateRange(devid uint32, start, length uint64) int {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	return c.invalidateRange(devid, start, length)
+}
+
+// Invalidates all the blocks of the device.  Returns the number
+// of blocks which were in the cache.
+func (c *CacheMap) InvalidateDevice(devid uint32) int {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	return c.invalidateDevice(devid)
+}
+
+// Handles MsgInvalidateRange and MsgInvalidateDevice messages.  The
+// message is done once the blocks have been invalidated.
+func (c *CacheMap) InvalidateMsg(msg *message.Message) error {
+
+	err := msg.Check()
+	if err != nil {
+		return err
+	}
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	pkt := msg.InvalidatePkt()
+	switch msg.Type {
+	case message.MsgInvalidateRange:
+		c.invalidateRange(pkt.Devid, pkt.Start, pkt.Length)
+	case message.MsgInvalidateDevice:
+		c.invalidateDevice(pkt.Devid)
+	default:
+		return ErrMessageType
+	}
+	msg.Done()
+
+	return nil
+}
+
+func (c *CacheMap) invalidateRange(devid uint32, start, length uint64) int {
+	invalidated := 0
+	c.forRange(devid, start, length, func(key Address) {
+		c.invalidate(key)
+		invalidated++
+	})
+
+	return invalidated
+}
+
+func (c *CacheMap) invalidateDevice(devid uint32) int {
+	invalidated := 0
+	for lba := range c.devices[devid] {
+		c.invalidate(Address{Devid: devid, Lba: lba})
+		invalidated++
+	}
+
+	return invalidated
+}
+
+// Calls f with each address of the range which is in the cache
+func (c *CacheMap) forRange(devid uint32, start, length uint64, f func(key Address)) {
+	blocks := c.devices[devid]
+
+	if length < uint64(len(blocks)) {
+		for lba := start; lba-start < length; lba++ {
+			if _, ok := blocks[lba]; ok {
+				f(Address{Devid: devid, Lba: lba})
+			}
+		}
+	} else {
+		for lba := range blocks {
+			if lba >= start && lba-start < length {
+				f(Address{Devid: devid, Lba: lba})
+			}
+		}
+	}
+}
@@ -0,0 +1,162 @@
+//
+// Copyright (c) 2014 The pblcache Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package cache
+
+import (
+	"github.com/pblcache/pblcache/message"
+	"github.com/pblcache/pblcache/tests"
+	"os"
+	"testing"
+)
+
+func TestCacheMapInvalidateRange(t *testing.T) {
+	nc := message.NewNullTerminator()
+	nc.Start()
+	defer nc.Close()
+
+	c := NewCacheMap(16, 4096, nc.In)
+	released := 0
+	c.SetReleaser(func(index uint64) {
+		released++
+	})
+	for lba := uint64(0); lba < 8; lba++ {
+		c.put(Address{Devid: 1, Lba: lba})
+	}
+	c.put(Address{Devid: 2, Lba: 3})
+
+	// Fewer blocks than cached, so the range is walked
+	tests.Assert(t, c.InvalidateRange(1, 2, 3) == 3)
+	tests.Assert(t, released == 3)
+	for lba := uint64(2); lba < 5; lba++ {
+		_, ok := c.addressmap[Address{Devid: 1, Lba: lba}]
+		tests.Assert(t, !ok)
+	}
+	tests.Assert(t, len(c.devices[1]) == 5)
+
+	// Larger than cached, so the cached blocks are walked
+	tests.Assert(t, c.InvalidateRange(1, 6, 1<<40) == 2)
+	tests.Assert(t, len(c.devices[1]) == 3)
+	_, ok := c.addressmap[Address{Devid: 1, Lba: 5}]
+	tests.Assert(t, ok)
+
+	// Other devices are not touched
+	tests.Assert(t, c.InvalidateRange(3, 0, 1<<40) == 0)
+	_, ok = c.addressmap[Address{Devid: 2, Lba: 3}]
+	tests.Assert(t, ok)
+	tests.Assert(t, len(c.addressmap) == 4)
+}
+
+func TestCacheMapInvalidateDevice(t *testing.T) {
+	nc := message.NewNullTerminator()
+	nc.Start()
+	defer nc.Close()
+
+	c := NewCacheMap(16, 4096, nc.In)
+	for lba := uint64(0); lba < 8; lba++ {
+		c.put(Address{Devid: 7, Lba: lba * 1000})
+	}
+	index := c.put(Address{Devid: 8, Lba: 0})
+
+	tests.Assert(t, c.InvalidateDevice(7) == 8)
+	tests.Assert(t, len(c.addressmap) == 1)
+	tests.Assert(t, c.addressmap[Address{Devid: 8, Lba: 0}] == index)
+	_, ok := c.devices[7]
+	tests.Assert(t, !ok)
+	tests.Assert(t, c.InvalidateDevice(7) == 0)
+
+	// Blocks can be cached again
+	c.put(Address{Devid: 7, Lba: 1})
+	tests.Assert(t, len(c.devices[7]) == 1)
+}
+
+func TestCacheMapInvalidateMsg(t *testing.T) {
+	nc := message.NewNullTerminator()
+	nc.Start()
+	defer nc.Close()
+
+	c := NewCacheMap(16, 4096, nc.In)
+	for lba := uint64(0); lba < 4; lba++ {
+		c.put(Address{Devid: 1, Lba: lba})
+		c.put(Address{Devid: 2, Lba: lba})
+	}
+
+	here := make(chan *message.Message, 1)
+	m := message.NewMsgInvalidateRange(1, 0, 2)
+	m.RetChan = here
+	tests.Assert(t, c.InvalidateMsg(m) == nil)
+	<-here
+	tests.Assert(t, len(c.devices[1]) == 2)
+	tests.Assert(t, c.InvalidateMsg(m) == message.ErrMessageUsed)
+
+	m = message.NewMsgInvalidateDevice(2)
+	m.RetChan = here
+	tests.Assert(t, c.InvalidateMsg(m) == nil)
+	<-here
+	tests.Assert(t, len(c.addressmap) == 2)
+
+	m = message.NewMsgInvalidateDevice(1)
+	m.Type = message.MsgGet
+	tests.Assert(t, c.InvalidateMsg(m) == ErrMessageType)
+}
+
+func TestCacheMapInvalidateDeviceDedup(t *testing.T) {
+	nc := message.NewNullTerminator()
+	nc.Start()
+	defer nc.Close()
+
+	c := NewCacheMap(8, 4096, nc.In)
+	c.EnableDedup()
+
+	// Both devices share the log block
+	buffer := make([]byte, 4096)
+	m := message.NewMsgPut()
+	m.IoPkt().Devid = 1
+	m.IoPkt().Buffer = buffer
+	tests.Assert(t, c.Put(m) == nil)
+	m = message.NewMsgPut()
+	m.IoPkt().Devid = 2
+	m.IoPkt().Buffer = buffer
+	tests.Assert(t, c.Put(m) == nil)
+	index := m.IoPkt().LogBlock
+
+	tests.Assert(t, c.InvalidateDevice(1) == 1)
+	tests.Assert(t, c.bda.bds[index].used)
+	tests.Assert(t, c.bda.bds[index].key == Address{Devid: 2})
+	tests.Assert(t, c.InvalidateDevice(2) == 1)
+	tests.Assert(t, !c.bda.bds[index].used)
+}
+
+func TestCacheMapInvalidateDeviceLoad(t *testing.T) {
+	nc := message.NewNullTerminator()
+	nc.Start()
+	defer nc.Close()
+
+	save := tests.Tempfile()
+	defer os.Remove(save)
+
+	c := NewCacheMap(8, 4096, nc.In)
+	c.put(Address{Devid: 1, Lba: 1})
+	c.put(Address{Devid: 1, Lba: 2})
+	c.put(Address{Devid: 2, Lba: 1})
+	tests.Assert(t, c.Save(save, nil) == nil)
+
+	// The device index is rebuilt on load
+	c2 := NewCacheMap(8, 4096, nc.In)
+	tests.Assert(t, c2.Load(save, nil) == nil)
+	tests.Assert(t, c2.InvalidateDevice(1) == 2)
+	tests.Assert(t, len(c2.addressmap) == 1)
+}
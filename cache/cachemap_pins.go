@@ -0,0 +1,249 @@
+//
+// Copyright (c) 2014 The pblcache Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package cache
+
+import (
+	"errors"
+	"github.com/lpabon/godbc"
+	"sort"
+)
+
+const (
+	// Default fraction of the cache blocks which may be pinned
+	DefaultPinLimit = 0.25
+)
+
+var (
+	ErrPinLimit    = errors.New("Pinned ranges would exceed the fraction of the cache which may be pinned")
+	ErrPinExists   = errors.New("Range overlaps a pinned range")
+	ErrPinNotFound = errors.New("Range is not pinned")
+	ErrPinRange    = errors.New("Pinned range must not be empty")
+)
+
+// Range of blocks of a device which is never evicted from the cache
+type PinRange struct {
+	Devid  uint32
+	Start  uint64
+	Length uint64
+}
+
+type PinSave struct {
+	Ranges []PinRange
+	Limit  float64
+}
+
+func (p PinRange) contains(key Address) bool {
+	return key.Devid == p.Devid && key.Lba >= p.Start && key.Lba-p.Start < p.Length
+}
+
+func (p PinRange) overlaps(r PinRange) bool {
+	return p.Devid == r.Devid && p.Start < r.Start+r.Length && r.Start < p.Start+p.Length
+}
+
+// Pins length blocks of the device starting at block start.  Blocks of
+// the range which are in the cache, or are later placed in the cache,
+// are not evicted until the range is unpinned, they are invalidated
+// or they expire.
+// The total length of the pinned ranges may not exceed the pin limit.
+func (c *CacheMap) Pin(devid uint32, start, length uint64) error {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	pin := PinRange{
+		Devid:  devid,
+		Start:  start,
+		Length: length,
+	}
+	if length == 0 || start+length < start {
+		return ErrPinRange
+	}
+	for _, p := range c.pins {
+		if p.overlaps(pin) {
+			return ErrPinExists
+		}
+	}
+	if c.pinnedLength()+length > c.pinCapacity() {
+		return ErrPinLimit
+	}
+
+	c.pins = append(c.pins, pin)
+	c.forRange(devid, start, length, func(key Address) {
+		c.pinAddress(key, c.addressmap[key])
+	})
+
+	return nil
+}
+
+// Removes a range previously pinned with the same values.  The blocks
+// of the range may then be evicted.
+func (c *CacheMap) Unpin(devid uint32, start, length uint64) error {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	pin := PinRange{
+		Devid:  devid,
+		Start:  start,
+		Length: length,
+	}
+	for i, p := range c.pins {
+		if p == pin {
+			c.pins = append(c.pins[:i], c.pins[i+1:]...)
+			c.forRange(devid, start, length, func(key Address) {
+				index := c.addressmap[key]
+				if !c.pinnedIndex(index) {
+					c.bda.Unpin(index)
+				}
+			})
+			return nil
+		}
+	}
+
+	return ErrPinNotFound
+}
+
+// Returns the pinned ranges sorted by device id and start
+func (c *CacheMap) Pins() []PinRange {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	pins := append([]PinRange(nil), c.pins...)
+	sort.Slice(pins, func(i, j int) bool {
+		if pins[i].Devid != pins[j].Devid {
+			return pins[i].Devid < pins[j].Devid
+		}
+		return pins[i].Start < pins[j].Start
+	})
+
+	return pins
+}
+
+// Returns the number of cache blocks which are pinned
+func (c *CacheMap) PinnedBlocks() uint64 {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	return c.bda.Pinned()
+}
+
+// Sets the fraction of the cache blocks which may be pinned.  The
+// limit must leave at least one block which can be evicted.
+func (c *CacheMap) SetPinLimit(limit float64) error {
+	godbc.Require(limit >= 0 && limit < 1)
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if c.pinnedLength() > uint64(float64(c.blocks)*limit) {
+		return ErrPinLimit
+	}
+	c.pinlimit = limit
+
+	return nil
+}
+
+// Maximum number of blocks which may be pinned
+func (c *CacheMap) pinCapacity() uint64 {
+	return uint64(float64(c.blocks) * c.pinlimit)
+}
+
+func (c *CacheMap) pinnedLength() uint64 {
+	length := uint64(0)
+	for _, p := range c.pins {
+		length += p.Length
+	}
+
+	return length
+}
+
+// Returns true if the address is in a pinned range
+func (c *CacheMap) pinned(key Address) bool {
+	for _, p := range c.pins {
+		if p.contains(key) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Returns true if any of the addresses referencing the log block
+// are in a pinned range
+func (c *CacheMap) pinnedIndex(index uint64) bool {
+	if c.dedup != nil {
+		for _, key := range c.dedup[index].addresses {
+			if c.pinned(key) {
+				return true
+			}
+		}
+		return false
+	}
+
+	return c.pinned(c.bda.bds[index].key)
+}
+
+// Pins the log block if the address is in a pinned range.  The cache
+// may have been shrunk after the ranges were pinned, so the number of
+// pinned blocks is checked against the capacity.
+func (c *CacheMap) pinAddress(key Address, index uint64) {
+	if len(c.pins) == 0 || !c.pinned(key) || c.expired(index, key.Devid) {
+		return
+	}
+	if c.bda.bds[index].pinned || c.bda.Pinned() < c.pinCapacity() {
+		c.bda.Pin(index)
+	}
+}
+
+// Unpins blocks until the number of pinned blocks is within
+// the capacity
+func (c *CacheMap) limitPins() {
+	capacity := c.pinCapacity()
+	for index := uint64(0); index < c.blocks && c.bda.Pinned() > capacity; index++ {
+		c.bda.Unpin(index)
+	}
+}
+
+// Removes the pinned ranges of the device
+func (c *CacheMap) unpinDevice(devid uint32) {
+	pins := c.pins[:0]
+	for _, p := range c.pins {
+		if p.Devid != devid {
+			pins = append(pins, p)
+		}
+	}
+	c.pins = pins
+}
+
+func (c *CacheMap) savePins() *PinSave {
+	return &PinSave{
+		Ranges: c.pins,
+		Limit:  c.pinlimit,
+	}
+}
+
+func (c *CacheMap) loadPins(save *PinSave) {
+	// Metadata saved before ranges could be pinned
+	if save == nil {
+		return
+	}
+
+	c.pins = save.Ranges
+	c.pinlimit = save.Limit
+
+	for key, index := range c.addressmap {
+		c.pinAddress(key, index)
+	}
+}
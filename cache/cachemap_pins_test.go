@@ -0,0 +1,183 @@
+//
+// Copyright (c) 2014 The pblcache Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package cache
+
+import (
+	"github.com/pblcache/pblcache/message"
+	"github.com/pblcache/pblcache/tests"
+	"os"
+	"testing"
+)
+
+func TestCacheMapPin(t *testing.T) {
+	nc := message.NewNullTerminator()
+	nc.Start()
+	defer nc.Close()
+
+	c := NewCacheMap(16, 4096, nc.In)
+	tests.Assert(t, c.SetPinLimit(0.5) == nil)
+
+	// Blocks already in the cache are pinned
+	c.put(Address{Devid: 1, Lba: 10})
+	c.put(Address{Devid: 1, Lba: 20})
+	tests.Assert(t, c.Pin(1, 10, 4) == nil)
+	tests.Assert(t, c.PinnedBlocks() == 1)
+
+	tests.Assert(t, c.Pin(1, 0, 0) == ErrPinRange)
+	tests.Assert(t, c.Pin(1, 12, 4) == ErrPinExists)
+	tests.Assert(t, c.Pin(1, 14, 5) == ErrPinLimit)
+	tests.Assert(t, c.Pin(2, 0, 4) == nil)
+	tests.Assert(t, c.SetPinLimit(0.25) == ErrPinLimit)
+
+	// Blocks placed in the cache later are pinned
+	c.put(Address{Devid: 1, Lba: 11})
+	c.put(Address{Devid: 2, Lba: 3})
+	tests.Assert(t, c.PinnedBlocks() == 3)
+
+	pins := c.Pins()
+	tests.Assert(t, len(pins) == 2)
+	tests.Assert(t, pins[0] == PinRange{Devid: 1, Start: 10, Length: 4})
+	tests.Assert(t, pins[1] == PinRange{Devid: 2, Start: 0, Length: 4})
+
+	// Pinned blocks survive the rest of the cache being replaced
+	for lba := uint64(100); lba < 200; lba++ {
+		c.put(Address{Devid: 3, Lba: lba})
+	}
+	tests.Assert(t, len(c.addressmap) == 16)
+	_, ok := c.addressmap[Address{Devid: 1, Lba: 20}]
+	tests.Assert(t, !ok)
+	for _, key := range []Address{
+		Address{Devid: 1, Lba: 10},
+		Address{Devid: 1, Lba: 11},
+		Address{Devid: 2, Lba: 3},
+	} {
+		_, ok := c.get(key)
+		tests.Assert(t, ok)
+	}
+	_, ok = c.get(Address{Devid: 3, Lba: 199})
+	tests.Assert(t, ok)
+	tests.Assert(t, c.stats.pinnedhits == 3)
+	tests.Assert(t, c.stats.readhits == 4)
+
+	// Unpinned blocks may be evicted
+	tests.Assert(t, c.Unpin(1, 10, 3) == ErrPinNotFound)
+	tests.Assert(t, c.Unpin(1, 10, 4) == nil)
+	tests.Assert(t, c.PinnedBlocks() == 1)
+	tests.Assert(t, len(c.Pins()) == 1)
+	for lba := uint64(200); lba < 300; lba++ {
+		c.put(Address{Devid: 3, Lba: lba})
+	}
+	_, ok = c.addressmap[Address{Devid: 1, Lba: 10}]
+	tests.Assert(t, !ok)
+	_, ok = c.addressmap[Address{Devid: 2, Lba: 3}]
+	tests.Assert(t, ok)
+
+	// Invalidating a pinned block frees it
+	tests.Assert(t, c.InvalidateRange(2, 0, 4) == 1)
+	tests.Assert(t, c.PinnedBlocks() == 0)
+	c.put(Address{Devid: 2, Lba: 3})
+	tests.Assert(t, c.PinnedBlocks() == 1)
+
+	// Writing new contents moves the pin to the new block
+	c.put(Address{Devid: 2, Lba: 3})
+	tests.Assert(t, c.PinnedBlocks() == 1)
+}
+
+func TestCacheMapPinDedup(t *testing.T) {
+	nc := message.NewNullTerminator()
+	nc.Start()
+	defer nc.Close()
+
+	c := NewCacheMap(8, 4096, nc.In)
+	c.EnableDedup()
+	tests.Assert(t, c.SetPinLimit(0.5) == nil)
+	tests.Assert(t, c.Pin(1, 0, 2) == nil)
+
+	buffer := make([]byte, 4096)
+	index, _ := c.insert(Address{Devid: 1, Lba: 0}, buffer)
+	c.insert(Address{Devid: 2, Lba: 0}, buffer)
+	tests.Assert(t, c.bda.bds[index].pinned)
+
+	// Still pinned while a pinned address references the block
+	tests.Assert(t, c.Pin(2, 0, 1) == nil)
+	tests.Assert(t, c.Unpin(1, 0, 2) == nil)
+	tests.Assert(t, c.bda.bds[index].pinned)
+	tests.Assert(t, c.Unpin(2, 0, 1) == nil)
+	tests.Assert(t, !c.bda.bds[index].pinned)
+}
+
+func TestCacheMapPinVolume(t *testing.T) {
+	nc := message.NewNullTerminator()
+	nc.Start()
+	defer nc.Close()
+
+	c := NewCacheMap(8, 4096, nc.In)
+	devid, err := c.RegisterVolume("vol1")
+	tests.Assert(t, err == nil)
+	tests.Assert(t, c.Pin(devid, 0, 2) == nil)
+	c.put(Address{Devid: devid, Lba: 1})
+	tests.Assert(t, c.PinnedBlocks() == 1)
+
+	tests.Assert(t, c.RemoveVolume("vol1") == nil)
+	tests.Assert(t, len(c.Pins()) == 0)
+	tests.Assert(t, c.PinnedBlocks() == 0)
+}
+
+func TestCacheMapPinResize(t *testing.T) {
+	nc := message.NewNullTerminator()
+	nc.Start()
+	defer nc.Close()
+
+	c := NewCacheMap(16, 4096, nc.In)
+	tests.Assert(t, c.Pin(1, 0, 4) == nil)
+	for lba := uint64(0); lba < 4; lba++ {
+		c.put(Address{Devid: 1, Lba: lba})
+	}
+	tests.Assert(t, c.PinnedBlocks() == 4)
+
+	// The pinned blocks are kept within the limit of the smaller cache
+	c.Resize(8)
+	tests.Assert(t, c.PinnedBlocks() == 2)
+	for lba := uint64(100); lba < 200; lba++ {
+		c.put(Address{Devid: 2, Lba: lba})
+	}
+	tests.Assert(t, c.PinnedBlocks() == 2)
+}
+
+func TestCacheMapPinSaveLoad(t *testing.T) {
+	nc := message.NewNullTerminator()
+	nc.Start()
+	defer nc.Close()
+
+	save := tests.Tempfile()
+	defer os.Remove(save)
+
+	c := NewCacheMap(16, 4096, nc.In)
+	tests.Assert(t, c.SetPinLimit(0.5) == nil)
+	tests.Assert(t, c.Pin(1, 0, 8) == nil)
+	index := c.put(Address{Devid: 1, Lba: 5})
+	c.put(Address{Devid: 2, Lba: 5})
+	tests.Assert(t, c.Save(save, nil) == nil)
+
+	c2 := NewCacheMap(16, 4096, nc.In)
+	tests.Assert(t, c2.Load(save, nil) == nil)
+	tests.Assert(t, c2.pinlimit == 0.5)
+	tests.Assert(t, len(c2.Pins()) == 1)
+	tests.Assert(t, c2.Pins()[0] == PinRange{Devid: 1, Start: 0, Length: 8})
+	tests.Assert(t, c2.PinnedBlocks() == 1)
+	tests.Assert(t, c2.bda.bds[index].pinned)
+}
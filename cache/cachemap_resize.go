@@ -0,0 +1,87 @@
+//
+// Copyright (c) 2014 The pblcache Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package cache
+
+import (
+	"github.com/lpabon/godbc"
+)
+
+// Returns the number of blocks in the cache map
+func (c *CacheMap) Blocks() uint64 {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	return c.blocks
+}
+
+// Changes the number of blocks in the cache map.  When shrinking, the
+// blocks past the new size are evicted.  See Resize() to resize the
+// cache map together with its log.
+func (c *CacheMap) Resize(blocks uint64) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	c.resize(blocks)
+}
+
+func (c *CacheMap) resize(blocks uint64) {
+	godbc.Require(blocks > 0)
+
+	for index := blocks; index < c.blocks; index++ {
+		bd := &c.bda.bds[index]
+		if !bd.used {
+			continue
+		}
+
+		c.stats.eviction()
+		c.stats.deviceRemoved(bd.key.Devid)
+		if current, ok := c.addressmap[bd.key]; c.dedup != nil || (ok && current == index) {
+			c.evict(index, bd.key)
+		}
+		c.free(index)
+	}
+
+	c.bda.Resize(blocks)
+	c.blocks = blocks
+	c.limitPins()
+}
+
+// Resizes the log to use size bytes of its device, and the cache map
+// to the new number of blocks in the log, while I/O continues.  When
+// shrinking, the blocks past the new end of the log are evicted from
+// the cache map before the log is resized, so the device may be
+// truncated once Resize returns.  When growing, the device must be
+// extended first.  Returns the new number of blocks.
+func Resize(c *CacheMap, l *Log, size int64) (uint64, error) {
+	blocks, err := l.ResizeBlocks(size)
+	if err != nil {
+		return 0, err
+	}
+
+	if blocks < c.Blocks() {
+		c.Resize(blocks)
+		return l.Resize(size)
+	}
+
+	blocks, err = l.Resize(size)
+	if err != nil {
+		return 0, err
+	}
+	c.Resize(blocks)
+
+	return blocks, nil
+}
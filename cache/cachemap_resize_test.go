@@ -0,0 +1,243 @@
+//
+// Copyright (c) 2014 The pblcache Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package cache
+
+import (
+	"github.com/pblcache/pblcache/message"
+	"github.com/pblcache/pblcache/tests"
+	"os"
+	"sync"
+	"testing"
+)
+
+func TestCacheMapResize(t *testing.T) {
+	nc := message.NewNullTerminator()
+	nc.Start()
+	defer nc.Close()
+
+	c := NewCacheMap(16, 4096, nc.In)
+	released := make([]uint64, 0)
+	c.SetReleaser(func(index uint64) {
+		released = append(released, index)
+	})
+	for lba := uint64(0); lba < 8; lba++ {
+		c.put(Address{Lba: lba})
+	}
+
+	// Blocks past the end are evicted
+	c.Resize(4)
+	tests.Assert(t, c.Blocks() == 4)
+	tests.Assert(t, len(c.bda.bds) == 4)
+	tests.Assert(t, len(c.addressmap) == 4)
+	tests.Assert(t, len(released) == 4)
+	tests.Assert(t, c.stats.evictions == 4)
+	for _, index := range c.addressmap {
+		tests.Assert(t, index < 4)
+	}
+
+	// The next insert wraps to the start
+	c.put(Address{Lba: 100})
+	tests.Assert(t, len(c.addressmap) == 4)
+
+	c.Resize(16)
+	tests.Assert(t, c.Blocks() == 16)
+	tests.Assert(t, len(c.bda.bds) == 16)
+	grown := false
+	for lba := uint64(200); lba < 216; lba++ {
+		if c.put(Address{Lba: lba}) >= 4 {
+			grown = true
+		}
+	}
+	tests.Assert(t, grown)
+	tests.Assert(t, len(c.addressmap) > 4)
+}
+
+func TestCacheMapLoadResized(t *testing.T) {
+	nc := message.NewNullTerminator()
+	nc.Start()
+	defer nc.Close()
+
+	save := tests.Tempfile()
+	defer os.Remove(save)
+
+	c := NewCacheMap(16, 4096, nc.In)
+	for lba := uint64(0); lba < 16; lba++ {
+		c.put(Address{Lba: lba})
+	}
+	tests.Assert(t, c.Save(save, nil) == nil)
+
+	// Smaller
+	c2 := NewCacheMap(8, 4096, nc.In)
+	tests.Assert(t, c2.Load(save, nil) == nil)
+	tests.Assert(t, c2.Blocks() == 8)
+	tests.Assert(t, len(c2.addressmap) == 8)
+	for lba := uint64(0); lba < 8; lba++ {
+		tests.Assert(t, c2.addressmap[Address{Lba: lba}] == lba)
+	}
+
+	// Larger
+	c2 = NewCacheMap(32, 4096, nc.In)
+	tests.Assert(t, c2.Load(save, nil) == nil)
+	tests.Assert(t, c2.Blocks() == 32)
+	tests.Assert(t, len(c2.addressmap) == 16)
+	tests.Assert(t, len(c2.bda.bds) == 32)
+}
+
+func TestResize(t *testing.T) {
+	testcachefile := tests.Tempfile()
+	tests.Assert(t, nil == tests.CreateFile(testcachefile, 256*4096))
+	defer os.Remove(testcachefile)
+
+	l, blocks, err := NewLog(testcachefile, 4096, 2, 0, false)
+	tests.Assert(t, err == nil)
+	c := NewCacheMap(blocks, 4096, l.Msgchan)
+	c.SetReleaser(l.Free)
+	l.Start()
+	defer l.Close()
+
+	here := make(chan *message.Message, 1)
+	put := func(lba uint64) {
+		m := message.NewMsgPut()
+		m.RetChan = here
+		io := m.IoPkt()
+		io.Address = lba
+		io.Buffer = make([]byte, 4096)
+		io.Buffer[0] = byte(lba)
+		tests.Assert(t, c.Put(m) == nil)
+		<-here
+	}
+	get := func(lba uint64) (bool, error) {
+		m := message.NewMsgGet()
+		m.RetChan = here
+		io := m.IoPkt()
+		io.Address = lba
+		io.Buffer = make([]byte, 4096)
+		if _, err := c.Get(m); err != nil {
+			return false, err
+		}
+		<-here
+		return io.Buffer[0] == byte(lba), m.Err
+	}
+
+	for lba := uint64(0); lba < blocks; lba++ {
+		put(lba)
+	}
+
+	// Keep I/O going while the cache is resized
+	var wg sync.WaitGroup
+	quit := make(chan struct{})
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		r := make(chan *message.Message, 1)
+		for lba := uint64(0); ; lba = (lba + 1) % 1024 {
+			select {
+			case <-quit:
+				return
+			default:
+			}
+			m := message.NewMsgGet()
+			m.RetChan = r
+			m.IoPkt().Address = lba
+			m.IoPkt().Buffer = make([]byte, 4096)
+			if _, err := c.Get(m); err == nil {
+				<-r
+			}
+		}
+	}()
+
+	blocks, err = Resize(c, l, 128*4096)
+	tests.Assert(t, err == nil)
+	tests.Assert(t, blocks == 128)
+	tests.Assert(t, c.Blocks() == 128)
+	tests.Assert(t, len(c.addressmap) == 128)
+	for lba := uint64(0); lba < 128; lba++ {
+		ok, err := get(lba)
+		tests.Assert(t, err == nil)
+		tests.Assert(t, ok)
+	}
+	_, err = get(200)
+	tests.Assert(t, err == ErrNotFound)
+
+	tests.Assert(t, nil == os.Truncate(testcachefile, 512*4096))
+	blocks, err = Resize(c, l, 512*4096)
+	tests.Assert(t, err == nil)
+	tests.Assert(t, blocks == 512)
+	tests.Assert(t, c.Blocks() == 512)
+	for lba := uint64(1000); lba < 1400; lba++ {
+		put(lba)
+	}
+	tests.Assert(t, len(c.addressmap) > 128)
+	tests.Assert(t, len(c.addressmap) <= 512)
+	ok, err := get(1399)
+	tests.Assert(t, err == nil)
+	tests.Assert(t, ok)
+
+	close(quit)
+	wg.Wait()
+
+	_, err = Resize(c, l, 1024*4096)
+	tests.Assert(t, err == ErrLogDeviceSize)
+}
+
+func TestCacheMapLoadResizedLog(t *testing.T) {
+	testcachefile := tests.Tempfile()
+	tests.Assert(t, nil == tests.CreateFile(testcachefile, 256*4096))
+	defer os.Remove(testcachefile)
+	save := tests.Tempfile()
+	defer os.Remove(save)
+
+	l, blocks, err := NewLog(testcachefile, 4096, 2, 0, false)
+	tests.Assert(t, err == nil)
+	c := NewCacheMap(blocks, 4096, l.Msgchan)
+	l.Start()
+
+	here := make(chan *message.Message, 1)
+	for lba := uint64(0); lba < blocks; lba++ {
+		m := message.NewMsgPut()
+		m.RetChan = here
+		m.IoPkt().Address = lba
+		m.IoPkt().Buffer = make([]byte, 4096)
+		m.IoPkt().Buffer[0] = byte(lba)
+		tests.Assert(t, c.Put(m) == nil)
+		<-here
+	}
+	l.Close()
+	tests.Assert(t, c.Save(save, l) == nil)
+
+	// The device was made smaller while the cache was offline
+	tests.Assert(t, nil == os.Truncate(testcachefile, 128*4096))
+	l, blocks, err = NewLog(testcachefile, 4096, 2, 0, false)
+	tests.Assert(t, err == nil)
+	tests.Assert(t, blocks == 128)
+	c = NewCacheMap(blocks, 4096, l.Msgchan)
+	tests.Assert(t, c.Load(save, l) == nil)
+	tests.Assert(t, len(c.addressmap) == 128)
+	tests.Assert(t, len(l.checksums) == 128)
+	l.Start()
+	defer l.Close()
+
+	m := message.NewMsgGet()
+	m.RetChan = here
+	m.IoPkt().Address = 100
+	m.IoPkt().Buffer = make([]byte, 4096)
+	_, err = c.Get(m)
+	tests.Assert(t, err == nil)
+	<-here
+	tests.Assert(t, m.Err == nil)
+	tests.Assert(t, m.IoPkt().Buffer[0] == 100)
+}
@@ -0,0 +1,182 @@
+//
+// Copyright (c) 2014 The pblcache Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package cache
+
+import (
+	"github.com/lpabon/godbc"
+	"github.com/pblcache/pblcache/message"
+)
+
+// Returns the first block, the byte offset in the first block, and the
+// number of blocks covered by an I/O of length bytes at the byte offset.
+// The returned values can be used to set the Address, Offset, and Blocks
+// of an IoPkt for an I/O which is not aligned to the block size.
+func SubBlockRange(offset, length uint64, blocksize uint32) (block uint64,
+	blockoffset uint32,
+	nblocks uint32) {
+
+	godbc.Require(blocksize > 0)
+	godbc.Require(length > 0)
+
+	block = offset / uint64(blocksize)
+	blockoffset = uint32(offset % uint64(blocksize))
+	end := offset + length
+	nblocks = uint32((end+uint64(blocksize)-1)/uint64(blocksize) - block)
+
+	return
+}
+
+// Returns true if the I/O does not cover whole blocks
+func (c *CacheMap) subBlock(io *message.IoPkt) bool {
+	return io.Offset != 0 || uint32(len(io.Buffer)) != io.Blocks*c.blocksize
+}
+
+// Returns the part of the caller buffer which is in the specified block,
+// and the byte offset of that part in the block
+func (c *CacheMap) subBlockBuffer(io *message.IoPkt, block uint32) ([]byte, uint32) {
+	godbc.Require(io.Offset < c.blocksize)
+	godbc.Require(uint64(io.Offset)+uint64(len(io.Buffer)) <= uint64(io.Blocks)*uint64(c.blocksize))
+	godbc.Require(uint64(io.Offset)+uint64(len(io.Buffer)) > uint64(io.Blocks-1)*uint64(c.blocksize))
+
+	var start, offset uint32
+	if block == 0 {
+		offset = io.Offset
+	} else {
+		start = block*c.blocksize - io.Offset
+	}
+
+	end := start + c.blocksize - offset
+	if end > uint32(len(io.Buffer)) {
+		end = uint32(len(io.Buffer))
+	}
+
+	return io.Buffer[start:end], offset
+}
+
+// Put for I/O which is not aligned to the block size.  Whole blocks
+// are placed in the cache.  Partially written blocks are invalidated
+// since the rest of the block is not available to merge with.
+func (c *CacheMap) putSubBlock(msg *message.Message) {
+	defer msg.Done()
+
+	io := msg.IoPkt()
+	for block := uint32(0); block < io.Blocks; block++ {
+		address := IoAddress(io).Add(uint64(block))
+		buffer, offset := c.subBlockBuffer(io, block)
+
+		if offset != 0 || uint32(len(buffer)) != c.blocksize {
+			c.invalidate(address)
+			continue
+		}
+
+		child := message.NewMsgPut()
+		msg.Add(child)
+
+		child_io := child.IoPkt()
+		child_io.Devid = address.Devid
+		child_io.Address = address.Lba
+		child_io.Buffer = buffer
+		child_io.Blocks = 1
+
+		var write bool
+		child_io.LogBlock, write = c.insert(address, child_io.Buffer)
+		if write {
+			c.pipeline <- child
+		} else {
+			child.Done()
+		}
+	}
+}
+
+// Get for I/O which is not aligned to the block size.  Each cached
+// block is read whole from the log, and the part requested is copied
+// to the caller buffer.
+func (c *CacheMap) getSubBlock(msg *message.Message) *HitmapPkt {
+	io := msg.IoPkt()
+	hitmappkt := newHitmapPkt(io.Blocks)
+	hits := 0
+
+	for block := uint32(0); block < io.Blocks; block++ {
+		address := IoAddress(io).Add(uint64(block))
+		index, ok := c.get(address)
+		if !ok {
+			continue
+		}
+		hitmappkt.Hitmap[block] = true
+		hits++
+
+		buffer, offset := c.subBlockBuffer(io, block)
+		if offset == 0 && uint32(len(buffer)) == c.blocksize {
+			c.pipeline <- c.create_get_submsg(msg,
+				hitmappkt,
+				block,
+				c.readAddress(index, address),
+				index,
+				buffer)
+		} else {
+			c.getPartialBlock(msg,
+				hitmappkt,
+				block,
+				c.readAddress(index, address),
+				index,
+				buffer,
+				offset)
+		}
+	}
+
+	if hits == 0 {
+		return nil
+	}
+
+	hitmappkt.Hits = hits
+
+	return hitmappkt
+}
+
+// Reads the whole block from the log, then copies the part
+// requested to the buffer before notifying the parent message
+func (c *CacheMap) getPartialBlock(msg *message.Message,
+	hitmappkt *HitmapPkt, block uint32,
+	address Address, logblock uint64,
+	buffer []byte, offset uint32) {
+
+	// The parent waits on this message, which is done
+	// once the data has been copied
+	copied := message.NewMsgGet()
+	msg.Add(copied)
+	hitmappkt.addRead(copied, block)
+
+	m := message.NewMsgGet()
+	m.RetChan = make(chan *message.Message, 1)
+	mio := m.IoPkt()
+	mio.Devid = address.Devid
+	mio.Address = address.Lba
+	mio.LogBlock = logblock
+	mio.Buffer = AlignedBuffer(int(c.blocksize), DefaultAlignment)
+
+	c.pipeline <- m
+
+	go func() {
+		m := <-m.RetChan
+		if m.Err != nil {
+			copied.SetErr(m.Err)
+		} else {
+			copy(buffer, m.IoPkt().Buffer[offset:])
+		}
+		copied.Done()
+	}()
+}
@@ -0,0 +1,143 @@
+//
+// Copyright (c) 2014 The pblcache Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package cache
+
+import (
+	"bytes"
+	"github.com/pblcache/pblcache/message"
+	"github.com/pblcache/pblcache/tests"
+	"testing"
+)
+
+func TestSubBlockRange(t *testing.T) {
+	block, offset, nblocks := SubBlockRange(0, 4096, 4096)
+	tests.Assert(t, block == 0 && offset == 0 && nblocks == 1)
+
+	block, offset, nblocks = SubBlockRange(512, 512, 4096)
+	tests.Assert(t, block == 0 && offset == 512 && nblocks == 1)
+
+	block, offset, nblocks = SubBlockRange(4096+3584, 1024, 4096)
+	tests.Assert(t, block == 1 && offset == 3584 && nblocks == 2)
+
+	block, offset, nblocks = SubBlockRange(3*4096+1024, 2*4096, 4096)
+	tests.Assert(t, block == 3 && offset == 1024 && nblocks == 3)
+}
+
+// Log which fills each block read with its log block number
+func subBlockLog() chan *message.Message {
+	mocklog := make(chan *message.Message, 32)
+	go func() {
+		for m := range mocklog {
+			io := m.IoPkt()
+			if m.Type == message.MsgGet {
+				for i := range io.Buffer {
+					io.Buffer[i] = byte(io.LogBlock + uint64(i)/4096)
+				}
+			}
+			m.Done()
+		}
+	}()
+
+	return mocklog
+}
+
+func TestCacheMapSubBlockPut(t *testing.T) {
+	mocklog := subBlockLog()
+	defer close(mocklog)
+
+	c := NewCacheMap(8, 4096, mocklog)
+	for address := uint64(10); address < 13; address++ {
+		c.put(Address{Lba: address})
+	}
+
+	// Write from the middle of block 10 to the middle of block 12
+	here := make(chan *message.Message)
+	m := message.NewMsgPut()
+	m.RetChan = here
+	io := m.IoPkt()
+	io.Address = 10
+	io.Offset = 512
+	io.Buffer = make([]byte, 2*4096)
+	io.Blocks = 3
+	tests.Assert(t, c.Put(m) == nil)
+	<-here
+
+	// Partial blocks are invalidated
+	_, ok := c.addressmap[Address{Lba: 10}]
+	tests.Assert(t, !ok)
+	_, ok = c.addressmap[Address{Lba: 12}]
+	tests.Assert(t, !ok)
+
+	// Whole blocks are inserted
+	_, ok = c.addressmap[Address{Lba: 11}]
+	tests.Assert(t, ok)
+	tests.Assert(t, c.stats.insertions == 4)
+}
+
+func TestCacheMapSubBlockGet(t *testing.T) {
+	mocklog := subBlockLog()
+	defer close(mocklog)
+
+	c := NewCacheMap(8, 4096, mocklog)
+	index10 := c.put(Address{Lba: 10})
+	index11 := c.put(Address{Lba: 11})
+	index13 := c.put(Address{Lba: 13})
+
+	get := func(address uint64, offset uint32, length int, blocks uint32) (*message.Message, *HitmapPkt, error) {
+		here := make(chan *message.Message, 1)
+		m := message.NewMsgGet()
+		m.RetChan = here
+		io := m.IoPkt()
+		io.Address = address
+		io.Offset = offset
+		io.Buffer = make([]byte, length)
+		io.Blocks = blocks
+		hitmap, err := c.Get(m)
+		if err == nil {
+			<-here
+		}
+		return m, hitmap, err
+	}
+
+	// 512 bytes in the middle of a block
+	m, hitmap, err := get(10, 1024, 512, 1)
+	tests.Assert(t, err == nil)
+	tests.Assert(t, hitmap.Hits == 1)
+	tests.Assert(t, bytes.Equal(m.IoPkt().Buffer, bytes.Repeat([]byte{byte(index10)}, 512)))
+
+	// Across the end of block 10 and the start of block 11
+	m, hitmap, err = get(10, 3584, 1024, 2)
+	tests.Assert(t, err == nil)
+	tests.Assert(t, hitmap.Hits == 2)
+	buf := m.IoPkt().Buffer
+	tests.Assert(t, bytes.Equal(buf[:512], bytes.Repeat([]byte{byte(index10)}, 512)))
+	tests.Assert(t, bytes.Equal(buf[512:], bytes.Repeat([]byte{byte(index11)}, 512)))
+
+	// A whole block in the middle, and a missing block
+	m, hitmap, err = get(11, 2048, 2*4096, 3)
+	tests.Assert(t, err == nil)
+	tests.Assert(t, hitmap.Hits == 2)
+	tests.Assert(t, hitmap.Hitmap[0] && !hitmap.Hitmap[1] && hitmap.Hitmap[2])
+	buf = m.IoPkt().Buffer
+	tests.Assert(t, bytes.Equal(buf[:2048], bytes.Repeat([]byte{byte(index11)}, 2048)))
+	tests.Assert(t, bytes.Equal(buf[2048:6144], make([]byte, 4096)))
+	tests.Assert(t, bytes.Equal(buf[6144:], bytes.Repeat([]byte{byte(index13)}, 2048)))
+
+	// Not cached
+	_, _, err = get(20, 512, 512, 1)
+	tests.Assert(t, err == ErrNotFound)
+}
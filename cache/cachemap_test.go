@@ -16,6 +16,7 @@
 package cache
 
 import (
+	"encoding/gob"
 	"fmt"
 	"github.com/lpabon/tm"
 	"github.com/pblcache/pblcache/message"
@@ -47,14 +48,14 @@ func TestInvalidateMultipleBlocks(t *testing.T) {
 	defer c.Close()
 
 	// Insert some values in the addressmap
-	for i := uint32(0); i < 4; i++ {
+	for i := uint64(0); i < 4; i++ {
 
 		// The key is block number
-		c.addressmap[uint64(i)] = i
+		c.addressmap[Address{Lba: i}] = i
 	}
 
 	// This value should still be on the addressmap
-	c.addressmap[8] = 8
+	c.addressmap[Address{Lba: 8}] = 8
 
 	iopkt := &message.IoPkt{
 		Address: 0,
@@ -64,7 +65,7 @@ func TestInvalidateMultipleBlocks(t *testing.T) {
 	c.Invalidate(iopkt)
 	tests.Assert(t, c.stats.invalidations == uint64(iopkt.Blocks))
 	tests.Assert(t, c.stats.invalidatehits == 4)
-	tests.Assert(t, c.addressmap[8] == 8)
+	tests.Assert(t, c.addressmap[Address{Lba: 8}] == 8)
 }
 
 func TestCacheMapSimple(t *testing.T) {
@@ -110,7 +111,7 @@ func TestCacheMapSimple(t *testing.T) {
 	tests.Assert(t, c.stats.insertions == 1)
 	tests.Assert(t, returnedmsg.Err == nil)
 
-	val, ok := c.addressmap[io.Address]
+	val, ok := c.addressmap[IoAddress(io)]
 	tests.Assert(t, val == 0)
 	tests.Assert(t, ok == true)
 
@@ -139,7 +140,7 @@ func TestCacheMapSimple(t *testing.T) {
 	tests.Assert(t, returnedmsg.Err == nil)
 	tests.Assert(t, c.stats.insertions == 2)
 
-	val, ok = c.addressmap[io.Address]
+	val, ok = c.addressmap[IoAddress(io)]
 	tests.Assert(t, val == 1)
 	tests.Assert(t, ok == true)
 
@@ -274,11 +275,11 @@ func TestCacheMapMultiblock(t *testing.T) {
 	tests.Assert(t, c.stats.insertions == 4)
 	tests.Assert(t, c.stats.invalidatehits == 2)
 	tests.Assert(t, c.bda.bds[0].used == true)
-	tests.Assert(t, c.bda.bds[0].key == 0)
+	tests.Assert(t, c.bda.bds[0].key == Address{Lba: 0})
 	tests.Assert(t, c.bda.bds[1].used == false)
 	tests.Assert(t, c.bda.bds[2].used == false)
 	tests.Assert(t, c.bda.bds[3].used == true)
-	tests.Assert(t, c.bda.bds[3].key == 3)
+	tests.Assert(t, c.bda.bds[3].key == Address{Lba: 3})
 
 	// Set the clock so they do not get erased
 	c.bda.bds[0].clock_set = true
@@ -308,36 +309,36 @@ func TestCacheMapMultiblock(t *testing.T) {
 
 	// Check the two blocks left from before
 	tests.Assert(t, c.bda.bds[0].used == true)
-	tests.Assert(t, c.bda.bds[0].key == 0)
+	tests.Assert(t, c.bda.bds[0].key == Address{Lba: 0})
 	tests.Assert(t, c.bda.bds[0].clock_set == false)
 
 	tests.Assert(t, c.bda.bds[3].used == true)
-	tests.Assert(t, c.bda.bds[3].key == 3)
+	tests.Assert(t, c.bda.bds[3].key == Address{Lba: 3})
 	tests.Assert(t, c.bda.bds[3].clock_set == true)
 
 	// Now check the blocks we inserted
 	tests.Assert(t, c.bda.bds[4].used == true)
-	tests.Assert(t, c.bda.bds[4].key == 10)
+	tests.Assert(t, c.bda.bds[4].key == Address{Lba: 10})
 	tests.Assert(t, c.bda.bds[4].clock_set == false)
 
 	tests.Assert(t, c.bda.bds[5].used == true)
-	tests.Assert(t, c.bda.bds[5].key == 11)
+	tests.Assert(t, c.bda.bds[5].key == Address{Lba: 11})
 	tests.Assert(t, c.bda.bds[5].clock_set == false)
 
 	tests.Assert(t, c.bda.bds[6].used == true)
-	tests.Assert(t, c.bda.bds[6].key == 12)
+	tests.Assert(t, c.bda.bds[6].key == Address{Lba: 12})
 	tests.Assert(t, c.bda.bds[6].clock_set == false)
 
 	tests.Assert(t, c.bda.bds[7].used == true)
-	tests.Assert(t, c.bda.bds[7].key == 13)
+	tests.Assert(t, c.bda.bds[7].key == Address{Lba: 13})
 	tests.Assert(t, c.bda.bds[7].clock_set == false)
 
 	tests.Assert(t, c.bda.bds[1].used == true)
-	tests.Assert(t, c.bda.bds[1].key == 14)
+	tests.Assert(t, c.bda.bds[1].key == Address{Lba: 14})
 	tests.Assert(t, c.bda.bds[1].clock_set == false)
 
 	tests.Assert(t, c.bda.bds[2].used == true)
-	tests.Assert(t, c.bda.bds[2].key == 15)
+	tests.Assert(t, c.bda.bds[2].key == Address{Lba: 15})
 	tests.Assert(t, c.bda.bds[2].clock_set == false)
 
 	// Check for a block not in the cache
@@ -405,6 +406,7 @@ func TestCacheMapMultiblock(t *testing.T) {
 	tests.Assert(t, retio.Address == 10)
 	tests.Assert(t, retio.LogBlock == 4)
 	tests.Assert(t, retio.Blocks == 4)
+	tests.Assert(t, len(retio.Buffer) == 4*4096)
 	retmsg.Done()
 
 	// Second message will have the rest of the contigous block
@@ -414,6 +416,7 @@ func TestCacheMapMultiblock(t *testing.T) {
 	tests.Assert(t, retio.Address == 14)
 	tests.Assert(t, retio.LogBlock == 1)
 	tests.Assert(t, retio.Blocks == 2)
+	tests.Assert(t, len(retio.Buffer) == 2*4096)
 	retmsg.Done()
 
 	<-here
@@ -457,6 +460,7 @@ func TestCacheMapMultiblock(t *testing.T) {
 	tests.Assert(t, retio.Address == 10)
 	tests.Assert(t, retio.LogBlock == 4)
 	tests.Assert(t, retio.Blocks == 4)
+	tests.Assert(t, len(retio.Buffer) == 4*4096)
 	retmsg.Done()
 
 	// Second message will have the rest of the contigous block
@@ -466,6 +470,7 @@ func TestCacheMapMultiblock(t *testing.T) {
 	tests.Assert(t, retio.Address == 14)
 	tests.Assert(t, retio.LogBlock == 1)
 	tests.Assert(t, retio.Blocks == 2)
+	tests.Assert(t, len(retio.Buffer) == 2*4096)
 	retmsg.Done()
 
 	<-here
@@ -596,3 +601,295 @@ func TestCacheMapConcurrency(t *testing.T) {
 	// Wait for receiver to finish emptying its channel
 	wgRet.Wait()
 }
+
+func TestCacheMapInvalidateLogBlock(t *testing.T) {
+	nc := message.NewNullTerminator()
+	nc.Start()
+	defer nc.Close()
+
+	c := NewCacheMap(8, 4096, nc.In)
+	tests.Assert(t, c != nil)
+	defer c.Close()
+
+	// Put address 10 in the cache
+	index := c.put(Address{Lba: 10})
+	tests.Assert(t, c.addressmap[Address{Lba: 10}] == index)
+
+	// Reported before the log block was reused
+	stale := func() bool {
+		return false
+	}
+	tests.Assert(t, c.InvalidateLogBlock(index, stale) == false)
+	tests.Assert(t, c.addressmap[Address{Lba: 10}] == index)
+
+	// Log block which is not used
+	tests.Assert(t, c.InvalidateLogBlock(index+1, current) == false)
+	tests.Assert(t, c.addressmap[Address{Lba: 10}] == index)
+
+	tests.Assert(t, c.InvalidateLogBlock(index, current) == true)
+	_, ok := c.addressmap[Address{Lba: 10}]
+	tests.Assert(t, ok == false)
+	tests.Assert(t, c.bda.bds[index].used == false)
+	tests.Assert(t, c.stats.invalidatehits == 1)
+
+	// Already invalidated
+	tests.Assert(t, c.InvalidateLogBlock(index, current) == false)
+}
+
+func TestCacheMapGetClearFailed(t *testing.T) {
+	mocklog := make(chan *message.Message, 32)
+	pipeline := message.NewNullPipeline(mocklog)
+	pipeline.Start()
+	defer pipeline.Close()
+
+	c := NewCacheMap(8, 4096, pipeline.In)
+	c.put(Address{Lba: 1})
+	c.put(Address{Lba: 2})
+	c.put(Address{Lba: 5})
+
+	here := make(chan *message.Message, 1)
+	msg := message.NewMsgGet()
+	msg.RetChan = here
+	iopkt := msg.IoPkt()
+	iopkt.Address = 1
+	iopkt.Blocks = 5
+	iopkt.Buffer = make([]byte, 5*4096)
+	hitmap, err := c.Get(msg)
+	tests.Assert(t, err == nil)
+	tests.Assert(t, hitmap.Hits == 3)
+
+	// The read of the first two blocks fails
+	m := <-mocklog
+	tests.Assert(t, m.IoPkt().Blocks == 2)
+	m.SetErr(ErrChecksum)
+	m.Done()
+	m = <-mocklog
+	tests.Assert(t, m.IoPkt().Blocks == 1)
+	m.Done()
+	<-here
+
+	tests.Assert(t, hitmap.ClearFailed() == 2)
+	tests.Assert(t, hitmap.Hits == 1)
+	tests.Assert(t, !hitmap.Hitmap[0] && !hitmap.Hitmap[1] && hitmap.Hitmap[4])
+	tests.Assert(t, hitmap.ClearFailed() == 0)
+}
+
+func TestCacheMapReleaser(t *testing.T) {
+	nc := message.NewNullTerminator()
+	nc.Start()
+	defer nc.Close()
+
+	c := NewCacheMap(8, 4096, nc.In)
+	released := make([]uint64, 0)
+	c.SetReleaser(func(index uint64) {
+		released = append(released, index)
+	})
+
+	index := c.put(Address{Lba: 10})
+	c.put(Address{Lba: 11})
+
+	// Invalidated blocks are released
+	tests.Assert(t, c.Invalidate(&message.IoPkt{Address: 10, Blocks: 1}) == nil)
+	tests.Assert(t, len(released) == 1)
+	tests.Assert(t, released[0] == index)
+
+	// Not in the cache
+	tests.Assert(t, c.Invalidate(&message.IoPkt{Address: 10, Blocks: 1}) == nil)
+	tests.Assert(t, len(released) == 1)
+
+	// Evicted blocks are released
+	evicted := c.addressmap[Address{Lba: 11}]
+	for lba := uint64(20); lba < 27; lba++ {
+		c.put(Address{Lba: lba})
+	}
+	tests.Assert(t, len(released) == 1)
+	c.put(Address{Lba: 27})
+	tests.Assert(t, c.stats.evictions == 1)
+	tests.Assert(t, len(released) == 2)
+	tests.Assert(t, released[1] == evicted)
+}
+
+func TestCacheMapWideAddresses(t *testing.T) {
+	nc := message.NewNullTerminator()
+	nc.Start()
+	defer nc.Close()
+
+	c := NewCacheMap(8, 4096, nc.In)
+
+	// Device ids and blocks which did not fit in the packed address
+	a := Address{Devid: 1 << 20, Lba: 10}
+	b := Address{Devid: 1<<20 + 1<<16, Lba: 10}
+	d := Address{Devid: 1, Lba: 1 << 60}
+	for _, address := range []Address{a, b, d} {
+		c.put(address)
+	}
+	tests.Assert(t, len(c.addressmap) == 3)
+
+	tests.Assert(t, c.Invalidate(&message.IoPkt{
+		Devid:   a.Devid,
+		Address: a.Lba,
+		Blocks:  1,
+	}) == nil)
+	_, ok := c.addressmap[a]
+	tests.Assert(t, !ok)
+	_, ok = c.addressmap[b]
+	tests.Assert(t, ok)
+
+	save := tests.Tempfile()
+	defer os.Remove(save)
+	tests.Assert(t, c.Save(save, nil) == nil)
+
+	c2 := NewCacheMap(8, 4096, nc.In)
+	tests.Assert(t, c2.Load(save, nil) == nil)
+	tests.Assert(t, len(c2.addressmap) == 2)
+	tests.Assert(t, c2.addressmap[b] == c.addressmap[b])
+	tests.Assert(t, c2.addressmap[d] == c.addressmap[d])
+	tests.Assert(t, c2.bda.bds[c2.addressmap[d]].key == d)
+}
+
+func TestCacheMapLoadLegacy(t *testing.T) {
+	testcachefile := tests.Tempfile()
+	tests.Assert(t, nil == tests.CreateFile(testcachefile, 256*4096))
+	defer os.Remove(testcachefile)
+
+	// Fill a log with blocks from two devices
+	l, blocks, err := NewLog(testcachefile, 4096, 2, 0, false)
+	tests.Assert(t, err == nil)
+	c := NewCacheMap(blocks, 4096, l.Msgchan)
+	l.Start()
+
+	here := make(chan *message.Message, 1)
+	for lba := uint64(0); lba < blocks; lba++ {
+		m := message.NewMsgPut()
+		m.RetChan = here
+		m.IoPkt().Devid = uint32(lba%2) + 2
+		m.IoPkt().Address = lba
+		m.IoPkt().Buffer = make([]byte, 4096)
+		m.IoPkt().Buffer[0] = byte(lba)
+		tests.Assert(t, c.Put(m) == nil)
+		<-here
+	}
+	l.Close()
+
+	// Metadata as saved before version 1, with the log metadata
+	// saved before block checksums
+	type legacyBdaSave struct {
+		Index uint32
+		Size  uint32
+	}
+	type legacyLogSave struct {
+		Size    uint64
+		Wrapped bool
+	}
+	type legacySave struct {
+		Bda               *legacyBdaSave
+		Log               *legacyLogSave
+		Addressmap        map[uint64]uint32
+		Blocks, Blocksize uint32
+	}
+	legacy := &legacySave{
+		Bda: &legacyBdaSave{
+			Index: uint32(c.bda.index),
+			Size:  uint32(blocks),
+		},
+		Log: &legacyLogSave{
+			Size:    l.size,
+			Wrapped: l.wrapped,
+		},
+		Addressmap: make(map[uint64]uint32),
+		Blocks:     uint32(blocks),
+		Blocksize:  4096,
+	}
+	for address, index := range c.addressmap {
+		legacy.Addressmap[(uint64(address.Devid)<<48)|address.Lba] = uint32(index)
+	}
+
+	save := tests.Tempfile()
+	defer os.Remove(save)
+	fi, err := os.Create(save)
+	tests.Assert(t, err == nil)
+	tests.Assert(t, gob.NewEncoder(fi).Encode(legacy) == nil)
+	fi.Close()
+
+	l, blocks, err = NewLog(testcachefile, 4096, 2, 0, false)
+	tests.Assert(t, err == nil)
+	c2 := NewCacheMap(blocks, 4096, l.Msgchan)
+	tests.Assert(t, c2.Load(save, l) == nil)
+	tests.Assert(t, len(c2.addressmap) == len(c.addressmap))
+	for address, index := range c.addressmap {
+		tests.Assert(t, c2.addressmap[address] == index)
+		tests.Assert(t, c2.bda.bds[index].key == address)
+	}
+	tests.Assert(t, c2.bda.index == c.bda.index)
+	l.Start()
+
+	// The blocks are still readable
+	for _, lba := range []uint64{10, 101, 200, 255} {
+		m := message.NewMsgGet()
+		m.RetChan = here
+		m.IoPkt().Devid = uint32(lba%2) + 2
+		m.IoPkt().Address = lba
+		m.IoPkt().Buffer = make([]byte, 4096)
+		_, err = c2.Get(m)
+		tests.Assert(t, err == nil)
+		<-here
+		tests.Assert(t, m.Err == nil)
+		tests.Assert(t, m.IoPkt().Buffer[0] == byte(lba))
+	}
+	tests.Assert(t, l.Stats().Corruptions == 0)
+	l.Close()
+
+	// Newer versions are not supported
+	cs := &CacheMapSave{
+		Version: CacheMapSaveVersion + 1,
+	}
+	fi, err = os.Create(save)
+	tests.Assert(t, err == nil)
+	tests.Assert(t, gob.NewEncoder(fi).Encode(cs) == nil)
+	fi.Close()
+	tests.Assert(t, c2.Load(save, nil) == ErrSaveVersion)
+}
+
+// Lookup of cached blocks, which updates the statistics of the cache
+// and of the device on every block
+func BenchmarkCacheMapGet(b *testing.B) {
+	nc := message.NewNullTerminator()
+	nc.Start()
+	defer nc.Close()
+
+	c := NewCacheMap(1024, 4096, nc.In)
+	defer c.Close()
+	for lba := uint64(0); lba < 1024; lba++ {
+		c.put(Address{Devid: 1, Lba: lba})
+	}
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		c.lock.Lock()
+		c.get(Address{Devid: 1, Lba: uint64(i) % 1024})
+		c.lock.Unlock()
+	}
+}
+
+func BenchmarkCacheMapGetParallel(b *testing.B) {
+	nc := message.NewNullTerminator()
+	nc.Start()
+	defer nc.Close()
+
+	c := NewCacheMap(1024, 4096, nc.In)
+	defer c.Close()
+	for lba := uint64(0); lba < 1024; lba++ {
+		c.put(Address{Devid: 1, Lba: lba})
+	}
+
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		lba := uint64(0)
+		for pb.Next() {
+			c.lock.Lock()
+			c.get(Address{Devid: 1, Lba: lba % 1024})
+			c.lock.Unlock()
+			lba++
+		}
+	})
+}
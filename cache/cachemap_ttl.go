@@ -0,0 +1,118 @@
+//
+// Copyright (c) 2014 The pblcache Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package cache
+
+import (
+	"github.com/lpabon/godbc"
+	"time"
+)
+
+// Allows the time to be mocked by tests
+var (
+	ttlNow = time.Now
+)
+
+// Sets the time to live of the blocks of the device.  Blocks which
+// were placed in the cache longer than the TTL ago are treated as
+// misses, and are reclaimed by the eviction sweep.  Use this for
+// backends which may be written without invalidating the cache.
+// Blocks loaded from metadata saved while the device had no TTL are
+// treated as expired.  A TTL of 0 removes the TTL of the device.
+// Expiration overrides pinning: expired blocks of a pinned range
+// are reclaimed, and the block placed in the cache on the next miss
+// is pinned again.
+func (c *CacheMap) SetTTL(devid uint32, ttl time.Duration) {
+	godbc.Require(ttl >= 0)
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if ttl == 0 {
+		delete(c.ttls, devid)
+	} else {
+		c.ttls[devid] = ttl
+	}
+}
+
+// Returns the time to live of the blocks of the device, or
+// 0 if they do not expire
+func (c *CacheMap) TTL(devid uint32) time.Duration {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	return c.ttls[devid]
+}
+
+// Returns true if the log block was placed in the cache longer than
+// the TTL of the device ago
+func (c *CacheMap) expired(index uint64, devid uint32) bool {
+	ttl, ok := c.ttls[devid]
+	if !ok {
+		return false
+	}
+
+	return ttlNow().UnixNano()-c.bda.bds[index].inserted > int64(ttl)
+}
+
+// Returns true if the log block has expired.  Used by the eviction
+// sweep to reclaim expired blocks which are pinned.
+func (c *CacheMap) expiredIndex(index uint64) bool {
+	return c.expired(index, c.bda.bds[index].key.Devid)
+}
+
+// Counts the log block as expired, or as evicted to insert
+// a block of the evictor device
+func (c *CacheMap) reclaimed(index uint64, key Address, evictor uint32) {
+	if c.expired(index, key.Devid) {
+		c.stats.expiration()
+	} else {
+		c.stats.eviction()
+		c.stats.deviceEviction(key.Devid, evictor)
+	}
+}
+
+// Insertion times of the blocks of the devices with a TTL.  Blocks
+// without a saved insertion time expire when they are loaded.
+func (c *CacheMap) saveInserted() map[uint64]int64 {
+	if len(c.ttls) == 0 {
+		return nil
+	}
+
+	inserted := make(map[uint64]int64)
+	for key, index := range c.addressmap {
+		if _, ok := c.ttls[key.Devid]; ok {
+			inserted[index] = c.bda.bds[index].inserted
+		}
+	}
+
+	return inserted
+}
+
+func (c *CacheMap) loadTTLs(ttls map[uint32]time.Duration,
+	inserted map[uint64]int64) {
+
+	c.ttls = ttls
+	if c.ttls == nil {
+		c.ttls = make(map[uint32]time.Duration)
+	}
+
+	for index, t := range inserted {
+		if index < c.blocks {
+			c.bda.bds[index].inserted = t
+		}
+	}
+}
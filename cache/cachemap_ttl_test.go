@@ -0,0 +1,248 @@
+//
+// Copyright (c) 2014 The pblcache Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package cache
+
+import (
+	"github.com/pblcache/pblcache/message"
+	"github.com/pblcache/pblcache/tests"
+	"os"
+	"testing"
+	"time"
+)
+
+// Mocks the time used for TTLs and returns a function to move it
+func mockTTLNow() (advance func(d time.Duration), restore func()) {
+	now := time.Now()
+	ttlNow = func() time.Time {
+		return now
+	}
+
+	return func(d time.Duration) {
+			now = now.Add(d)
+		}, func() {
+			ttlNow = time.Now
+		}
+}
+
+func TestCacheMapTTL(t *testing.T) {
+	nc := message.NewNullTerminator()
+	nc.Start()
+	defer nc.Close()
+
+	advance, restore := mockTTLNow()
+	defer restore()
+
+	c := NewCacheMap(4, 4096, nc.In)
+	c.SetTTL(1, time.Minute)
+	tests.Assert(t, c.TTL(1) == time.Minute)
+	tests.Assert(t, c.TTL(2) == 0)
+
+	c.put(Address{Devid: 1, Lba: 1})
+	c.put(Address{Devid: 2, Lba: 1})
+	advance(30 * time.Second)
+	_, ok := c.get(Address{Devid: 1, Lba: 1})
+	tests.Assert(t, ok)
+
+	// Expired blocks are misses, but stay until they are reclaimed
+	advance(31 * time.Second)
+	_, ok = c.get(Address{Devid: 1, Lba: 1})
+	tests.Assert(t, !ok)
+	_, ok = c.get(Address{Devid: 2, Lba: 1})
+	tests.Assert(t, ok)
+	tests.Assert(t, len(c.addressmap) == 2)
+	tests.Assert(t, c.stats.readhits == 2)
+	tests.Assert(t, c.stats.reads == 3)
+
+	// The eviction sweep reclaims the expired block
+	c.put(Address{Devid: 2, Lba: 2})
+	c.put(Address{Devid: 2, Lba: 3})
+	c.put(Address{Devid: 2, Lba: 4})
+	tests.Assert(t, c.stats.expirations == 1)
+	tests.Assert(t, c.stats.evictions == 0)
+	_, ok = c.addressmap[Address{Devid: 1, Lba: 1}]
+	tests.Assert(t, !ok)
+	_, ok = c.addressmap[Address{Devid: 2, Lba: 1}]
+	tests.Assert(t, ok)
+
+	// Removing the TTL keeps the blocks
+	c.SetTTL(1, 0)
+	tests.Assert(t, c.TTL(1) == 0)
+}
+
+func TestCacheMapTTLReplace(t *testing.T) {
+	nc := message.NewNullTerminator()
+	nc.Start()
+	defer nc.Close()
+
+	advance, restore := mockTTLNow()
+	defer restore()
+
+	c := NewCacheMap(8, 4096, nc.In)
+	released := 0
+	c.SetReleaser(func(index uint64) {
+		released++
+	})
+	c.SetTTL(1, time.Minute)
+
+	// A miss on an expired block is placed in a new block
+	old := c.put(Address{Devid: 1, Lba: 1})
+	advance(2 * time.Minute)
+	_, ok := c.get(Address{Devid: 1, Lba: 1})
+	tests.Assert(t, !ok)
+	index := c.put(Address{Devid: 1, Lba: 1})
+	tests.Assert(t, index != old)
+	tests.Assert(t, !c.bda.bds[old].used)
+	tests.Assert(t, released == 1)
+	tests.Assert(t, c.stats.expirations == 1)
+	tests.Assert(t, len(c.addressmap) == 1)
+
+	_, ok = c.get(Address{Devid: 1, Lba: 1})
+	tests.Assert(t, ok)
+}
+
+func TestCacheMapTTLDedup(t *testing.T) {
+	nc := message.NewNullTerminator()
+	nc.Start()
+	defer nc.Close()
+
+	advance, restore := mockTTLNow()
+	defer restore()
+
+	c := NewCacheMap(8, 4096, nc.In)
+	c.EnableDedup()
+	c.SetTTL(1, time.Minute)
+
+	buffer := make([]byte, 4096)
+	old, write := c.insert(Address{Devid: 1, Lba: 1}, buffer)
+	tests.Assert(t, write)
+	index, write := c.insert(Address{Devid: 2, Lba: 1}, buffer)
+	tests.Assert(t, !write)
+	tests.Assert(t, index == old)
+
+	// Sharing the contents renews them
+	advance(45 * time.Second)
+	index, write = c.insert(Address{Devid: 1, Lba: 3}, buffer)
+	tests.Assert(t, !write)
+	tests.Assert(t, index == old)
+	advance(45 * time.Second)
+	_, ok := c.get(Address{Devid: 1, Lba: 3})
+	tests.Assert(t, ok)
+	c.invalidate(Address{Devid: 1, Lba: 3})
+
+	// Expired contents are not shared with new addresses
+	advance(2 * time.Minute)
+	index, write = c.insert(Address{Devid: 1, Lba: 2}, buffer)
+	tests.Assert(t, write)
+	tests.Assert(t, index != old)
+	tests.Assert(t, c.fingerprints[c.dedupKey(1, c.dedup[index].fingerprint)] == index)
+
+	// Removing the old block keeps the fingerprint of the new one
+	c.invalidate(Address{Devid: 1, Lba: 1})
+	c.invalidate(Address{Devid: 2, Lba: 1})
+	_, ok = c.dedup[old]
+	tests.Assert(t, !ok)
+	tests.Assert(t, c.fingerprints[c.dedupKey(1, c.dedup[index].fingerprint)] == index)
+}
+
+func TestCacheMapTTLPinned(t *testing.T) {
+	nc := message.NewNullTerminator()
+	nc.Start()
+	defer nc.Close()
+
+	advance, restore := mockTTLNow()
+	defer restore()
+
+	c := NewCacheMap(4, 4096, nc.In)
+	c.SetTTL(1, time.Minute)
+	tests.Assert(t, c.SetPinLimit(0.5) == nil)
+	tests.Assert(t, c.Pin(1, 0, 2) == nil)
+	c.put(Address{Devid: 1, Lba: 0})
+	c.put(Address{Devid: 1, Lba: 1})
+	tests.Assert(t, c.PinnedBlocks() == 2)
+
+	// Expiration overrides pinning.  A miss on an expired
+	// block unpins it.
+	advance(2 * time.Minute)
+	_, ok := c.get(Address{Devid: 1, Lba: 0})
+	tests.Assert(t, !ok)
+	tests.Assert(t, c.PinnedBlocks() == 1)
+
+	// The eviction sweep reclaims expired blocks, even
+	// if they are still pinned
+	c.put(Address{Devid: 2, Lba: 1})
+	c.put(Address{Devid: 2, Lba: 2})
+	c.put(Address{Devid: 2, Lba: 3})
+	c.put(Address{Devid: 2, Lba: 4})
+	tests.Assert(t, c.PinnedBlocks() == 0)
+	tests.Assert(t, c.stats.expirations == 2)
+	tests.Assert(t, c.stats.evictions == 0)
+	_, ok = c.addressmap[Address{Devid: 1, Lba: 0}]
+	tests.Assert(t, !ok)
+	_, ok = c.addressmap[Address{Devid: 1, Lba: 1}]
+	tests.Assert(t, !ok)
+
+	// The range is still pinned, so new blocks are pinned again
+	c.put(Address{Devid: 1, Lba: 0})
+	tests.Assert(t, c.PinnedBlocks() == 1)
+	_, ok = c.get(Address{Devid: 1, Lba: 0})
+	tests.Assert(t, ok)
+	tests.Assert(t, c.stats.pinnedhits == 1)
+
+	// Pinning a range does not pin expired blocks
+	c.put(Address{Devid: 1, Lba: 5})
+	advance(2 * time.Minute)
+	tests.Assert(t, c.Pin(1, 5, 1) == ErrPinLimit)
+	tests.Assert(t, c.Unpin(1, 0, 2) == nil)
+	tests.Assert(t, c.Pin(1, 5, 1) == nil)
+	tests.Assert(t, c.PinnedBlocks() == 0)
+}
+
+func TestCacheMapTTLSaveLoad(t *testing.T) {
+	nc := message.NewNullTerminator()
+	nc.Start()
+	defer nc.Close()
+
+	advance, restore := mockTTLNow()
+	defer restore()
+
+	save := tests.Tempfile()
+	defer os.Remove(save)
+
+	c := NewCacheMap(8, 4096, nc.In)
+	c.SetTTL(1, time.Minute)
+	c.put(Address{Devid: 1, Lba: 1})
+	c.put(Address{Devid: 2, Lba: 1})
+	advance(30 * time.Second)
+	c.put(Address{Devid: 1, Lba: 2})
+	tests.Assert(t, c.Save(save, nil) == nil)
+
+	c2 := NewCacheMap(8, 4096, nc.In)
+	tests.Assert(t, c2.Load(save, nil) == nil)
+	tests.Assert(t, c2.TTL(1) == time.Minute)
+
+	// Insertion times are kept
+	advance(45 * time.Second)
+	_, ok := c2.get(Address{Devid: 1, Lba: 1})
+	tests.Assert(t, !ok)
+	_, ok = c2.get(Address{Devid: 1, Lba: 2})
+	tests.Assert(t, ok)
+
+	// Blocks saved without a TTL expire once a TTL is set
+	c2.SetTTL(2, time.Hour)
+	_, ok = c2.get(Address{Devid: 2, Lba: 1})
+	tests.Assert(t, !ok)
+}
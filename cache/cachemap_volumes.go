@@ -0,0 +1,138 @@
+//
+// Copyright (c) 2014 The pblcache Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package cache
+
+import (
+	"errors"
+	"sort"
+)
+
+const (
+	// Device id of the first registered volume
+	FirstVolumeDevid = 1
+)
+
+var (
+	ErrVolumeExists   = errors.New("Volume is already registered")
+	ErrVolumeNotFound = errors.New("Volume is not registered")
+	ErrVolumesFull    = errors.New("No device ids available for a new volume")
+	ErrVolumeName     = errors.New("Volume name must not be empty")
+)
+
+type VolumeSave struct {
+	Volumes   map[string]uint32
+	NextDevid uint32
+}
+
+// Volume registered in the cache map
+type Volume struct {
+	Name  string
+	Devid uint32
+}
+
+// Registers a volume identified by name, which may be a volume name
+// or UUID, and returns the device id which must be used as the Devid
+// of its I/O.  Device ids are never reused, so blocks or keys of a
+// removed volume cannot be confused with a new one.
+func (c *CacheMap) RegisterVolume(name string) (uint32, error) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if name == "" {
+		return 0, ErrVolumeName
+	}
+	if _, ok := c.volumes[name]; ok {
+		return 0, ErrVolumeExists
+	}
+	if c.nextdevid == 0 {
+		return 0, ErrVolumesFull
+	}
+
+	devid := c.nextdevid
+	c.volumes[name] = devid
+
+	// Zero marks the device ids as exhausted
+	c.nextdevid++
+
+	return devid, nil
+}
+
+// Returns the device id of the registered volume
+func (c *CacheMap) LookupVolume(name string) (uint32, bool) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	devid, ok := c.volumes[name]
+	return devid, ok
+}
+
+// Returns all the registered volumes sorted by device id
+func (c *CacheMap) Volumes() []Volume {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	volumes := make([]Volume, 0, len(c.volumes))
+	for name, devid := range c.volumes {
+		volumes = append(volumes, Volume{
+			Name:  name,
+			Devid: devid,
+		})
+	}
+	sort.Slice(volumes, func(i, j int) bool {
+		return volumes[i].Devid < volumes[j].Devid
+	})
+
+	return volumes
+}
+
+// Removes the volume from the registry, invalidates all of its
+// blocks in the cache, and removes its pinned ranges
+func (c *CacheMap) RemoveVolume(name string) error {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	devid, ok := c.volumes[name]
+	if !ok {
+		return ErrVolumeNotFound
+	}
+
+	c.invalidateDevice(devid)
+	c.unpinDevice(devid)
+	delete(c.volumes, name)
+
+	return nil
+}
+
+func (c *CacheMap) saveVolumes() *VolumeSave {
+	return &VolumeSave{
+		Volumes:   c.volumes,
+		NextDevid: c.nextdevid,
+	}
+}
+
+func (c *CacheMap) loadVolumes(save *VolumeSave) {
+	// Metadata saved before volumes were registered
+	if save == nil {
+		return
+	}
+
+	c.volumes = save.Volumes
+	if c.volumes == nil {
+		c.volumes = make(map[string]uint32)
+	}
+	c.nextdevid = save.NextDevid
+}
@@ -0,0 +1,120 @@
+//
+// Copyright (c) 2014 The pblcache Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package cache
+
+import (
+	"github.com/pblcache/pblcache/message"
+	"github.com/pblcache/pblcache/tests"
+	"os"
+	"testing"
+)
+
+func TestCacheMapVolumes(t *testing.T) {
+	nc := message.NewNullTerminator()
+	nc.Start()
+	defer nc.Close()
+
+	c := NewCacheMap(8, 4096, nc.In)
+	tests.Assert(t, len(c.Volumes()) == 0)
+
+	devid, err := c.RegisterVolume("vol1")
+	tests.Assert(t, err == nil)
+	tests.Assert(t, devid == FirstVolumeDevid)
+
+	_, err = c.RegisterVolume("vol1")
+	tests.Assert(t, err == ErrVolumeExists)
+	_, err = c.RegisterVolume("")
+	tests.Assert(t, err == ErrVolumeName)
+
+	uuid := "6f1a7c3e-3f55-4b8e-9a0c-2f6d4c1e8b2a"
+	devid2, err := c.RegisterVolume(uuid)
+	tests.Assert(t, err == nil)
+	tests.Assert(t, devid2 != devid)
+
+	found, ok := c.LookupVolume(uuid)
+	tests.Assert(t, ok)
+	tests.Assert(t, found == devid2)
+	_, ok = c.LookupVolume("nothere")
+	tests.Assert(t, !ok)
+
+	volumes := c.Volumes()
+	tests.Assert(t, len(volumes) == 2)
+	tests.Assert(t, volumes[0] == Volume{Name: "vol1", Devid: devid})
+	tests.Assert(t, volumes[1] == Volume{Name: uuid, Devid: devid2})
+
+	// Removing the volume invalidates only its blocks
+	c.put(Address{Devid: devid, Lba: 1})
+	c.put(Address{Devid: devid, Lba: 2})
+	index := c.put(Address{Devid: devid2, Lba: 1})
+	tests.Assert(t, c.RemoveVolume("vol1") == nil)
+	tests.Assert(t, len(c.addressmap) == 1)
+	tests.Assert(t, c.addressmap[Address{Devid: devid2, Lba: 1}] == index)
+	tests.Assert(t, c.RemoveVolume("vol1") == ErrVolumeNotFound)
+	_, ok = c.LookupVolume("vol1")
+	tests.Assert(t, !ok)
+
+	// Device ids are not reused
+	devid3, err := c.RegisterVolume("vol1")
+	tests.Assert(t, err == nil)
+	tests.Assert(t, devid3 != devid)
+	tests.Assert(t, devid3 != devid2)
+}
+
+func TestCacheMapVolumesFull(t *testing.T) {
+	nc := message.NewNullTerminator()
+	nc.Start()
+	defer nc.Close()
+
+	c := NewCacheMap(8, 4096, nc.In)
+	c.nextdevid = ^uint32(0)
+
+	devid, err := c.RegisterVolume("last")
+	tests.Assert(t, err == nil)
+	tests.Assert(t, devid == ^uint32(0))
+
+	_, err = c.RegisterVolume("full")
+	tests.Assert(t, err == ErrVolumesFull)
+}
+
+func TestCacheMapVolumesSaveLoad(t *testing.T) {
+	nc := message.NewNullTerminator()
+	nc.Start()
+	defer nc.Close()
+
+	save := tests.Tempfile()
+	defer os.Remove(save)
+
+	c := NewCacheMap(8, 4096, nc.In)
+	devid1, err := c.RegisterVolume("vol1")
+	tests.Assert(t, err == nil)
+	devid2, err := c.RegisterVolume("vol2")
+	tests.Assert(t, err == nil)
+	tests.Assert(t, c.RemoveVolume("vol1") == nil)
+	tests.Assert(t, c.Save(save, nil) == nil)
+
+	c2 := NewCacheMap(8, 4096, nc.In)
+	tests.Assert(t, c2.Load(save, nil) == nil)
+	volumes := c2.Volumes()
+	tests.Assert(t, len(volumes) == 1)
+	tests.Assert(t, volumes[0] == Volume{Name: "vol2", Devid: devid2})
+
+	// Device ids are not reused after a load
+	devid3, err := c2.RegisterVolume("vol3")
+	tests.Assert(t, err == nil)
+	tests.Assert(t, devid3 != devid1)
+	tests.Assert(t, devid3 != devid2)
+}
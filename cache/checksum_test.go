@@ -0,0 +1,32 @@
+//
+// Copyright (c) 2014 The pblcache Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package cache
+
+import (
+	"github.com/pblcache/pblcache/tests"
+	"testing"
+)
+
+func TestChecksum(t *testing.T) {
+	// Well known CRC32C check value
+	tests.Assert(t, Checksum([]byte("123456789")) == 0xe3069283)
+
+	buf := make([]byte, 4096)
+	sum := Checksum(buf)
+	buf[100] = 1
+	tests.Assert(t, sum != Checksum(buf))
+}
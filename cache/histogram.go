@@ -0,0 +1,266 @@
+//
+// Copyright (c) 2014 The pblcache Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package cache
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"math/bits"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// Each power of two is split into 16 buckets, so a value
+	// is recorded with an error of less than 6.25%
+	histogramSubBits    = 4
+	histogramSubBuckets = 1 << histogramSubBits
+	histogramBuckets    = (64 - histogramSubBits + 1) * histogramSubBuckets
+)
+
+// Latency histogram with logarithmic buckets.  Recording a value
+// takes constant time, and histograms can be merged or subtracted
+// to get the histogram of an interval.  The zero value is an empty
+// histogram.
+type Histogram struct {
+	counts [histogramBuckets]uint64
+	count  uint64
+	max    time.Duration
+}
+
+type histogramJson struct {
+	Count   uint64      `json:"count"`
+	Max     int64       `json:"max"`
+	P50     float64     `json:"p50_usecs"`
+	P95     float64     `json:"p95_usecs"`
+	P99     float64     `json:"p99_usecs"`
+	P999    float64     `json:"p999_usecs"`
+	Buckets [][2]uint64 `json:"buckets"`
+}
+
+func histogramIndex(v uint64) int {
+	if v < histogramSubBuckets {
+		return int(v)
+	}
+
+	shift := bits.Len64(v) - histogramSubBits - 1
+	return (shift+1)*histogramSubBuckets + int(v>>uint(shift)) - histogramSubBuckets
+}
+
+// Returns the largest value recorded in the bucket
+func histogramUpper(index int) uint64 {
+	if index < histogramSubBuckets {
+		return uint64(index)
+	}
+
+	shift := uint(index/histogramSubBuckets - 1)
+	low := uint64(histogramSubBuckets+index%histogramSubBuckets) << shift
+	return low + (1 << shift) - 1
+}
+
+func (h *Histogram) Add(d time.Duration) {
+	if d < 0 {
+		d = 0
+	}
+
+	h.counts[histogramIndex(uint64(d))]++
+	h.count++
+	if d > h.max {
+		h.max = d
+	}
+}
+
+// Same as Add, but safe to call concurrently with other callers of
+// addAtomic and load
+func (h *Histogram) addAtomic(d time.Duration) {
+	if d < 0 {
+		d = 0
+	}
+
+	atomic.AddUint64(&h.counts[histogramIndex(uint64(d))], 1)
+	atomic.AddUint64(&h.count, 1)
+	for {
+		max := atomic.LoadInt64((*int64)(&h.max))
+		if int64(d) <= max ||
+			atomic.CompareAndSwapInt64((*int64)(&h.max), max, int64(d)) {
+			return
+		}
+	}
+}
+
+// Returns a copy of a histogram updated by addAtomic.  The count is
+// loaded before the buckets, so it is never larger than the sum of
+// the buckets.
+func (h *Histogram) load() *Histogram {
+	c := &Histogram{}
+	c.count = atomic.LoadUint64(&h.count)
+	for i := range h.counts {
+		c.counts[i] = atomic.LoadUint64(&h.counts[i])
+	}
+	c.max = time.Duration(atomic.LoadInt64((*int64)(&h.max)))
+	return c
+}
+
+// Adds the values recorded in the other histogram
+func (h *Histogram) Merge(other *Histogram) {
+	for i, count := range other.counts {
+		h.counts[i] += count
+	}
+	h.count += other.count
+	if other.max > h.max {
+		h.max = other.max
+	}
+}
+
+// Returns the histogram of the values recorded since prev was copied
+// from this histogram.  The maximum is the largest value which could
+// have been recorded since prev.
+func (h *Histogram) Delta(prev *Histogram) *Histogram {
+	delta := &Histogram{}
+	highest := -1
+	for i := range h.counts {
+		delta.counts[i] = h.counts[i] - prev.counts[i]
+		if delta.counts[i] != 0 {
+			highest = i
+		}
+	}
+	delta.count = h.count - prev.count
+
+	if highest >= 0 {
+		delta.max = time.Duration(histogramUpper(highest))
+		if delta.max > h.max {
+			delta.max = h.max
+		}
+	}
+
+	return delta
+}
+
+func (h *Histogram) Copy() *Histogram {
+	c := *h
+	return &c
+}
+
+func (h *Histogram) Count() uint64 {
+	return h.count
+}
+
+func (h *Histogram) Max() time.Duration {
+	return h.max
+}
+
+// Returns the value below which the percent of the recorded
+// values fall
+func (h *Histogram) Percentile(percent float64) time.Duration {
+	if h.count == 0 {
+		return 0
+	}
+
+	rank := uint64(math.Ceil(percent / 100 * float64(h.count)))
+	if rank == 0 {
+		rank = 1
+	}
+
+	seen := uint64(0)
+	for i, count := range h.counts {
+		seen += count
+		if seen >= rank {
+			value := time.Duration(histogramUpper(i))
+			if value > h.max {
+				value = h.max
+			}
+			return value
+		}
+	}
+
+	return h.max
+}
+
+func (h *Histogram) PercentileUsecs(percent float64) float64 {
+	return float64(h.Percentile(percent)) / float64(time.Microsecond)
+}
+
+func (h *Histogram) String() string {
+	return fmt.Sprintf("p50 %.2f usec p95 %.2f usec p99 %.2f usec "+
+		"p99.9 %.2f usec max %.2f usec",
+		h.PercentileUsecs(50),
+		h.PercentileUsecs(95),
+		h.PercentileUsecs(99),
+		h.PercentileUsecs(99.9),
+		float64(h.max)/float64(time.Microsecond))
+}
+
+func (h *Histogram) Csv() string {
+	return fmt.Sprintf(
+		"%v,"+ // Count
+			"%v,"+ // p50 usecs
+			"%v,"+ // p95 usecs
+			"%v,"+ // p99 usecs
+			"%v,"+ // p99.9 usecs
+			"%v,", // Max usecs
+		h.count,
+		h.PercentileUsecs(50),
+		h.PercentileUsecs(95),
+		h.PercentileUsecs(99),
+		h.PercentileUsecs(99.9),
+		float64(h.max)/float64(time.Microsecond))
+}
+
+func (h *Histogram) CsvDelta(prev *Histogram) string {
+	return h.Delta(prev).Csv()
+}
+
+// Only the buckets with values are saved
+func (h Histogram) MarshalJSON() ([]byte, error) {
+	j := &histogramJson{
+		Count:   h.count,
+		Max:     int64(h.max),
+		P50:     h.PercentileUsecs(50),
+		P95:     h.PercentileUsecs(95),
+		P99:     h.PercentileUsecs(99),
+		P999:    h.PercentileUsecs(99.9),
+		Buckets: make([][2]uint64, 0),
+	}
+	for i, count := range h.counts {
+		if count != 0 {
+			j.Buckets = append(j.Buckets, [2]uint64{uint64(i), count})
+		}
+	}
+
+	return json.Marshal(j)
+}
+
+func (h *Histogram) UnmarshalJSON(data []byte) error {
+	j := &histogramJson{}
+	err := json.Unmarshal(data, j)
+	if err != nil {
+		return err
+	}
+
+	*h = Histogram{}
+	for _, bucket := range j.Buckets {
+		if bucket[0] >= histogramBuckets {
+			return fmt.Errorf("Histogram bucket %d is out of range", bucket[0])
+		}
+		h.counts[bucket[0]] = bucket[1]
+	}
+	h.count = j.Count
+	h.max = time.Duration(j.Max)
+
+	return nil
+}
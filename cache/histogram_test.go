@@ -0,0 +1,154 @@
+//
+// Copyright (c) 2014 The pblcache Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package cache
+
+import (
+	"encoding/json"
+	"github.com/pblcache/pblcache/tests"
+	"math/rand"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestHistogramIndex(t *testing.T) {
+	// Exact values for small numbers
+	for v := uint64(0); v < histogramSubBuckets; v++ {
+		tests.Assert(t, histogramIndex(v) == int(v))
+		tests.Assert(t, histogramUpper(int(v)) == v)
+	}
+
+	// Every value is in a bucket which contains it, with an error
+	// of less than 1/16th
+	for _, v := range []uint64{16, 17, 31, 32, 33, 1000, 123456789, 1 << 40, ^uint64(0)} {
+		index := histogramIndex(v)
+		tests.Assert(t, index < histogramBuckets)
+		tests.Assert(t, histogramUpper(index) >= v)
+		tests.Assert(t, float64(histogramUpper(index)-v) < float64(v)/16)
+		if index > 0 {
+			tests.Assert(t, histogramUpper(index-1) < v)
+		}
+	}
+	tests.Assert(t, histogramIndex(^uint64(0)) == histogramBuckets-1)
+}
+
+func TestHistogramPercentiles(t *testing.T) {
+	h := &Histogram{}
+	tests.Assert(t, h.Percentile(50) == 0)
+	tests.Assert(t, h.Max() == 0)
+
+	// 1..1000 usecs
+	values := make([]time.Duration, 0, 1000)
+	for i := 1; i <= 1000; i++ {
+		values = append(values, time.Duration(i)*time.Microsecond)
+	}
+	for _, i := range rand.Perm(len(values)) {
+		h.Add(values[i])
+	}
+	sort.Slice(values, func(i, j int) bool {
+		return values[i] < values[j]
+	})
+
+	tests.Assert(t, h.Count() == 1000)
+	tests.Assert(t, h.Max() == time.Millisecond)
+	for _, p := range []float64{50, 95, 99, 99.9, 100} {
+		exact := values[int(p/100*1000)-1]
+		value := h.Percentile(p)
+		tests.Assert(t, value >= exact)
+		tests.Assert(t, value-exact <= exact/16)
+	}
+	tests.Assert(t, h.Percentile(100) == time.Millisecond)
+	tests.Assert(t, h.Percentile(0) <= time.Microsecond+time.Microsecond/16)
+}
+
+func TestHistogramMergeDelta(t *testing.T) {
+	h1 := &Histogram{}
+	h2 := &Histogram{}
+	for i := 0; i < 100; i++ {
+		h1.Add(time.Millisecond)
+		h2.Add(time.Second)
+	}
+
+	h := h1.Copy()
+	h.Merge(h2)
+	tests.Assert(t, h.Count() == 200)
+	tests.Assert(t, h.Max() == time.Second)
+	tests.Assert(t, h.Percentile(50) <= time.Millisecond+time.Millisecond/16)
+	tests.Assert(t, h.Percentile(51) >= time.Second)
+
+	// Copies are not changed
+	tests.Assert(t, h1.Count() == 100)
+	tests.Assert(t, h1.Max() == time.Millisecond)
+
+	// The delta has only the values added since the copy
+	prev := h1.Copy()
+	h1.Add(2 * time.Millisecond)
+	h1.Add(2 * time.Millisecond)
+	delta := h1.Delta(prev)
+	tests.Assert(t, delta.Count() == 2)
+	tests.Assert(t, delta.Percentile(50) >= 2*time.Millisecond)
+	tests.Assert(t, delta.Max() == 2*time.Millisecond)
+
+	// The delta maximum is an upper bound of the added values
+	prev = h.Copy()
+	h.Add(5 * time.Millisecond)
+	delta = h.Delta(prev)
+	tests.Assert(t, delta.Max() >= 5*time.Millisecond)
+	tests.Assert(t, delta.Max() < time.Second)
+	tests.Assert(t, h.Delta(h).Count() == 0)
+	tests.Assert(t, h.Delta(h).Max() == 0)
+}
+
+func TestHistogramCsv(t *testing.T) {
+	h := &Histogram{}
+	h.Add(10 * time.Microsecond)
+	h.Add(10 * time.Microsecond)
+
+	// 6 elements per csv line + the empty
+	slice := strings.Split(h.Csv(), ",")
+	tests.Assert(t, len(slice) == 7)
+	tests.Assert(t, slice[0] == "2")
+	tests.Assert(t, slice[5] == "10")
+
+	prev := h.Copy()
+	h.Add(20 * time.Microsecond)
+	slice = strings.Split(h.CsvDelta(prev), ",")
+	tests.Assert(t, len(slice) == 7)
+	tests.Assert(t, slice[0] == "1")
+	tests.Assert(t, slice[5] == "20")
+}
+
+func TestHistogramJson(t *testing.T) {
+	h := &Histogram{}
+	h.Add(0)
+	h.Add(123 * time.Microsecond)
+	h.Add(4 * time.Second)
+
+	jsonhist, err := json.Marshal(h)
+	tests.Assert(t, err == nil)
+	tests.Assert(t, strings.Contains(string(jsonhist), `"p99_usecs":4`))
+
+	dec := &Histogram{}
+	err = json.Unmarshal(jsonhist, dec)
+	tests.Assert(t, err == nil)
+	tests.Assert(t, reflect.DeepEqual(dec, h))
+
+	err = json.Unmarshal([]byte(`{"buckets":[[100000,1]]}`), dec)
+	tests.Assert(t, err != nil)
+}
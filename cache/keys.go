@@ -0,0 +1,129 @@
+//
+// Copyright (c) 2014 The pblcache Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package cache
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+var (
+	ErrKeyNotFound = errors.New("No key available for device")
+	ErrKeyChanged  = errors.New("Block was encrypted with a different key")
+)
+
+// Provides the keys used to encrypt the blocks of each device
+// in the log.  Keys must be 32 or 64 bytes for AES-128-XTS or
+// AES-256-XTS.  Key is called on every I/O, so implementations
+// should be fast.
+type KeyProvider interface {
+	Key(devid uint32) ([]byte, error)
+}
+
+// KeyFile is a KeyProvider which reads the keys from a file.  Each
+// line of the file has a device id followed by the key in hex:
+//
+//	# devid key
+//	1 000102030405060708090a0b0c0d0e0f101112131415161718191a1b1c1d1e1f
+type KeyFile struct {
+	filename string
+	keys     map[uint32][]byte
+	lock     sync.RWMutex
+}
+
+func NewKeyFile(filename string) (*KeyFile, error) {
+	k := &KeyFile{
+		filename: filename,
+	}
+
+	_, err := k.Reload()
+	if err != nil {
+		return nil, err
+	}
+
+	return k, nil
+}
+
+// Rereads the key file.  Blocks of devices whose key has been
+// changed or removed can no longer be read from the log.  Returns
+// the ids of those devices, so that their blocks can be invalidated.
+func (k *KeyFile) Reload() ([]uint32, error) {
+	fp, err := os.Open(k.filename)
+	if err != nil {
+		return nil, err
+	}
+	defer fp.Close()
+
+	keys := make(map[uint32][]byte)
+	scanner := bufio.NewScanner(fp)
+	for line := 1; scanner.Scan(); line++ {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 0 || strings.HasPrefix(fields[0], "#") {
+			continue
+		}
+		if len(fields) != 2 {
+			return nil, fmt.Errorf("%s:%d: expected device id and key", k.filename, line)
+		}
+
+		devid, err := strconv.ParseUint(fields[0], 10, 32)
+		if err != nil {
+			return nil, fmt.Errorf("%s:%d: %s", k.filename, line, err)
+		}
+		key, err := hex.DecodeString(fields[1])
+		if err != nil {
+			return nil, fmt.Errorf("%s:%d: %s", k.filename, line, err)
+		}
+		if len(key) != 32 && len(key) != 64 {
+			return nil, fmt.Errorf("%s:%d: %s", k.filename, line, ErrXtsKeySize)
+		}
+		keys[uint32(devid)] = key
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	k.lock.Lock()
+	defer k.lock.Unlock()
+
+	changed := make([]uint32, 0)
+	for devid, key := range k.keys {
+		if newkey, ok := keys[devid]; !ok || !bytes.Equal(key, newkey) {
+			changed = append(changed, devid)
+		}
+	}
+	k.keys = keys
+
+	return changed, nil
+}
+
+func (k *KeyFile) Key(devid uint32) ([]byte, error) {
+	k.lock.RLock()
+	defer k.lock.RUnlock()
+
+	if key, ok := k.keys[devid]; ok {
+		return key, nil
+	}
+
+	return nil, ErrKeyNotFound
+}
@@ -0,0 +1,97 @@
+//
+// Copyright (c) 2014 The pblcache Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package cache
+
+import (
+	"bytes"
+	"github.com/pblcache/pblcache/tests"
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestKeyFile(t *testing.T) {
+	keyfile := tests.Tempfile()
+	defer os.Remove(keyfile)
+
+	fp, err := os.Create(keyfile)
+	tests.Assert(t, err == nil)
+	fp.WriteString("# Comment\n\n" +
+		"1 " + strings.Repeat("01", 32) + "\n" +
+		"20 " + strings.Repeat("ff", 64) + "\n")
+	fp.Close()
+
+	keys, err := NewKeyFile(keyfile)
+	tests.Assert(t, err == nil)
+
+	key, err := keys.Key(1)
+	tests.Assert(t, err == nil)
+	tests.Assert(t, bytes.Equal(key, bytes.Repeat([]byte{1}, 32)))
+
+	key, err = keys.Key(20)
+	tests.Assert(t, err == nil)
+	tests.Assert(t, bytes.Equal(key, bytes.Repeat([]byte{0xff}, 64)))
+
+	_, err = keys.Key(2)
+	tests.Assert(t, err == ErrKeyNotFound)
+
+	// Devices whose key was changed or removed are returned
+	fp, err = os.Create(keyfile)
+	tests.Assert(t, err == nil)
+	fp.WriteString("1 " + strings.Repeat("01", 32) + "\n" +
+		"2 " + strings.Repeat("02", 32) + "\n" +
+		"3 " + strings.Repeat("03", 32) + "\n")
+	fp.Close()
+	changed, err := keys.Reload()
+	tests.Assert(t, err == nil)
+	tests.Assert(t, len(changed) == 1)
+	tests.Assert(t, changed[0] == 20)
+
+	fp, err = os.Create(keyfile)
+	tests.Assert(t, err == nil)
+	fp.WriteString("1 " + strings.Repeat("11", 32) + "\n" +
+		"2 " + strings.Repeat("02", 32) + "\n")
+	fp.Close()
+	changed, err = keys.Reload()
+	tests.Assert(t, err == nil)
+	tests.Assert(t, len(changed) == 2)
+	tests.Assert(t, changed[0]+changed[1] == 4)
+	tests.Assert(t, changed[0] == 1 || changed[0] == 3)
+}
+
+func TestKeyFileErrors(t *testing.T) {
+	_, err := NewKeyFile("/doesnotexist/keyfile")
+	tests.Assert(t, err != nil)
+
+	keyfile := tests.Tempfile()
+	defer os.Remove(keyfile)
+
+	for _, contents := range []string{
+		"1\n",
+		"x " + strings.Repeat("01", 32) + "\n",
+		"1 xyz\n",
+		"1 " + strings.Repeat("01", 16) + "\n",
+	} {
+		fp, err := os.Create(keyfile)
+		tests.Assert(t, err == nil)
+		fp.WriteString(contents)
+		fp.Close()
+
+		_, err = NewKeyFile(keyfile)
+		tests.Assert(t, err != nil)
+	}
+}
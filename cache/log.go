@@ -17,25 +17,18 @@
 package cache
 
 import (
+	"compress/flate"
 	"errors"
 	"fmt"
 	"github.com/lpabon/bufferio"
 	"github.com/lpabon/godbc"
 	"github.com/pblcache/pblcache/message"
-	"io"
 	"math"
-	"os"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
-type Filer interface {
-	io.Closer
-	io.Seeker
-	io.ReaderAt
-	io.WriterAt
-}
-
 const (
 	KB                   = 1024
 	MB                   = 1024 * KB
@@ -46,17 +39,23 @@ const (
 
 // Allows these functions to be mocked by tests
 var (
-	logMaxBlocks = int64(math.Pow(2, 32))
-	openFile     = func(name string, flag int, perm os.FileMode) (Filer, error) {
-		return os.OpenFile(name, flag, perm)
-	}
+	logMaxBlocks   = int64(math.MaxInt64)
 	ErrLogTooSmall = errors.New("Log is too small")
 	ErrLogTooLarge = errors.New("Log is too large")
+	ErrChecksum    = errors.New("Block checksum mismatch")
+
+	ErrBlockOverwritten = errors.New("Block has been overwritten in the log")
 )
 
 type LogSave struct {
-	Size    uint64
-	Wrapped bool
+	Size      uint64
+	Wrapped   bool
+	Checksums []uint32
+	Unchecked []bool
+	KeyIds    []uint32
+	Extents   []LogExtent
+	Current   uint64
+	Cursor    uint32
 }
 
 type IoSegment struct {
@@ -71,70 +70,138 @@ type Log struct {
 	size               uint64
 	blocksize          uint32
 	segmentsize        uint32
-	numsegments        uint32
-	blocks             uint32
+	numsegments        uint64
+	blocks             uint64
 	segments           []IoSegment
 	segment            *IoSegment
 	segmentbuffers     int
+	alignment          int
+	bounces            *BufferPool
+	bc                 *BufferCache
+	checksums          []uint32
+	generations        []uint32
+	unchecked          []bool
+	keyids             []uint32
+	invalidator        func(index uint64, current func() bool)
+	invalidations      chan logLostBlock
+	invalidatorwg      sync.WaitGroup
+	compression        bool
+	ratio              uint32
+	compressor         *flate.Writer
+	compressbuf        []byte
+	cursor             uint32
+	extents            []LogExtent
+	owners             [][]uint64
+	discardrate        uint64
+	discards           []uint64
+	livesegment        []uint64
+	segmentlive        []uint32
+	segmentdiscarded   []bool
+	discardlock        sync.Mutex
+	devlock            sync.Mutex
+	keys               KeyProvider
+	ciphers            map[uint32]*logCipher
+	cipherlock         sync.Mutex
 	chwriting          chan *IoSegment
 	chreader           chan *IoSegment
 	chavailable        chan *IoSegment
 	wg                 sync.WaitGroup
-	current            uint32
+	current            uint64
 	blocks_per_segment uint32
-	fp                 Filer
+	dev                LogDevice
 	wrapped            bool
 	stats              *logstats
 	Msgchan            chan *message.Message
 	quitchan           chan struct{}
 	logreaders         chan *message.Message
 	closed             bool
+
+	// Online resize
+	resizes    chan *logResize
+	resizelock sync.RWMutex
 }
 
 func NewLog(logfile string,
 	blocksize, blocks_per_segment, bcsize uint32,
-	usedirectio bool) (*Log, uint32, error) {
+	usedirectio bool) (*Log, uint64, error) {
+	return openLog(logfile, blocksize, blocks_per_segment, bcsize, usedirectio, 0)
+}
+
+// Creates a log which compresses each block before placing it in a
+// segment.  Since the number of blocks which fit in the log depends
+// on how well they compress, the number of blocks returned is the
+// number of blocks in the log multiplied by ratio.  Blocks which are
+// overwritten in the log before they are evicted from the cache are
+// reported to the invalidator.
+func NewCompressedLog(logfile string,
+	blocksize, blocks_per_segment, bcsize uint32,
+	usedirectio bool,
+	ratio uint32) (*Log, uint64, error) {
+	godbc.Require(ratio > 0)
+	return openLog(logfile, blocksize, blocks_per_segment, bcsize, usedirectio, ratio)
+}
+
+func openLog(logfile string,
+	blocksize, blocks_per_segment, bcsize uint32,
+	usedirectio bool,
+	ratio uint32) (*Log, uint64, error) {
+
+	dev, err := OpenLogDevice(logfile, usedirectio)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	log, blocks, err := NewLogFromDevice(dev, blocksize, blocks_per_segment, bcsize, ratio)
+	if err != nil {
+		dev.Close()
+		return nil, 0, err
+	}
+
+	return log, blocks, nil
+}
+
+// Creates a log on the specified device.  The log owns the device
+// and closes it on Close(), unless an error is returned.  If ratio is
+// not zero, blocks are compressed as described in NewCompressedLog().
+func NewLogFromDevice(dev LogDevice,
+	blocksize, blocks_per_segment, bcsize uint32,
+	ratio uint32) (*Log, uint64, error) {
+
+	godbc.Require(dev != nil)
 
 	var err error
 
 	// Initialize Log
 	log := &Log{}
+	log.dev = dev
 	log.stats = &logstats{}
 	log.blocksize = blocksize
 	log.blocks_per_segment = blocks_per_segment
 	log.segmentsize = log.blocks_per_segment * log.blocksize
 
-	// For DirectIO
-	if usedirectio {
-		log.fp, err = openFile(logfile, OSSYNC|os.O_RDWR|os.O_EXCL, os.ModePerm)
-	} else {
-		log.fp, err = openFile(logfile, os.O_RDWR|os.O_EXCL, os.ModePerm)
-	}
-	if err != nil {
-		return nil, 0, err
+	// Segments are written whole, so they must be aligned to the
+	// device.  Reads of blocks smaller than the alignment are done
+	// through a bounce buffer.
+	log.alignment = 1
+	if alignment := dev.Alignment(); alignment > 1 {
+		if log.segmentsize%alignment != 0 {
+			return nil, 0, ErrLogAlignment
+		}
+		log.alignment = int(alignment)
 	}
 
 	// Determine cache size
 	var size int64
-	size, err = log.fp.Seek(0, os.SEEK_END)
+	size, err = dev.Size()
 	if err != nil {
 		return nil, 0, err
 	}
-	if size == 0 {
-		return nil, 0, ErrLogTooSmall
-	}
-	blocks := size / int64(blocksize)
-	if logMaxBlocks <= blocks {
-		return nil, 0, ErrLogTooLarge
+	log.ratio = ratio
+	log.numsegments, log.blocks, err = log.geometry(size)
+	if err != nil {
+		return nil, 0, err
 	}
-
-	// We have to make sure that the number of blocks requested
-	// fit into the segments tracked by the log
-	log.numsegments = uint32(blocks) / log.blocks_per_segment
-	log.size = uint64(log.numsegments) * uint64(log.segmentsize)
-
-	// maximum number of aligned blocks to segments
-	log.blocks = log.numsegments * log.blocks_per_segment
+	log.size = log.numsegments * uint64(log.segmentsize)
 
 	// Adjust the number of segment buffers
 	if log.numsegments < NumberSegmentBuffers {
@@ -148,10 +215,43 @@ func NewLog(logfile string,
 			log.blocksize, log.segmentsize, log.segmentbuffers, log.blocks,
 			log.blocks_per_segment, log.numsegments, log.size))
 
+	// When compressing, each segment may hold more than
+	// blocks_per_segment blocks
+	if ratio > 0 {
+		log.compression = true
+		log.extents = make([]LogExtent, log.blocks)
+		log.owners = make([][]uint64, log.numsegments)
+		log.compressbuf = make([]byte, log.blocksize)
+		log.compressor, err = flate.NewWriter(nil, flate.BestSpeed)
+		if err != nil {
+			return nil, 0, err
+		}
+	}
+
+	// One checksum per block, and the number of times each block
+	// has been written to tell reads of the previous data apart
+	log.checksums = make([]uint32, log.blocks)
+	log.generations = make([]uint32, log.blocks)
+
+	// Track the blocks used in each segment
+	log.livesegment = make([]uint64, log.blocks)
+	log.segmentlive = make([]uint32, log.numsegments)
+	log.segmentdiscarded = make([]bool, log.numsegments)
+
+	// Setup the buffer cache RAM tier if requested
+	if bcsize >= blocksize {
+		log.bc = NewBufferCache(bcsize, blocksize, log.stats)
+	}
+
+	// Used to read into caller buffers which are not aligned
+	log.bounces = NewBufferPool(int(log.segmentsize), log.alignment)
+
 	// Incoming message channel
 	log.Msgchan = make(chan *message.Message, 32)
 	log.quitchan = make(chan struct{})
 	log.logreaders = make(chan *message.Message, 32)
+	log.invalidations = make(chan logLostBlock, 1024)
+	log.resizes = make(chan *logResize)
 
 	// Segment channel state machine:
 	// 		-> Client writes available segment
@@ -165,7 +265,7 @@ func NewLog(logfile string,
 	// Set up each of the segments
 	log.segments = make([]IoSegment, log.segmentbuffers)
 	for i := 0; i < log.segmentbuffers; i++ {
-		log.segments[i].segmentbuf = make([]byte, log.segmentsize)
+		log.segments[i].segmentbuf = AlignedBuffer(int(log.segmentsize), log.alignment)
 		log.segments[i].data = bufferio.NewBufferIO(log.segments[i].segmentbuf)
 
 		// Fill ch available with all the available buffers
@@ -194,25 +294,159 @@ func NewLog(logfile string,
 func (c *Log) logread() {
 	defer c.wg.Done()
 	for m := range c.logreaders {
-		iopkt := m.IoPkt()
-		offset := c.offset(iopkt.LogBlock)
+		c.resizelock.RLock()
+		c.logreadBlocks(m)
+		c.resizelock.RUnlock()
 
-		// Read from storage
-		start := time.Now()
-		n, err := c.fp.ReadAt(iopkt.Buffer, offset)
-		end := time.Now()
-		c.stats.ReadTimeRecord(end.Sub(start))
+		// Return to caller
+		m.Done()
+	}
+}
 
-		godbc.Check(n == len(iopkt.Buffer))
-		godbc.Check(err == nil)
-		c.stats.StorageHit()
+// Reads the blocks of the message from storage.  Must be
+// called with the resizelock held.
+func (c *Log) logreadBlocks(m *message.Message) {
+	iopkt := m.IoPkt()
+	if !c.inLog(iopkt.LogBlock, iopkt.Blocks) {
+		m.SetErr(ErrLogResized)
+		return
+	}
 
-		// Save in buffer cache
-		//c.bc.Set(offset, iopkt.Buffer)
+	if c.compression {
+		c.logreadCompressed(m)
+		return
+	}
 
-		// Return to caller
-		m.Done()
+	offset := c.offset(iopkt.LogBlock)
+
+	// Read from storage
+	buf, bufoffset := c.bounce(iopkt.Buffer, offset)
+	start := time.Now()
+	n, err := c.dev.ReadAt(buf, bufoffset)
+	end := time.Now()
+	c.stats.ReadTimeRecord(end.Sub(start))
+
+	godbc.Check(n == len(buf))
+	godbc.Check(err == nil)
+	c.stats.StorageHit()
+	c.unbounce(iopkt.Buffer, offset, buf, bufoffset)
+
+	states := m.Priv.([]logBlockState)
+	for block := uint32(0); block < iopkt.Blocks; block++ {
+		index := iopkt.LogBlock + uint64(block)
+		buf := SubBlockBuffer(iopkt.Buffer, c.blocksize, block, 1)
+		state := states[block]
+
+		// The data read may belong to the next owner of the block
+		if c.overwritten(index, state) {
+			m.SetErr(ErrBlockOverwritten)
+			continue
+		}
+
+		// Do not return or promote corrupted data
+		if err := c.readable(buf, index, iopkt.Devid, state); err != nil {
+			m.SetErr(err)
+			continue
+		}
+
+		// Promote hot blocks to the buffer cache
+		if c.bc != nil {
+			c.bc.StorageHit(index, buf, func() bool {
+				return !c.overwritten(index, state)
+			})
+		}
+	}
+}
+
+// State of a log block when a read of it was sent to storage.  The
+// data read is checked against the checksum of the block at the
+// time, since the block may be written again before the read is
+// done.
+type logBlockState struct {
+	generation uint32
+	checksum   uint32
+	unchecked  bool
+	keyid      uint32
+}
+
+// Returns the state of the log block to check the data read from
+// storage against.  Must be called from the server goroutine.
+func (c *Log) blockState(index uint64) logBlockState {
+	state := logBlockState{
+		generation: atomic.LoadUint32(&c.generations[index]),
+		checksum:   atomic.LoadUint32(&c.checksums[index]),
+		unchecked:  c.unchecked != nil && c.unchecked[index],
 	}
+	if c.keyids != nil {
+		state.keyid = c.keyids[index]
+	}
+	return state
+}
+
+// Saves the checksum of the data written to the log block.  Must be
+// called from the server goroutine.
+func (c *Log) setChecksum(index uint64, buffer []byte) {
+	atomic.StoreUint32(&c.checksums[index], Checksum(buffer))
+	if c.unchecked != nil {
+		c.unchecked[index] = false
+	}
+}
+
+// True if the log block was written or freed after its state
+// was taken
+func (c *Log) overwritten(index uint64, state logBlockState) bool {
+	return atomic.LoadUint32(&c.generations[index]) != state.generation
+}
+
+// Same as overwritten() but may be called from any goroutine
+func (c *Log) unchanged(index uint64, generation uint32) bool {
+	c.discardlock.Lock()
+	defer c.discardlock.Unlock()
+
+	return index < uint64(len(c.generations)) &&
+		atomic.LoadUint32(&c.generations[index]) == generation
+}
+
+// Returns the buffer and device offset to use to read into the caller
+// buffer from the offset.  If either is not aligned, a bounce buffer
+// covering the aligned region of the device is returned instead.
+func (c *Log) bounce(buffer []byte, offset int64) ([]byte, int64) {
+	alignment := int64(c.alignment)
+	start := offset - offset%alignment
+	end := offset + int64(len(buffer))
+	if rem := end % alignment; rem != 0 {
+		end += alignment - rem
+	}
+
+	if start == offset &&
+		end == offset+int64(len(buffer)) &&
+		alignedAddress(buffer, c.alignment) {
+		return buffer, offset
+	}
+
+	c.stats.Bounce()
+	if end-start <= int64(c.bounces.Size()) {
+		return c.bounces.Get()[:end-start], start
+	}
+	return AlignedBuffer(int(end-start), c.alignment), start
+}
+
+// Copies the data read into the bounce buffer to the caller buffer
+func (c *Log) unbounce(buffer []byte, offset int64, bounce []byte, start int64) {
+	if &buffer[0] == &bounce[0] {
+		return
+	}
+
+	copy(buffer, bounce[offset-start:])
+	if cap(bounce) == c.bounces.Size() {
+		c.bounces.Put(bounce[:cap(bounce)])
+	}
+}
+
+// Alignment in bytes which buffers must have to avoid being
+// copied through a bounce buffer.  See AlignedBuffer().
+func (c *Log) Alignment() int {
+	return c.alignment
 }
 
 func (c *Log) server() {
@@ -230,12 +464,25 @@ func (c *Log) server() {
 
 		select {
 		case msg := <-c.Msgchan:
-			switch msg.Type {
-			case message.MsgPut:
+			switch {
+			case msg.Type == message.MsgPut && c.compression:
+				c.putCompressed(msg)
+			case msg.Type == message.MsgGet && c.compression:
+				c.getCompressed(msg)
+			case msg.Type == message.MsgPut:
 				c.put(msg)
-			case message.MsgGet:
+			case msg.Type == message.MsgGet:
 				c.get(msg)
+			case msg.Type == message.MsgInvalidateRange,
+				msg.Type == message.MsgInvalidateDevice:
+				// Blocks invalidated by the cache map are
+				// released through Free()
+				msg.Done()
 			}
+		case resize := <-c.resizes:
+			var err error
+			resize.blocks, err = c.resize(resize.size)
+			resize.done <- err
 		case <-c.quitchan:
 			// :TODO: Ok for now, but we cannot just quit
 			// We need to empty the Iochan
@@ -254,11 +501,15 @@ func (c *Log) server() {
 func (c *Log) writer() {
 	defer c.wg.Done()
 	for s := range c.chwriting {
-		if s.written {
+		c.resizelock.RLock()
+
+		// Segments past the end of a resized log are not written
+		if s.written && uint64(s.offset) < c.size {
 			start := time.Now()
-			n, err := c.fp.WriteAt(s.segmentbuf, s.offset)
+			c.devlock.Lock()
+			n, err := c.dev.WriteAt(s.segmentbuf, s.offset)
+			c.devlock.Unlock()
 			end := time.Now()
-			s.written = false
 
 			c.stats.WriteTimeRecord(end.Sub(start))
 			godbc.Check(n == len(s.segmentbuf))
@@ -266,6 +517,9 @@ func (c *Log) writer() {
 		} else {
 			c.stats.SegmentSkipped()
 		}
+		s.written = false
+
+		c.resizelock.RUnlock()
 		c.chreader <- s
 	}
 	close(c.chreader)
@@ -280,6 +534,7 @@ func (c *Log) reader() {
 		s.data.Reset()
 
 		// Move to the next offset
+		c.resizelock.RLock()
 		c.current += 1
 		c.current = c.current % c.numsegments
 
@@ -291,12 +546,13 @@ func (c *Log) reader() {
 
 		if c.wrapped {
 			start := time.Now()
-			n, err := c.fp.ReadAt(s.segmentbuf, s.offset)
+			n, err := c.dev.ReadAt(s.segmentbuf, s.offset)
 			end := time.Now()
 			c.stats.SegmentReadTimeRecord(end.Sub(start))
 			godbc.Check(n == len(s.segmentbuf))
 			godbc.Check(err == nil)
 		}
+		c.resizelock.RUnlock()
 
 		s.lock.Unlock()
 
@@ -313,12 +569,12 @@ func (c *Log) sync() {
 }
 
 // Returns the offset in bytes
-func (c *Log) offset(index uint32) int64 {
+func (c *Log) offset(index uint64) int64 {
 	return int64(index) * int64(c.blocksize)
 }
 
 // Determines if the index is in the specified segment
-func (c *Log) inRange(index uint32, s *IoSegment) bool {
+func (c *Log) inRange(index uint64, s *IoSegment) bool {
 	offset := c.offset(index)
 
 	return ((offset >= s.offset) &&
@@ -328,7 +584,13 @@ func (c *Log) inRange(index uint32, s *IoSegment) bool {
 func (c *Log) put(msg *message.Message) error {
 
 	iopkt := msg.IoPkt()
-	godbc.Require(iopkt.LogBlock < c.blocks)
+	godbc.Require(uint32(len(iopkt.Buffer)) == c.blocksize)
+
+	if !c.inLog(iopkt.LogBlock, 1) {
+		msg.SetErr(ErrLogResized)
+		msg.Done()
+		return ErrLogResized
+	}
 
 	// Make sure the block number curresponds to the
 	// current segment.  If not, c.sync() will place
@@ -340,12 +602,35 @@ func (c *Log) put(msg *message.Message) error {
 	// get log offset
 	offset := c.offset(iopkt.LogBlock)
 
+	// Make sure we can encrypt it before placing it in the log
+	if c.keys != nil {
+		if _, err := c.cipher(iopkt.Devid); err != nil {
+			c.lost(iopkt.LogBlock, c.blockState(iopkt.LogBlock))
+			msg.SetErr(err)
+			msg.Done()
+			return err
+		}
+	}
+
 	// Write to current buffer
 	n, err := c.segment.data.WriteAt(iopkt.Buffer, offset-c.segment.offset)
 	godbc.Check(n == len(iopkt.Buffer))
 	godbc.Check(err == nil)
 
+	err = c.encrypt(c.segment.segmentbuf[offset-c.segment.offset:][:n],
+		iopkt.LogBlock, iopkt.Devid)
+	godbc.Check(err == nil)
+
 	c.segment.written = true
+	c.setChecksum(iopkt.LogBlock, iopkt.Buffer)
+	c.used(iopkt.LogBlock, c.segmentNumber(c.segment))
+
+	// The buffer cache copy is now stale.  The generation must change
+	// first so that reads still in flight do not promote the old data.
+	atomic.AddUint32(&c.generations[iopkt.LogBlock], 1)
+	if c.bc != nil {
+		c.bc.Invalidate(iopkt.LogBlock)
+	}
 
 	// We have written the data, and we are done with the message
 	msg.Done()
@@ -360,16 +645,34 @@ func (c *Log) get(msg *message.Message) error {
 
 	defer msg.Done()
 	iopkt := msg.IoPkt()
+	godbc.Require(uint32(len(iopkt.Buffer)) == iopkt.Blocks*c.blocksize)
+
+	if !c.inLog(iopkt.LogBlock, iopkt.Blocks) {
+		msg.SetErr(ErrLogResized)
+		return ErrLogResized
+	}
 
 	var readmsg *message.Message
 	var readmsg_block uint32
 	for block := uint32(0); block < iopkt.Blocks; block++ {
 		ramhit := false
-		index := iopkt.LogBlock + block
+		index := iopkt.LogBlock + uint64(block)
 		offset := c.offset(index)
 
+		// Check the buffer cache RAM tier first
+		if c.bc != nil &&
+			c.bc.Get(index, SubBlockBuffer(iopkt.Buffer, c.blocksize, block, 1)) {
+			ramhit = true
+			c.stats.BufferHit()
+			if !c.verify(index, SubBlockBuffer(iopkt.Buffer, c.blocksize, block, 1),
+				c.blockState(index)) {
+				c.bc.Invalidate(index)
+				msg.SetErr(ErrChecksum)
+			}
+		}
+
 		// Check if the data is in RAM.  Go through each buffered segment
-		for i := 0; i < c.segmentbuffers; i++ {
+		for i := 0; !ramhit && i < c.segmentbuffers; i++ {
 
 			c.segments[i].lock.RLock()
 			if c.inRange(index, &c.segments[i]) {
@@ -381,6 +684,12 @@ func (c *Log) get(msg *message.Message) error {
 				godbc.Check(err == nil, err, block, offset, i)
 				godbc.Check(uint32(n) == c.blocksize)
 				c.stats.RamHit()
+
+				err = c.readable(SubBlockBuffer(iopkt.Buffer, c.blocksize, block, 1),
+					index, iopkt.Devid, c.blockState(index))
+				if err != nil {
+					msg.SetErr(err)
+				}
 			}
 			c.segments[i].lock.RUnlock()
 		}
@@ -389,8 +698,11 @@ func (c *Log) get(msg *message.Message) error {
 		if !ramhit {
 			if readmsg == nil {
 				readmsg = message.NewMsgGet()
+				readmsg.Priv = make([]logBlockState, 0, iopkt.Blocks-block)
 				msg.Add(readmsg)
 				io := readmsg.IoPkt()
+				io.Devid = iopkt.Devid
+				io.Address = iopkt.Address + uint64(block)
 				io.LogBlock = index
 				io.Blocks = 1
 				readmsg_block = block
@@ -398,6 +710,7 @@ func (c *Log) get(msg *message.Message) error {
 				readmsg.IoPkt().Blocks++
 			}
 
+			readmsg.Priv = append(readmsg.Priv.([]logBlockState), c.blockState(index))
 			io := readmsg.IoPkt()
 			io.Buffer = SubBlockBuffer(iopkt.Buffer,
 				c.blocksize,
@@ -420,14 +733,86 @@ func (c *Log) get(msg *message.Message) error {
 	return nil
 }
 
+// Checks the data read against the checksum in the state of the
+// block when it was read.  Blocks loaded from metadata saved without
+// checksums are not checked until they are written again.  On a
+// mismatch the block is reported as corrupted and the invalidator,
+// if set, is notified.
+func (c *Log) verify(index uint64, buffer []byte, state logBlockState) bool {
+	if state.unchecked || Checksum(buffer) == state.checksum {
+		return true
+	}
+
+	c.stats.Corruption()
+	c.lost(index, state)
+
+	return false
+}
+
+// Decrypts and verifies a block read from the log
+func (c *Log) readable(buffer []byte, index uint64, devid uint32, state logBlockState) error {
+	if err := c.decrypt(buffer, index, devid, state); err != nil {
+		return err
+	}
+	if !c.verify(index, buffer, state) {
+		return ErrChecksum
+	}
+
+	return nil
+}
+
+// Log block reported to the invalidator, with the generation
+// of the block when it was found to be lost
+type logLostBlock struct {
+	index      uint64
+	generation uint32
+}
+
+// Reports to the invalidator that the block can no longer be read
+// from the log.  It does not block the I/O path waiting for the
+// invalidator.  If the block is not invalidated now, it will be
+// on the next read.
+func (c *Log) lost(index uint64, state logBlockState) {
+	select {
+	case c.invalidations <- logLostBlock{index: index, generation: state.generation}:
+	default:
+	}
+}
+
+func (c *Log) invalidate() {
+	defer c.invalidatorwg.Done()
+	for lb := range c.invalidations {
+		if c.invalidator != nil {
+			lb := lb
+			c.invalidator(lb.index, func() bool {
+				return c.unchanged(lb.index, lb.generation)
+			})
+		}
+	}
+}
+
+// Sets the function called with the log block number of blocks which
+// can no longer be used.  It is called from its own goroutine, so it
+// may safely send messages to the log.  The block may have been
+// written or freed since it was reported, so the invalidator must
+// check that current() still returns true while the block cannot
+// be reused.  Must be called before Start().
+func (c *Log) SetInvalidator(invalidator func(index uint64, current func() bool)) {
+	c.invalidator = invalidator
+}
+
 func (c *Log) Close() {
 
 	// Shut down server first
 	close(c.quitchan)
 	c.wg.Wait()
 
+	// Now that all the readers are done, shut down the invalidator
+	close(c.invalidations)
+	c.invalidatorwg.Wait()
+
 	// Close the storage
-	c.fp.Close()
+	c.dev.Close()
 
 	c.closed = true
 }
@@ -450,17 +835,86 @@ func (l *Log) Save() (*LogSave, error) {
 
 	ls.Size = l.size
 	ls.Wrapped = l.wrapped
+	ls.Checksums = l.checksums
+	ls.Unchecked = l.unchecked
+	ls.KeyIds = l.keyids
+	ls.Extents = l.extents
+	ls.Current = l.current
+	ls.Cursor = l.cursor
 
 	return ls, nil
 }
 
-func (l *Log) Load(ls *LogSave, blocknum uint32) error {
-	if ls.Size != l.size {
+func (l *Log) Load(ls *LogSave, blocknum uint64) error {
+	// The log may have been resized since the metadata was saved
+	numsegments, blocks, err := l.geometry(int64(ls.Size))
+	if err != nil || numsegments == 0 {
 		return errors.New("Loaded log metadata does not equal to current state")
 	}
 
+	// Metadata saved before block checksums were added has none
+	legacy := len(ls.Checksums) == 0
+	if !legacy && uint64(len(ls.Checksums)) != blocks {
+		return errors.New("Loaded log metadata does not contain block checksums")
+	}
+	if ls.Unchecked != nil && uint64(len(ls.Unchecked)) != blocks {
+		return errors.New("Loaded log metadata does not contain unchecked blocks")
+	}
+	if ls.KeyIds != nil && uint64(len(ls.KeyIds)) != blocks {
+		return errors.New("Loaded log metadata does not contain block key ids")
+	}
+
+	if l.compression && uint64(len(ls.Extents)) != blocks {
+		return errors.New("Loaded log metadata does not contain compressed block locations")
+	}
+
 	l.wrapped = ls.Wrapped
-	l.current = blocknum / l.blocks_per_segment
+	if legacy {
+		l.checksums = make([]uint32, blocks)
+		l.unchecked = make([]bool, blocks)
+		for index := range l.unchecked {
+			l.unchecked[index] = true
+		}
+	} else {
+		l.checksums = ls.Checksums
+		l.unchecked = ls.Unchecked
+	}
+
+	// Keys of blocks saved without key ids are not known
+	if ls.KeyIds != nil {
+		l.keyids = ls.KeyIds
+	} else if l.keyids != nil {
+		l.keyids = make([]uint32, blocks)
+	}
+	l.livesegment = make([]uint64, blocks)
+	l.segmentlive = make([]uint32, numsegments)
+	l.segmentdiscarded = make([]bool, numsegments)
+	if l.compression {
+		l.extents = ls.Extents
+		l.current = ls.Current
+		l.cursor = ls.Cursor
+		l.owners = make([][]uint64, numsegments)
+		for index, extent := range l.extents {
+			if extent.Length != 0 {
+				l.owners[extent.Segment] = append(l.owners[extent.Segment], uint64(index))
+			}
+		}
+	} else {
+		l.current = blocknum / uint64(l.blocks_per_segment)
+	}
+
+	// Adjust the loaded metadata to the size of the log
+	current, currentblocks := l.numsegments, l.blocks
+	l.numsegments = numsegments
+	l.resizeMetadata(current, currentblocks)
+	if l.current >= l.numsegments {
+		// Continue from the start of the log.  When compressing, the
+		// full cursor moves the first put to the next segment.
+		l.current = l.numsegments - 1
+		if l.compression {
+			l.cursor = l.segmentsize
+		}
+	}
 
 	return nil
 }
@@ -480,7 +934,7 @@ func (l *Log) Start() {
 	l.segment = <-l.chreader
 	l.segment.offset = int64(l.current) * int64(l.segmentsize)
 	if l.wrapped {
-		n, err := l.fp.ReadAt(l.segment.segmentbuf, l.segment.offset)
+		n, err := l.dev.ReadAt(l.segment.segmentbuf, l.segment.offset)
 		godbc.Check(n == len(l.segment.segmentbuf), n)
 		godbc.Check(err == nil)
 	}
@@ -495,4 +949,12 @@ func (l *Log) Start() {
 	go l.writer()
 	go l.reader()
 	l.wg.Add(3)
+
+	l.invalidatorwg.Add(1)
+	go l.invalidate()
+
+	if discarder, ok := l.dev.(Discarder); ok && l.discardrate > 0 {
+		l.wg.Add(1)
+		go l.discarder(discarder)
+	}
 }
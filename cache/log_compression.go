@@ -0,0 +1,305 @@
+//
+// Copyright (c) 2014 The pblcache Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package cache
+
+import (
+	"bytes"
+	"compress/flate"
+	"github.com/lpabon/godbc"
+	"github.com/pblcache/pblcache/message"
+	"io"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Location of a compressed block in the log.  When compression
+// is enabled, segments hold a variable number of blocks, so each
+// log block index is mapped to the segment, offset in the segment,
+// and length of its data.  A Length equal to the block size means
+// the data did not compress and was stored as is.  A Length of
+// zero means the block is not on the log.
+type LogExtent struct {
+	Segment uint64
+	Offset  uint32
+	Length  uint32
+}
+
+var (
+	decompressors = sync.Pool{
+		New: func() interface{} {
+			return flate.NewReader(bytes.NewReader(nil))
+		},
+	}
+)
+
+// Compresses the block into dst.  If the block does not compress,
+// it is copied as is.  Returns the number of bytes used in dst.
+func (c *Log) compress(dst, block []byte) int {
+	var out bytes.Buffer
+
+	c.compressor.Reset(&out)
+	c.compressor.Write(block)
+	c.compressor.Close()
+
+	// Encrypted data must be a multiple of the cipher block size
+	length := out.Len()
+	if c.keys != nil && length%xtsBlockSize != 0 {
+		length += xtsBlockSize - length%xtsBlockSize
+	}
+
+	if length >= len(block) {
+		return copy(dst, block)
+	}
+	n := copy(dst, out.Bytes())
+	for ; n < length; n++ {
+		dst[n] = 0
+	}
+	return length
+}
+
+// Decompresses src into block
+func (c *Log) decompress(block, src []byte) error {
+	if len(src) == len(block) {
+		copy(block, src)
+		return nil
+	}
+
+	r := decompressors.Get().(io.ReadCloser)
+	defer decompressors.Put(r)
+	r.(flate.Resetter).Reset(bytes.NewReader(src), nil)
+
+	_, err := io.ReadFull(r, block)
+	return err
+}
+
+// Decrypts and decompresses the data read from the log into block
+// and verifies it.  Data is decrypted in place.
+func (c *Log) inflate(block, data []byte,
+	index uint64,
+	devid uint32,
+	state logBlockState) error {
+
+	if err := c.decrypt(data, index, devid, state); err != nil {
+		return err
+	}
+	if err := c.decompress(block, data); err != nil || !c.verify(index, block, state) {
+		return ErrChecksum
+	}
+
+	return nil
+}
+
+// Marks all log blocks stored in the segment as overwritten.
+// Must be called before the segment is written to again.
+func (c *Log) reclaimSegment(segment uint64) {
+	for _, index := range c.owners[segment] {
+		if c.extents[index].Segment == segment && c.extents[index].Length != 0 {
+			c.extents[index].Length = 0
+
+			// The block is no longer on the log
+			c.Free(index)
+			c.lost(index, c.blockState(index))
+		}
+	}
+	c.owners[segment] = c.owners[segment][:0]
+}
+
+func (c *Log) segmentNumber(s *IoSegment) uint64 {
+	return uint64(s.offset / int64(c.segmentsize))
+}
+
+func (c *Log) putCompressed(msg *message.Message) error {
+
+	iopkt := msg.IoPkt()
+	godbc.Require(uint32(len(iopkt.Buffer)) == c.blocksize)
+
+	if !c.inLog(iopkt.LogBlock, 1) {
+		msg.SetErr(ErrLogResized)
+		msg.Done()
+		return ErrLogResized
+	}
+
+	length := uint32(c.compress(c.compressbuf, iopkt.Buffer))
+	if err := c.encrypt(c.compressbuf[:length], iopkt.LogBlock, iopkt.Devid); err != nil {
+		c.lost(iopkt.LogBlock, c.blockState(iopkt.LogBlock))
+		msg.SetErr(err)
+		msg.Done()
+		return err
+	}
+
+	// Move to the next segment if it does not fit in
+	// the current one
+	if c.cursor+length > c.segmentsize {
+		c.sync()
+		c.cursor = 0
+		c.reclaimSegment(c.segmentNumber(c.segment))
+	}
+
+	// Write to current buffer
+	n, err := c.segment.data.WriteAt(c.compressbuf[:length], int64(c.cursor))
+	godbc.Check(n == int(length))
+	godbc.Check(err == nil)
+
+	segment := c.segmentNumber(c.segment)
+	c.extents[iopkt.LogBlock] = LogExtent{
+		Segment: segment,
+		Offset:  c.cursor,
+		Length:  length,
+	}
+	c.owners[segment] = append(c.owners[segment], iopkt.LogBlock)
+	c.cursor += length
+	c.used(iopkt.LogBlock, segment)
+
+	c.segment.written = true
+	c.setChecksum(iopkt.LogBlock, iopkt.Buffer)
+	c.stats.Compressed(c.blocksize, length)
+
+	// The buffer cache copy is now stale
+	atomic.AddUint32(&c.generations[iopkt.LogBlock], 1)
+	if c.bc != nil {
+		c.bc.Invalidate(iopkt.LogBlock)
+	}
+
+	msg.Done()
+
+	return nil
+}
+
+func (c *Log) getCompressed(msg *message.Message) error {
+
+	defer msg.Done()
+	iopkt := msg.IoPkt()
+
+	if !c.inLog(iopkt.LogBlock, iopkt.Blocks) {
+		msg.SetErr(ErrLogResized)
+		return ErrLogResized
+	}
+
+	for block := uint32(0); block < iopkt.Blocks; block++ {
+		index := iopkt.LogBlock + uint64(block)
+		buf := SubBlockBuffer(iopkt.Buffer, c.blocksize, block, 1)
+		extent := c.extents[index]
+
+		if extent.Length == 0 {
+			msg.SetErr(ErrBlockOverwritten)
+			continue
+		}
+
+		// Check the buffer cache RAM tier first
+		if c.bc != nil && c.bc.Get(index, buf) {
+			c.stats.BufferHit()
+			if !c.verify(index, buf, c.blockState(index)) {
+				c.bc.Invalidate(index)
+				msg.SetErr(ErrChecksum)
+			}
+			continue
+		}
+
+		// Check if the data is in RAM.  Go through each buffered segment
+		ramhit := false
+		for i := 0; !ramhit && i < c.segmentbuffers; i++ {
+			s := &c.segments[i]
+
+			s.lock.RLock()
+			if c.segmentNumber(s) == extent.Segment {
+				ramhit = true
+				c.stats.RamHit()
+
+				data := make([]byte, extent.Length)
+				copy(data, s.segmentbuf[extent.Offset:extent.Offset+extent.Length])
+				if err := c.inflate(buf, data, index, iopkt.Devid, c.blockState(index)); err != nil {
+					msg.SetErr(err)
+				}
+			}
+			s.lock.RUnlock()
+		}
+
+		// Read it from storage
+		if !ramhit {
+			readmsg := message.NewMsgGet()
+			msg.Add(readmsg)
+			readmsg.Priv = &compressedRead{
+				extent: extent,
+				state:  c.blockState(index),
+			}
+
+			io := readmsg.IoPkt()
+			io.Devid = iopkt.Devid
+			io.Address = iopkt.Address + uint64(block)
+			io.LogBlock = index
+			io.Buffer = buf
+
+			c.logreaders <- readmsg
+		}
+	}
+
+	return nil
+}
+
+// Location and state of a compressed block read from storage
+type compressedRead struct {
+	extent LogExtent
+	state  logBlockState
+}
+
+// Called by the log readers to read a compressed block from storage
+func (c *Log) logreadCompressed(m *message.Message) {
+	iopkt := m.IoPkt()
+	read := m.Priv.(*compressedRead)
+	extent := read.extent
+
+	// Read whole blocks so that the read is aligned
+	unit := int64(c.blocksize)
+	if int64(c.alignment) > unit {
+		unit = int64(c.alignment)
+	}
+	offset := int64(extent.Segment)*int64(c.segmentsize) + int64(extent.Offset)
+	start := offset - (offset % unit)
+	end := offset + int64(extent.Length)
+	if rem := end % unit; rem != 0 {
+		end += unit - rem
+	}
+	buf := AlignedBuffer(int(end-start), c.alignment)
+
+	readstart := time.Now()
+	n, err := c.dev.ReadAt(buf, start)
+	c.stats.ReadTimeRecord(time.Now().Sub(readstart))
+
+	godbc.Check(n == len(buf))
+	godbc.Check(err == nil)
+	c.stats.StorageHit()
+
+	// The segment may have been overwritten after the read
+	// was sent
+	if c.overwritten(iopkt.LogBlock, read.state) {
+		m.SetErr(ErrBlockOverwritten)
+		return
+	}
+
+	data := buf[offset-start : offset-start+int64(extent.Length)]
+	if err := c.inflate(iopkt.Buffer, data, iopkt.LogBlock, iopkt.Devid, read.state); err != nil {
+		m.SetErr(err)
+		return
+	}
+
+	if c.bc != nil {
+		c.bc.StorageHit(iopkt.LogBlock, iopkt.Buffer, func() bool {
+			return !c.overwritten(iopkt.LogBlock, read.state)
+		})
+	}
+}
@@ -0,0 +1,226 @@
+//
+// Copyright (c) 2014 The pblcache Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package cache
+
+import (
+	"github.com/pblcache/pblcache/message"
+	"github.com/pblcache/pblcache/tests"
+	"math/rand"
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestNewCompressedLog(t *testing.T) {
+	testcachefile := tests.Tempfile()
+	tests.Assert(t, nil == tests.CreateFile(testcachefile, 16*4096))
+	defer os.Remove(testcachefile)
+
+	l, blocks, err := NewCompressedLog(testcachefile, 4096, 4, 0, false, 4)
+	tests.Assert(t, err == nil)
+	tests.Assert(t, l != nil)
+	tests.Assert(t, l.compression == true)
+	tests.Assert(t, blocks == 16*4)
+	tests.Assert(t, len(l.extents) == 16*4)
+	tests.Assert(t, len(l.owners) == 4)
+	l.Close()
+}
+
+func TestCompressedLogReadWrite(t *testing.T) {
+	// 64 blocks in the log, but up to 256 blocks
+	// can be stored when compressed
+	testcachefile := tests.Tempfile()
+	tests.Assert(t, nil == tests.CreateFile(testcachefile, 64*4096))
+	defer os.Remove(testcachefile)
+
+	l, blocks, err := NewCompressedLog(testcachefile, 4096, 2, 0, false, 4)
+	tests.Assert(t, err == nil)
+	tests.Assert(t, blocks == 256)
+
+	invalidated := make(chan uint64, 1024)
+	l.SetInvalidator(func(index uint64, current func() bool) {
+		invalidated <- index
+	})
+	l.Start()
+
+	here := make(chan *message.Message)
+	put := func(index uint64, buf []byte) {
+		msg := message.NewMsgPut()
+		msg.RetChan = here
+		iopkt := msg.IoPkt()
+		iopkt.Buffer = buf
+		iopkt.LogBlock = index
+		l.Msgchan <- msg
+		<-here
+	}
+	get := func(index uint64) *message.Message {
+		msg := message.NewMsgGet()
+		msg.RetChan = here
+		iopkt := msg.IoPkt()
+		iopkt.Buffer = make([]byte, 4096)
+		iopkt.LogBlock = index
+		l.Msgchan <- msg
+		return <-here
+	}
+
+	// Compressible blocks.  All of them should fit in the log
+	for index := uint64(0); index < blocks; index++ {
+		buf := make([]byte, 4096)
+		buf[0] = byte(index)
+		buf[4095] = byte(index)
+		put(index, buf)
+	}
+	for index := uint64(0); index < blocks; index++ {
+		msg := get(index)
+		tests.Assert(t, msg.Err == nil)
+		tests.Assert(t, msg.IoPkt().Buffer[0] == byte(index))
+		tests.Assert(t, msg.IoPkt().Buffer[4095] == byte(index))
+	}
+	tests.Assert(t, len(invalidated) == 0)
+	tests.Assert(t, l.Stats().CompressionRatio() > 4.0)
+	tests.Assert(t, l.Stats().Corruptions == 0)
+
+	// Random data does not compress, so it will
+	// overwrite the compressed blocks
+	r := rand.New(rand.NewSource(1))
+	for index := uint64(0); index < 64; index++ {
+		buf := make([]byte, 4096)
+		r.Read(buf)
+		put(index, buf)
+	}
+	for index := uint64(0); index < 64; index++ {
+		msg := get(index)
+		tests.Assert(t, msg.Err == nil)
+	}
+
+	// The last compressed block was overwritten
+	msg := get(blocks - 1)
+	tests.Assert(t, msg.Err == ErrBlockOverwritten)
+	for index := range invalidated {
+		if index == blocks-1 {
+			break
+		}
+	}
+
+	l.Close()
+}
+
+func TestCompressedLogSaveLoad(t *testing.T) {
+	testcachefile := tests.Tempfile()
+	tests.Assert(t, nil == tests.CreateFile(testcachefile, 64*4096))
+	defer os.Remove(testcachefile)
+
+	l, blocks, err := NewCompressedLog(testcachefile, 4096, 2, 0, false, 4)
+	tests.Assert(t, err == nil)
+	l.Start()
+
+	here := make(chan *message.Message)
+	for index := uint64(0); index < blocks/2; index++ {
+		buf := make([]byte, 4096)
+		buf[0] = byte(index)
+
+		msg := message.NewMsgPut()
+		msg.RetChan = here
+		iopkt := msg.IoPkt()
+		iopkt.Buffer = buf
+		iopkt.LogBlock = index
+		l.Msgchan <- msg
+		<-here
+	}
+	l.Close()
+
+	save, err := l.Save()
+	tests.Assert(t, err == nil)
+	tests.Assert(t, len(save.Extents) == int(blocks))
+
+	// Load the metadata on a new log
+	l, blocks, err = NewCompressedLog(testcachefile, 4096, 2, 0, false, 4)
+	tests.Assert(t, err == nil)
+	err = l.Load(save, 0)
+	tests.Assert(t, err == nil)
+	tests.Assert(t, l.cursor == save.Cursor)
+	tests.Assert(t, l.current == save.Current)
+	l.Start()
+
+	for index := uint64(0); index < blocks/2; index++ {
+		msg := message.NewMsgGet()
+		msg.RetChan = here
+		iopkt := msg.IoPkt()
+		iopkt.Buffer = make([]byte, 4096)
+		iopkt.LogBlock = index
+		l.Msgchan <- msg
+		<-here
+
+		tests.Assert(t, msg.Err == nil)
+		tests.Assert(t, iopkt.Buffer[0] == byte(index))
+	}
+	l.Close()
+}
+
+func TestCompressedLogEncryption(t *testing.T) {
+	testcachefile := tests.Tempfile()
+	tests.Assert(t, nil == tests.CreateFile(testcachefile, 64*4096))
+	defer os.Remove(testcachefile)
+
+	keyfile := tests.Tempfile()
+	defer os.Remove(keyfile)
+	fp, err := os.Create(keyfile)
+	tests.Assert(t, err == nil)
+	fp.WriteString("0 " + strings.Repeat("ab", 32) + "\n")
+	fp.Close()
+	keys, err := NewKeyFile(keyfile)
+	tests.Assert(t, err == nil)
+
+	l, blocks, err := NewCompressedLog(testcachefile, 4096, 2, 0, false, 4)
+	tests.Assert(t, err == nil)
+	l.SetKeyProvider(keys)
+	l.Start()
+
+	here := make(chan *message.Message)
+	for index := uint64(0); index < blocks; index++ {
+		buf := make([]byte, 4096)
+		buf[0] = byte(index)
+
+		msg := message.NewMsgPut()
+		msg.RetChan = here
+		iopkt := msg.IoPkt()
+		iopkt.Buffer = buf
+		iopkt.LogBlock = index
+		l.Msgchan <- msg
+		<-here
+		tests.Assert(t, msg.Err == nil)
+
+		// Encrypted extents are a multiple of the cipher block size
+		tests.Assert(t, l.extents[index].Length%xtsBlockSize == 0)
+	}
+
+	for index := uint64(0); index < blocks; index++ {
+		msg := message.NewMsgGet()
+		msg.RetChan = here
+		iopkt := msg.IoPkt()
+		iopkt.Buffer = make([]byte, 4096)
+		iopkt.LogBlock = index
+		l.Msgchan <- msg
+		<-here
+
+		tests.Assert(t, msg.Err == nil)
+		tests.Assert(t, iopkt.Buffer[0] == byte(index))
+	}
+	tests.Assert(t, l.Stats().Corruptions == 0)
+
+	l.Close()
+}
@@ -0,0 +1,171 @@
+//
+// Copyright (c) 2014 The pblcache Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package cache
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// Number of times per second discards are issued
+	DiscardTicksPerSecond = 10
+)
+
+// Sets the maximum number of bytes per second which are discarded
+// from the log device.  Segments which no longer hold any blocks used
+// by the cache are discarded so that the storage device knows the
+// space is free.  A rate of zero, the default, disables discards.  It
+// has no effect if the log device is not a Discarder.  Must be called
+// before Start().
+func (c *Log) SetDiscardRate(bytespersecond uint64) {
+	c.discardrate = bytespersecond
+}
+
+// Notifies the log that the block is no longer used by the cache.  It
+// may be called from any goroutine.  Reads of the block still in
+// flight are treated as reads of an overwritten block, since the
+// segment may be discarded before they are done.
+func (c *Log) Free(index uint64) {
+	c.discardlock.Lock()
+	defer c.discardlock.Unlock()
+
+	if index < uint64(len(c.generations)) {
+		atomic.AddUint32(&c.generations[index], 1)
+	}
+	c.release(index)
+}
+
+// Marks the block as used by the segment.  Must be called
+// with the discardlock held.
+func (c *Log) use(index, segment uint64) {
+	if c.livesegment[index] == segment+1 {
+		return
+	}
+
+	c.release(index)
+	c.livesegment[index] = segment + 1
+	c.segmentlive[segment]++
+	c.segmentdiscarded[segment] = false
+}
+
+// Must be called with the discardlock held
+func (c *Log) release(index uint64) {
+	// The block may have been removed by a resize
+	if index >= uint64(len(c.livesegment)) || c.livesegment[index] == 0 {
+		return
+	}
+
+	segment := c.livesegment[index] - 1
+	c.livesegment[index] = 0
+	c.segmentlive[segment]--
+
+	if c.segmentlive[segment] == 0 &&
+		!c.segmentdiscarded[segment] &&
+		c.discardrate > 0 {
+		c.segmentdiscarded[segment] = true
+		c.discards = append(c.discards, segment)
+	}
+}
+
+func (c *Log) used(index, segment uint64) {
+	c.discardlock.Lock()
+	defer c.discardlock.Unlock()
+
+	c.use(index, segment)
+}
+
+// Returns the next segment to discard if it is still unused
+func (c *Log) nextDiscard() (uint64, bool) {
+	c.discardlock.Lock()
+	defer c.discardlock.Unlock()
+
+	for len(c.discards) > 0 {
+		segment := c.discards[0]
+		c.discards = c.discards[1:]
+
+		if c.segmentlive[segment] == 0 && c.segmentdiscarded[segment] {
+			return segment, true
+		}
+	}
+
+	return 0, false
+}
+
+func (c *Log) discarder(discarder Discarder) {
+	defer c.wg.Done()
+
+	ticker := time.NewTicker(time.Second / DiscardTicksPerSecond)
+	defer ticker.Stop()
+
+	// Number of bytes allowed to be discarded per tick
+	budget := c.discardrate / DiscardTicksPerSecond
+	if budget < uint64(c.segmentsize) {
+		budget = uint64(c.segmentsize)
+	}
+
+	for {
+		select {
+		case <-c.quitchan:
+			return
+		case <-ticker.C:
+		}
+
+		for discarded := uint64(0); discarded+uint64(c.segmentsize) <= budget; {
+			// Hold the device lock so that the discard is not
+			// reordered with a write of the same segment
+			var err error
+			c.devlock.Lock()
+			segment, ok := c.nextDiscard()
+			if ok {
+				err = discarder.Discard(int64(segment)*int64(c.segmentsize),
+					int64(c.segmentsize))
+			}
+			c.devlock.Unlock()
+
+			if !ok {
+				break
+			}
+
+			// Discards are only advisory.  Stop sending them
+			// if the device cannot handle them.
+			if err != nil {
+				return
+			}
+
+			discarded += uint64(c.segmentsize)
+			c.stats.Discarded(c.segmentsize)
+		}
+	}
+}
+
+// Marks a block loaded from saved metadata as used.  Returns false
+// if the block is no longer in the log.
+func (c *Log) reuse(index uint64) bool {
+	switch {
+	case index >= c.blocks:
+		return false
+	case !c.compression:
+		c.used(index, index/uint64(c.blocks_per_segment))
+	case c.extents[index].Length != 0:
+		c.used(index, c.extents[index].Segment)
+	default:
+		return false
+	}
+
+	return true
+}
@@ -0,0 +1,157 @@
+//
+// Copyright (c) 2014 The pblcache Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package cache
+
+import (
+	"bytes"
+	"github.com/pblcache/pblcache/message"
+	"github.com/pblcache/pblcache/tests"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestLogDiscard(t *testing.T) {
+	// 64 segments of 2 blocks
+	dev := NewMemoryLogDevice(128 * 4096)
+	l, blocks, err := NewLogFromDevice(dev, 4096, 2, 0, 0)
+	tests.Assert(t, err == nil)
+	tests.Assert(t, blocks == 128)
+	l.SetDiscardRate(1 * MB)
+	l.Start()
+
+	here := make(chan *message.Message)
+	for index := uint64(0); index < blocks; index++ {
+		m := message.NewMsgPut()
+		m.RetChan = here
+		io := m.IoPkt()
+		io.Buffer = bytes.Repeat([]byte{0xff}, 4096)
+		io.LogBlock = index
+		l.Msgchan <- m
+		<-here
+	}
+	for index := uint64(0); index < blocks; index++ {
+		tests.Assert(t, l.livesegment[index] == index/2+1)
+	}
+
+	// Wait for segment 0 to be written to the device
+	data := make([]byte, 2*4096)
+	for {
+		dev.ReadAt(data, 0)
+		if data[0] == 0xff {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	// Freeing only one block of the segment is not enough
+	l.Free(0)
+	tests.Assert(t, l.segmentlive[0] == 1)
+	time.Sleep(time.Second / DiscardTicksPerSecond * 2)
+	tests.Assert(t, l.Stats().Discardedbytes == 0)
+
+	// Freeing a block twice has no effect
+	l.Free(0)
+	tests.Assert(t, l.segmentlive[0] == 1)
+
+	l.Free(1)
+	tests.Assert(t, l.segmentlive[0] == 0)
+	for l.Stats().Discardedbytes == 0 {
+		time.Sleep(time.Millisecond)
+	}
+	tests.Assert(t, l.Stats().Discardedbytes == 2*4096)
+
+	dev.ReadAt(data, 0)
+	tests.Assert(t, bytes.Equal(data, make([]byte, 2*4096)))
+
+	// Using the segment again allows it to be discarded again
+	l.discardlock.Lock()
+	l.use(0, 0)
+	tests.Assert(t, !l.segmentdiscarded[0])
+	l.discardlock.Unlock()
+
+	l.Close()
+}
+
+func TestLogDiscardRate(t *testing.T) {
+	dev := NewMemoryLogDevice(128 * 4096)
+	l, blocks, err := NewLogFromDevice(dev, 4096, 2, 0, 0)
+	tests.Assert(t, err == nil)
+
+	// One segment per tick
+	l.SetDiscardRate(2 * 4096 * DiscardTicksPerSecond)
+
+	for index := uint64(0); index < blocks; index++ {
+		l.used(index, index/2)
+	}
+	l.Start()
+
+	for index := uint64(0); index < blocks; index++ {
+		l.Free(index)
+	}
+
+	// Only a few segments can be discarded in this time
+	time.Sleep(time.Second / DiscardTicksPerSecond * 3)
+	discarded := l.Stats().Discardedbytes
+	tests.Assert(t, discarded > 0)
+	tests.Assert(t, discarded <= 4*2*4096)
+
+	l.Close()
+}
+
+func TestLogDiscardDisabled(t *testing.T) {
+	l, blocks, err := NewLogFromDevice(NewMemoryLogDevice(16*4096), 4096, 2, 0, 0)
+	tests.Assert(t, err == nil)
+	l.Start()
+
+	for index := uint64(0); index < blocks; index++ {
+		l.used(index, index/2)
+		l.Free(index)
+	}
+	tests.Assert(t, len(l.discards) == 0)
+
+	l.Close()
+}
+
+func TestFileLogDeviceDiscard(t *testing.T) {
+	filename := tests.Tempfile()
+	tests.Assert(t, nil == tests.CreateFile(filename, 4*4096))
+	defer os.Remove(filename)
+
+	dev, err := OpenFileLogDevice(filename, false)
+	tests.Assert(t, err == nil)
+	defer dev.Close()
+
+	buf := bytes.Repeat([]byte{0xff}, 4*4096)
+	_, err = dev.WriteAt(buf, 0)
+	tests.Assert(t, err == nil)
+
+	err = dev.Discard(4096, 2*4096)
+	if err != nil {
+		t.Skipf("Filesystem does not support punching holes: %v", err)
+	}
+
+	_, err = dev.ReadAt(buf, 0)
+	tests.Assert(t, err == nil)
+	tests.Assert(t, buf[0] == 0xff)
+	tests.Assert(t, bytes.Equal(buf[4096:3*4096], make([]byte, 2*4096)))
+	tests.Assert(t, buf[3*4096] == 0xff)
+
+	size, err := dev.Size()
+	tests.Assert(t, err == nil)
+	tests.Assert(t, size == 4*4096)
+}
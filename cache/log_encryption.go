@@ -0,0 +1,130 @@
+//
+// Copyright (c) 2014 The pblcache Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package cache
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+)
+
+const (
+	// Hashed with the key to get the id of the key.  The id is saved
+	// next to the encrypted blocks, so it must not tell anything
+	// about the key.
+	keyIdLabel = "pblcache key id"
+)
+
+type logCipher struct {
+	key    []byte
+	id     uint32
+	cipher *XtsCipher
+}
+
+// Returns the id saved with the blocks encrypted with the key.  Zero
+// is used for blocks whose key is not known.
+func keyId(key []byte) uint32 {
+	sum := sha256.Sum256(append([]byte(keyIdLabel), key...))
+	id := binary.LittleEndian.Uint32(sum[:])
+	if id == 0 {
+		id = 1
+	}
+	return id
+}
+
+// Encrypts the blocks placed in the log with AES-XTS using the key
+// of the device of each block.  Blocks whose key has been removed
+// or changed can no longer be read and are reported to the
+// invalidator.  Changed keys are found using the id of the key saved
+// with each block, and are counted apart from corrupted blocks.
+// Must be called before Start().
+func (c *Log) SetKeyProvider(keys KeyProvider) {
+	c.keys = keys
+	c.ciphers = make(map[uint32]*logCipher)
+	if c.keyids == nil {
+		c.keyids = make([]uint32, c.blocks)
+	}
+}
+
+func (c *Log) cipher(devid uint32) (*logCipher, error) {
+	key, err := c.keys.Key(devid)
+	if err != nil {
+		return nil, err
+	}
+
+	c.cipherlock.Lock()
+	defer c.cipherlock.Unlock()
+
+	// Only create a new cipher if the key has changed
+	if lc, ok := c.ciphers[devid]; ok && bytes.Equal(lc.key, key) {
+		return lc, nil
+	}
+
+	x, err := NewXtsCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	lc := &logCipher{
+		key:    key,
+		id:     keyId(key),
+		cipher: x,
+	}
+	c.ciphers[devid] = lc
+
+	return lc, nil
+}
+
+// Encrypts the buffer in place for the specified log block, and
+// saves the id of the key used.  Must be called from the server
+// goroutine.
+func (c *Log) encrypt(buffer []byte, index uint64, devid uint32) error {
+	if c.keys == nil {
+		return nil
+	}
+
+	lc, err := c.cipher(devid)
+	if err != nil {
+		return err
+	}
+	lc.cipher.Encrypt(buffer, buffer, index)
+	c.keyids[index] = lc.id
+
+	return nil
+}
+
+// Decrypts the buffer in place for the specified log block.  If the
+// key is not available, or is not the key the block was encrypted
+// with, the block is reported to the invalidator.
+func (c *Log) decrypt(buffer []byte, index uint64, devid uint32, state logBlockState) error {
+	if c.keys == nil {
+		return nil
+	}
+
+	lc, err := c.cipher(devid)
+	if err != nil {
+		c.lost(index, state)
+		return err
+	}
+	if state.keyid != 0 && state.keyid != lc.id {
+		c.stats.KeyChange()
+		c.lost(index, state)
+		return ErrKeyChanged
+	}
+	lc.cipher.Decrypt(buffer, buffer, index)
+
+	return nil
+}
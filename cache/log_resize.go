@@ -0,0 +1,225 @@
+//
+// Copyright (c) 2014 The pblcache Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package cache
+
+import (
+	"errors"
+	"github.com/lpabon/godbc"
+)
+
+var (
+	ErrLogResized    = errors.New("Log block is beyond the end of the resized log")
+	ErrLogDeviceSize = errors.New("Log device is smaller than the requested size")
+)
+
+type logResize struct {
+	size   int64
+	blocks uint64
+	done   chan error
+}
+
+// Returns the number of segments and blocks which fit in size bytes
+func (c *Log) geometry(size int64) (numsegments, blocks uint64, err error) {
+	if size <= 0 {
+		return 0, 0, ErrLogTooSmall
+	}
+
+	devblocks := size / int64(c.blocksize)
+	logblocks := devblocks
+	if c.ratio > 0 {
+		logblocks *= int64(c.ratio)
+	}
+	if logMaxBlocks <= logblocks {
+		return 0, 0, ErrLogTooLarge
+	}
+
+	// We have to make sure that the number of blocks requested
+	// fit into the segments tracked by the log
+	numsegments = uint64(devblocks) / uint64(c.blocks_per_segment)
+
+	// maximum number of aligned blocks to segments
+	blocks = numsegments * uint64(c.blocks_per_segment)
+	if c.ratio > 0 {
+		blocks *= uint64(c.ratio)
+	}
+
+	return numsegments, blocks, nil
+}
+
+// Resizes the log to use size bytes of the log device while I/O
+// continues.  When growing, the device must already have been extended.
+// When shrinking, the blocks in the removed region must no longer be
+// used by the cache map, and the device may be truncated once Resize
+// returns.  Returns the new number of blocks in the log.  Resize()
+// can only be called after Start().  See also Resize() to resize both
+// the log and the cache map.
+func (c *Log) Resize(size int64) (uint64, error) {
+	r := &logResize{
+		size: size,
+		done: make(chan error, 1),
+	}
+
+	// The server goroutine resizes the log between messages
+	c.resizes <- r
+	err := <-r.done
+
+	return r.blocks, err
+}
+
+// Returns the number of blocks the log would have if resized
+func (c *Log) ResizeBlocks(size int64) (uint64, error) {
+	numsegments, blocks, err := c.geometry(size)
+	if err != nil {
+		return 0, err
+	}
+	if numsegments < uint64(c.segmentbuffers) {
+		return 0, ErrLogTooSmall
+	}
+
+	devsize, err := c.dev.Size()
+	if err != nil {
+		return 0, err
+	}
+	if devsize < size {
+		return 0, ErrLogDeviceSize
+	}
+
+	return blocks, nil
+}
+
+// Called by the server goroutine
+func (c *Log) resize(size int64) (uint64, error) {
+	blocks, err := c.ResizeBlocks(size)
+	if err != nil {
+		return 0, err
+	}
+	numsegments, _, _ := c.geometry(size)
+
+	// Blocks stored in the removed segments are no longer available
+	if c.compression {
+		for segment := numsegments; segment < c.numsegments; segment++ {
+			c.reclaimSegment(segment)
+		}
+	}
+
+	// Wait for the readers, the writer, and the discarder to be
+	// done with the current geometry
+	c.resizelock.Lock()
+	defer c.resizelock.Unlock()
+	c.devlock.Lock()
+	defer c.devlock.Unlock()
+	c.discardlock.Lock()
+	defer c.discardlock.Unlock()
+
+	c.resizeMetadata(numsegments, blocks)
+
+	// The segments past the end are never written.  Move the
+	// next segment to the start of the log.
+	if c.current >= numsegments {
+		c.current = numsegments - 1
+	}
+	if c.compression && c.segmentNumber(c.segment) >= numsegments {
+		c.cursor = c.segmentsize
+	}
+
+	return blocks, nil
+}
+
+// Adjusts the block and segment metadata to the new geometry.  Must
+// be called before Start() or with the resizelock, devlock, and
+// discardlock held.
+func (c *Log) resizeMetadata(numsegments, blocks uint64) {
+	godbc.Require(numsegments > 0)
+
+	checksums := make([]uint32, blocks)
+	copy(checksums, c.checksums)
+	c.checksums = checksums
+
+	generations := make([]uint32, blocks)
+	copy(generations, c.generations)
+	c.generations = generations
+
+	if c.unchecked != nil {
+		unchecked := make([]bool, blocks)
+		copy(unchecked, c.unchecked)
+		c.unchecked = unchecked
+	}
+
+	if c.keyids != nil {
+		keyids := make([]uint32, blocks)
+		copy(keyids, c.keyids)
+		c.keyids = keyids
+	}
+
+	livesegment := make([]uint64, blocks)
+	copy(livesegment, c.livesegment)
+	for index, segment := range livesegment {
+		if segment > numsegments {
+			livesegment[index] = 0
+		}
+	}
+	c.livesegment = livesegment
+
+	segmentlive := make([]uint32, numsegments)
+	copy(segmentlive, c.segmentlive)
+	c.segmentlive = segmentlive
+
+	segmentdiscarded := make([]bool, numsegments)
+	copy(segmentdiscarded, c.segmentdiscarded)
+	c.segmentdiscarded = segmentdiscarded
+
+	discards := c.discards[:0]
+	for _, segment := range c.discards {
+		if segment < numsegments {
+			discards = append(discards, segment)
+		}
+	}
+	c.discards = discards
+
+	if c.compression {
+		extents := make([]LogExtent, blocks)
+		copy(extents, c.extents)
+		for index := range extents {
+			if extents[index].Segment >= numsegments {
+				extents[index] = LogExtent{}
+			}
+		}
+		c.extents = extents
+
+		owners := make([][]uint64, numsegments)
+		copy(owners, c.owners)
+		for segment := range owners {
+			owners[segment] = owners[segment][:0]
+		}
+		for index, extent := range c.extents {
+			if extent.Length != 0 {
+				owners[extent.Segment] = append(owners[extent.Segment], uint64(index))
+			}
+		}
+		c.owners = owners
+	}
+
+	c.numsegments = numsegments
+	c.blocks = blocks
+	c.size = numsegments * uint64(c.segmentsize)
+}
+
+// Returns true if the blocks are in the log.  Messages sent before the
+// log was resized may refer to blocks which have been removed.
+func (c *Log) inLog(index uint64, blocks uint32) bool {
+	return index+uint64(blocks) <= c.blocks
+}
@@ -0,0 +1,167 @@
+//
+// Copyright (c) 2014 The pblcache Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package cache
+
+import (
+	"github.com/pblcache/pblcache/message"
+	"github.com/pblcache/pblcache/tests"
+	"os"
+	"testing"
+)
+
+func resizeTestLog(t *testing.T, l *Log) (func(index uint64) error,
+	func(index uint64) (byte, error)) {
+
+	here := make(chan *message.Message)
+	put := func(index uint64) error {
+		m := message.NewMsgPut()
+		m.RetChan = here
+		io := m.IoPkt()
+		io.Buffer = make([]byte, 4096)
+		io.Buffer[0] = byte(index)
+		io.LogBlock = index
+		l.Msgchan <- m
+		<-here
+		return m.Err
+	}
+	get := func(index uint64) (byte, error) {
+		m := message.NewMsgGet()
+		m.RetChan = here
+		io := m.IoPkt()
+		io.Buffer = make([]byte, 4096)
+		io.LogBlock = index
+		l.Msgchan <- m
+		<-here
+		return io.Buffer[0], m.Err
+	}
+
+	return put, get
+}
+
+func TestLogResize(t *testing.T) {
+	// 128 segments of 2 blocks
+	testcachefile := tests.Tempfile()
+	tests.Assert(t, nil == tests.CreateFile(testcachefile, 256*4096))
+	defer os.Remove(testcachefile)
+
+	l, blocks, err := NewLog(testcachefile, 4096, 2, 0, false)
+	tests.Assert(t, err == nil)
+	tests.Assert(t, blocks == 256)
+	l.Start()
+	defer l.Close()
+
+	put, get := resizeTestLog(t, l)
+	for index := uint64(0); index < blocks; index++ {
+		tests.Assert(t, put(index) == nil)
+	}
+
+	// The device must be extended before growing the log
+	_, err = l.Resize(512 * 4096)
+	tests.Assert(t, err == ErrLogDeviceSize)
+	tests.Assert(t, nil == os.Truncate(testcachefile, 512*4096))
+	blocks, err = l.Resize(512 * 4096)
+	tests.Assert(t, err == nil)
+	tests.Assert(t, blocks == 512)
+	tests.Assert(t, l.numsegments == 256)
+	tests.Assert(t, len(l.checksums) == 512)
+
+	// Blocks in the new region can be used, and the
+	// old ones are still available
+	tests.Assert(t, put(400) == nil)
+	for _, index := range []uint64{10, 200, 400} {
+		data, err := get(index)
+		tests.Assert(t, err == nil)
+		tests.Assert(t, data == byte(index))
+	}
+
+	// Shrink
+	blocks, err = l.Resize(128 * 4096)
+	tests.Assert(t, err == nil)
+	tests.Assert(t, blocks == 128)
+	tests.Assert(t, nil == os.Truncate(testcachefile, 128*4096))
+
+	_, err = get(200)
+	tests.Assert(t, err == ErrLogResized)
+	tests.Assert(t, put(200) == ErrLogResized)
+	data, err := get(10)
+	tests.Assert(t, err == nil)
+	tests.Assert(t, data == 10)
+
+	// Wrap around the smaller log a few times.  Nothing
+	// must be written past the end of the device.
+	for i := 0; i < 4; i++ {
+		for index := uint64(0); index < blocks; index++ {
+			tests.Assert(t, put(index) == nil)
+		}
+	}
+	for index := uint64(0); index < blocks; index++ {
+		data, err := get(index)
+		tests.Assert(t, err == nil)
+		tests.Assert(t, data == byte(index))
+	}
+	fi, err := os.Stat(testcachefile)
+	tests.Assert(t, err == nil)
+	tests.Assert(t, fi.Size() == 128*4096)
+
+	// Fewer segments than segment buffers
+	_, err = l.Resize(16 * 4096)
+	tests.Assert(t, err == ErrLogTooSmall)
+}
+
+func TestCompressedLogResize(t *testing.T) {
+	testcachefile := tests.Tempfile()
+	tests.Assert(t, nil == tests.CreateFile(testcachefile, 256*4096))
+	defer os.Remove(testcachefile)
+
+	l, blocks, err := NewCompressedLog(testcachefile, 4096, 2, 0, false, 2)
+	tests.Assert(t, err == nil)
+	tests.Assert(t, blocks == 512)
+	l.Start()
+	defer l.Close()
+
+	put, get := resizeTestLog(t, l)
+	for index := uint64(0); index < blocks; index++ {
+		tests.Assert(t, put(index) == nil)
+	}
+
+	// All the blocks compress, so they are stored in the
+	// first segments.  Shrinking keeps them.
+	blocks, err = l.Resize(128 * 4096)
+	tests.Assert(t, err == nil)
+	tests.Assert(t, blocks == 256)
+	for index := uint64(0); index < blocks; index++ {
+		data, err := get(index)
+		tests.Assert(t, err == nil)
+		tests.Assert(t, data == byte(index))
+	}
+	_, err = get(300)
+	tests.Assert(t, err == ErrLogResized)
+	for segment := range l.owners {
+		for _, index := range l.owners[segment] {
+			tests.Assert(t, index < blocks)
+		}
+	}
+
+	// Grow back
+	blocks, err = l.Resize(256 * 4096)
+	tests.Assert(t, err == nil)
+	tests.Assert(t, blocks == 512)
+	tests.Assert(t, put(300) == nil)
+	data, err := get(300)
+	tests.Assert(t, err == nil)
+	tests.Assert(t, data == byte(300%256))
+}
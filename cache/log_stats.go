@@ -19,20 +19,31 @@ package cache
 import (
 	"fmt"
 	"github.com/lpabon/tm"
-	"sync"
+	"sync/atomic"
 	"time"
 )
 
 type LogStats struct {
-	Ramhits         uint64           `json:"ramhits"`
-	Storagehits     uint64           `json:"storagehits"`
-	Wraps           uint64           `json:"wraps"`
-	Seg_skipped     uint64           `json:"segments_skipped"`
-	Bufferhits      uint64           `json:"buffercachehits"`
-	Totalhits       uint64           `json:"totalhits"`
-	Readtime        *tm.TimeDuration `json:"mean_read_usecs"`
-	Segmentreadtime *tm.TimeDuration `json:"mean_segmentread_usecs"`
-	Writetime       *tm.TimeDuration `json:"mean_segmentwrite_usecs"`
+	Ramhits           uint64           `json:"ramhits"`
+	Storagehits       uint64           `json:"storagehits"`
+	Wraps             uint64           `json:"wraps"`
+	Seg_skipped       uint64           `json:"segments_skipped"`
+	Bufferhits        uint64           `json:"buffercachehits"`
+	Totalhits         uint64           `json:"totalhits"`
+	Promotions        uint64           `json:"promotions"`
+	Demotions         uint64           `json:"demotions"`
+	Corruptions       uint64           `json:"corruptions"`
+	KeyChanges        uint64           `json:"keychanges"`
+	Uncompressedbytes uint64           `json:"uncompressedbytes"`
+	Compressedbytes   uint64           `json:"compressedbytes"`
+	Discardedbytes    uint64           `json:"discardedbytes"`
+	Bounces           uint64           `json:"bounces"`
+	Readtime          *tm.TimeDuration `json:"mean_read_usecs"`
+	Segmentreadtime   *tm.TimeDuration `json:"mean_segmentread_usecs"`
+	Writetime         *tm.TimeDuration `json:"mean_segmentwrite_usecs"`
+	Readlatency       *Histogram       `json:"read_latency"`
+	Seg_readlatency   *Histogram       `json:"segmentread_latency"`
+	Writelatency      *Histogram       `json:"segmentwrite_latency"`
 }
 
 func (s *LogStats) RamHitRate() float64 {
@@ -51,6 +62,16 @@ func (s *LogStats) BufferHitRate() float64 {
 	}
 }
 
+// Ratio of the size of the blocks placed in the log over the
+// size they use in the log
+func (s *LogStats) CompressionRatio() float64 {
+	if 0 == s.Compressedbytes {
+		return 0.0
+	} else {
+		return float64(s.Uncompressedbytes) / float64(s.Compressedbytes)
+	}
+}
+
 func (s *LogStats) String() string {
 	return fmt.Sprintf(
 		"Ram Hit Rate: %.4f\n"+
@@ -60,9 +81,19 @@ func (s *LogStats) String() string {
 			"Storage Hits: %v\n"+
 			"Wraps: %v\n"+
 			"Segments Skipped: %v\n"+
+			"Promotions: %v\n"+
+			"Demotions: %v\n"+
+			"Corruptions: %v\n"+
+			"Key Changes: %v\n"+
+			"Compression Ratio: %.2f\n"+
+			"Discarded Bytes: %v\n"+
+			"Bounces: %v\n"+
 			"Mean Read Latency: %.2f usec\n"+
 			"Mean Segment Read Latency: %.2f usec\n"+
-			"Mean Write Latency: %.2f usec\n",
+			"Mean Write Latency: %.2f usec\n"+
+			"Read Latency: %v\n"+
+			"Segment Read Latency: %v\n"+
+			"Write Latency: %v\n",
 		s.RamHitRate(),
 		s.Ramhits,
 		s.BufferHitRate(),
@@ -70,9 +101,19 @@ func (s *LogStats) String() string {
 		s.Storagehits,
 		s.Wraps,
 		s.Seg_skipped,
+		s.Promotions,
+		s.Demotions,
+		s.Corruptions,
+		s.KeyChanges,
+		s.CompressionRatio(),
+		s.Discardedbytes,
+		s.Bounces,
 		s.Readtime.MeanTimeUsecs(),
 		s.Segmentreadtime.MeanTimeUsecs(),
-		s.Writetime.MeanTimeUsecs())
+		s.Writetime.MeanTimeUsecs(),
+		s.Readlatency,
+		s.Seg_readlatency,
+		s.Writelatency)
 }
 
 func (s *LogStats) Csv() string {
@@ -93,88 +134,157 @@ func (s *LogStats) Csv() string {
 		s.Seg_skipped) +
 		s.Readtime.Csv() + // 9,10
 		s.Segmentreadtime.Csv() + // 11,12
-		s.Writetime.Csv() // 13,14
+		s.Writetime.Csv() + // 13,14
+		fmt.Sprintf(
+			"%v,"+ // 15 Promotions
+				"%v,"+ // 16 Demotions
+				"%v,"+ // 17 Corruptions
+				"%v,"+ // 18 Compression Ratio
+				"%v,"+ // 19 Discarded Bytes
+				"%v,"+ // 20 Bounces
+				"%v,", // 21 Key Changes
+			s.Promotions,
+			s.Demotions,
+			s.Corruptions,
+			s.CompressionRatio(),
+			s.Discardedbytes,
+			s.Bounces,
+			s.KeyChanges) +
+		s.Readlatency.Csv() + // 22-27
+		s.Seg_readlatency.Csv() + // 28-33
+		s.Writelatency.Csv() // 34-39
 }
 
+// Counters are updated with atomic operations so the hot path does
+// not take a lock.  The total hits are incremented before the hits
+// and loaded after them.
 type logstats struct {
-	ramhits         uint64
-	storagehits     uint64
-	wraps           uint64
-	seg_skipped     uint64
-	bufferhits      uint64
-	totalhits       uint64
-	readtime        tm.TimeDuration
-	segmentreadtime tm.TimeDuration
-	writetime       tm.TimeDuration
-	lock            sync.Mutex
+	ramhits           uint64
+	storagehits       uint64
+	wraps             uint64
+	seg_skipped       uint64
+	bufferhits        uint64
+	totalhits         uint64
+	promotions        uint64
+	demotions         uint64
+	corruptions       uint64
+	keychanges        uint64
+	uncompressedbytes uint64
+	compressedbytes   uint64
+	discardedbytes    uint64
+	bounces           uint64
+	readtime          tm.TimeDuration
+	segmentreadtime   tm.TimeDuration
+	writetime         tm.TimeDuration
+	readlatency       Histogram
+	seg_readlatency   Histogram
+	writelatency      Histogram
+}
+
+func timeDurationAdd(t *tm.TimeDuration, d time.Duration) {
+	atomic.AddInt64(&t.Duration, d.Nanoseconds())
+	atomic.AddInt64(&t.Counter, 1)
+}
+
+func timeDurationLoad(t *tm.TimeDuration) *tm.TimeDuration {
+	return &tm.TimeDuration{
+		Counter:  atomic.LoadInt64(&t.Counter),
+		Duration: atomic.LoadInt64(&t.Duration),
+	}
 }
 
 func (s *logstats) Stats() *LogStats {
-	scopy := &logstats{}
-	s.lock.Lock()
-	*scopy = *s
-	s.lock.Unlock()
-
-	return &LogStats{
-		Ramhits:         scopy.ramhits,
-		Storagehits:     scopy.storagehits,
-		Wraps:           scopy.wraps,
-		Seg_skipped:     scopy.seg_skipped,
-		Bufferhits:      scopy.bufferhits,
-		Totalhits:       scopy.totalhits,
-		Readtime:        scopy.readtime.Copy(),
-		Segmentreadtime: scopy.segmentreadtime.Copy(),
-		Writetime:       scopy.writetime.Copy(),
+	stats := &LogStats{
+		Ramhits:     atomic.LoadUint64(&s.ramhits),
+		Storagehits: atomic.LoadUint64(&s.storagehits),
+		Bufferhits:  atomic.LoadUint64(&s.bufferhits),
 	}
+	stats.Totalhits = atomic.LoadUint64(&s.totalhits)
+	stats.Wraps = atomic.LoadUint64(&s.wraps)
+	stats.Seg_skipped = atomic.LoadUint64(&s.seg_skipped)
+	stats.Promotions = atomic.LoadUint64(&s.promotions)
+	stats.Demotions = atomic.LoadUint64(&s.demotions)
+	stats.Corruptions = atomic.LoadUint64(&s.corruptions)
+	stats.KeyChanges = atomic.LoadUint64(&s.keychanges)
+	stats.Uncompressedbytes = atomic.LoadUint64(&s.uncompressedbytes)
+	stats.Compressedbytes = atomic.LoadUint64(&s.compressedbytes)
+	stats.Discardedbytes = atomic.LoadUint64(&s.discardedbytes)
+	stats.Bounces = atomic.LoadUint64(&s.bounces)
+	stats.Readtime = timeDurationLoad(&s.readtime)
+	stats.Segmentreadtime = timeDurationLoad(&s.segmentreadtime)
+	stats.Writetime = timeDurationLoad(&s.writetime)
+	stats.Readlatency = s.readlatency.load()
+	stats.Seg_readlatency = s.seg_readlatency.load()
+	stats.Writelatency = s.writelatency.load()
+
+	return stats
 }
 
 func (s *logstats) BufferHit() {
-	s.lock.Lock()
-	defer s.lock.Unlock()
-	s.bufferhits++
-	s.totalhits++
+	atomic.AddUint64(&s.totalhits, 1)
+	atomic.AddUint64(&s.bufferhits, 1)
 }
 
 func (s *logstats) SegmentSkipped() {
-	s.lock.Lock()
-	defer s.lock.Unlock()
-	s.seg_skipped++
+	atomic.AddUint64(&s.seg_skipped, 1)
 }
 
 func (s *logstats) RamHit() {
-	s.lock.Lock()
-	defer s.lock.Unlock()
-	s.ramhits++
-	s.totalhits++
+	atomic.AddUint64(&s.totalhits, 1)
+	atomic.AddUint64(&s.ramhits, 1)
 }
 
 func (s *logstats) StorageHit() {
-	s.lock.Lock()
-	defer s.lock.Unlock()
-	s.storagehits++
-	s.totalhits++
+	atomic.AddUint64(&s.totalhits, 1)
+	atomic.AddUint64(&s.storagehits, 1)
+}
+
+func (s *logstats) Promotion() {
+	atomic.AddUint64(&s.promotions, 1)
+}
+
+func (s *logstats) Demotion() {
+	atomic.AddUint64(&s.demotions, 1)
+}
+
+func (s *logstats) Corruption() {
+	atomic.AddUint64(&s.corruptions, 1)
+}
+
+// Counts blocks which can no longer be read because the key of their
+// device changed since they were written
+func (s *logstats) KeyChange() {
+	atomic.AddUint64(&s.keychanges, 1)
+}
+
+func (s *logstats) Compressed(uncompressed, compressed uint32) {
+	atomic.AddUint64(&s.uncompressedbytes, uint64(uncompressed))
+	atomic.AddUint64(&s.compressedbytes, uint64(compressed))
+}
+
+func (s *logstats) Discarded(bytes uint32) {
+	atomic.AddUint64(&s.discardedbytes, uint64(bytes))
+}
+
+func (s *logstats) Bounce() {
+	atomic.AddUint64(&s.bounces, 1)
 }
 
 func (s *logstats) Wrapped() {
-	s.lock.Lock()
-	defer s.lock.Unlock()
-	s.wraps++
+	atomic.AddUint64(&s.wraps, 1)
 }
 
 func (s *logstats) ReadTimeRecord(d time.Duration) {
-	s.lock.Lock()
-	defer s.lock.Unlock()
-	s.readtime.Add(d)
+	timeDurationAdd(&s.readtime, d)
+	s.readlatency.addAtomic(d)
 }
 
 func (s *logstats) WriteTimeRecord(d time.Duration) {
-	s.lock.Lock()
-	defer s.lock.Unlock()
-	s.writetime.Add(d)
+	timeDurationAdd(&s.writetime, d)
+	s.writelatency.addAtomic(d)
 }
 
 func (s *logstats) SegmentReadTimeRecord(d time.Duration) {
-	s.lock.Lock()
-	defer s.lock.Unlock()
-	s.segmentreadtime.Add(d)
+	timeDurationAdd(&s.segmentreadtime, d)
+	s.seg_readlatency.addAtomic(d)
 }
@@ -20,6 +20,7 @@ import (
 	"github.com/pblcache/pblcache/tests"
 	"reflect"
 	"testing"
+	"time"
 )
 
 func TestLogStatsRamhits(t *testing.T) {
@@ -86,6 +87,10 @@ func TestLogStatsReadTimeRecord(t *testing.T) {
 	tests.Assert(t, s.readtime.MeanTimeUsecs() == 50.0)
 	tests.Assert(t, s.segmentreadtime.MeanTimeUsecs() == 0.0)
 	tests.Assert(t, s.writetime.MeanTimeUsecs() == 0.0)
+	tests.Assert(t, s.readlatency.Count() == 2)
+	tests.Assert(t, s.readlatency.Max() == 50*1000)
+	tests.Assert(t, s.seg_readlatency.Count() == 0)
+	tests.Assert(t, s.writelatency.Count() == 0)
 	tests.Assert(t, s.ramhits == 0)
 	tests.Assert(t, s.storagehits == 0)
 	tests.Assert(t, s.wraps == 0)
@@ -103,6 +108,9 @@ func TestLogStatsSegmentReadTimeRecord(t *testing.T) {
 	tests.Assert(t, s.readtime.MeanTimeUsecs() == 0.0)
 	tests.Assert(t, s.segmentreadtime.MeanTimeUsecs() == 50.0)
 	tests.Assert(t, s.writetime.MeanTimeUsecs() == 0.0)
+	tests.Assert(t, s.readlatency.Count() == 0)
+	tests.Assert(t, s.seg_readlatency.Count() == 2)
+	tests.Assert(t, s.writelatency.Count() == 0)
 	tests.Assert(t, s.ramhits == 0)
 	tests.Assert(t, s.storagehits == 0)
 	tests.Assert(t, s.wraps == 0)
@@ -120,6 +128,9 @@ func TestLogStatsWriteTimeRecord(t *testing.T) {
 	tests.Assert(t, s.readtime.MeanTimeUsecs() == 0.0)
 	tests.Assert(t, s.segmentreadtime.MeanTimeUsecs() == 0.0)
 	tests.Assert(t, s.writetime.MeanTimeUsecs() == 50.0)
+	tests.Assert(t, s.readlatency.Count() == 0)
+	tests.Assert(t, s.seg_readlatency.Count() == 0)
+	tests.Assert(t, s.writelatency.Count() == 2)
 	tests.Assert(t, s.ramhits == 0)
 	tests.Assert(t, s.storagehits == 0)
 	tests.Assert(t, s.wraps == 0)
@@ -168,6 +179,9 @@ func TestLogStatsJson(t *testing.T) {
 	s.writetime.Add(1234567)
 	s.writetime.Add(1234567)
 	s.writetime.Add(1234567)
+	s.readlatency.Add(1234)
+	s.seg_readlatency.Add(123456)
+	s.writelatency.Add(1234567)
 
 	// Encode
 	exportedstats := s.Stats()
@@ -188,5 +202,76 @@ func TestLogStatsJson(t *testing.T) {
 	tests.Assert(t, s.readtime.MeanTimeUsecs() == decstats.Readtime.MeanTimeUsecs())
 	tests.Assert(t, s.segmentreadtime.MeanTimeUsecs() == decstats.Segmentreadtime.MeanTimeUsecs())
 	tests.Assert(t, s.writetime.MeanTimeUsecs() == decstats.Writetime.MeanTimeUsecs())
+	tests.Assert(t, s.readlatency.Percentile(99) == decstats.Readlatency.Percentile(99))
+	tests.Assert(t, s.writelatency.Max() == decstats.Writelatency.Max())
 
 }
+
+func TestLogStatsPromotionDemotion(t *testing.T) {
+	s := &logstats{}
+	s.Promotion()
+	s.Promotion()
+	s.Demotion()
+	tests.Assert(t, s.promotions == 2)
+	tests.Assert(t, s.demotions == 1)
+	tests.Assert(t, s.ramhits == 0)
+	tests.Assert(t, s.bufferhits == 0)
+	tests.Assert(t, s.totalhits == 0)
+
+	ls := s.Stats()
+	tests.Assert(t, ls.Promotions == 2)
+	tests.Assert(t, ls.Demotions == 1)
+}
+
+func TestLogStatsCorruption(t *testing.T) {
+	s := &logstats{}
+	s.Corruption()
+	tests.Assert(t, s.corruptions == 1)
+	tests.Assert(t, s.ramhits == 0)
+	tests.Assert(t, s.storagehits == 0)
+	tests.Assert(t, s.totalhits == 0)
+	tests.Assert(t, s.Stats().Corruptions == 1)
+}
+
+func TestLogStatsKeyChange(t *testing.T) {
+	s := &logstats{}
+	s.KeyChange()
+	tests.Assert(t, s.keychanges == 1)
+	tests.Assert(t, s.corruptions == 0)
+	tests.Assert(t, s.Stats().KeyChanges == 1)
+}
+
+func TestLogStatsDiscarded(t *testing.T) {
+	s := &logstats{}
+	s.Discarded(4096)
+	s.Discarded(8192)
+	tests.Assert(t, s.discardedbytes == 12288)
+	tests.Assert(t, s.Stats().Discardedbytes == 12288)
+}
+
+func TestLogStatsBounce(t *testing.T) {
+	s := &logstats{}
+	s.Bounce()
+	tests.Assert(t, s.bounces == 1)
+	tests.Assert(t, s.Stats().Bounces == 1)
+}
+
+func BenchmarkLogStatsRamHitParallel(b *testing.B) {
+	s := &logstats{}
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			s.RamHit()
+		}
+	})
+}
+
+func BenchmarkLogStatsReadTimeRecordParallel(b *testing.B) {
+	s := &logstats{}
+	b.RunParallel(func(pb *testing.PB) {
+		d := time.Duration(0)
+		for pb.Next() {
+			d += 100
+			s.ReadTimeRecord(d % time.Millisecond)
+		}
+	})
+}
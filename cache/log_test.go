@@ -17,33 +17,37 @@
 package cache
 
 import (
+	"bytes"
 	"fmt"
 	"github.com/lpabon/tm"
 	"github.com/pblcache/pblcache/message"
 	"github.com/pblcache/pblcache/tests"
+	"io/ioutil"
 	"math/rand"
 	"os"
+	"strings"
 	"sync"
 	"testing"
 	"time"
 )
 
-func TestNewLog(t *testing.T) {
+// Log device which uses a mock file
+type mockLogDevice struct {
+	*tests.MockFile
+}
 
-	mockfile := tests.NewMockFile()
-	seeklen := int64(16 * 4096)
-	mockfile.MockSeek = func(offset int64, whence int) (int64, error) {
-		return seeklen, nil
-	}
+func (m *mockLogDevice) Size() (int64, error) {
+	return m.Seek(0, os.SEEK_END)
+}
+
+func (m *mockLogDevice) Alignment() uint32 {
+	return 1
+}
 
-	// Mock openFile
-	defer tests.Patch(&openFile,
-		func(name string, flag int, perm os.FileMode) (Filer, error) {
-			return mockfile, nil
-		}).Restore()
+func TestNewLog(t *testing.T) {
 
 	// Simple log
-	l, blocks, err := NewLog("file", 4096, 4, 4096*2, false)
+	l, blocks, err := NewLogFromDevice(NewMemoryLogDevice(16*4096), 4096, 4, 4096*2, 0)
 	tests.Assert(t, err == nil)
 	tests.Assert(t, l != nil)
 	tests.Assert(t, blocks == 16)
@@ -53,8 +57,7 @@ func TestNewLog(t *testing.T) {
 	// blocks that are aligned to the segments.
 	// 17 blocks are not aligned to a segment with 4 blocks
 	// per segment
-	seeklen = 17 * 4096
-	l, blocks, err = NewLog("file", 4096, 4, 4096*2, false)
+	l, blocks, err = NewLogFromDevice(NewMemoryLogDevice(17*4096), 4096, 4, 4096*2, 0)
 	tests.Assert(t, err == nil)
 	tests.Assert(t, l != nil)
 	tests.Assert(t, blocks == 16)
@@ -95,14 +98,8 @@ func TestLogMultiBlock(t *testing.T) {
 		return len(p), nil
 	}
 
-	// Mock openFile
-	defer tests.Patch(&openFile,
-		func(name string, flag int, perm os.FileMode) (Filer, error) {
-			return mockfile, nil
-		}).Restore()
-
 	// Simple log
-	l, blocks, err := NewLog("file", 4096, 4, 0, false)
+	l, blocks, err := NewLogFromDevice(&mockLogDevice{mockfile}, 4096, 4, 0, 0)
 	tests.Assert(t, err == nil)
 	tests.Assert(t, l != nil)
 	tests.Assert(t, blocks == 256)
@@ -123,7 +120,7 @@ func TestLogMultiBlock(t *testing.T) {
 		child_io := child.IoPkt()
 		child_io.Address = iopkt.Address + uint64(block)
 		child_io.Buffer = SubBlockBuffer(iopkt.Buffer, 4096, block, 1)
-		child_io.LogBlock = block
+		child_io.LogBlock = uint64(block)
 		child_io.Blocks = 1
 
 		l.Msgchan <- child
@@ -194,7 +191,7 @@ func TestLogMultiBlock(t *testing.T) {
 // Should wrap four times
 func TestWrapPut(t *testing.T) {
 	// Simple log
-	blocks := uint32(16)
+	blocks := uint64(16)
 
 	testcachefile := tests.Tempfile()
 	err := tests.CreateFile(testcachefile, 16*4096)
@@ -208,11 +205,11 @@ func TestWrapPut(t *testing.T) {
 	l.Start()
 
 	here := make(chan *message.Message)
-	wraps := uint32(4)
+	wraps := uint64(4)
 
 	// Write enough blocks to wrap around the log
 	// as many times as determined by the value in 'wraps'
-	for io := uint32(0); io < (blocks * wraps); io++ {
+	for io := uint64(0); io < (blocks * wraps); io++ {
 		buf := make([]byte, 4096)
 		buf[0] = byte(io)
 
@@ -236,7 +233,7 @@ func TestWrapPut(t *testing.T) {
 
 func TestReadCorrectness(t *testing.T) {
 	// Simple log
-	blocks := uint32(240)
+	blocks := uint64(240)
 	bs := uint32(4096)
 	blocks_per_segment := uint32(2)
 	buffercache := uint32(4096 * 10)
@@ -257,7 +254,7 @@ func TestReadCorrectness(t *testing.T) {
 
 	// Write enough blocks in the log to reach
 	// the end.
-	for io := uint32(0); io < blocks; io++ {
+	for io := uint64(0); io < blocks; io++ {
 		buf := make([]byte, 4096)
 
 		// Save the block number in the buffer
@@ -289,7 +286,7 @@ func TestReadCorrectness(t *testing.T) {
 
 	tests.Assert(t, buf[0] == uint8(blocks-1))
 
-	for io := uint32(0); io < blocks; io++ {
+	for io := uint64(0); io < blocks; io++ {
 		buf := make([]byte, 4096)
 		msg := message.NewMsgGet()
 		msg.RetChan = here
@@ -358,7 +355,7 @@ func logtest_response_handler(
 
 func TestLogConcurrency(t *testing.T) {
 	// Simple log
-	blocks := uint32(240)
+	blocks := uint64(240)
 	bs := uint32(4096)
 	blocks_per_segment := uint32(2)
 	buffercache := uint32(4096 * 24)
@@ -378,7 +375,7 @@ func TestLogConcurrency(t *testing.T) {
 	here := make(chan *message.Message)
 
 	// Fill the log
-	for io := uint32(0); io < blocks; io++ {
+	for io := uint64(0); io < blocks; io++ {
 		buf := make([]byte, 4096)
 		buf[0] = byte(io)
 
@@ -415,7 +412,7 @@ func TestLogConcurrency(t *testing.T) {
 				iopkt.Buffer = make([]byte, bs)
 
 				// Maximum "disk" size is 10 times bigger than cache
-				iopkt.LogBlock = uint32(r.Int31n(int32(blocks)))
+				iopkt.LogBlock = uint64(r.Int63n(int64(blocks)))
 				msg.RetChan = returnch
 
 				// Send request
@@ -432,7 +429,7 @@ func TestLogConcurrency(t *testing.T) {
 	// Write to the log while the readers are reading
 	r := rand.New(rand.NewSource(time.Now().UnixNano()))
 	for wrap := 0; wrap < 30; wrap++ {
-		for io := uint32(0); io < blocks; io++ {
+		for io := uint64(0); io < blocks; io++ {
 			buf := make([]byte, 4096)
 			buf[0] = byte(io)
 
@@ -464,3 +461,583 @@ func TestLogConcurrency(t *testing.T) {
 	os.Remove(testcachefile)
 
 }
+
+func TestLogBufferCache(t *testing.T) {
+	// Use enough segments so that some are not in RAM
+	blocks := uint64(256)
+	bs := uint32(4096)
+	blocks_per_segment := uint32(2)
+	testcachefile := tests.Tempfile()
+	tests.Assert(t, nil == tests.CreateFile(testcachefile, int64(blocks*4096)))
+	defer os.Remove(testcachefile)
+	l, logblocks, err := NewLog(testcachefile,
+		bs,
+		blocks_per_segment,
+		bs*4,
+		false)
+	tests.Assert(t, err == nil)
+	tests.Assert(t, l != nil)
+	tests.Assert(t, l.bc != nil)
+	tests.Assert(t, blocks == logblocks)
+	l.Start()
+
+	here := make(chan *message.Message)
+
+	// Fill the log
+	for io := uint64(0); io < blocks; io++ {
+		buf := make([]byte, 4096)
+		buf[0] = byte(io)
+
+		msg := message.NewMsgPut()
+		msg.RetChan = here
+
+		iopkt := msg.IoPkt()
+		iopkt.Buffer = buf
+		iopkt.LogBlock = io
+
+		l.Msgchan <- msg
+		<-here
+	}
+
+	// Read a block which is only on the storage device.  It should
+	// be promoted to the buffer cache after BufferCachePromoteHits
+	// reads from storage
+	read := func(index uint64) byte {
+		buf := make([]byte, 4096)
+		msg := message.NewMsgGet()
+		msg.RetChan = here
+
+		iopkt := msg.IoPkt()
+		iopkt.Buffer = buf
+		iopkt.LogBlock = index
+		l.Msgchan <- msg
+		<-here
+
+		return buf[0]
+	}
+
+	for i := 0; i < BufferCachePromoteHits; i++ {
+		tests.Assert(t, read(100) == 100)
+	}
+	stats := l.Stats()
+	tests.Assert(t, stats.Storagehits == BufferCachePromoteHits)
+	tests.Assert(t, stats.Bufferhits == 0)
+	tests.Assert(t, stats.Promotions == 1)
+
+	// Now it should be served from the buffer cache
+	tests.Assert(t, read(100) == 100)
+	stats = l.Stats()
+	tests.Assert(t, stats.Storagehits == BufferCachePromoteHits)
+	tests.Assert(t, stats.Bufferhits == 1)
+
+	// Overwrite the block.  The buffer cache copy must
+	// not be returned
+	buf := make([]byte, 4096)
+	buf[0] = 'X'
+	msg := message.NewMsgPut()
+	msg.RetChan = here
+	iopkt := msg.IoPkt()
+	iopkt.Buffer = buf
+	iopkt.LogBlock = 100
+	l.Msgchan <- msg
+	<-here
+
+	tests.Assert(t, read(100) == 'X')
+	stats = l.Stats()
+	tests.Assert(t, stats.Bufferhits == 1)
+
+	l.Close()
+}
+
+// Log device which stops reads at an offset until they are released
+type stallLogDevice struct {
+	LogDevice
+	offset  int64
+	stall   bool
+	stalled chan struct{}
+	release chan struct{}
+}
+
+func (d *stallLogDevice) ReadAt(p []byte, off int64) (int, error) {
+	if d.stall && off == d.offset {
+		d.stall = false
+		d.stalled <- struct{}{}
+		<-d.release
+	}
+	return d.LogDevice.ReadAt(p, off)
+}
+
+func TestLogBufferCacheOverwrittenRead(t *testing.T) {
+	blocks := uint64(256)
+	dev := &stallLogDevice{
+		LogDevice: NewMemoryLogDevice(int64(blocks * 4096)),
+		offset:    100 * 4096,
+		stalled:   make(chan struct{}),
+		release:   make(chan struct{}),
+	}
+	l, _, err := NewLogFromDevice(dev, 4096, 2, 4096*4, 0)
+	tests.Assert(t, err == nil)
+
+	invalidated := make(chan uint64, 10)
+	l.SetInvalidator(func(index uint64, current func() bool) {
+		invalidated <- index
+	})
+	l.Start()
+
+	here := make(chan *message.Message, 1)
+	put := func(index uint64, b byte) {
+		msg := message.NewMsgPut()
+		msg.RetChan = here
+		iopkt := msg.IoPkt()
+		iopkt.Buffer = make([]byte, 4096)
+		iopkt.Buffer[0] = b
+		iopkt.LogBlock = index
+		l.Msgchan <- msg
+		<-here
+	}
+	get := func(index uint64, retchan chan *message.Message) *message.Message {
+		msg := message.NewMsgGet()
+		msg.RetChan = retchan
+		iopkt := msg.IoPkt()
+		iopkt.Buffer = make([]byte, 4096)
+		iopkt.LogBlock = index
+		l.Msgchan <- msg
+		return msg
+	}
+
+	// Fill the log so that block 100 is only on the storage device
+	for io := uint64(0); io < blocks; io++ {
+		put(io, byte(io))
+	}
+	get(100, here)
+	tests.Assert(t, (<-here).IoPkt().Buffer[0] == 100)
+
+	// Overwrite the block while it is read from storage.  The data
+	// read is not returned and not promoted to the buffer cache,
+	// even though it is the second read from storage.
+	dev.stall = true
+	stalledchan := make(chan *message.Message, 1)
+	stalled := get(100, stalledchan)
+	<-dev.stalled
+	put(100, 'X')
+	dev.release <- struct{}{}
+	<-stalledchan
+	tests.Assert(t, stalled.Err == ErrBlockOverwritten)
+
+	stats := l.Stats()
+	tests.Assert(t, stats.Promotions == 0)
+	tests.Assert(t, stats.Corruptions == 0)
+	tests.Assert(t, len(invalidated) == 0)
+
+	get(100, here)
+	msg := <-here
+	tests.Assert(t, msg.Err == nil)
+	tests.Assert(t, msg.IoPkt().Buffer[0] == 'X')
+
+	l.Close()
+}
+
+func TestLogVerifyReadState(t *testing.T) {
+	l, _, err := NewLogFromDevice(NewMemoryLogDevice(16*4096), 4096, 4, 0, 0)
+	tests.Assert(t, err == nil)
+	defer l.Close()
+
+	old := make([]byte, 4096)
+	old[0] = 'a'
+	l.checksums[5] = Checksum(old)
+	state := l.blockState(5)
+
+	// Block written again while the old data was read
+	l.checksums[5] = Checksum(make([]byte, 4096))
+	l.generations[5]++
+
+	// The old data is checked against the checksum when it was read
+	tests.Assert(t, l.verify(5, old, state))
+	tests.Assert(t, l.Stats().Corruptions == 0)
+	tests.Assert(t, len(l.invalidations) == 0)
+
+	tests.Assert(t, !l.verify(5, old, l.blockState(5)))
+	tests.Assert(t, l.Stats().Corruptions == 1)
+	lb := <-l.invalidations
+	tests.Assert(t, lb.index == 5)
+	tests.Assert(t, l.unchanged(lb.index, lb.generation))
+
+	// Freed blocks are no longer current
+	state = l.blockState(5)
+	l.Free(5)
+	tests.Assert(t, l.overwritten(5, state))
+	tests.Assert(t, !l.unchanged(5, lb.generation))
+}
+
+func TestLogChecksum(t *testing.T) {
+	// Use enough segments so that some are not in RAM
+	blocks := uint64(256)
+	bs := uint32(4096)
+	blocks_per_segment := uint32(2)
+	testcachefile := tests.Tempfile()
+	tests.Assert(t, nil == tests.CreateFile(testcachefile, int64(blocks*4096)))
+	defer os.Remove(testcachefile)
+	l, logblocks, err := NewLog(testcachefile,
+		bs,
+		blocks_per_segment,
+		0,
+		false)
+	tests.Assert(t, err == nil)
+	tests.Assert(t, blocks == logblocks)
+
+	invalidated := make(chan uint64, 10)
+	l.SetInvalidator(func(index uint64, current func() bool) {
+		invalidated <- index
+	})
+	l.Start()
+
+	here := make(chan *message.Message)
+
+	// Fill the log
+	for io := uint64(0); io < blocks; io++ {
+		buf := make([]byte, 4096)
+		buf[0] = byte(io)
+
+		msg := message.NewMsgPut()
+		msg.RetChan = here
+
+		iopkt := msg.IoPkt()
+		iopkt.Buffer = buf
+		iopkt.LogBlock = io
+
+		l.Msgchan <- msg
+		<-here
+	}
+
+	read := func(index uint64, nblocks uint32) *message.Message {
+		msg := message.NewMsgGet()
+		msg.RetChan = here
+
+		iopkt := msg.IoPkt()
+		iopkt.Buffer = make([]byte, 4096*nblocks)
+		iopkt.LogBlock = index
+		iopkt.Blocks = nblocks
+		l.Msgchan <- msg
+
+		return <-here
+	}
+
+	// Good data
+	msg := read(100, 2)
+	tests.Assert(t, msg.Err == nil)
+	tests.Assert(t, msg.IoPkt().Buffer[0] == 100)
+	tests.Assert(t, msg.IoPkt().Buffer[4096] == 101)
+	tests.Assert(t, l.Stats().Corruptions == 0)
+
+	// Corrupt block 101 on the storage device
+	fp, err := os.OpenFile(testcachefile, os.O_RDWR, os.ModePerm)
+	tests.Assert(t, err == nil)
+	_, err = fp.WriteAt([]byte{0xFF}, 101*4096+10)
+	tests.Assert(t, err == nil)
+	fp.Close()
+
+	msg = read(100, 2)
+	tests.Assert(t, msg.Err == ErrChecksum)
+	tests.Assert(t, l.Stats().Corruptions == 1)
+	tests.Assert(t, <-invalidated == 101)
+
+	// Corrupt a block in a RAM segment
+	l.segment.segmentbuf[20] = 0xFF
+	index := uint64(l.segment.offset / 4096)
+	msg = read(index, 1)
+	tests.Assert(t, msg.Err == ErrChecksum)
+	tests.Assert(t, l.Stats().Corruptions == 2)
+	tests.Assert(t, <-invalidated == index)
+
+	l.Close()
+}
+
+func TestLogLoadLegacy(t *testing.T) {
+	blocks := uint64(256)
+	testcachefile := tests.Tempfile()
+	tests.Assert(t, nil == tests.CreateFile(testcachefile, int64(blocks*4096)))
+	defer os.Remove(testcachefile)
+
+	l, _, err := NewLog(testcachefile, 4096, 2, 0, false)
+	tests.Assert(t, err == nil)
+	l.Start()
+
+	here := make(chan *message.Message)
+	put := func(l *Log, index uint64, b byte) {
+		msg := message.NewMsgPut()
+		msg.RetChan = here
+		iopkt := msg.IoPkt()
+		iopkt.Buffer = make([]byte, 4096)
+		iopkt.Buffer[0] = b
+		iopkt.LogBlock = index
+		l.Msgchan <- msg
+		<-here
+	}
+	read := func(l *Log, index uint64) *message.Message {
+		msg := message.NewMsgGet()
+		msg.RetChan = here
+		iopkt := msg.IoPkt()
+		iopkt.Buffer = make([]byte, 4096)
+		iopkt.LogBlock = index
+		iopkt.Blocks = 1
+		l.Msgchan <- msg
+		return <-here
+	}
+
+	for io := uint64(0); io < blocks; io++ {
+		put(l, io, byte(io))
+	}
+	l.Close()
+	save, err := l.Save()
+	tests.Assert(t, err == nil)
+
+	// Metadata as saved before block checksums
+	legacy := &LogSave{
+		Size:    save.Size,
+		Wrapped: save.Wrapped,
+	}
+
+	l, _, err = NewLog(testcachefile, 4096, 2, 0, false)
+	tests.Assert(t, err == nil)
+	tests.Assert(t, l.Load(legacy, 0) == nil)
+	l.Start()
+
+	// Blocks are readable without a checksum
+	msg := read(l, 200)
+	tests.Assert(t, msg.Err == nil)
+	tests.Assert(t, msg.IoPkt().Buffer[0] == 200)
+	tests.Assert(t, l.Stats().Corruptions == 0)
+
+	// Blocks written again are checked
+	put(l, 150, 'X')
+	l.Close()
+	save, err = l.Save()
+	tests.Assert(t, err == nil)
+	tests.Assert(t, len(save.Checksums) == int(blocks))
+	tests.Assert(t, len(save.Unchecked) == int(blocks))
+	tests.Assert(t, !save.Unchecked[150])
+	tests.Assert(t, save.Unchecked[200])
+
+	// Unchecked blocks are saved with the metadata
+	l, _, err = NewLog(testcachefile, 4096, 2, 0, false)
+	tests.Assert(t, err == nil)
+	tests.Assert(t, l.Load(save, 0) == nil)
+	l.Start()
+
+	msg = read(l, 150)
+	tests.Assert(t, msg.Err == nil)
+	tests.Assert(t, msg.IoPkt().Buffer[0] == 'X')
+
+	fp, err := os.OpenFile(testcachefile, os.O_RDWR, os.ModePerm)
+	tests.Assert(t, err == nil)
+	_, err = fp.WriteAt([]byte{0xFF}, 150*4096+10)
+	tests.Assert(t, err == nil)
+	fp.Close()
+
+	msg = read(l, 150)
+	tests.Assert(t, msg.Err == ErrChecksum)
+	msg = read(l, 200)
+	tests.Assert(t, msg.Err == nil)
+	tests.Assert(t, msg.IoPkt().Buffer[0] == 200)
+
+	l.Close()
+}
+
+func TestLogEncryption(t *testing.T) {
+	// Use enough segments so that some are not in RAM
+	blocks := uint64(256)
+	bs := uint32(4096)
+	testcachefile := tests.Tempfile()
+	tests.Assert(t, nil == tests.CreateFile(testcachefile, int64(blocks*4096)))
+	defer os.Remove(testcachefile)
+
+	keyfile := tests.Tempfile()
+	defer os.Remove(keyfile)
+	writeKeys := func(keys string) {
+		fp, err := os.Create(keyfile)
+		tests.Assert(t, err == nil)
+		fp.WriteString(keys)
+		fp.Close()
+	}
+	writeKeys("# devid key\n" +
+		"1 " + strings.Repeat("01", 32) + "\n" +
+		"2 " + strings.Repeat("02", 64) + "\n")
+	keys, err := NewKeyFile(keyfile)
+	tests.Assert(t, err == nil)
+
+	l, logblocks, err := NewLog(testcachefile, bs, 2, 0, false)
+	tests.Assert(t, err == nil)
+	tests.Assert(t, blocks == logblocks)
+
+	invalidated := make(chan uint64, 1024)
+	l.SetInvalidator(func(index uint64, current func() bool) {
+		invalidated <- index
+	})
+	l.SetKeyProvider(keys)
+	l.Start()
+
+	here := make(chan *message.Message)
+	devid := func(index uint64) uint32 {
+		return uint32(index%2) + 1
+	}
+
+	// Fill the log. Even blocks are from device 1 and
+	// odd blocks from device 2
+	plaintext := []byte("pblcache plaintext")
+	for io := uint64(0); io < blocks; io++ {
+		buf := make([]byte, 4096)
+		copy(buf, plaintext)
+		buf[100] = byte(io)
+
+		msg := message.NewMsgPut()
+		msg.RetChan = here
+
+		iopkt := msg.IoPkt()
+		iopkt.Buffer = buf
+		iopkt.Devid = devid(io)
+		iopkt.Address = io
+		iopkt.LogBlock = io
+
+		l.Msgchan <- msg
+		<-here
+		tests.Assert(t, msg.Err == nil)
+	}
+
+	read := func(index uint64) *message.Message {
+		msg := message.NewMsgGet()
+		msg.RetChan = here
+
+		iopkt := msg.IoPkt()
+		iopkt.Buffer = make([]byte, 4096)
+		iopkt.Devid = devid(index)
+		iopkt.Address = index
+		iopkt.LogBlock = index
+		l.Msgchan <- msg
+
+		return <-here
+	}
+
+	// Data on the device must not be plaintext
+	data, err := ioutil.ReadFile(testcachefile)
+	tests.Assert(t, err == nil)
+	tests.Assert(t, !bytes.Contains(data, plaintext))
+
+	// Read from storage
+	for _, index := range []uint64{100, 101} {
+		msg := read(index)
+		tests.Assert(t, msg.Err == nil)
+		tests.Assert(t, bytes.HasPrefix(msg.IoPkt().Buffer, plaintext))
+		tests.Assert(t, msg.IoPkt().Buffer[100] == byte(index))
+	}
+
+	// Read from RAM segment
+	index := uint64(l.segment.offset / 4096)
+	msg := read(index)
+	tests.Assert(t, msg.Err == nil)
+	tests.Assert(t, msg.IoPkt().Buffer[100] == byte(index))
+
+	// Remove the key for device 1 and rotate the key for device 2
+	writeKeys("2 " + strings.Repeat("03", 64) + "\n")
+	changed, err := keys.Reload()
+	tests.Assert(t, err == nil)
+	tests.Assert(t, len(changed) == 2)
+
+	msg = read(100)
+	tests.Assert(t, msg.Err == ErrKeyNotFound)
+	tests.Assert(t, <-invalidated == 100)
+
+	// Blocks written with the old key are not counted as corrupted
+	msg = read(101)
+	tests.Assert(t, msg.Err == ErrKeyChanged)
+	tests.Assert(t, <-invalidated == 101)
+	tests.Assert(t, l.Stats().KeyChanges == 1)
+	tests.Assert(t, l.Stats().Corruptions == 0)
+
+	// Blocks written with the new key can be read
+	msg = message.NewMsgPut()
+	msg.RetChan = here
+	iopkt := msg.IoPkt()
+	iopkt.Buffer = make([]byte, 4096)
+	copy(iopkt.Buffer, plaintext)
+	iopkt.Devid = devid(101)
+	iopkt.LogBlock = 101
+	l.Msgchan <- msg
+	<-here
+	tests.Assert(t, msg.Err == nil)
+	msg = read(101)
+	tests.Assert(t, msg.Err == nil)
+	tests.Assert(t, bytes.HasPrefix(msg.IoPkt().Buffer, plaintext))
+
+	// Blocks from a device without a key are not placed in the log
+	msg = message.NewMsgPut()
+	msg.RetChan = here
+	iopkt = msg.IoPkt()
+	iopkt.Buffer = make([]byte, 4096)
+	iopkt.Devid = devid(0)
+	iopkt.LogBlock = 0
+	l.Msgchan <- msg
+	<-here
+	tests.Assert(t, msg.Err == ErrKeyNotFound)
+	tests.Assert(t, <-invalidated == 0)
+
+	l.Close()
+}
+
+func TestLogEncryptionKeyIdsSaved(t *testing.T) {
+	blocks := uint64(256)
+	testcachefile := tests.Tempfile()
+	tests.Assert(t, nil == tests.CreateFile(testcachefile, int64(blocks*4096)))
+	defer os.Remove(testcachefile)
+
+	keyfile := tests.Tempfile()
+	defer os.Remove(keyfile)
+	writeKeys := func(keys string) *KeyFile {
+		fp, err := os.Create(keyfile)
+		tests.Assert(t, err == nil)
+		fp.WriteString(keys)
+		fp.Close()
+		k, err := NewKeyFile(keyfile)
+		tests.Assert(t, err == nil)
+		return k
+	}
+
+	l, _, err := NewLog(testcachefile, 4096, 2, 0, false)
+	tests.Assert(t, err == nil)
+	l.SetKeyProvider(writeKeys("0 " + strings.Repeat("01", 32) + "\n"))
+	l.Start()
+
+	here := make(chan *message.Message)
+	for io := uint64(0); io < blocks; io++ {
+		msg := message.NewMsgPut()
+		msg.RetChan = here
+		iopkt := msg.IoPkt()
+		iopkt.Buffer = make([]byte, 4096)
+		iopkt.LogBlock = io
+		l.Msgchan <- msg
+		<-here
+	}
+	l.Close()
+	save, err := l.Save()
+	tests.Assert(t, err == nil)
+	tests.Assert(t, len(save.KeyIds) == int(blocks))
+
+	// The key was rotated while the cache was offline
+	l, _, err = NewLog(testcachefile, 4096, 2, 0, false)
+	tests.Assert(t, err == nil)
+	l.SetKeyProvider(writeKeys("0 " + strings.Repeat("02", 32) + "\n"))
+	tests.Assert(t, l.Load(save, 0) == nil)
+	l.Start()
+
+	msg := message.NewMsgGet()
+	msg.RetChan = here
+	iopkt := msg.IoPkt()
+	iopkt.Buffer = make([]byte, 4096)
+	iopkt.LogBlock = 200
+	l.Msgchan <- msg
+	<-here
+	tests.Assert(t, msg.Err == ErrKeyChanged)
+	tests.Assert(t, l.Stats().KeyChanges == 1)
+	tests.Assert(t, l.Stats().Corruptions == 0)
+
+	l.Close()
+}
@@ -0,0 +1,240 @@
+//
+// Copyright (c) 2014 The pblcache Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package cache
+
+import (
+	"errors"
+	"github.com/lpabon/godbc"
+	"io"
+	"os"
+	"sync"
+	"syscall"
+)
+
+// LogDevice is the storage used by the Log to hold its segments
+type LogDevice interface {
+	io.ReaderAt
+	io.WriterAt
+	io.Closer
+
+	// Size of the device in bytes
+	Size() (int64, error)
+
+	// Alignment in bytes required for the offset and
+	// length of every read and write.
+	Alignment() uint32
+}
+
+// LogDevice which can be told that a region no longer holds data
+type Discarder interface {
+	Discard(offset, length int64) error
+}
+
+var (
+	ErrLogAlignment        = errors.New("Log segment size is not aligned to the device")
+	ErrDiscardNotSupported = errors.New("Discard is not supported by the device")
+)
+
+// Opens the log device at the specified path.  Block devices are
+// opened as a BlockLogDevice, any other file as a FileLogDevice.
+func OpenLogDevice(name string, usedirectio bool) (LogDevice, error) {
+	fi, err := os.Stat(name)
+	if err != nil {
+		return nil, err
+	}
+
+	if fi.Mode()&os.ModeDevice != 0 && fi.Mode()&os.ModeCharDevice == 0 {
+		return OpenBlockLogDevice(name, usedirectio)
+	}
+	return OpenFileLogDevice(name, usedirectio)
+}
+
+func openLogFile(name string, usedirectio bool) (*os.File, error) {
+	if usedirectio {
+		return os.OpenFile(name, OSSYNC|os.O_RDWR|os.O_EXCL, os.ModePerm)
+	} else {
+		return os.OpenFile(name, os.O_RDWR|os.O_EXCL, os.ModePerm)
+	}
+}
+
+// Log device on a regular file
+type FileLogDevice struct {
+	*os.File
+	alignment uint32
+}
+
+func OpenFileLogDevice(name string, usedirectio bool) (*FileLogDevice, error) {
+	fp, err := openLogFile(name, usedirectio)
+	if err != nil {
+		return nil, err
+	}
+
+	d := &FileLogDevice{
+		File:      fp,
+		alignment: 1,
+	}
+
+	// Direct I/O must be aligned to the blocks of the filesystem
+	if usedirectio {
+		var st syscall.Statfs_t
+		if err := syscall.Fstatfs(int(fp.Fd()), &st); err != nil {
+			fp.Close()
+			return nil, err
+		}
+		d.alignment = uint32(st.Bsize)
+	}
+
+	return d, nil
+}
+
+func (d *FileLogDevice) Size() (int64, error) {
+	return d.Seek(0, os.SEEK_END)
+}
+
+func (d *FileLogDevice) Alignment() uint32 {
+	return d.alignment
+}
+
+// Punches a hole in the file so the filesystem can free the space
+func (d *FileLogDevice) Discard(offset, length int64) error {
+	return punchHole(d.Fd(), offset, length)
+}
+
+// Log device on a raw block device.  The size and alignment are
+// retrieved from the block device itself.
+type BlockLogDevice struct {
+	*os.File
+	size       int64
+	sectorsize uint32
+}
+
+func OpenBlockLogDevice(name string, usedirectio bool) (*BlockLogDevice, error) {
+	fp, err := openLogFile(name, usedirectio)
+	if err != nil {
+		return nil, err
+	}
+
+	size, sectorsize, err := blockDeviceGeometry(fp.Fd())
+	if err != nil {
+		fp.Close()
+		return nil, err
+	}
+
+	return &BlockLogDevice{
+		File:       fp,
+		size:       size,
+		sectorsize: sectorsize,
+	}, nil
+}
+
+func (d *BlockLogDevice) Size() (int64, error) {
+	return d.size, nil
+}
+
+func (d *BlockLogDevice) Alignment() uint32 {
+	return d.sectorsize
+}
+
+func (d *BlockLogDevice) Discard(offset, length int64) error {
+	return blockDeviceDiscard(d.Fd(), offset, length)
+}
+
+// Log device in RAM.  Nothing is persisted once it is closed.
+type MemoryLogDevice struct {
+	data []byte
+	lock sync.RWMutex
+}
+
+func NewMemoryLogDevice(size int64) *MemoryLogDevice {
+	godbc.Require(size >= 0)
+
+	return &MemoryLogDevice{
+		data: make([]byte, size),
+	}
+}
+
+func (d *MemoryLogDevice) ReadAt(p []byte, off int64) (int, error) {
+	d.lock.RLock()
+	defer d.lock.RUnlock()
+
+	return memoryReadAt(d.data, p, off)
+}
+
+func (d *MemoryLogDevice) WriteAt(p []byte, off int64) (int, error) {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	return memoryWriteAt(d.data, p, off)
+}
+
+func (d *MemoryLogDevice) Close() error {
+	return nil
+}
+
+func (d *MemoryLogDevice) Size() (int64, error) {
+	return int64(len(d.data)), nil
+}
+
+func (d *MemoryLogDevice) Alignment() uint32 {
+	return 1
+}
+
+// Zeros the region, like a device which returns zeros
+// after a discard
+func (d *MemoryLogDevice) Discard(offset, length int64) error {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	if offset < 0 || offset+length > int64(len(d.data)) {
+		return io.ErrShortWrite
+	}
+
+	region := d.data[offset : offset+length]
+	for i := range region {
+		region[i] = 0
+	}
+
+	return nil
+}
+
+// Reads from device memory at the specified offset
+func memoryReadAt(data, p []byte, off int64) (int, error) {
+	if off < 0 || off >= int64(len(data)) {
+		return 0, io.EOF
+	}
+
+	n := copy(p, data[off:])
+	if n < len(p) {
+		return n, io.EOF
+	}
+
+	return n, nil
+}
+
+// Writes to device memory at the specified offset
+func memoryWriteAt(data, p []byte, off int64) (int, error) {
+	if off < 0 || off >= int64(len(data)) {
+		return 0, io.ErrShortWrite
+	}
+
+	n := copy(data[off:], p)
+	if n < len(p) {
+		return n, io.ErrShortWrite
+	}
+
+	return n, nil
+}
@@ -0,0 +1,75 @@
+//
+// Copyright (c) 2014 The pblcache Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package cache
+
+import (
+	"syscall"
+	"unsafe"
+)
+
+const (
+	dkiocGetBlockSize  = 0x40046418
+	dkiocGetBlockCount = 0x40086419
+)
+
+// Returns the size in bytes and the logical sector size of the block device
+func blockDeviceGeometry(fd uintptr) (int64, uint32, error) {
+	var count uint64
+	var sectorsize uint32
+
+	_, _, errno := syscall.Syscall(syscall.SYS_IOCTL, fd,
+		dkiocGetBlockSize, uintptr(unsafe.Pointer(&sectorsize)))
+	if errno != 0 {
+		return 0, 0, errno
+	}
+
+	_, _, errno = syscall.Syscall(syscall.SYS_IOCTL, fd,
+		dkiocGetBlockCount, uintptr(unsafe.Pointer(&count)))
+	if errno != 0 {
+		return 0, 0, errno
+	}
+
+	return int64(count) * int64(sectorsize), sectorsize, nil
+}
+
+const (
+	fPunchHole = 99
+)
+
+func blockDeviceDiscard(fd uintptr, offset, length int64) error {
+	return ErrDiscardNotSupported
+}
+
+func punchHole(fd uintptr, offset, length int64) error {
+	args := struct {
+		flags    uint32
+		reserved uint32
+		offset   int64
+		length   int64
+	}{
+		offset: offset,
+		length: length,
+	}
+
+	_, _, errno := syscall.Syscall(syscall.SYS_FCNTL, fd,
+		fPunchHole, uintptr(unsafe.Pointer(&args)))
+	if errno != 0 {
+		return errno
+	}
+
+	return nil
+}
@@ -0,0 +1,74 @@
+//
+// Copyright (c) 2014 The pblcache Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package cache
+
+import (
+	"syscall"
+	"unsafe"
+)
+
+// BLKGETSIZE64 returns a size_t, so its request number
+// depends on the size of a pointer
+const (
+	blkSszGet    = iocNone | 0x1268
+	blkGetSize64 = iocRead | unsafe.Sizeof(uintptr(0))<<16 | 0x1272
+)
+
+// Returns the size in bytes and the logical sector size of the block device
+func blockDeviceGeometry(fd uintptr) (int64, uint32, error) {
+	var size uint64
+	var sectorsize int32
+
+	_, _, errno := syscall.Syscall(syscall.SYS_IOCTL, fd,
+		blkGetSize64, uintptr(unsafe.Pointer(&size)))
+	if errno != 0 {
+		return 0, 0, errno
+	}
+
+	_, _, errno = syscall.Syscall(syscall.SYS_IOCTL, fd,
+		blkSszGet, uintptr(unsafe.Pointer(&sectorsize)))
+	if errno != 0 {
+		return 0, 0, errno
+	}
+
+	return int64(size), uint32(sectorsize), nil
+}
+
+const (
+	blkDiscard = iocNone | 0x1277
+
+	fallocFlKeepSize  = 0x01
+	fallocFlPunchHole = 0x02
+)
+
+func blockDeviceDiscard(fd uintptr, offset, length int64) error {
+	region := [2]uint64{uint64(offset), uint64(length)}
+
+	_, _, errno := syscall.Syscall(syscall.SYS_IOCTL, fd,
+		blkDiscard, uintptr(unsafe.Pointer(&region)))
+	if errno != 0 {
+		return errno
+	}
+
+	return nil
+}
+
+func punchHole(fd uintptr, offset, length int64) error {
+	return syscall.Fallocate(int(fd),
+		fallocFlPunchHole|fallocFlKeepSize,
+		offset, length)
+}
@@ -0,0 +1,117 @@
+//
+// Copyright (c) 2014 The pblcache Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package cache
+
+import (
+	"os"
+	"sync"
+	"syscall"
+	"unsafe"
+)
+
+// Log device on a file which is memory mapped.  Reads and writes are
+// memory copies, and the kernel writes the data back to the file.
+type MmapLogDevice struct {
+	fp   *os.File
+	data []byte
+	lock sync.RWMutex
+}
+
+func OpenMmapLogDevice(name string) (*MmapLogDevice, error) {
+	fp, err := os.OpenFile(name, os.O_RDWR|os.O_EXCL, os.ModePerm)
+	if err != nil {
+		return nil, err
+	}
+
+	size, err := fp.Seek(0, os.SEEK_END)
+	if err != nil {
+		fp.Close()
+		return nil, err
+	}
+	if size == 0 {
+		fp.Close()
+		return nil, ErrLogTooSmall
+	}
+
+	data, err := syscall.Mmap(int(fp.Fd()), 0, int(size),
+		syscall.PROT_READ|syscall.PROT_WRITE, syscall.MAP_SHARED)
+	if err != nil {
+		fp.Close()
+		return nil, err
+	}
+
+	return &MmapLogDevice{
+		fp:   fp,
+		data: data,
+	}, nil
+}
+
+func (d *MmapLogDevice) ReadAt(p []byte, off int64) (int, error) {
+	d.lock.RLock()
+	defer d.lock.RUnlock()
+
+	return memoryReadAt(d.data, p, off)
+}
+
+func (d *MmapLogDevice) WriteAt(p []byte, off int64) (int, error) {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	return memoryWriteAt(d.data, p, off)
+}
+
+// Writes all modified pages back to the file
+func (d *MmapLogDevice) Sync() error {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	_, _, errno := syscall.Syscall(syscall.SYS_MSYNC,
+		uintptr(unsafe.Pointer(&d.data[0])),
+		uintptr(len(d.data)),
+		syscall.MS_SYNC)
+	if errno != 0 {
+		return errno
+	}
+
+	return nil
+}
+
+// Writes the modified pages back, then releases the mapping and the
+// file even if any of them fail.  Returns the first error.
+func (d *MmapLogDevice) Close() error {
+	err := d.Sync()
+
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	if e := syscall.Munmap(d.data); e != nil && err == nil {
+		err = e
+	}
+	if e := d.fp.Close(); e != nil && err == nil {
+		err = e
+	}
+
+	return err
+}
+
+func (d *MmapLogDevice) Size() (int64, error) {
+	return int64(len(d.data)), nil
+}
+
+func (d *MmapLogDevice) Alignment() uint32 {
+	return 1
+}
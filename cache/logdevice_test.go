@@ -0,0 +1,187 @@
+//
+// Copyright (c) 2014 The pblcache Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package cache
+
+import (
+	"bytes"
+	"github.com/pblcache/pblcache/message"
+	"github.com/pblcache/pblcache/tests"
+	"io"
+	"io/ioutil"
+	"os"
+	"syscall"
+	"testing"
+)
+
+func testLogDeviceReadWrite(t *testing.T, dev LogDevice, size int64) {
+	s, err := dev.Size()
+	tests.Assert(t, err == nil)
+	tests.Assert(t, s == size)
+
+	buf := []byte("logdevice")
+	n, err := dev.WriteAt(buf, 100)
+	tests.Assert(t, err == nil)
+	tests.Assert(t, n == len(buf))
+
+	// Read at the start of the device
+	read := make([]byte, 100+len(buf))
+	n, err = dev.ReadAt(read, 0)
+	tests.Assert(t, err == nil)
+	tests.Assert(t, n == len(read))
+	tests.Assert(t, bytes.Equal(read[100:], buf))
+
+	// Past the end of the device
+	n, err = dev.ReadAt(read, size-10)
+	tests.Assert(t, err == io.EOF)
+	tests.Assert(t, n == 10)
+	n, err = dev.ReadAt(read, size)
+	tests.Assert(t, err == io.EOF)
+	tests.Assert(t, n == 0)
+	_, err = dev.WriteAt(buf, size-1)
+	tests.Assert(t, err != nil)
+}
+
+func TestMemoryLogDevice(t *testing.T) {
+	dev := NewMemoryLogDevice(4096)
+	testLogDeviceReadWrite(t, dev, 4096)
+	tests.Assert(t, dev.Alignment() == 1)
+	tests.Assert(t, dev.Close() == nil)
+}
+
+func TestFileLogDevice(t *testing.T) {
+	filename := tests.Tempfile()
+	tests.Assert(t, nil == tests.CreateFile(filename, 4096))
+	defer os.Remove(filename)
+
+	dev, err := OpenLogDevice(filename, false)
+	tests.Assert(t, err == nil)
+	_, ok := dev.(*FileLogDevice)
+	tests.Assert(t, ok)
+	tests.Assert(t, dev.Alignment() == 1)
+	tests.Assert(t, dev.Close() == nil)
+
+	// Regular files are not block devices
+	_, err = OpenBlockLogDevice(filename, false)
+	tests.Assert(t, err != nil)
+
+	_, err = OpenLogDevice("/doesnotexist/file", false)
+	tests.Assert(t, err != nil)
+}
+
+func TestMmapLogDevice(t *testing.T) {
+	filename := tests.Tempfile()
+	tests.Assert(t, nil == tests.CreateFile(filename, 4096))
+	defer os.Remove(filename)
+
+	dev, err := OpenMmapLogDevice(filename)
+	tests.Assert(t, err == nil)
+	testLogDeviceReadWrite(t, dev, 4096)
+	tests.Assert(t, dev.Close() == nil)
+
+	// Data must be in the file
+	data, err := ioutil.ReadFile(filename)
+	tests.Assert(t, err == nil)
+	tests.Assert(t, bytes.Equal(data[100:109], []byte("logdevice")))
+
+	// Empty file
+	empty := tests.Tempfile()
+	tests.Assert(t, nil == tests.CreateFile(empty, 0))
+	defer os.Remove(empty)
+	_, err = OpenMmapLogDevice(empty)
+	tests.Assert(t, err == ErrLogTooSmall)
+
+	// The file is closed even if the pages cannot be written back
+	dev, err = OpenMmapLogDevice(filename)
+	tests.Assert(t, err == nil)
+	tests.Assert(t, syscall.Munmap(dev.data) == nil)
+	tests.Assert(t, dev.Close() != nil)
+	tests.Assert(t, dev.fp.Close() != nil)
+}
+
+func TestLogDeviceAlignment(t *testing.T) {
+	mockfile := tests.NewMockFile()
+	mockfile.MockSeek = func(offset int64, whence int) (int64, error) {
+		return 16 * 4096, nil
+	}
+
+	dev := &alignedLogDevice{mockLogDevice{mockfile}}
+	_, _, err := NewLogFromDevice(dev, 512, 4, 0, 0)
+	tests.Assert(t, err == ErrLogAlignment)
+
+	// Blocks smaller than the alignment are allowed
+	// as long as the segments are aligned
+	l, blocks, err := NewLogFromDevice(dev, 512, 8, 0, 0)
+	tests.Assert(t, err == nil)
+	tests.Assert(t, blocks == 128)
+	l.Close()
+
+	l, blocks, err = NewLogFromDevice(dev, 4096, 4, 0, 0)
+	tests.Assert(t, err == nil)
+	tests.Assert(t, blocks == 16)
+	l.Close()
+}
+
+type alignedLogDevice struct {
+	mockLogDevice
+}
+
+func (a *alignedLogDevice) Alignment() uint32 {
+	return 4096
+}
+
+func TestLogOnDevices(t *testing.T) {
+	filename := tests.Tempfile()
+	tests.Assert(t, nil == tests.CreateFile(filename, 128*4096))
+	defer os.Remove(filename)
+
+	mmap, err := OpenMmapLogDevice(filename)
+	tests.Assert(t, err == nil)
+
+	for _, dev := range []LogDevice{NewMemoryLogDevice(128 * 4096), mmap} {
+		l, blocks, err := NewLogFromDevice(dev, 4096, 2, 0, 0)
+		tests.Assert(t, err == nil)
+		tests.Assert(t, blocks == 128)
+		l.Start()
+
+		here := make(chan *message.Message)
+		for index := uint64(0); index < blocks; index++ {
+			m := message.NewMsgPut()
+			m.RetChan = here
+			io := m.IoPkt()
+			io.Buffer = bytes.Repeat([]byte{byte(index)}, 4096)
+			io.LogBlock = index
+			l.Msgchan <- m
+			<-here
+		}
+
+		// Most of these are read from the device
+		for index := uint64(0); index < blocks; index++ {
+			m := message.NewMsgGet()
+			m.RetChan = here
+			io := m.IoPkt()
+			io.Buffer = make([]byte, 4096)
+			io.LogBlock = index
+			l.Msgchan <- m
+			<-here
+			tests.Assert(t, m.Err == nil)
+			tests.Assert(t, bytes.Equal(io.Buffer, bytes.Repeat([]byte{byte(index)}, 4096)))
+		}
+		tests.Assert(t, l.Stats().Storagehits > 0)
+
+		l.Close()
+	}
+}
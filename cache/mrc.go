@@ -0,0 +1,224 @@
+//
+// Copyright (c) 2014 The pblcache Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package cache
+
+import (
+	"fmt"
+	"github.com/lpabon/godbc"
+	"sort"
+)
+
+const (
+	// Addresses are sampled when their hash modulo the modulus
+	// is below the threshold
+	mrcModulus = 1 << 24
+
+	mrcMinTimestamps = 1024
+)
+
+type MissRatioPoint struct {
+	Blocks    uint64  `json:"blocks"`
+	MissRatio float64 `json:"missratio"`
+}
+
+// Miss ratio curve of an LRU cache computed in a single pass with
+// SHARDS, Spatially Hashed Approximate Reuse Distance Sampling.
+// Only the references to a sample of the addresses chosen by their
+// hash are tracked, and their reuse distances are scaled by the
+// sampling rate.  Memory used is proportional to the number of
+// sampled addresses.  Like SHARDS-adj, the miss ratio is computed
+// over the number of reads expected in the sample, which corrects
+// for samples with too few or too many hot addresses.
+type MissRatioCurve struct {
+	rate      float64
+	threshold uint64
+
+	// Last reference time of each sampled address, and a Fenwick
+	// tree with a one at the last reference time of each address
+	last  map[Address]int
+	tree  []uint32
+	clock int
+
+	// Number of sampled reads at each reuse distance.  A distance
+	// of one is a reference to the most recently used address.
+	distances []uint64
+	cold      uint64
+	reads     uint64
+
+	// Reads of all the addresses
+	allreads uint64
+}
+
+func NewMissRatioCurve(rate float64) *MissRatioCurve {
+	godbc.Require(rate > 0 && rate <= 1, rate)
+
+	m := &MissRatioCurve{
+		rate:      rate,
+		threshold: uint64(rate * mrcModulus),
+		last:      make(map[Address]int),
+		tree:      make([]uint32, mrcMinTimestamps+1),
+	}
+	if m.threshold == 0 {
+		m.threshold = 1
+	}
+
+	return m
+}
+
+func mrcHash(key Address) uint64 {
+	// splitmix64 finalizer
+	h := key.Lba ^ uint64(key.Devid)*0x9e3779b97f4a7c15
+	h = (h ^ (h >> 30)) * 0xbf58476d1ce4e5b9
+	h = (h ^ (h >> 27)) * 0x94d049bb133111eb
+	return h ^ (h >> 31)
+}
+
+func (m *MissRatioCurve) treeAdd(t int, v int) {
+	for ; t < len(m.tree); t += t & -t {
+		m.tree[t] = uint32(int(m.tree[t]) + v)
+	}
+}
+
+// Number of addresses referenced at or before time t
+func (m *MissRatioCurve) treeSum(t int) int {
+	sum := 0
+	for ; t > 0; t -= t & -t {
+		sum += int(m.tree[t])
+	}
+	return sum
+}
+
+// Renumbers the reference times of the sampled addresses from one
+// when the tree runs out of times
+func (m *MissRatioCurve) compact() {
+	keys := make([]Address, 0, len(m.last))
+	for key := range m.last {
+		keys = append(keys, key)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		return m.last[keys[i]] < m.last[keys[j]]
+	})
+
+	size := 2 * len(keys)
+	if size < mrcMinTimestamps {
+		size = mrcMinTimestamps
+	}
+	m.tree = make([]uint32, size+1)
+	for i, key := range keys {
+		m.last[key] = i + 1
+		m.treeAdd(i+1, 1)
+	}
+	m.clock = len(keys)
+}
+
+// Records a reference to the block.  Only reads are counted in the
+// curve, but writes also make the block the most recently used.
+func (m *MissRatioCurve) Reference(key Address, read bool) {
+	if read {
+		m.allreads++
+	}
+	if mrcHash(key)%mrcModulus >= m.threshold {
+		return
+	}
+
+	if m.clock+1 >= len(m.tree) {
+		m.compact()
+	}
+	m.clock++
+
+	prev, ok := m.last[key]
+	if ok {
+		// Addresses referenced since the previous reference
+		distance := m.treeSum(m.clock-1) - m.treeSum(prev) + 1
+		m.treeAdd(prev, -1)
+		if read {
+			for len(m.distances) <= distance {
+				m.distances = append(m.distances, 0)
+			}
+			m.distances[distance]++
+		}
+	} else if read {
+		m.cold++
+	}
+	if read {
+		m.reads++
+	}
+
+	m.last[key] = m.clock
+	m.treeAdd(m.clock, 1)
+}
+
+// Number of sampled reads
+func (m *MissRatioCurve) Reads() uint64 {
+	return m.reads
+}
+
+// Estimated number of distinct blocks referenced
+func (m *MissRatioCurve) Blocks() uint64 {
+	return uint64(float64(len(m.last)) / m.rate)
+}
+
+// Ratio of reads which would miss in an LRU cache of this many blocks
+func (m *MissRatioCurve) MissRatio(blocks uint64) float64 {
+	expected := float64(m.allreads) * m.rate
+	if m.reads == 0 || expected == 0 {
+		return 0.0
+	}
+
+	// Sampled reads with a reuse distance of up to the cache
+	// size scaled by the sampling rate are hits
+	sampled := int(float64(blocks) * m.rate)
+	hits := uint64(0)
+	for distance := 1; distance < len(m.distances) && distance <= sampled; distance++ {
+		hits += m.distances[distance]
+	}
+
+	missratio := float64(m.reads-hits) / expected
+	if missratio > 1.0 {
+		missratio = 1.0
+	}
+
+	return missratio
+}
+
+// Returns the miss ratio of the number of points of cache sizes
+// evenly spaced up to maxblocks
+func (m *MissRatioCurve) Curve(maxblocks uint64, points int) []MissRatioPoint {
+	godbc.Require(points > 0)
+
+	curve := make([]MissRatioPoint, points)
+	for i := range curve {
+		blocks := maxblocks * uint64(i+1) / uint64(points)
+		curve[i] = MissRatioPoint{
+			Blocks:    blocks,
+			MissRatio: m.MissRatio(blocks),
+		}
+	}
+
+	return curve
+}
+
+func (m *MissRatioCurve) String() string {
+	return fmt.Sprintf("Sampling rate: %v\n"+
+		"Sampled reads: %d\n"+
+		"Cold misses: %d\n"+
+		"Estimated blocks: %d\n",
+		m.rate,
+		m.reads,
+		m.cold,
+		m.Blocks())
+}
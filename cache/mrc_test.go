@@ -0,0 +1,83 @@
+//
+// Copyright (c) 2014 The pblcache Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package cache
+
+import (
+	"github.com/pblcache/pblcache/tests"
+	"math"
+	"testing"
+)
+
+func TestMissRatioCurveDistances(t *testing.T) {
+	m := NewMissRatioCurve(1)
+	a := Address{Devid: 1, Lba: 1}
+	b := Address{Devid: 1, Lba: 2}
+
+	m.Reference(a, true)
+	m.Reference(b, true)
+	m.Reference(a, true)
+	tests.Assert(t, m.Reads() == 3)
+	tests.Assert(t, m.Blocks() == 2)
+	tests.Assert(t, m.MissRatio(0) == 1.0)
+	tests.Assert(t, m.MissRatio(1) == 1.0)
+	tests.Assert(t, m.MissRatio(2) == 2.0/3.0)
+
+	// Writes move the block to the top without being counted
+	m.Reference(b, false)
+	m.Reference(b, true)
+	tests.Assert(t, m.Reads() == 4)
+	tests.Assert(t, m.MissRatio(1) == 3.0/4.0)
+}
+
+func TestMissRatioCurveLoop(t *testing.T) {
+	m := NewMissRatioCurve(1)
+
+	// More addresses than timestamps in the tree, so it is compacted
+	blocks := uint64(3000)
+	for loop := 0; loop < 3; loop++ {
+		for lba := uint64(0); lba < blocks; lba++ {
+			m.Reference(Address{Devid: 2, Lba: lba}, true)
+		}
+	}
+
+	// A loop larger than an LRU cache always misses
+	tests.Assert(t, m.MissRatio(blocks-1) == 1.0)
+	tests.Assert(t, m.MissRatio(blocks) == 1.0/3.0)
+
+	curve := m.Curve(2*blocks, 2)
+	tests.Assert(t, len(curve) == 2)
+	tests.Assert(t, curve[0].Blocks == blocks)
+	tests.Assert(t, curve[0].MissRatio == 1.0/3.0)
+	tests.Assert(t, curve[1].Blocks == 2*blocks)
+}
+
+func TestMissRatioCurveSampled(t *testing.T) {
+	m := NewMissRatioCurve(0.1)
+
+	blocks := uint64(20000)
+	for loop := 0; loop < 4; loop++ {
+		for lba := uint64(0); lba < blocks; lba++ {
+			m.Reference(Address{Devid: 3, Lba: lba}, true)
+		}
+	}
+
+	// Only a sample of the reads is tracked
+	tests.Assert(t, m.Reads() < 4*blocks/5)
+	tests.Assert(t, math.Abs(float64(m.Blocks())-float64(blocks)) < float64(blocks)/10)
+	tests.Assert(t, m.MissRatio(blocks/2) == 1.0)
+	tests.Assert(t, math.Abs(m.MissRatio(2*blocks)-0.25) < 0.025)
+}
@@ -0,0 +1,146 @@
+//
+// Copyright (c) 2014 The pblcache Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package cache
+
+import (
+	"github.com/lpabon/godbc"
+	"github.com/pblcache/pblcache/message"
+)
+
+// Runs a CacheMap without a Log to simulate the hit ratio of a cache.
+// Messages sent by the CacheMap are completed immediately, so only
+// the cache metadata is used.  I/O is handled like pblio handles it:
+// read misses are placed in the cache, and writes invalidate the
+// blocks before placing the whole blocks written in the cache.
+type Simulator struct {
+	cachemap  *CacheMap
+	pipeline  *message.NullPipeline
+	blocksize uint32
+	buffer    []byte
+	retchan   chan *message.Message
+}
+
+func NewSimulator(blocks uint64, blocksize uint32) *Simulator {
+	godbc.Require(blocks > 0)
+	godbc.Require(blocksize > 0)
+
+	s := &Simulator{
+		pipeline:  message.NewNullTerminator(),
+		blocksize: blocksize,
+		retchan:   make(chan *message.Message, 1),
+	}
+	s.pipeline.Start()
+	s.cachemap = NewCacheMap(blocks, blocksize, s.pipeline.In)
+
+	return s
+}
+
+// CacheMap simulated, which can be used to configure the cache
+func (s *Simulator) CacheMap() *CacheMap {
+	return s.cachemap
+}
+
+// Returns a buffer of the length.  The contents are never used.
+func (s *Simulator) data(length uint64) []byte {
+	if uint64(len(s.buffer)) < length {
+		s.buffer = make([]byte, length)
+	}
+	return s.buffer[:length]
+}
+
+// Sends a put of the bytes at the offset and waits for it
+func (s *Simulator) put(devid uint32, offset, length uint64) {
+	block, blockoffset, nblocks := SubBlockRange(offset, length, s.blocksize)
+
+	msg := message.NewMsgPut()
+	msg.RetChan = s.retchan
+	io := msg.IoPkt()
+	io.Devid = devid
+	io.Address = block
+	io.Offset = blockoffset
+	io.Blocks = nblocks
+	io.Buffer = s.data(length)
+
+	err := s.cachemap.Put(msg)
+	godbc.Check(err == nil, err)
+	<-s.retchan
+}
+
+// Reads the bytes at the offset.  Blocks which miss are placed in
+// the cache.
+func (s *Simulator) Read(devid uint32, offset, length uint64) {
+	godbc.Require(length > 0)
+
+	block, blockoffset, nblocks := SubBlockRange(offset, length, s.blocksize)
+
+	msg := message.NewMsgGet()
+	msg.RetChan = s.retchan
+	io := msg.IoPkt()
+	io.Devid = devid
+	io.Address = block
+	io.Offset = blockoffset
+	io.Blocks = nblocks
+	io.Buffer = s.data(length)
+
+	hitmap := make([]bool, nblocks)
+	if hitpkt, err := s.cachemap.Get(msg); err == nil {
+		hitmap = hitpkt.Hitmap
+		<-s.retchan
+	}
+
+	blocksize := uint64(s.blocksize)
+	for first := uint32(0); first < nblocks; {
+		if hitmap[first] {
+			first++
+			continue
+		}
+
+		last := first
+		for last < nblocks && !hitmap[last] {
+			last++
+		}
+
+		s.put(devid,
+			(block+uint64(first))*blocksize,
+			uint64(last-first)*blocksize)
+		first = last
+	}
+}
+
+// Writes the bytes at the offset.  Blocks which are only partially
+// written are removed from the cache.
+func (s *Simulator) Write(devid uint32, offset, length uint64) {
+	godbc.Require(length > 0)
+
+	block, _, nblocks := SubBlockRange(offset, length, s.blocksize)
+	s.cachemap.Invalidate(&message.IoPkt{
+		Devid:   devid,
+		Address: block,
+		Blocks:  nblocks,
+	})
+
+	s.put(devid, offset, length)
+}
+
+func (s *Simulator) Stats() *CacheStats {
+	return s.cachemap.Stats()
+}
+
+func (s *Simulator) Close() {
+	s.cachemap.Close()
+	s.pipeline.Close()
+}
@@ -0,0 +1,61 @@
+//
+// Copyright (c) 2014 The pblcache Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package cache
+
+import (
+	"github.com/pblcache/pblcache/tests"
+	"testing"
+)
+
+func TestSimulator(t *testing.T) {
+	s := NewSimulator(8, 4096)
+	defer s.Close()
+
+	// Misses are placed in the cache
+	s.Read(1, 0, 4*4096)
+	stats := s.Stats()
+	tests.Assert(t, stats.Reads == 4)
+	tests.Assert(t, stats.Readhits == 0)
+	tests.Assert(t, stats.Insertions == 4)
+
+	// Part of the read is cached
+	s.Read(1, 2*4096, 4*4096)
+	stats = s.Stats()
+	tests.Assert(t, stats.Reads == 8)
+	tests.Assert(t, stats.Readhits == 2)
+	tests.Assert(t, stats.Insertions == 6)
+
+	// Reads which are not aligned use the cached blocks
+	s.Read(1, 100, 200)
+	stats = s.Stats()
+	tests.Assert(t, stats.Readhits == 3)
+
+	// Whole blocks written are cached, partial blocks are not
+	s.Write(2, 4096+512, 2*4096)
+	stats = s.Stats()
+	tests.Assert(t, stats.Insertions == 7)
+	s.Read(2, 4096, 3*4096)
+	stats = s.Stats()
+	tests.Assert(t, stats.Reads == 12)
+	tests.Assert(t, stats.Readhits == 4)
+
+	// Evictions once the cache is full
+	s.Read(3, 0, 8*4096)
+	stats = s.Stats()
+	tests.Assert(t, stats.Evictions > 0)
+	tests.Assert(t, stats.Devices[3].Insertions == 8)
+}
@@ -19,6 +19,7 @@ package cache
 import (
 	"fmt"
 	"sync"
+	"sync/atomic"
 )
 
 type CacheStats struct {
@@ -28,6 +29,12 @@ type CacheStats struct {
 	Evictions      uint64 `json:"evictions"`
 	Invalidations  uint64 `json:"invalidations"`
 	Insertions     uint64 `json:"insertions"`
+	Deduplications uint64 `json:"deduplications"`
+	Pinnedhits     uint64 `json:"pinnedhits"`
+	Expirations    uint64 `json:"expirations"`
+
+	// Statistics of each device id
+	Devices map[uint32]*DeviceStats `json:"devices,omitempty"`
 }
 
 func (c *CacheStats) ReadHitRateDelta(prev *CacheStats) float64 {
@@ -67,9 +74,18 @@ func (c *CacheStats) InvalidateHitRate() float64 {
 
 }
 
+// Ratio of blocks inserted to blocks written to the log
+func (c *CacheStats) DedupRatio() float64 {
+	if c.Insertions == c.Deduplications {
+		return 0.0
+	} else {
+		return float64(c.Insertions) / float64(c.Insertions-c.Deduplications)
+	}
+}
+
 func (c *CacheStats) String() string {
 
-	return fmt.Sprintf(
+	s := fmt.Sprintf(
 		"Read Hit Rate: %.4f\n"+
 			"Invalidate Hit Rate: %.4f\n"+
 			"Read hits: %d\n"+
@@ -77,7 +93,11 @@ func (c *CacheStats) String() string {
 			"Reads: %d\n"+
 			"Insertions: %d\n"+
 			"Evictions: %d\n"+
-			"Invalidations: %d\n",
+			"Invalidations: %d\n"+
+			"Deduplications: %d\n"+
+			"Dedup Ratio: %.4f\n"+
+			"Pinned hits: %d\n"+
+			"Expirations: %d\n",
 		c.ReadHitRate(),
 		c.InvalidateHitRate(),
 		c.Readhits,
@@ -85,12 +105,22 @@ func (c *CacheStats) String() string {
 		c.Reads,
 		c.Insertions,
 		c.Evictions,
-		c.Invalidations)
+		c.Invalidations,
+		c.Deduplications,
+		c.DedupRatio(),
+		c.Pinnedhits,
+		c.Expirations)
+
+	for _, devid := range c.Devids() {
+		s += fmt.Sprintf("Device %d: %v\n", devid, c.Devices[devid])
+	}
+
+	return s
 }
 
 func (c *CacheStats) Csv() string {
 
-	return fmt.Sprintf(
+	s := fmt.Sprintf(
 		"%v,"+ // Read Hit Rate 1
 			"%v,"+ // Invalidate Hit Rate 2
 			"%d,"+ // Read Hits 3
@@ -98,7 +128,10 @@ func (c *CacheStats) Csv() string {
 			"%d,"+ // Reads 5
 			"%d,"+ // Insertions 6
 			"%d,"+ // Evictions 7
-			"%d,", // Invalidations 8
+			"%d,"+ // Invalidations 8
+			"%d,"+ // Deduplications 9
+			"%d,"+ // Pinned hits 10
+			"%d,", // Expirations 11
 		c.ReadHitRate(),
 		c.InvalidateHitRate(),
 		c.Readhits,
@@ -106,12 +139,17 @@ func (c *CacheStats) Csv() string {
 		c.Reads,
 		c.Insertions,
 		c.Evictions,
-		c.Invalidations)
+		c.Invalidations,
+		c.Deduplications,
+		c.Pinnedhits,
+		c.Expirations)
+
+	return s
 }
 
 func (c *CacheStats) CsvDelta(prev *CacheStats) string {
 
-	return fmt.Sprintf(
+	s := fmt.Sprintf(
 		"%v,"+ // Read Hit Rate 1
 			"%v,"+ // Invalidate Hit Rate 2
 			"%d,"+ // Read Hits 3
@@ -119,7 +157,10 @@ func (c *CacheStats) CsvDelta(prev *CacheStats) string {
 			"%d,"+ // Reads 5
 			"%d,"+ // Insertions 6
 			"%d,"+ // Evictions 7
-			"%d,", // Invalidations 8
+			"%d,"+ // Invalidations 8
+			"%d,"+ // Deduplications 9
+			"%d,"+ // Pinned hits 10
+			"%d,", // Expirations 11
 		c.ReadHitRateDelta(prev),
 		c.InvalidateHitRateDelta(prev),
 		c.Readhits-prev.Readhits,
@@ -127,9 +168,17 @@ func (c *CacheStats) CsvDelta(prev *CacheStats) string {
 		c.Reads-prev.Reads,
 		c.Insertions-prev.Insertions,
 		c.Evictions-prev.Evictions,
-		c.Invalidations-prev.Invalidations)
+		c.Invalidations-prev.Invalidations,
+		c.Deduplications-prev.Deduplications,
+		c.Pinnedhits-prev.Pinnedhits,
+		c.Expirations-prev.Expirations)
+
+	return s
 }
 
+// Counters are updated with atomic operations so the hot path does
+// not take a lock.  Totals are incremented before their hits and
+// loaded after them, so a snapshot never has more hits than totals.
 type cachestats struct {
 	readhits       uint64
 	invalidatehits uint64
@@ -137,82 +186,81 @@ type cachestats struct {
 	insertions     uint64
 	evictions      uint64
 	invalidations  uint64
-	lock           sync.Mutex
+	deduplications uint64
+	pinnedhits     uint64
+	expirations    uint64
+	devices        sync.Map
 }
 
 func (c *cachestats) stats() *CacheStats {
-	stats := c.copy()
-
-	return &CacheStats{
-		Readhits:       stats.readhits,
-		Invalidatehits: stats.invalidatehits,
-		Reads:          stats.reads,
-		Evictions:      stats.evictions,
-		Invalidations:  stats.invalidations,
-		Insertions:     stats.insertions,
+	stats := &CacheStats{
+		Readhits:       atomic.LoadUint64(&c.readhits),
+		Invalidatehits: atomic.LoadUint64(&c.invalidatehits),
+		Pinnedhits:     atomic.LoadUint64(&c.pinnedhits),
+		Evictions:      atomic.LoadUint64(&c.evictions),
+		Expirations:    atomic.LoadUint64(&c.expirations),
+		Deduplications: atomic.LoadUint64(&c.deduplications),
 	}
-}
+	stats.Reads = atomic.LoadUint64(&c.reads)
+	stats.Invalidations = atomic.LoadUint64(&c.invalidations)
+	stats.Insertions = atomic.LoadUint64(&c.insertions)
 
-func (c *cachestats) clear() {
-	c.lock.Lock()
-	defer c.lock.Unlock()
+	c.devices.Range(func(key, value interface{}) bool {
+		*stats.device(key.(uint32)) = value.(*DeviceStats).load()
+		return true
+	})
 
-	c.readhits = 0
-	c.invalidatehits = 0
-	c.reads = 0
-	c.insertions = 0
-	c.evictions = 0
-	c.invalidations = 0
+	return stats
 }
 
-func (c *cachestats) copy() *cachestats {
-	c.lock.Lock()
-	defer c.lock.Unlock()
-
-	statscopy := &cachestats{}
-	*statscopy = *c
-
-	return statscopy
+func (c *cachestats) clear() {
+	atomic.StoreUint64(&c.readhits, 0)
+	atomic.StoreUint64(&c.invalidatehits, 0)
+	atomic.StoreUint64(&c.reads, 0)
+	atomic.StoreUint64(&c.insertions, 0)
+	atomic.StoreUint64(&c.evictions, 0)
+	atomic.StoreUint64(&c.invalidations, 0)
+	atomic.StoreUint64(&c.deduplications, 0)
+	atomic.StoreUint64(&c.pinnedhits, 0)
+	atomic.StoreUint64(&c.expirations, 0)
+	c.devices.Range(func(key, value interface{}) bool {
+		c.devices.Delete(key)
+		return true
+	})
 }
 
 func (c *cachestats) readHit() {
-	c.lock.Lock()
-	defer c.lock.Unlock()
-
-	c.readhits++
+	atomic.AddUint64(&c.readhits, 1)
 }
 
 func (c *cachestats) invalidateHit() {
-	c.lock.Lock()
-	defer c.lock.Unlock()
-
-	c.invalidatehits++
+	atomic.AddUint64(&c.invalidatehits, 1)
 }
 
 func (c *cachestats) read() {
-	c.lock.Lock()
-	defer c.lock.Unlock()
-
-	c.reads++
+	atomic.AddUint64(&c.reads, 1)
 }
 
 func (c *cachestats) eviction() {
-	c.lock.Lock()
-	defer c.lock.Unlock()
-
-	c.evictions++
+	atomic.AddUint64(&c.evictions, 1)
 }
 
 func (c *cachestats) invalidation() {
-	c.lock.Lock()
-	defer c.lock.Unlock()
-
-	c.invalidations++
+	atomic.AddUint64(&c.invalidations, 1)
 }
 
 func (c *cachestats) insertion() {
-	c.lock.Lock()
-	defer c.lock.Unlock()
+	atomic.AddUint64(&c.insertions, 1)
+}
+
+func (c *cachestats) deduplication() {
+	atomic.AddUint64(&c.deduplications, 1)
+}
+
+func (c *cachestats) pinnedHit() {
+	atomic.AddUint64(&c.pinnedhits, 1)
+}
 
-	c.insertions++
+func (c *cachestats) expiration() {
+	atomic.AddUint64(&c.expirations, 1)
 }
@@ -0,0 +1,233 @@
+//
+// Copyright (c) 2014 The pblcache Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package cache
+
+import (
+	"fmt"
+	"sort"
+	"sync/atomic"
+)
+
+// Statistics of the blocks of a device
+type DeviceStats struct {
+	Readhits        uint64 `json:"readhits"`
+	Invalidatehits  uint64 `json:"invalidatehits"`
+	Reads           uint64 `json:"reads"`
+	Evictions       uint64 `json:"evictions"`
+	Evictionscaused uint64 `json:"evictionscaused"`
+	Invalidations   uint64 `json:"invalidations"`
+	Insertions      uint64 `json:"insertions"`
+	Blocks          uint64 `json:"blocks"`
+	Bytes           uint64 `json:"bytes"`
+}
+
+func (d *DeviceStats) ReadHitRate() float64 {
+	if d.Reads == 0 {
+		return 0.0
+	} else {
+		return float64(d.Readhits) / float64(d.Reads)
+	}
+}
+
+func (d *DeviceStats) ReadHitRateDelta(prev *DeviceStats) float64 {
+	Reads := d.Reads - prev.Reads
+	Readhits := d.Readhits - prev.Readhits
+	if Reads == 0 {
+		return 0.0
+	} else {
+		return float64(Readhits) / float64(Reads)
+	}
+}
+
+func (d *DeviceStats) String() string {
+	return fmt.Sprintf("Read Hit Rate: %.4f "+
+		"Reads: %d "+
+		"Insertions: %d "+
+		"Evictions: %d "+
+		"Evictions caused: %d "+
+		"Invalidations: %d "+
+		"Blocks: %d "+
+		"Bytes: %d",
+		d.ReadHitRate(),
+		d.Reads,
+		d.Insertions,
+		d.Evictions,
+		d.Evictionscaused,
+		d.Invalidations,
+		d.Blocks,
+		d.Bytes)
+}
+
+func (d *DeviceStats) Csv() string {
+	return fmt.Sprintf(
+		"%v,"+ // Read Hit Rate 1
+			"%d,"+ // Read Hits 2
+			"%d,"+ // Invalidation Hits 3
+			"%d,"+ // Reads 4
+			"%d,"+ // Insertions 5
+			"%d,"+ // Evictions 6
+			"%d,"+ // Evictions caused 7
+			"%d,"+ // Invalidations 8
+			"%d,"+ // Blocks 9
+			"%d,", // Bytes 10
+		d.ReadHitRate(),
+		d.Readhits,
+		d.Invalidatehits,
+		d.Reads,
+		d.Insertions,
+		d.Evictions,
+		d.Evictionscaused,
+		d.Invalidations,
+		d.Blocks,
+		d.Bytes)
+}
+
+// Blocks and bytes are the current values instead of the difference
+func (d *DeviceStats) CsvDelta(prev *DeviceStats) string {
+	return fmt.Sprintf(
+		"%v,"+ // Read Hit Rate 1
+			"%d,"+ // Read Hits 2
+			"%d,"+ // Invalidation Hits 3
+			"%d,"+ // Reads 4
+			"%d,"+ // Insertions 5
+			"%d,"+ // Evictions 6
+			"%d,"+ // Evictions caused 7
+			"%d,"+ // Invalidations 8
+			"%d,"+ // Blocks 9
+			"%d,", // Bytes 10
+		d.ReadHitRateDelta(prev),
+		d.Readhits-prev.Readhits,
+		d.Invalidatehits-prev.Invalidatehits,
+		d.Reads-prev.Reads,
+		d.Insertions-prev.Insertions,
+		d.Evictions-prev.Evictions,
+		d.Evictionscaused-prev.Evictionscaused,
+		d.Invalidations-prev.Invalidations,
+		d.Blocks,
+		d.Bytes)
+}
+
+// Statistics of each device in CSV format, one line per device.
+// Each line starts with the device id, so that all the lines have
+// the same columns, unlike Csv() if the devices were added there.
+func (c *CacheStats) DevicesCsv() string {
+	s := ""
+	for _, devid := range c.Devids() {
+		s += fmt.Sprintf("%d,", devid) + c.Devices[devid].Csv() + "\n"
+	}
+
+	return s
+}
+
+// Same as DevicesCsv() with the difference from the previous
+// statistics.  Devices without previous statistics are compared
+// to zero.
+func (c *CacheStats) DevicesCsvDelta(prev *CacheStats) string {
+	s := ""
+	for _, devid := range c.Devids() {
+		devprev, ok := prev.Devices[devid]
+		if !ok {
+			devprev = &DeviceStats{}
+		}
+		s += fmt.Sprintf("%d,", devid) + c.Devices[devid].CsvDelta(devprev) + "\n"
+	}
+
+	return s
+}
+
+// Returns the device ids of the devices with statistics in order
+func (c *CacheStats) Devids() []uint32 {
+	devids := make([]uint32, 0, len(c.Devices))
+	for devid := range c.Devices {
+		devids = append(devids, devid)
+	}
+	sort.Slice(devids, func(i, j int) bool {
+		return devids[i] < devids[j]
+	})
+
+	return devids
+}
+
+// Returns the statistics of the device, creating them if needed
+func (c *CacheStats) device(devid uint32) *DeviceStats {
+	if c.Devices == nil {
+		c.Devices = make(map[uint32]*DeviceStats)
+	}
+
+	d, ok := c.Devices[devid]
+	if !ok {
+		d = &DeviceStats{}
+		c.Devices[devid] = d
+	}
+
+	return d
+}
+
+// Returns a copy of the statistics updated atomically by cachestats
+func (d *DeviceStats) load() DeviceStats {
+	return DeviceStats{
+		Readhits:        atomic.LoadUint64(&d.Readhits),
+		Invalidatehits:  atomic.LoadUint64(&d.Invalidatehits),
+		Reads:           atomic.LoadUint64(&d.Reads),
+		Evictions:       atomic.LoadUint64(&d.Evictions),
+		Evictionscaused: atomic.LoadUint64(&d.Evictionscaused),
+		Invalidations:   atomic.LoadUint64(&d.Invalidations),
+		Insertions:      atomic.LoadUint64(&d.Insertions),
+	}
+}
+
+func (c *cachestats) device(devid uint32) *DeviceStats {
+	if d, ok := c.devices.Load(devid); ok {
+		return d.(*DeviceStats)
+	}
+
+	d, _ := c.devices.LoadOrStore(devid, &DeviceStats{})
+	return d.(*DeviceStats)
+}
+
+func (c *cachestats) deviceRead(devid uint32, hit bool) {
+	d := c.device(devid)
+	atomic.AddUint64(&d.Reads, 1)
+	if hit {
+		atomic.AddUint64(&d.Readhits, 1)
+	}
+}
+
+func (c *cachestats) deviceInvalidation(devid uint32, hit bool) {
+	d := c.device(devid)
+	atomic.AddUint64(&d.Invalidations, 1)
+	if hit {
+		atomic.AddUint64(&d.Invalidatehits, 1)
+	}
+}
+
+func (c *cachestats) deviceInsertion(devid uint32) {
+	atomic.AddUint64(&c.device(devid).Insertions, 1)
+}
+
+// The block of the evicted device was evicted to insert a block
+// of the evictor device
+func (c *cachestats) deviceEviction(evicted, evictor uint32) {
+	atomic.AddUint64(&c.device(evicted).Evictions, 1)
+	atomic.AddUint64(&c.device(evictor).Evictionscaused, 1)
+}
+
+// The block of the device was evicted without inserting another
+// block, for example when the cache is shrunk
+func (c *cachestats) deviceRemoved(devid uint32) {
+	atomic.AddUint64(&c.device(devid).Evictions, 1)
+}
@@ -0,0 +1,170 @@
+//
+// Copyright (c) 2014 The pblcache Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package cache
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/pblcache/pblcache/message"
+	"github.com/pblcache/pblcache/tests"
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func TestCacheStatsDevices(t *testing.T) {
+	s := &cachestats{}
+
+	s.deviceRead(1, true)
+	s.deviceRead(1, false)
+	s.deviceRead(2, false)
+	s.deviceInvalidation(2, true)
+	s.deviceInvalidation(2, false)
+	s.deviceInsertion(1)
+	s.deviceEviction(2, 1)
+	s.deviceRemoved(2)
+
+	stats := s.stats()
+	tests.Assert(t, len(stats.Devices) == 2)
+	tests.Assert(t, *stats.Devices[1] == DeviceStats{
+		Readhits:        1,
+		Reads:           2,
+		Insertions:      1,
+		Evictionscaused: 1,
+	})
+	tests.Assert(t, *stats.Devices[2] == DeviceStats{
+		Reads:          1,
+		Invalidations:  2,
+		Invalidatehits: 1,
+		Evictions:      2,
+	})
+	tests.Assert(t, stats.Devices[1].ReadHitRate() == 0.5)
+	tests.Assert(t, reflect.DeepEqual(stats.Devids(), []uint32{1, 2}))
+
+	// Exported statistics are a copy
+	s.deviceRead(1, true)
+	tests.Assert(t, stats.Devices[1].Reads == 2)
+
+	s.clear()
+	tests.Assert(t, len(s.stats().Devices) == 0)
+}
+
+func TestCacheStatsDevicesCsv(t *testing.T) {
+	s := &cachestats{}
+	s.deviceRead(3, true)
+	s.deviceInsertion(3)
+	prev := s.stats()
+
+	s.deviceRead(3, true)
+	s.deviceRead(3, false)
+	s.deviceRead(1, false)
+	stats := s.stats()
+	stats.Devices[3].Blocks = 4
+	stats.Devices[3].Bytes = 4 * 4096
+
+	// Devices are not in the cache statistics
+	tests.Assert(t, len(strings.Split(stats.Csv(), ",")) == 12)
+	tests.Assert(t, len(strings.Split(stats.CsvDelta(prev), ",")) == 12)
+
+	// One line per device, with the device id and 10 elements + the empty
+	lines := strings.Split(stats.DevicesCsv(), "\n")
+	tests.Assert(t, len(lines) == 3)
+	tests.Assert(t, lines[2] == "")
+	slice := strings.Split(lines[0], ",")
+	tests.Assert(t, len(slice) == 12)
+	tests.Assert(t, slice[0] == "1")
+	tests.Assert(t, slice[4] == "1")
+	slice = strings.Split(lines[1], ",")
+	tests.Assert(t, len(slice) == 12)
+	tests.Assert(t, slice[0] == "3")
+	tests.Assert(t, slice[1] == fmt.Sprintf("%v", stats.Devices[3].ReadHitRate()))
+	tests.Assert(t, slice[2] == "2")
+	tests.Assert(t, slice[4] == "3")
+	tests.Assert(t, slice[5] == "1")
+	tests.Assert(t, slice[9] == "4")
+	tests.Assert(t, slice[10] == strconv.Itoa(4*4096))
+
+	// Devices without previous statistics are compared to zero
+	lines = strings.Split(stats.DevicesCsvDelta(prev), "\n")
+	tests.Assert(t, len(lines) == 3)
+	slice = strings.Split(lines[0], ",")
+	tests.Assert(t, slice[0] == "1")
+	tests.Assert(t, slice[4] == "1")
+	slice = strings.Split(lines[1], ",")
+	tests.Assert(t, len(slice) == 12)
+	tests.Assert(t, slice[1] == "0.5")
+	tests.Assert(t, slice[2] == "1")
+	tests.Assert(t, slice[4] == "2")
+	tests.Assert(t, slice[5] == "0")
+	tests.Assert(t, slice[9] == "4")
+}
+
+func TestCacheStatsDevicesJson(t *testing.T) {
+	s := &cachestats{}
+	s.deviceRead(1, true)
+	s.deviceEviction(2, 1)
+
+	exportedstats := s.stats()
+	jsonstats, err := json.Marshal(exportedstats)
+	tests.Assert(t, err == nil)
+
+	decstats := &CacheStats{}
+	err = json.Unmarshal(jsonstats, &decstats)
+	tests.Assert(t, err == nil)
+	tests.Assert(t, reflect.DeepEqual(decstats, exportedstats))
+}
+
+func TestCacheMapDeviceStats(t *testing.T) {
+	nc := message.NewNullTerminator()
+	nc.Start()
+	defer nc.Close()
+
+	c := NewCacheMap(4, 4096, nc.In)
+	for lba := uint64(0); lba < 4; lba++ {
+		c.put(Address{Devid: 1, Lba: lba})
+	}
+	c.get(Address{Devid: 1, Lba: 0})
+	c.get(Address{Devid: 1, Lba: 10})
+
+	// Device 2 thrashes device 1
+	for lba := uint64(0); lba < 3; lba++ {
+		c.put(Address{Devid: 2, Lba: lba})
+	}
+	c.invalidate(Address{Devid: 2, Lba: 0})
+
+	stats := c.Stats()
+	tests.Assert(t, len(stats.Devices) == 2)
+	d1 := stats.Devices[1]
+	tests.Assert(t, d1.Reads == 2)
+	tests.Assert(t, d1.Readhits == 1)
+	tests.Assert(t, d1.Insertions == 4)
+	tests.Assert(t, d1.Evictions == 3)
+	tests.Assert(t, d1.Evictionscaused == 0)
+	tests.Assert(t, d1.Blocks == 1)
+	tests.Assert(t, d1.Bytes == 4096)
+
+	d2 := stats.Devices[2]
+	tests.Assert(t, d2.Insertions == 3)
+	tests.Assert(t, d2.Evictionscaused == 3)
+	tests.Assert(t, d2.Invalidations == 1)
+	tests.Assert(t, d2.Invalidatehits == 1)
+	tests.Assert(t, d2.Blocks == 2)
+	tests.Assert(t, d2.Bytes == 2*4096)
+
+	tests.Assert(t, strings.Contains(c.String(), "Device 2: "))
+}
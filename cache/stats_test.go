@@ -22,6 +22,7 @@ import (
 	"reflect"
 	"strconv"
 	"strings"
+	"sync"
 	"testing"
 )
 
@@ -91,6 +92,40 @@ func TestCacheStatsInsertions(t *testing.T) {
 	tests.Assert(t, s.insertions == 1)
 }
 
+func TestCacheStatsDeduplications(t *testing.T) {
+	s := cachestats{}
+	tests.Assert(t, s.stats().DedupRatio() == 0.0)
+
+	s.insertion()
+	s.insertion()
+	s.insertion()
+	s.insertion()
+	s.deduplication()
+	s.deduplication()
+	s.deduplication()
+	tests.Assert(t, s.insertions == 4)
+	tests.Assert(t, s.deduplications == 3)
+	tests.Assert(t, s.stats().DedupRatio() == 4.0)
+}
+
+func TestCacheStatsPinnedHits(t *testing.T) {
+	s := cachestats{}
+
+	s.pinnedHit()
+	s.pinnedHit()
+	tests.Assert(t, s.pinnedhits == 2)
+	tests.Assert(t, s.stats().Pinnedhits == 2)
+}
+
+func TestCacheStatsExpirations(t *testing.T) {
+	s := cachestats{}
+
+	s.expiration()
+	tests.Assert(t, s.expirations == 1)
+	tests.Assert(t, s.stats().Expirations == 1)
+	tests.Assert(t, s.evictions == 0)
+}
+
 func TestCacheStatsClear(t *testing.T) {
 	s := &cachestats{
 		readhits:       1,
@@ -99,6 +134,9 @@ func TestCacheStatsClear(t *testing.T) {
 		evictions:      1234,
 		invalidations:  12345,
 		insertions:     123456,
+		deduplications: 1234567,
+		pinnedhits:     12345678,
+		expirations:    123456789,
 	}
 
 	s.clear()
@@ -108,6 +146,9 @@ func TestCacheStatsClear(t *testing.T) {
 	tests.Assert(t, s.evictions == 0)
 	tests.Assert(t, s.invalidations == 0)
 	tests.Assert(t, s.insertions == 0)
+	tests.Assert(t, s.deduplications == 0)
+	tests.Assert(t, s.pinnedhits == 0)
+	tests.Assert(t, s.expirations == 0)
 }
 
 func TestCacheStatsCsv(t *testing.T) {
@@ -118,13 +159,16 @@ func TestCacheStatsCsv(t *testing.T) {
 		evictions:      1234,
 		invalidations:  12345,
 		insertions:     123456,
+		deduplications: 1234567,
+		pinnedhits:     12345678,
+		expirations:    123456789,
 	}
 
 	stats := s.stats()
 	slice := strings.Split(stats.Csv(), ",")
 
-	// 8 elements per csv line + the empty
-	tests.Assert(t, len(slice) == 9)
+	// 11 elements per csv line + the empty
+	tests.Assert(t, len(slice) == 12)
 	tests.Assert(t, slice[0] == fmt.Sprintf("%v", stats.ReadHitRate()))
 	tests.Assert(t, slice[1] == fmt.Sprintf("%v", stats.InvalidateHitRate()))
 	tests.Assert(t, slice[2] == strconv.FormatUint(s.readhits, 10))
@@ -133,6 +177,9 @@ func TestCacheStatsCsv(t *testing.T) {
 	tests.Assert(t, slice[5] == strconv.FormatUint(s.insertions, 10))
 	tests.Assert(t, slice[6] == strconv.FormatUint(s.evictions, 10))
 	tests.Assert(t, slice[7] == strconv.FormatUint(s.invalidations, 10))
+	tests.Assert(t, slice[8] == strconv.FormatUint(s.deduplications, 10))
+	tests.Assert(t, slice[9] == strconv.FormatUint(s.pinnedhits, 10))
+	tests.Assert(t, slice[10] == strconv.FormatUint(s.expirations, 10))
 }
 
 func TestCacheStatsCsvDelta(t *testing.T) {
@@ -143,6 +190,9 @@ func TestCacheStatsCsvDelta(t *testing.T) {
 		evictions:      1234,
 		invalidations:  12345,
 		insertions:     123456,
+		deduplications: 1234567,
+		pinnedhits:     12345678,
+		expirations:    123456789,
 	}
 	s2 := &cachestats{
 		readhits:       12,
@@ -151,14 +201,17 @@ func TestCacheStatsCsvDelta(t *testing.T) {
 		evictions:      12345,
 		invalidations:  123456,
 		insertions:     1234567,
+		deduplications: 12345678,
+		pinnedhits:     123456789,
+		expirations:    1234567890,
 	}
 
 	stats1 := s1.stats()
 	stats2 := s2.stats()
 	slice := strings.Split(stats2.CsvDelta(stats1), ",")
 
-	// 8 elements per csv line + the empty
-	tests.Assert(t, len(slice) == 9)
+	// 11 elements per csv line + the empty
+	tests.Assert(t, len(slice) == 12)
 	tests.Assert(t, slice[0] == fmt.Sprintf("%v", stats2.ReadHitRateDelta(stats1)))
 	tests.Assert(t, slice[1] == fmt.Sprintf("%v", stats2.InvalidateHitRateDelta(stats1)))
 	tests.Assert(t, slice[2] == strconv.FormatUint(s2.readhits-s1.readhits, 10))
@@ -167,6 +220,9 @@ func TestCacheStatsCsvDelta(t *testing.T) {
 	tests.Assert(t, slice[5] == strconv.FormatUint(s2.insertions-s1.insertions, 10))
 	tests.Assert(t, slice[6] == strconv.FormatUint(s2.evictions-s1.evictions, 10))
 	tests.Assert(t, slice[7] == strconv.FormatUint(s2.invalidations-s1.invalidations, 10))
+	tests.Assert(t, slice[8] == strconv.FormatUint(s2.deduplications-s1.deduplications, 10))
+	tests.Assert(t, slice[9] == strconv.FormatUint(s2.pinnedhits-s1.pinnedhits, 10))
+	tests.Assert(t, slice[10] == strconv.FormatUint(s2.expirations-s1.expirations, 10))
 }
 
 func TestCacheStatsRates(t *testing.T) {
@@ -188,6 +244,9 @@ func TestCacheStatsJson(t *testing.T) {
 		evictions:      1234,
 		invalidations:  12345,
 		insertions:     123456,
+		deduplications: 1234567,
+		pinnedhits:     12345678,
+		expirations:    123456789,
 	}
 
 	// Encode
@@ -206,5 +265,70 @@ func TestCacheStatsJson(t *testing.T) {
 	tests.Assert(t, s.evictions == decstats.Evictions)
 	tests.Assert(t, s.invalidations == decstats.Invalidations)
 	tests.Assert(t, s.insertions == decstats.Insertions)
+	tests.Assert(t, s.deduplications == decstats.Deduplications)
+	tests.Assert(t, s.pinnedhits == decstats.Pinnedhits)
+	tests.Assert(t, s.expirations == decstats.Expirations)
+
+}
 
+func TestCacheStatsConcurrent(t *testing.T) {
+	s := &cachestats{}
+
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func(devid uint32) {
+			defer wg.Done()
+			for j := 0; j < 1000; j++ {
+				s.read()
+				s.readHit()
+				s.deviceRead(devid%2, true)
+				stats := s.stats()
+				tests.Assert(t, stats.Readhits <= stats.Reads)
+			}
+		}(uint32(i))
+	}
+	wg.Wait()
+
+	stats := s.stats()
+	tests.Assert(t, stats.Reads == 8000)
+	tests.Assert(t, stats.Readhits == 8000)
+	tests.Assert(t, stats.Devices[0].Reads == 4000)
+	tests.Assert(t, stats.Devices[1].Readhits == 4000)
+
+	s.clear()
+	stats = s.stats()
+	tests.Assert(t, stats.Reads == 0)
+	tests.Assert(t, stats.Devices == nil)
+}
+
+func BenchmarkCacheStatsRead(b *testing.B) {
+	s := &cachestats{}
+	for i := 0; i < b.N; i++ {
+		s.read()
+		s.readHit()
+		s.deviceRead(1, true)
+	}
+}
+
+func BenchmarkCacheStatsReadParallel(b *testing.B) {
+	s := &cachestats{}
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			s.read()
+			s.readHit()
+			s.deviceRead(1, true)
+		}
+	})
+}
+
+func BenchmarkCacheStatsSnapshot(b *testing.B) {
+	s := &cachestats{}
+	for devid := uint32(0); devid < 16; devid++ {
+		s.deviceRead(devid, true)
+	}
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		s.stats()
+	}
 }
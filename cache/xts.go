@@ -0,0 +1,99 @@
+//
+// Copyright (c) 2014 The pblcache Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package cache
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"encoding/binary"
+	"errors"
+)
+
+const (
+	xtsBlockSize = aes.BlockSize
+)
+
+var (
+	ErrXtsKeySize = errors.New("XTS key must be 32 or 64 bytes")
+)
+
+// AES-XTS (IEEE 1619) cipher used to encrypt blocks in the log.
+// The tweak is the log block number.  Data must be a multiple
+// of 16 bytes.
+type XtsCipher struct {
+	k1, k2 cipher.Block
+}
+
+func NewXtsCipher(key []byte) (*XtsCipher, error) {
+	if len(key) != 32 && len(key) != 64 {
+		return nil, ErrXtsKeySize
+	}
+
+	var err error
+	x := &XtsCipher{}
+	x.k1, err = aes.NewCipher(key[:len(key)/2])
+	if err != nil {
+		return nil, err
+	}
+	x.k2, err = aes.NewCipher(key[len(key)/2:])
+	if err != nil {
+		return nil, err
+	}
+
+	return x, nil
+}
+
+func (x *XtsCipher) Encrypt(dst, src []byte, sector uint64) {
+	x.crypt(dst, src, sector, x.k1.Encrypt)
+}
+
+func (x *XtsCipher) Decrypt(dst, src []byte, sector uint64) {
+	x.crypt(dst, src, sector, x.k1.Decrypt)
+}
+
+func (x *XtsCipher) crypt(dst, src []byte, sector uint64, f func(dst, src []byte)) {
+	if len(src)%xtsBlockSize != 0 {
+		panic("xts: data is not a multiple of the block size")
+	}
+	if len(dst) < len(src) {
+		panic("xts: destination buffer too small")
+	}
+
+	var tweak, block [xtsBlockSize]byte
+	binary.LittleEndian.PutUint64(tweak[:8], sector)
+	x.k2.Encrypt(tweak[:], tweak[:])
+
+	for i := 0; i < len(src); i += xtsBlockSize {
+		for j := range block {
+			block[j] = src[i+j] ^ tweak[j]
+		}
+		f(block[:], block[:])
+		for j := range block {
+			dst[i+j] = block[j] ^ tweak[j]
+		}
+
+		// Multiply the tweak by x in GF(2^128)
+		carry := tweak[xtsBlockSize-1] >> 7
+		for j := xtsBlockSize - 1; j > 0; j-- {
+			tweak[j] = tweak[j]<<1 | tweak[j-1]>>7
+		}
+		tweak[0] <<= 1
+		if carry != 0 {
+			tweak[0] ^= 0x87
+		}
+	}
+}
@@ -0,0 +1,92 @@
+//
+// Copyright (c) 2014 The pblcache Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package cache
+
+import (
+	"bytes"
+	"encoding/hex"
+	"github.com/pblcache/pblcache/tests"
+	"testing"
+)
+
+func TestXtsVectors(t *testing.T) {
+	// IEEE 1619 test vectors
+	vectors := []struct {
+		key, plaintext, ciphertext string
+		sector                     uint64
+	}{
+		{
+			key:        "0000000000000000000000000000000000000000000000000000000000000000",
+			sector:     0,
+			plaintext:  "0000000000000000000000000000000000000000000000000000000000000000",
+			ciphertext: "917cf69ebd68b2ec9b9fe9a3eadda692cd43d2f59598ed858c02c2652fbf922e",
+		},
+		{
+			key:        "1111111111111111111111111111111122222222222222222222222222222222",
+			sector:     0x3333333333,
+			plaintext:  "4444444444444444444444444444444444444444444444444444444444444444",
+			ciphertext: "c454185e6a16936e39334038acef838bfb186fff7480adc4289382ecd6d394f0",
+		},
+		{
+			key:        "fffefdfcfbfaf9f8f7f6f5f4f3f2f1f022222222222222222222222222222222",
+			sector:     0x3333333333,
+			plaintext:  "4444444444444444444444444444444444444444444444444444444444444444",
+			ciphertext: "af85336b597afc1a900b2eb21ec949d292df4c047e0b21532186a5971a227a89",
+		},
+	}
+
+	for _, v := range vectors {
+		key, _ := hex.DecodeString(v.key)
+		plaintext, _ := hex.DecodeString(v.plaintext)
+		ciphertext, _ := hex.DecodeString(v.ciphertext)
+
+		x, err := NewXtsCipher(key)
+		tests.Assert(t, err == nil)
+
+		buf := make([]byte, len(plaintext))
+		x.Encrypt(buf, plaintext, v.sector)
+		tests.Assert(t, bytes.Equal(buf, ciphertext))
+
+		x.Decrypt(buf, buf, v.sector)
+		tests.Assert(t, bytes.Equal(buf, plaintext))
+	}
+}
+
+func TestXtsBlock(t *testing.T) {
+	x, err := NewXtsCipher(make([]byte, 64))
+	tests.Assert(t, err == nil)
+
+	block := make([]byte, 4096)
+	for i := range block {
+		block[i] = byte(i)
+	}
+	encrypted := make([]byte, 4096)
+	x.Encrypt(encrypted, block, 10)
+	tests.Assert(t, !bytes.Equal(encrypted, block))
+
+	// The same data on a different block number
+	// must not encrypt to the same value
+	other := make([]byte, 4096)
+	x.Encrypt(other, block, 11)
+	tests.Assert(t, !bytes.Equal(encrypted, other))
+
+	x.Decrypt(encrypted, encrypted, 10)
+	tests.Assert(t, bytes.Equal(encrypted, block))
+
+	_, err = NewXtsCipher(make([]byte, 16))
+	tests.Assert(t, err == ErrXtsKeySize)
+}
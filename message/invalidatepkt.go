@@ -0,0 +1,67 @@
+//
+// Copyright (c) 2014 The pblcache Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+package message
+
+import (
+	"fmt"
+)
+
+// Bulk invalidation of the blocks of a device.  Used by
+// MsgInvalidateRange and MsgInvalidateDevice messages.
+type InvalidatePkt struct {
+	// Backend id
+	Devid uint32
+
+	// First block and number of blocks to invalidate.
+	// Not used by MsgInvalidateDevice.
+	Start  uint64
+	Length uint64
+}
+
+func NewMsgInvalidateRange(devid uint32, start, length uint64) *Message {
+	return &Message{
+		Type: MsgInvalidateRange,
+		Pkg: &InvalidatePkt{
+			Devid:  devid,
+			Start:  start,
+			Length: length,
+		},
+	}
+}
+
+func NewMsgInvalidateDevice(devid uint32) *Message {
+	return &Message{
+		Type: MsgInvalidateDevice,
+		Pkg: &InvalidatePkt{
+			Devid: devid,
+		},
+	}
+}
+
+func (m *Message) InvalidatePkt() *InvalidatePkt {
+	return m.Pkg.(*InvalidatePkt)
+}
+
+func (i *InvalidatePkt) String() string {
+	return fmt.Sprintf("InvalidatePkt{"+
+		"Devid:%v "+
+		"Start:%v "+
+		"Length:%v"+
+		"}",
+		i.Devid,
+		i.Start,
+		i.Length)
+}
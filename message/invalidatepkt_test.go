@@ -0,0 +1,50 @@
+//
+// Copyright (c) 2014 The pblcache Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+package message
+
+import (
+	"github.com/pblcache/pblcache/tests"
+	"strings"
+	"testing"
+)
+
+func TestInvalidateRangePkt(t *testing.T) {
+	m := NewMsgInvalidateRange(7, 100, 20)
+	tests.Assert(t, m.Type == MsgInvalidateRange)
+
+	pkt := m.InvalidatePkt()
+	tests.Assert(t, pkt.Devid == 7)
+	tests.Assert(t, pkt.Start == 100)
+	tests.Assert(t, pkt.Length == 20)
+}
+
+func TestInvalidateDevicePkt(t *testing.T) {
+	m := NewMsgInvalidateDevice(7)
+	tests.Assert(t, m.Type == MsgInvalidateDevice)
+
+	pkt := m.InvalidatePkt()
+	tests.Assert(t, pkt.Devid == 7)
+	tests.Assert(t, pkt.Start == 0)
+	tests.Assert(t, pkt.Length == 0)
+}
+
+func TestInvalidatePktString(t *testing.T) {
+	s := NewMsgInvalidateRange(7, 100, 20).InvalidatePkt().String()
+
+	tests.Assert(t, strings.Contains(s, "Devid:7"))
+	tests.Assert(t, strings.Contains(s, "Start:100"))
+	tests.Assert(t, strings.Contains(s, "Length:20"))
+}
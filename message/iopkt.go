@@ -20,15 +20,22 @@ import (
 )
 
 type IoPkt struct {
-	// Backend id + offset
+	// Backend id
+	Devid uint32
+
+	// Block offset in the backend
 	Address uint64
 
 	// Buffer transfer data in or out
 	Buffer []byte
 
+	// Byte offset of the data in the first block.  Only used
+	// for I/O which is not aligned to the block size.
+	Offset uint32
+
 	// Block number on the Log to read
 	// from or write to
-	LogBlock uint32
+	LogBlock uint64
 
 	// Number of blocks
 	Blocks uint32
@@ -57,11 +64,15 @@ func (m *Message) IoPkt() *IoPkt {
 
 func (i *IoPkt) String() string {
 	return fmt.Sprintf("IoPkt{"+
+		"Devid:%v "+
 		"Address:%v "+
+		"Offset:%v "+
 		"LogBlock:%v "+
 		"Blocks:%v"+
 		"}",
+		i.Devid,
 		i.Address,
+		i.Offset,
 		i.LogBlock,
 		i.Blocks)
 }
@@ -28,7 +28,9 @@ func TestGetIoPkt(t *testing.T) {
 	iopkt := m.IoPkt()
 	tests.Assert(t, iopkt.LogBlock == 0)
 	tests.Assert(t, iopkt.Buffer == nil)
+	tests.Assert(t, iopkt.Devid == 0)
 	tests.Assert(t, iopkt.Address == 0)
+	tests.Assert(t, iopkt.Offset == 0)
 	tests.Assert(t, m.RetChan == c)
 	tests.Assert(t, m.Type == MsgGet)
 }
@@ -38,7 +40,9 @@ func TestIoPktString(t *testing.T) {
 	iopkt := m.IoPkt()
 	s := iopkt.String()
 
+	tests.Assert(t, strings.Contains(s, "Devid"))
 	tests.Assert(t, strings.Contains(s, "Address"))
+	tests.Assert(t, strings.Contains(s, "Offset"))
 	tests.Assert(t, strings.Contains(s, "LogBlock"))
 	tests.Assert(t, strings.Contains(s, "Blocks"))
 
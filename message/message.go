@@ -33,6 +33,8 @@ var (
 const (
 	MsgPut MsgType = iota + 1
 	MsgGet
+	MsgInvalidateRange
+	MsgInvalidateDevice
 )
 
 type MessageStats struct {
@@ -49,6 +51,7 @@ type Message struct {
 	parent  *Message
 	wg      sync.WaitGroup
 	done    uint32
+	errlock sync.Mutex
 }
 
 func (m *Message) TimeStart() {
@@ -99,14 +102,28 @@ func (m *Message) Done() {
 		}
 
 		// We are finished. Notify parent
-		// we are done
+		// we are done, passing along any error
 		if m.parent != nil {
+			if m.Err != nil {
+				m.parent.SetErr(m.Err)
+			}
 			m.parent.wg.Done()
 			m.parent = nil
 		}
 	}()
 }
 
+// Sets the error on the message only if one has not already
+// been set.  Safe to be called from children messages.
+func (m *Message) SetErr(err error) {
+	m.errlock.Lock()
+	defer m.errlock.Unlock()
+
+	if m.Err == nil {
+		m.Err = err
+	}
+}
+
 func (m *Message) Check() error {
 	if atomic.LoadUint32(&m.done) > 0 {
 		return ErrMessageUsed
@@ -16,6 +16,7 @@
 package message
 
 import (
+	"errors"
 	"github.com/lpabon/tm"
 	"github.com/pblcache/pblcache/tests"
 	"strings"
@@ -228,3 +229,29 @@ func TestMessageDone(t *testing.T) {
 	close(worker)
 	close(backhere)
 }
+
+func TestMessageErrPropagation(t *testing.T) {
+	parent := &Message{}
+	child1 := &Message{}
+	child2 := &Message{}
+
+	done := make(chan *Message)
+	parent.RetChan = done
+
+	parent.Add(child1)
+	parent.Add(child2)
+
+	// Only the first error is kept
+	child1.Err = errors.New("first")
+	child1.Done()
+	child2.Done()
+	parent.Done()
+
+	<-done
+	tests.Assert(t, parent.Err != nil)
+	tests.Assert(t, parent.Err.Error() == "first")
+
+	// SetErr does not overwrite an error
+	parent.SetErr(errors.New("second"))
+	tests.Assert(t, parent.Err.Error() == "first")
+}
@@ -84,7 +84,7 @@ func response_handler(t *testing.T,
 }
 
 func cacheio(t *testing.T, c *cache.CacheMap, log *cache.Log,
-	actual_blocks, blocksize uint32) {
+	actual_blocks uint64, blocksize uint32) {
 	var wgIo, wgRet sync.WaitGroup
 
 	// Start up response server
@@ -103,7 +103,7 @@ func cacheio(t *testing.T, c *cache.CacheMap, log *cache.Log,
 		wgIo.Add(1)
 		go func() {
 			defer wgIo.Done()
-			z := zipf.NewZipfWorkload(uint64(actual_blocks)*10, 60)
+			z := zipf.NewZipfWorkload(actual_blocks*10, 60)
 			r := rand.New(rand.NewSource(time.Now().UnixNano()))
 
 			// Each client to send 5k IOs
@@ -207,6 +207,9 @@ func TestSimpleCache(t *testing.T) {
 		false)
 	Assert(t, err == nil)
 	c := cache.NewCacheMap(actual_blocks, blocksize, log.Msgchan)
+	log.SetInvalidator(func(index uint64, current func() bool) {
+		c.InvalidateLogBlock(index, current)
+	})
 	defer os.Remove(logfile)
 	log.Start()
 
@@ -229,6 +232,9 @@ func TestSimpleCache(t *testing.T) {
 		false)
 	Assert(t, err == nil)
 	c = cache.NewCacheMap(actual_blocks, blocksize, log.Msgchan)
+	log.SetInvalidator(func(index uint64, current func() bool) {
+		c.InvalidateLogBlock(index, current)
+	})
 	c.Load(save, log)
 	log.Start()
 